@@ -26,6 +26,8 @@ const (
 	AuditRunGCEvent             = 24582 // 0x6006
 	AuditProfileCPUEvent        = 24583 // 0x6007
 	AuditProfileMemoryEvent     = 24584 // 0x6008
+
+	AuditScatterGatherQueryEvent = 24588 // 0x600C
 )
 
 type IndexControlAuditLog struct {
@@ -39,6 +41,35 @@ type IndexAuditLog struct {
 	IndexName string `json:"index_name"`
 }
 
+// CallerAuditLog records a scatter-gather request from a coordinator
+// node, with the real user being the original caller.
+type CallerAuditLog struct {
+	audit.GenericFields
+	RealUserid CallerAuditUserid `json:"real_userid"`
+	IndexName  string            `json:"index_name"`
+}
+
+type CallerAuditUserid struct {
+	Domain string `json:"domain"`
+	User   string `json:"user"`
+}
+
+func GetCallerAuditEventData(req *http.Request,
+	caller *CallerIdentity) interface{} {
+	indexName := rest.IndexNameLookup(req)
+	if indexName == "" {
+		indexName = rest.PIndexNameLookup(req)
+	}
+	return CallerAuditLog{
+		GenericFields: audit.GetAuditBasicFields(req),
+		RealUserid: CallerAuditUserid{
+			Domain: caller.Domain,
+			User:   caller.User,
+		},
+		IndexName: indexName,
+	}
+}
+
 func GetAuditEventData(eventId uint32, req *http.Request) interface{} {
 	switch eventId {
 	case AuditDeleteIndexEvent, AuditCreateUpdateIndexEvent:
@@ -0,0 +1,439 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/cbgt"
+	"github.com/couchbase/cbgt/rest"
+
+	log "github.com/couchbase/clog"
+)
+
+// CallerContextKey is the context key of the *CallerIdentity of the
+// user on whose behalf a query is run.
+const CallerContextKey = "_cbft_caller"
+
+// CallerTokenHeader is the HTTP header of the signed caller token that
+// an IndexClient sends along with scatter-gather requests.
+const CallerTokenHeader = "X-Cbft-Caller-Token"
+
+// CallerTokenTTL is how long a caller token is valid after it's issued.
+var CallerTokenTTL = 10 * time.Second
+
+// CallerTokenSkew is the allowed clock skew between the nodes.
+var CallerTokenSkew = 5 * time.Second
+
+// CallerIdentity is the user on whose behalf a query is run, along
+// with the permissions that were checked for the user.
+type CallerIdentity struct {
+	User   string   `json:"user"`
+	Domain string   `json:"domain"`
+	Perms  []string `json:"perms"`
+}
+
+// QueryCaller defines the part of the JSON query request that carries
+// the caller's identity.  It's filled in by the REST auth handler,
+// replacing any value provided by the client.
+type QueryCaller struct {
+	Caller *CallerIdentity `json:"_caller,omitempty"`
+}
+
+// callerPropagatedPaths are the REST endpoints that may fan out to
+// remote nodes, or that remote nodes call on behalf of a caller,
+// keyed by "method:path", with whether the request body receives the
+// caller's identity.
+var callerPropagatedPaths = map[string]bool{
+	"POST:/api/index/{indexName}/query":     true,
+	"POST:/api/pindex/{pindexName}/query":   true,
+	"GET:/api/index/{indexName}/suggest":    false,
+	"GET:/api/index/{indexName}/fieldStats": false,
+	"POST:/api/index/{indexName}/termStats": false,
+	"POST:/api/index/{indexName}/fields":    false,
+	"POST:/api/index/{indexName}/fieldDict": false,
+	"POST:/api/index/{indexName}/document":  false,
+}
+
+// callerTokenSecret returns the cluster-wide secret for signing caller
+// tokens, from the "callerTokenSecret" manager option.  Caller identity
+// propagation is disabled when the secret is not set, or when cbauth
+// is not in use.
+func callerTokenSecret(mgr *cbgt.Manager) []byte {
+	if mgr == nil || mgr.Options()["authType"] != "cbauth" {
+		return nil
+	}
+	secret := mgr.Options()["callerTokenSecret"]
+	if secret == "" {
+		return nil
+	}
+	return []byte(secret)
+}
+
+type callerTokenPayload struct {
+	CallerIdentity
+	IssuedAt  int64  `json:"iat"` // Unix time in milliseconds.
+	ExpiresAt int64  `json:"exp"` // Unix time in milliseconds.
+	Nonce     string `json:"nonce"`
+}
+
+// newCallerToken returns a signed, short-lived token for the caller,
+// in the form of base64(payload) "." base64(hmac-sha256(payload)).
+func newCallerToken(secret []byte, caller *CallerIdentity,
+	now time.Time) (string, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(&callerTokenPayload{
+		CallerIdentity: *caller,
+		IssuedAt:       now.UnixNano() / int64(time.Millisecond),
+		ExpiresAt:      now.Add(CallerTokenTTL).UnixNano() / int64(time.Millisecond),
+		Nonce:          hex.EncodeToString(nonce),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(callerTokenMAC(secret, payload)), nil
+}
+
+func callerTokenMAC(secret, payload []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// verifyCallerToken checks the signature, expiry and uniqueness of a
+// caller token, returning the caller's identity.
+func verifyCallerToken(secret []byte, token string,
+	now time.Time) (*CallerIdentity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("caller: malformed token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("caller: malformed token payload, err: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("caller: malformed token signature, err: %v", err)
+	}
+
+	if !hmac.Equal(sig, callerTokenMAC(secret, payload)) {
+		return nil, fmt.Errorf("caller: invalid token signature")
+	}
+
+	var p callerTokenPayload
+	err = json.Unmarshal(payload, &p)
+	if err != nil {
+		return nil, fmt.Errorf("caller: parsing token payload, err: %v", err)
+	}
+
+	nowMS := now.UnixNano() / int64(time.Millisecond)
+	skewMS := int64(CallerTokenSkew / time.Millisecond)
+	if p.IssuedAt > nowMS+skewMS || p.ExpiresAt < nowMS-skewMS {
+		return nil, fmt.Errorf("caller: token expired or not yet valid")
+	}
+
+	err = callerTokenNonces.add(p.Nonce,
+		time.Unix(0, (p.ExpiresAt+skewMS)*int64(time.Millisecond)), now)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p.CallerIdentity, nil
+}
+
+// callerTokenNonces remembers the nonces of the caller tokens that
+// were seen within their validity window, to reject replays.
+var callerTokenNonces = &nonceCache{seen: map[string]time.Time{}}
+
+// CallerTokenMaxNonces bounds the number of remembered caller token
+// nonces.  A nonce is remembered for the token's TTL plus the clock
+// skew, so the default allows for about 6500 scatter-gather requests
+// per second to this node.  When the cap is reached, new
+// tokens are rejected until nonces expire, as forgetting unexpired
+// nonces would let their tokens be replayed.
+var CallerTokenMaxNonces = 100000
+
+var errCallerTokenReplayed = errors.New("caller: token replayed")
+var errCallerTokenNoncesFull = errors.New("caller: too many caller" +
+	" tokens within their validity window")
+
+// Atomic counter of the caller tokens rejected for a full nonce cache.
+var totCallerTokenNoncesFull uint64
+
+type nonceCache struct {
+	m     sync.Mutex
+	seen  map[string]time.Time // Nonce => when it can be forgotten.
+	queue nonceHeap            // Ordered by when they can be forgotten.
+}
+
+// add returns errCallerTokenReplayed when the nonce was already seen,
+// and errCallerTokenNoncesFull when CallerTokenMaxNonces unexpired
+// nonces are remembered.  The expired nonces are forgotten as new ones
+// are added, in time order.
+func (c *nonceCache) add(nonce string, until, now time.Time) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if _, exists := c.seen[nonce]; exists {
+		return errCallerTokenReplayed
+	}
+
+	for len(c.queue) > 0 && now.After(c.queue[0].until) {
+		e := heap.Pop(&c.queue).(nonceEntry)
+		delete(c.seen, e.nonce)
+	}
+
+	if len(c.queue) >= CallerTokenMaxNonces {
+		if atomic.AddUint64(&totCallerTokenNoncesFull, 1)%1000 == 1 {
+			log.Warnf("caller: nonce cache full, max: %d,"+
+				" rejecting caller tokens until nonces expire",
+				CallerTokenMaxNonces)
+		}
+		return errCallerTokenNoncesFull
+	}
+
+	c.seen[nonce] = until
+	heap.Push(&c.queue, nonceEntry{nonce: nonce, until: until})
+
+	return nil
+}
+
+type nonceEntry struct {
+	nonce string
+	until time.Time
+}
+
+// nonceHeap is a min-heap of nonces by when they can be forgotten.
+type nonceHeap []nonceEntry
+
+func (h nonceHeap) Len() int           { return len(h) }
+func (h nonceHeap) Less(i, j int) bool { return h[i].until.Before(h[j].until) }
+func (h nonceHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *nonceHeap) Push(x interface{}) {
+	*h = append(*h, x.(nonceEntry))
+}
+
+func (h *nonceHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// missingPerm returns the first of the required perms that the caller's
+// checked perms don't include, or "" when they're all included.
+func (c *CallerIdentity) missingPerm(required []string) string {
+	for _, perm := range required {
+		found := false
+		for _, p := range c.Perms {
+			if p == perm {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return perm
+		}
+	}
+	return ""
+}
+
+// addCallerToken sets the caller token header on an outgoing request,
+// when the context carries a caller and propagation is enabled.
+func addCallerToken(ctx context.Context, mgr *cbgt.Manager,
+	req *http.Request) error {
+	caller, ok := ctx.Value(CallerContextKey).(*CallerIdentity)
+	if !ok || caller == nil {
+		return nil
+	}
+
+	secret := callerTokenSecret(mgr)
+	if secret == nil {
+		return nil
+	}
+
+	token, err := newCallerToken(secret, caller, time.Now())
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(CallerTokenHeader, token)
+
+	return nil
+}
+
+// injectCaller sets the "_caller" field of a JSON request body, or the
+// caller of a binary search request, to the caller's identity,
+// replacing any value provided by the client.
+func injectCaller(req *http.Request, caller *CallerIdentity) error {
+	if req.Body == nil {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+
+	var m map[string]json.RawMessage
+	if isSearchRequestBinary(body) {
+		// the handler tells the encodings apart the same way
+		b, err := setSearchRequestBinaryCaller(body, caller)
+		if err == nil {
+			body = b
+		}
+	} else if err = json.Unmarshal(body, &m); err == nil && m != nil {
+		m["_caller"], err = json.Marshal(caller)
+		if err != nil {
+			return err
+		}
+		body, err = json.Marshal(m)
+		if err != nil {
+			return err
+		}
+	}
+	// else, leave the malformed body for the handler to report
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	return nil
+}
+
+// checkCaller establishes the identity of the caller of an endpoint
+// that may fan out to remote nodes, after the usual auth checks.  For
+// a scatter-gather request from a coordinator node, the caller comes
+// from the caller token, whose permissions must cover the same
+// preparePerms() checks as on the coordinator.  Otherwise, the caller
+// is the authenticated user of the request.  The returned request
+// carries the caller in its context, for the handler's own requests to
+// remote nodes.
+func (c *AuthVersionHandler) checkCaller(w http.ResponseWriter,
+	req *http.Request, path string) (*http.Request, bool) {
+	inject, exists := callerPropagatedPaths[req.Method+":"+path]
+	if !exists {
+		return req, true
+	}
+
+	secret := callerTokenSecret(c.mgr)
+	if secret == nil {
+		return req, true
+	}
+
+	sendErr := func(msg string, err error, status int) bool {
+		requestBody, _ := ioutil.ReadAll(req.Body)
+		rest.PropagateError(w, requestBody,
+			fmt.Sprintf("rest_auth: %s, err: %v", msg, err), status)
+		return false
+	}
+
+	perms, err := preparePerms(c.mgr, req, req.Method, path)
+	if err != nil {
+		return req, sendErr("preparePerms", err, http.StatusBadRequest)
+	}
+
+	var caller *CallerIdentity
+
+	token := req.Header.Get(CallerTokenHeader)
+	if token != "" {
+		caller, err = verifyCallerToken(secret, token, time.Now())
+		if err == errCallerTokenNoncesFull {
+			// not a 5xx, so that coordinators don't count this node
+			// as failed while it sheds load
+			return req, sendErr("caller token", err,
+				http.StatusTooManyRequests)
+		}
+		if err != nil {
+			return req, sendErr("caller token", err, http.StatusForbidden)
+		}
+
+		if perm := caller.missingPerm(perms); perm != "" {
+			CBAuthSendForbidden(w, perm)
+			return req, false
+		}
+
+		c.doAuditCaller(req, caller)
+	} else if req.Header.Get(rest.CLUSTER_ACTION) == "fts/scatter-gather" {
+		return req, sendErr("scatter-gather request",
+			fmt.Errorf("missing caller token"), http.StatusForbidden)
+	} else {
+		creds, err := CBAuthWebCreds(req)
+		if err != nil {
+			return req, sendErr("cbauth.AuthWebCreds", err, http.StatusForbidden)
+		}
+
+		caller = &CallerIdentity{
+			User:   creds.Name(),
+			Domain: creds.Domain(),
+			Perms:  perms,
+		}
+	}
+
+	if inject {
+		// the caller's identity goes into the decompressed body, now
+		// that the request has passed the auth checks
+		err = decodeScatterGather(c.mgr, req)
+		if err == errRemoteBodyTooLarge {
+			return req, sendErr("scatter-gather request", err,
+				http.StatusRequestEntityTooLarge)
+		}
+		if err != nil {
+			return req, sendErr("scatter-gather request", err,
+				http.StatusUnsupportedMediaType)
+		}
+
+		err = injectCaller(req, caller)
+		if err != nil {
+			return req, sendErr("injecting caller", err, http.StatusBadRequest)
+		}
+	}
+
+	ctx := context.WithValue(req.Context(), CallerContextKey, caller)
+
+	return req.WithContext(ctx), true
+}
+
+func (c *AuthVersionHandler) doAuditCaller(req *http.Request,
+	caller *CallerIdentity) {
+	if c.adtSvc == nil {
+		return
+	}
+	d := GetCallerAuditEventData(req, caller)
+	go c.adtSvc.Write(AuditScatterGatherQueryEvent, d)
+}
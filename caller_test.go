@@ -0,0 +1,135 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCallerToken(t *testing.T) {
+	secret := []byte("secret")
+	caller := &CallerIdentity{
+		User:   "alice",
+		Domain: "local",
+		Perms:  []string{"cluster.bucket[beer].fts!read"},
+	}
+
+	now := time.Now()
+
+	token, err := newCallerToken(secret, caller, now)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	got, err := verifyCallerToken(secret, token, now)
+	if err != nil {
+		t.Fatalf("expected valid token, err: %v", err)
+	}
+	if got.User != "alice" || got.Domain != "local" ||
+		got.missingPerm(caller.Perms) != "" {
+		t.Errorf("unexpected caller: %#v", got)
+	}
+	if got.missingPerm([]string{"cluster.bucket[other].fts!read"}) == "" {
+		t.Errorf("expected missing perm for other bucket")
+	}
+
+	_, err = verifyCallerToken(secret, token, now)
+	if err == nil {
+		t.Errorf("expected replayed token to be rejected")
+	}
+
+	token, _ = newCallerToken(secret, caller, now)
+	_, err = verifyCallerToken([]byte("other"), token, now)
+	if err == nil {
+		t.Errorf("expected token with wrong secret to be rejected")
+	}
+
+	parts := strings.Split(token, ".")
+	tampered, _ := newCallerToken(secret,
+		&CallerIdentity{User: "admin", Domain: "local"}, now)
+	_, err = verifyCallerToken(secret,
+		strings.Split(tampered, ".")[0]+"."+parts[1], now)
+	if err == nil {
+		t.Errorf("expected tampered token to be rejected")
+	}
+
+	token, _ = newCallerToken(secret, caller, now)
+	_, err = verifyCallerToken(secret, token,
+		now.Add(CallerTokenTTL+CallerTokenSkew+time.Second))
+	if err == nil {
+		t.Errorf("expected expired token to be rejected")
+	}
+}
+
+func TestInjectCaller(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/api/index/beer/query",
+		bytes.NewReader([]byte(`{"query":{"match_all":{}},`+
+			`"_caller":{"user":"admin","domain":"local","perms":["*"]}}`)))
+
+	err := injectCaller(req, &CallerIdentity{User: "alice", Domain: "local"})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	if int64(len(body)) != req.ContentLength {
+		t.Errorf("expected content length to match body")
+	}
+
+	var qc QueryCaller
+	err = UnmarshalJSON(body, &qc)
+	if err != nil || qc.Caller == nil || qc.Caller.User != "alice" ||
+		len(qc.Caller.Perms) != 0 {
+		t.Errorf("expected injected caller to replace client's, got: %s", body)
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	defer func(n int) { CallerTokenMaxNonces = n }(CallerTokenMaxNonces)
+	CallerTokenMaxNonces = 3
+
+	c := &nonceCache{seen: map[string]time.Time{}}
+	now := time.Now()
+
+	if c.add("a", now.Add(time.Second), now) != nil ||
+		c.add("a", now, now) != errCallerTokenReplayed {
+		t.Errorf("expected a replayed nonce to be rejected")
+	}
+
+	c.add("b", now.Add(3*time.Second), now)
+	c.add("c", now.Add(2*time.Second), now)
+
+	// a full cache rejects new nonces, rather than forget live ones
+	if err := c.add("d", now.Add(4*time.Second), now); err != errCallerTokenNoncesFull {
+		t.Errorf("expected a full cache to reject d, got: %v", err)
+	}
+	if err := c.add("a", now.Add(time.Second), now); err != errCallerTokenReplayed {
+		t.Errorf("expected replayed unexpired a to be rejected, got: %v", err)
+	}
+	if len(c.seen) != 3 || len(c.queue) != 3 {
+		t.Errorf("expected a, b and c to be remembered, got: %v", c.seen)
+	}
+
+	// the expired nonces are forgotten as new ones are added
+	later := now.Add(2500 * time.Millisecond)
+	if err := c.add("d", later.Add(time.Second), later); err != nil {
+		t.Errorf("expected d once a and c expired, got: %v", err)
+	}
+	if len(c.seen) != 2 || c.add("b", later, later) != errCallerTokenReplayed {
+		t.Errorf("expected b and d to be remembered, got: %v", c.seen)
+	}
+}
@@ -105,17 +105,24 @@ func initHTTPOptions(options map[string]string) error {
 		httpWriteTimeout = time.Duration(wt) * time.Second
 	}
 
+	dialer := &net.Dialer{
+		Timeout:   httpTransportDialContextTimeout,
+		KeepAlive: httpTransportDialContextKeepAlive,
+	}
+
+	// With TLS configured, https connections verify the remote node's
+	// certificate and present this node's client certificate, using
+	// the certificates that are current as they're rotated.
 	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   httpTransportDialContextTimeout,
-			KeepAlive: httpTransportDialContextKeepAlive,
-		}).DialContext,
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
 		MaxIdleConns:          httpTransportMaxIdleConns,
 		MaxIdleConnsPerHost:   httpTransportMaxIdleConnsPerHost,
 		IdleConnTimeout:       httpTransportIdleConnTimeout,
 		TLSHandshakeTimeout:   httpTransportTLSHandshakeTimeout,
 		ExpectContinueTimeout: httpTransportExpectContinueTimeout,
+		DialTLS: cbft.TLSDial(dialer,
+			httpTransportTLSHandshakeTimeout, []string{"http/1.1"}),
 	}
 
 	cbft.HttpClient = &http.Client{Transport: transport}
@@ -124,7 +131,8 @@ func initHTTPOptions(options map[string]string) error {
 		MaxIdleConns:        httpTransportMaxIdleConns,
 		MaxIdleConnsPerHost: httpTransportMaxIdleConnsPerHost,
 		IdleConnTimeout:     httpTransportIdleConnTimeout,
-		TLSClientConfig:     cbft.TLSConfig,
+		DialTLS: cbft.TLSDial(dialer,
+			httpTransportTLSHandshakeTimeout, []string{"h2", "http/1.1"}),
 	}
 	err := http2.ConfigureTransport(transport2)
 	if err != nil {
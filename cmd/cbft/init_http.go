@@ -13,8 +13,6 @@ package main
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"strconv"
@@ -106,6 +104,12 @@ func closeAndClearHTTPSServerList() {
 }
 
 func setupHTTPSListeners() error {
+	// Pick up any rotated certificates right away
+	err := cbft.ReloadTLSConfig()
+	if err != nil {
+		log.Warnf("init_http: ReloadTLSConfig, err: %v", err)
+	}
+
 	// Close any previously open https servers
 	closeAndClearHTTPSServerList()
 
@@ -210,12 +214,6 @@ func mainServeHTTP(proto, bindHTTP string, anyHostPorts map[string]bool,
 			config.NextProtos = append(config.NextProtos, "h2")
 		}
 
-		config.Certificates = make([]tls.Certificate, 1)
-		config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
-		if err != nil {
-			log.Fatalf("init_http: LoadX509KeyPair, err: %v", err)
-		}
-
 		if authType == "cbauth" {
 			// Set MinTLSVersion and CipherSuites to what is provided by
 			// cbauth if authType were cbauth.
@@ -224,18 +222,22 @@ func mainServeHTTP(proto, bindHTTP string, anyHostPorts map[string]bool,
 
 			clientAuthType, er := cbauth.GetClientCertAuthType()
 			if er != nil {
-				log.Fatalf("init_http: GetClientCertAuthType, err: %v", err)
+				log.Fatalf("init_http: GetClientCertAuthType, err: %v", er)
 			}
 
-			if clientAuthType != tls.NoClientCert {
-				caCert, er := ioutil.ReadFile(certFile)
-				if er != nil {
-					log.Fatalf("init_http: ReadFile of cacert, err: %v", err)
-				}
-				caCertPool := x509.NewCertPool()
-				caCertPool.AppendCertsFromPEM(caCert)
-				config.ClientCAs = caCertPool
-				config.ClientAuth = clientAuthType
+			config.ClientAuth = clientAuthType
+		}
+
+		// The certificate and the CA bundle for verifying client
+		// certificates are re-read when they're rotated, and client
+		// certificates are verified when given, so that scatter-gather
+		// requests from other nodes can be required to present them.
+		config = cbft.TLSServerConfig(config)
+		if config.GetCertificate == nil {
+			config.Certificates = make([]tls.Certificate, 1)
+			config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				log.Fatalf("init_http: LoadX509KeyPair, err: %v", err)
 			}
 		}
 
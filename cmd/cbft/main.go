@@ -169,7 +169,8 @@ func main() {
 		})
 
 	// Init TLSConfig
-	err = cbft.InitTLSConfig(flags.TLSCertFile, flags.TLSKeyFile)
+	err = cbft.InitTLSConfig(flags.TLSCertFile, flags.TLSKeyFile,
+		flags.TLSCAFile)
 	if err != nil {
 		log.Fatalf("Error in initializing TLS Config, err: %v", err)
 	}
@@ -268,13 +269,18 @@ func mainStart(cfg cbgt.Cfg, uuid string, tags []string, container string,
 	}
 
 	extrasMap["features"] = cbgt.NodeFeatureLeanPlan +
-		"," + cbft.FeatureScorchIndex + "," + cbft.FeatureUpsidedownIndex
+		"," + cbft.FeatureScorchIndex + "," + cbft.FeatureUpsidedownIndex +
+		"," + cbft.FeatureBinaryScatterGather
 	extrasMap["version-cbft.app"] = version
 	extrasMap["version-cbft.lib"] = cbft.VERSION
 
 	s := options["http2"]
 	if s == "true" && flags.TLSCertFile != "" && flags.TLSKeyFile != "" {
 		extrasMap["bindHTTPS"] = flags.BindHTTPS
+
+		// the other nodes send their scatter-gather requests over
+		// https with client certificates
+		cbft.InternalClientCertsRequired = flags.BindHTTPS != ""
 	}
 
 	extrasJSON, err := json.Marshal(extrasMap)
@@ -423,6 +429,17 @@ func mainStart(cfg cbgt.Cfg, uuid string, tags []string, container string,
 	cbft.CurrentNodeDefsFetcher = &cbft.NodeDefsFetcher{}
 	cbft.CurrentNodeDefsFetcher.SetManager(mgr)
 
+	// set mgr for the IndexDefsFetcher, which is invoked for alias
+	// validation during creation
+	cbft.CurrentIndexDefsFetcher = &cbft.IndexDefsFetcher{}
+	cbft.CurrentIndexDefsFetcher.SetManager(mgr)
+
+	// resume the reindexes that this node was running before a restart
+	err = cbft.StartReindexes(mgr)
+	if err != nil {
+		log.Warnf("main: could not resume reindexes, err: %v", err)
+	}
+
 	var adtSvc *audit.AuditSvc
 	if options["cbaudit"] == "true" {
 		adtSvc, err = audit.NewAuditSvc(server)
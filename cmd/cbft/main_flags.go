@@ -43,6 +43,7 @@ type cbftFlags struct {
 
 	TLSCertFile string
 	TLSKeyFile  string
+	TLSCAFile   string
 }
 
 var flags cbftFlags
@@ -193,6 +194,10 @@ func initFlags(flags *cbftFlags) map[string][]string {
 	s(&flags.TLSKeyFile,
 		[]string{"tlsKeyFile"}, "PATH", "",
 		"TLS key file; see also bindHttps.")
+	s(&flags.TLSCAFile,
+		[]string{"tlsCAFile"}, "PATH", "",
+		"TLS CA bundle file, for verifying the certificates of the"+
+			"\nother nodes; default is the tlsCertFile.")
 
 	flag.Usage = func() {
 		if !flags.Help {
@@ -0,0 +1,238 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/document"
+
+	"github.com/couchbase/cbgt"
+	"github.com/couchbase/cbgt/rest"
+)
+
+// DocumentRequest is the JSON request body of the document REST
+// endpoint, which returns the stored fields of a document from the
+// local pindexes, or with Terms, the frequencies of its indexed terms,
+// optionally limited to some Fields.
+type DocumentRequest struct {
+	QueryPIndexes
+	ID     string   `json:"id"`
+	Terms  bool     `json:"terms,omitempty"`
+	Fields []string `json:"fields,omitempty"`
+}
+
+// RemoteDocument is the JSON form of a bleve document, holding the
+// stored fields with their types, so that the document can be
+// reconstructed on another node.  When the indexed terms were asked
+// for, Terms holds their frequencies, keyed by field name then by
+// term, in place of the stored fields.
+type RemoteDocument struct {
+	ID     string                    `json:"id"`
+	Fields []*RemoteDocumentField    `json:"fields"`
+	Terms  map[string]map[string]int `json:"terms,omitempty"`
+}
+
+// RemoteDocumentField is a stored field of a RemoteDocument, where the
+// Type is "t" (text), "n" (numeric), "d" (date time), "b" (boolean) or
+// "g" (geo point), as in bleve's stored field rows.
+type RemoteDocumentField struct {
+	Name           string                   `json:"name"`
+	Type           string                   `json:"type"`
+	ArrayPositions []uint64                 `json:"arrayPositions,omitempty"`
+	Options        document.IndexingOptions `json:"options,omitempty"`
+	Value          []byte                   `json:"value"`
+}
+
+// NewRemoteDocument converts a bleve document to its JSON form,
+// leaving out any fields of unknown types.
+func NewRemoteDocument(doc *document.Document) *RemoteDocument {
+	rv := &RemoteDocument{
+		ID:     doc.ID,
+		Fields: make([]*RemoteDocumentField, 0, len(doc.Fields)),
+	}
+
+	for _, f := range doc.Fields {
+		var typ string
+		switch f.(type) {
+		case *document.TextField:
+			typ = "t"
+		case *document.NumericField:
+			typ = "n"
+		case *document.DateTimeField:
+			typ = "d"
+		case *document.BooleanField:
+			typ = "b"
+		case *document.GeoPointField:
+			typ = "g"
+		default:
+			continue
+		}
+
+		rv.Fields = append(rv.Fields, &RemoteDocumentField{
+			Name:           f.Name(),
+			Type:           typ,
+			ArrayPositions: f.ArrayPositions(),
+			Options:        f.Options(),
+			Value:          f.Value(),
+		})
+	}
+
+	return rv
+}
+
+// Document reconstructs the bleve document.
+func (rd *RemoteDocument) Document() (*document.Document, error) {
+	doc := document.NewDocument(rd.ID)
+
+	for _, f := range rd.Fields {
+		switch f.Type {
+		case "t":
+			doc.AddField(document.NewTextFieldWithIndexingOptions(
+				f.Name, f.ArrayPositions, f.Value, f.Options))
+		case "n":
+			doc.AddField(document.NewNumericFieldFromBytes(
+				f.Name, f.ArrayPositions, f.Value))
+		case "d":
+			doc.AddField(document.NewDateTimeFieldFromBytes(
+				f.Name, f.ArrayPositions, f.Value))
+		case "b":
+			doc.AddField(document.NewBooleanFieldFromBytes(
+				f.Name, f.ArrayPositions, f.Value))
+		case "g":
+			doc.AddField(document.NewGeoPointFieldFromBytes(
+				f.Name, f.ArrayPositions, f.Value))
+		default:
+			return nil, fmt.Errorf("remote document, id: %s,"+
+				" field: %s, unknown type: %s", rd.ID, f.Name, f.Type)
+		}
+	}
+
+	return doc, nil
+}
+
+// ---------------------------------------------------------
+
+// aliasDocument looks up a document across the local and remote
+// targets of an index alias, returning nil when no target has it.
+func aliasDocument(ctx context.Context, targets []bleve.Index,
+	id string) (*document.Document, error) {
+	var rv *document.Document
+
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+
+	for _, target := range targets {
+		if _, ok := target.(*MissingPIndex); ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func(target bleve.Index) {
+			var doc *document.Document
+			var err error
+			if t, ok := target.(*IndexClient); ok {
+				doc, err = t.DocumentInContext(ctx, id)
+			} else {
+				doc, err = target.Document(id)
+			}
+
+			m.Lock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+			} else if doc != nil && rv == nil {
+				rv = doc
+			}
+			m.Unlock()
+			wg.Done()
+		}(target)
+	}
+
+	wg.Wait()
+
+	// a document lives in just one pindex, so it's found even when
+	// some other target failed
+	if rv == nil && firstErr != nil {
+		return nil, firstErr
+	}
+
+	return rv, nil
+}
+
+// DocumentHandler is a REST handler that returns the stored fields of
+// a document from the local pindexes of an index, for use by query
+// coordinators.  The response is null when the document isn't found.
+type DocumentHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewDocumentHandler(mgr *cbgt.Manager) *DocumentHandler {
+	return &DocumentHandler{mgr: mgr}
+}
+
+func (h *DocumentHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	var dr DocumentRequest
+	indexName, ok := readInternalRequest(w, req, &dr)
+	if !ok {
+		return
+	}
+
+	targets, err := localAliasTargets(h.mgr, indexName, dr.PIndexNames)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("document,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	if dr.Terms {
+		termFreqs, err := aliasDocTermFreqs(req.Context(), targets,
+			dr.ID, dr.Fields)
+		if err != nil {
+			rest.ShowError(w, req, fmt.Sprintf("document,"+
+				" indexName: %s, id: %s, err: %v", indexName, dr.ID, err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		var rd *RemoteDocument
+		if termFreqs != nil {
+			rd = &RemoteDocument{ID: dr.ID, Terms: termFreqs}
+		}
+
+		rest.MustEncode(w, rd)
+		return
+	}
+
+	doc, err := aliasDocument(req.Context(), targets, dr.ID)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("document,"+
+			" indexName: %s, id: %s, err: %v", indexName, dr.ID, err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	var rd *RemoteDocument
+	if doc != nil {
+		rd = NewRemoteDocument(doc)
+	}
+
+	rest.MustEncode(w, rd)
+}
@@ -0,0 +1,67 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve/document"
+)
+
+func TestRemoteDocument(t *testing.T) {
+	doc := document.NewDocument("beer-1")
+	doc.AddField(document.NewTextField("name", nil, []byte("hoppy")))
+	doc.AddField(document.NewTextField("tags", []uint64{1}, []byte("ale")))
+	doc.AddField(document.NewNumericField("abv", nil, 5.5))
+	doc.AddField(document.NewBooleanField("avail", nil, true))
+
+	buf, err := MarshalJSON(NewRemoteDocument(doc))
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	var rd *RemoteDocument
+	err = UnmarshalJSON(buf, &rd)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	got, err := rd.Document()
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	if got.ID != doc.ID || len(got.Fields) != len(doc.Fields) {
+		t.Fatalf("expected: %#v, got: %#v", doc, got)
+	}
+
+	for i, f := range doc.Fields {
+		g := got.Fields[i]
+		if g.Name() != f.Name() ||
+			reflect.TypeOf(g) != reflect.TypeOf(f) ||
+			!reflect.DeepEqual(g.ArrayPositions(), f.ArrayPositions()) ||
+			string(g.Value()) != string(f.Value()) {
+			t.Errorf("field %d, expected: %#v, got: %#v", i, f, g)
+		}
+	}
+
+	if v, err := got.Fields[2].(*document.NumericField).Number(); err != nil ||
+		v != 5.5 {
+		t.Errorf("expected number, got: %v, err: %v", v, err)
+	}
+
+	rd.Fields[0].Type = "?"
+	if _, err = rd.Document(); err == nil {
+		t.Errorf("expected err on unknown field type")
+	}
+}
@@ -0,0 +1,556 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/index"
+
+	"github.com/couchbase/cbgt"
+	"github.com/couchbase/cbgt/rest"
+)
+
+// FieldDictFlushEntries is the number of term dictionary entries
+// after which a streamed fieldDict response is flushed to the client.
+var FieldDictFlushEntries = 1000
+
+// FieldsRequest is the JSON request body of the fields REST endpoint,
+// which returns the fields of the local pindexes.
+type FieldsRequest struct {
+	QueryPIndexes
+}
+
+// FieldDictRequest is the JSON request body of the fieldDict REST
+// endpoint, which streams the term dictionary of a field, merged
+// across the local pindexes.  With a Prefix, only the terms with that
+// prefix are returned, else with a StartTerm or EndTerm only the terms
+// in that inclusive range.
+type FieldDictRequest struct {
+	QueryPIndexes
+	Field     string `json:"field"`
+	StartTerm string `json:"startTerm,omitempty"`
+	EndTerm   string `json:"endTerm,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+}
+
+// fieldDictLine is a line of a streamed fieldDict response, which is
+// a term dictionary entry, or else the final line that marks the end
+// of the dictionary or an error.
+type fieldDictLine struct {
+	Term  string `json:"term,omitempty"`
+	Count uint64 `json:"count,omitempty"`
+	Done  bool   `json:"done,omitempty"`
+	Err   string `json:"err,omitempty"`
+}
+
+// open returns the term dictionary that's requested from a target.
+func (fdr *FieldDictRequest) open(ctx context.Context,
+	target bleve.Index) (index.FieldDict, error) {
+	if t, ok := target.(*IndexClient); ok {
+		return t.FieldDictInContext(ctx, fdr)
+	}
+
+	switch {
+	case fdr.Prefix != "":
+		return target.FieldDictPrefix(fdr.Field, []byte(fdr.Prefix))
+	case fdr.EndTerm != "":
+		return target.FieldDictRange(fdr.Field,
+			[]byte(fdr.StartTerm), []byte(fdr.EndTerm))
+	case fdr.StartTerm != "":
+		// not every index type supports an open ended range
+		fd, err := target.FieldDict(fdr.Field)
+		if err != nil {
+			return nil, err
+		}
+		return &fieldDictFrom{FieldDict: fd, startTerm: fdr.StartTerm}, nil
+	}
+
+	return target.FieldDict(fdr.Field)
+}
+
+// fieldDictFrom skips the terms of a term dictionary that are before
+// a start term.
+type fieldDictFrom struct {
+	index.FieldDict
+	startTerm string
+}
+
+func (d *fieldDictFrom) Next() (*index.DictEntry, error) {
+	for {
+		entry, err := d.FieldDict.Next()
+		if err != nil || entry == nil || entry.Term >= d.startTerm {
+			return entry, err
+		}
+	}
+}
+
+// ---------------------------------------------------------
+
+// mergedFieldDict merges sorted term dictionaries, such as from
+// different pindexes, adding up the counts of the same term.
+type mergedFieldDict struct {
+	dicts   []index.FieldDict
+	cursors fieldDictCursors
+	started bool
+	err     error
+}
+
+type fieldDictCursor struct {
+	dict  index.FieldDict
+	term  string
+	count uint64
+}
+
+// fieldDictCursors is a min-heap of cursors, ordered by term.
+type fieldDictCursors []*fieldDictCursor
+
+func (h fieldDictCursors) Len() int           { return len(h) }
+func (h fieldDictCursors) Less(i, j int) bool { return h[i].term < h[j].term }
+func (h fieldDictCursors) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *fieldDictCursors) Push(x interface{}) {
+	*h = append(*h, x.(*fieldDictCursor))
+}
+
+func (h *fieldDictCursors) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+func newMergedFieldDict(dicts []index.FieldDict) *mergedFieldDict {
+	return &mergedFieldDict{dicts: dicts}
+}
+
+// advance moves a cursor to the next entry of its dictionary,
+// returning false when the dictionary is exhausted.
+func (d *mergedFieldDict) advance(c *fieldDictCursor) bool {
+	entry, err := c.dict.Next()
+	if err != nil {
+		if d.err == nil {
+			d.err = err
+		}
+		return false
+	}
+	if entry == nil {
+		return false
+	}
+	// entries may be reused by the dictionary, so they're copied
+	c.term, c.count = entry.Term, entry.Count
+	return true
+}
+
+func (d *mergedFieldDict) Next() (*index.DictEntry, error) {
+	if !d.started {
+		d.started = true
+		for _, dict := range d.dicts {
+			c := &fieldDictCursor{dict: dict}
+			if d.advance(c) {
+				d.cursors = append(d.cursors, c)
+			}
+		}
+		heap.Init(&d.cursors)
+	}
+
+	if d.err != nil || len(d.cursors) <= 0 {
+		return nil, d.err
+	}
+
+	rv := &index.DictEntry{Term: d.cursors[0].term}
+
+	for len(d.cursors) > 0 && d.cursors[0].term == rv.Term {
+		c := d.cursors[0]
+		rv.Count += c.count
+		if d.advance(c) {
+			heap.Fix(&d.cursors, 0)
+		} else {
+			heap.Pop(&d.cursors)
+		}
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return rv, nil
+}
+
+func (d *mergedFieldDict) Close() error {
+	var rv error
+	for _, dict := range d.dicts {
+		err := dict.Close()
+		if err != nil && rv == nil {
+			rv = err
+		}
+	}
+	return rv
+}
+
+// ---------------------------------------------------------
+
+// aliasFields returns the sorted union of the fields of the local and
+// remote targets of an index alias.
+func aliasFields(ctx context.Context, targets []bleve.Index) (
+	[]string, error) {
+	fields := map[string]bool{}
+
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+
+	for _, target := range targets {
+		if _, ok := target.(*MissingPIndex); ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func(target bleve.Index) {
+			var rv []string
+			var err error
+			if t, ok := target.(*IndexClient); ok {
+				rv, err = t.FieldsInContext(ctx)
+			} else {
+				rv, err = target.Fields()
+			}
+
+			m.Lock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+			} else {
+				for _, field := range rv {
+					fields[field] = true
+				}
+			}
+			m.Unlock()
+			wg.Done()
+		}(target)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	rv := make([]string, 0, len(fields))
+	for field := range fields {
+		rv = append(rv, field)
+	}
+	sort.Strings(rv)
+
+	return rv, nil
+}
+
+// aliasFieldDict returns the term dictionary of a field, merged
+// across the local and remote targets of an index alias, leaving out
+// the missing pindexes, which callers report with missingPIndexNames.
+// The caller must Close() the returned dictionary, which also cancels
+// any streams from remote nodes that weren't fully read.
+func aliasFieldDict(ctx context.Context, targets []bleve.Index,
+	fdr *FieldDictRequest) (index.FieldDict, error) {
+	var dicts []index.FieldDict
+
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+
+	for _, target := range targets {
+		if _, ok := missingTargetName(target); ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func(target bleve.Index) {
+			fd, err := fdr.open(ctx, target)
+
+			m.Lock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+			} else {
+				dicts = append(dicts, fd)
+			}
+			m.Unlock()
+			wg.Done()
+		}(target)
+	}
+
+	wg.Wait()
+
+	rv := newMergedFieldDict(dicts)
+	if firstErr != nil {
+		rv.Close()
+		return nil, firstErr
+	}
+
+	return rv, nil
+}
+
+// missingTargetName returns the name of a target that stands for a
+// pindex that can't be reached, or false for other targets.
+func missingTargetName(target bleve.Index) (string, bool) {
+	switch t := target.(type) {
+	case *MissingPIndex:
+		return t.name, true
+	case *fallbackPIndex:
+		return t.MissingPIndex.name, true
+	}
+	return "", false
+}
+
+// missingPIndexNames returns the sorted names of the targets that
+// stand for pindexes that can't be reached.
+func missingPIndexNames(targets []bleve.Index) []string {
+	var rv []string
+	for _, target := range targets {
+		if name, ok := missingTargetName(target); ok {
+			rv = append(rv, name)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// ---------------------------------------------------------
+
+// localAliasTargets returns the targets for serving an internal
+// request from a query coordinator, which are the given pindexes of
+// the index, or all of its pindexes.
+func localAliasTargets(mgr *cbgt.Manager, indexName string,
+	pindexNames []string) ([]bleve.Index, error) {
+	var onlyPIndexes map[string]bool
+	if len(pindexNames) > 0 {
+		onlyPIndexes = cbgt.StringsToMap(pindexNames)
+	}
+
+	alias, _, _, err := bleveIndexAlias(mgr, indexName, "", true,
+		nil, nil, false, onlyPIndexes)
+	if err != nil {
+		if _, ok := err.(*cbgt.ErrorLocalPIndexHealth); !ok {
+			return nil, err
+		}
+	}
+
+	return aliasTargets(alias), nil
+}
+
+// indexTargets returns the local and remote targets for serving an
+// index-wide request on a coordinator node, with the remote pindexes
+// grouped by node, and the pindexes that can't be reached as missing
+// pindexes.  A non-empty pindexNames limits the targets to
+// those pindexes.
+func indexTargets(mgr *cbgt.Manager, indexName string,
+	pindexNames []string) ([]bleve.Index, error) {
+	var onlyPIndexes map[string]bool
+	if len(pindexNames) > 0 {
+		onlyPIndexes = cbgt.StringsToMap(pindexNames)
+	}
+
+	alias, _, _, err := bleveIndexAlias(mgr, indexName, "", true,
+		nil, nil, true, onlyPIndexes)
+	if err != nil {
+		if _, ok := err.(*cbgt.ErrorLocalPIndexHealth); !ok {
+			return nil, err
+		}
+	}
+
+	rv := aliasTargets(alias)
+
+	// the local pindexes that aren't healthy are missing from the
+	// alias, so they're added as missing pindexes to be reported
+	if healthErr, ok := err.(*cbgt.ErrorLocalPIndexHealth); ok {
+		for pindexName := range healthErr.IndexErrMap {
+			rv = append(rv, &MissingPIndex{name: pindexName})
+		}
+	}
+
+	return rv, nil
+}
+
+// readInternalRequest parses the JSON request body of an index level
+// endpoint, such as the internal endpoints used by query coordinators.
+func readInternalRequest(w http.ResponseWriter, req *http.Request,
+	v interface{}) (string, bool) {
+	indexName := rest.IndexNameLookup(req)
+	if indexName == "" {
+		rest.ShowError(w, req, "index name is required",
+			http.StatusBadRequest)
+		return "", false
+	}
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("could not read request body,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return "", false
+	}
+
+	err = UnmarshalJSON(requestBody, v)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("could not parse request body,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return "", false
+	}
+
+	return indexName, true
+}
+
+// FieldsHandler is a REST handler that returns the fields of the
+// local pindexes of an index, for use by query coordinators.
+type FieldsHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewFieldsHandler(mgr *cbgt.Manager) *FieldsHandler {
+	return &FieldsHandler{mgr: mgr}
+}
+
+func (h *FieldsHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	var fr FieldsRequest
+	indexName, ok := readInternalRequest(w, req, &fr)
+	if !ok {
+		return
+	}
+
+	targets, err := localAliasTargets(h.mgr, indexName, fr.PIndexNames)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("fields,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	fields, err := aliasFields(req.Context(), targets)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("fields,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	rest.MustEncode(w, struct {
+		Fields []string `json:"fields"`
+	}{
+		Fields: fields,
+	})
+}
+
+// FieldDictHandler is a REST handler that streams the term dictionary
+// of a field of the local pindexes of an index, as newline delimited
+// JSON, for use by query coordinators.  The stream ends with a line
+// that marks its completion, so that clients can tell a complete
+// dictionary from a broken connection.
+type FieldDictHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewFieldDictHandler(mgr *cbgt.Manager) *FieldDictHandler {
+	return &FieldDictHandler{mgr: mgr}
+}
+
+func (h *FieldDictHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	var fdr FieldDictRequest
+	indexName, ok := readInternalRequest(w, req, &fdr)
+	if !ok {
+		return
+	}
+
+	if fdr.Field == "" {
+		rest.ShowError(w, req, "fieldDict, field is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	targets, err := localAliasTargets(h.mgr, indexName, fdr.PIndexNames)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("fieldDict,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+
+	fd, err := aliasFieldDict(ctx, targets, &fdr)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("fieldDict,"+
+			" indexName: %s, field: %s, err: %v", indexName, fdr.Field, err),
+			http.StatusInternalServerError)
+		return
+	}
+	defer fd.Close()
+
+	writeFieldDict(ctx, w, fd)
+}
+
+// writeFieldDict streams the entries of a term dictionary as newline
+// delimited JSON, until the dictionary is exhausted or the context is
+// done.
+func writeFieldDict(ctx context.Context, w http.ResponseWriter,
+	fd index.FieldDict) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	flusher, _ := w.(http.Flusher)
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	flush := func() {
+		bw.Flush()
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	for n := 1; ; n++ {
+		if ctx.Err() != nil {
+			return // The client went away.
+		}
+
+		entry, err := fd.Next()
+		if err != nil {
+			enc.Encode(&fieldDictLine{Err: err.Error()})
+			break
+		}
+		if entry == nil {
+			enc.Encode(&fieldDictLine{Done: true})
+			break
+		}
+
+		enc.Encode(&fieldDictLine{Term: entry.Term, Count: entry.Count})
+
+		if n%FieldDictFlushEntries == 0 {
+			flush()
+		}
+	}
+
+	flush()
+}
@@ -0,0 +1,174 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/index"
+	"github.com/gorilla/mux"
+)
+
+// testFieldDict is a term dictionary over sorted entries, which
+// generates n entries when the entries are nil.
+type testFieldDict struct {
+	entries []index.DictEntry
+	n       int
+	i       int
+	closed  bool
+}
+
+func (d *testFieldDict) Next() (*index.DictEntry, error) {
+	if d.entries == nil && d.i < d.n {
+		d.i++
+		return &index.DictEntry{Term: fmt.Sprintf("t%09d", d.i), Count: 1}, nil
+	}
+	if d.i >= len(d.entries) {
+		return nil, nil
+	}
+	d.i++
+	return &d.entries[d.i-1], nil
+}
+
+func (d *testFieldDict) Close() error {
+	d.closed = true
+	return nil
+}
+
+func readFieldDict(t *testing.T, fd index.FieldDict) []index.DictEntry {
+	var rv []index.DictEntry
+	for {
+		entry, err := fd.Next()
+		if err != nil {
+			t.Fatalf("expected no err, got: %v", err)
+		}
+		if entry == nil {
+			return rv
+		}
+		rv = append(rv, *entry)
+	}
+}
+
+func TestMergedFieldDict(t *testing.T) {
+	a := &testFieldDict{entries: []index.DictEntry{
+		{Term: "apple", Count: 1}, {Term: "cherry", Count: 2},
+	}}
+	b := &testFieldDict{entries: []index.DictEntry{
+		{Term: "banana", Count: 3}, {Term: "cherry", Count: 4},
+		{Term: "date", Count: 5},
+	}}
+	c := &testFieldDict{}
+
+	fd := newMergedFieldDict([]index.FieldDict{a, b, c})
+
+	exp := []index.DictEntry{
+		{Term: "apple", Count: 1}, {Term: "banana", Count: 3},
+		{Term: "cherry", Count: 6}, {Term: "date", Count: 5},
+	}
+	if got := readFieldDict(t, fd); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+
+	fd.Close()
+	if !a.closed || !b.closed || !c.closed {
+		t.Errorf("expected all dicts to be closed")
+	}
+
+	fd = newMergedFieldDict(nil)
+	if got := readFieldDict(t, fd); len(got) != 0 {
+		t.Errorf("expected empty dict, got: %v", got)
+	}
+}
+
+func TestRemoteFieldDict(t *testing.T) {
+	prevFlushEntries := FieldDictFlushEntries
+	FieldDictFlushEntries = 10
+	defer func() { FieldDictFlushEntries = prevFlushEntries }()
+
+	var gotReq FieldDictRequest
+	served := make(chan bool, 1)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/index/{indexName}/fieldDict",
+		func(w http.ResponseWriter, req *http.Request) {
+			if _, ok := readInternalRequest(w, req, &gotReq); !ok {
+				return
+			}
+
+			var fd index.FieldDict
+			if gotReq.Field == "endless" {
+				fd = &testFieldDict{n: 100000000}
+			} else {
+				fd = newMergedFieldDict([]index.FieldDict{
+					&testFieldDict{entries: []index.DictEntry{{Term: "x", Count: 1}}},
+					&testFieldDict{entries: []index.DictEntry{{Term: "x", Count: 2}}},
+				})
+			}
+
+			writeFieldDict(req.Context(), w, fd)
+			served <- true
+		})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	bc := &IndexClient{
+		HostPort:    strings.TrimPrefix(ts.URL, "http://"),
+		IndexName:   "idx",
+		PIndexNames: []string{"p0", "p1"},
+		QueryURL:    ts.URL + "/api/index/idx/query",
+		httpClient:  ts.Client(),
+	}
+
+	fd, err := bc.FieldDictPrefix("name", []byte("x"))
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	got := readFieldDict(t, fd)
+	fd.Close()
+	<-served
+
+	if !reflect.DeepEqual(got, []index.DictEntry{{Term: "x", Count: 3}}) {
+		t.Errorf("expected merged counts, got: %v", got)
+	}
+	if gotReq.Field != "name" || gotReq.Prefix != "x" ||
+		!reflect.DeepEqual(gotReq.PIndexNames, bc.PIndexNames) {
+		t.Errorf("unexpected request: %#v", gotReq)
+	}
+
+	// closing a partially read dict stops the remote node's stream
+	fd, err = bc.FieldDictInContext(context.Background(),
+		&FieldDictRequest{Field: "endless"})
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		entry, err := fd.Next()
+		if err != nil || entry == nil {
+			t.Fatalf("expected entry, got: %v, err: %v", entry, err)
+		}
+	}
+	fd.Close()
+
+	select {
+	case <-served:
+	case <-time.After(10 * time.Second):
+		t.Errorf("expected the stream to be cancelled")
+	}
+}
@@ -0,0 +1,464 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/index"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/numeric"
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/blevesearch/bleve/search/searcher"
+
+	"github.com/couchbase/cbgt"
+	"github.com/couchbase/cbgt/rest"
+)
+
+// FieldStatsDefaultSize is the number of top terms reported for each
+// field when the request doesn't specify a size.
+var FieldStatsDefaultSize = 10
+
+// FieldStatsMaxTerms bounds the number of dictionary terms that are
+// read for each field, beyond which the field's stats are reported
+// as partial.
+var FieldStatsMaxTerms = 1000000
+
+// FieldStatsDocCountMaxTerms bounds the number of distinct terms of a
+// text field whose document count is reported, as the count is made
+// by a search for any of the field's terms, which needs a clause per
+// term.  The bound is further limited by bleve's
+// DisjunctionMaxClauseCount.
+var FieldStatsDocCountMaxTerms = 1024
+
+// FieldStats are the statistics of an index field, gathered from its
+// term dictionaries across the pindexes of the index.
+type FieldStats struct {
+	Field string `json:"field"`
+
+	// Type is "number", "datetime" or "geopoint" for numerically
+	// encoded fields, else empty.
+	Type string `json:"type,omitempty"`
+
+	// DocCount is the number of documents that have the field, which
+	// is unavailable for geopoint fields, and for text fields with
+	// more than FieldStatsDocCountMaxTerms distinct terms.
+	DocCount *uint64 `json:"docCount,omitempty"`
+
+	// UniqueTerms is the number of distinct terms of the field, which
+	// is a lower bound when the stats are sampled or partial.
+	UniqueTerms uint64 `json:"uniqueTerms"`
+
+	TopTerms []*Suggestion `json:"topTerms"`
+
+	Min     *float64   `json:"min,omitempty"`
+	Max     *float64   `json:"max,omitempty"`
+	MinDate *time.Time `json:"minDate,omitempty"`
+	MaxDate *time.Time `json:"maxDate,omitempty"`
+
+	Partial bool `json:"partial,omitempty"`
+}
+
+// FieldStatsResult is the JSON response of the fieldStats REST
+// endpoint.  When the request asks for a sample, the document and
+// term counts are scaled up from the sampled pindexes.
+type FieldStatsResult struct {
+	Status string        `json:"status"`
+	Sample float64       `json:"sample,omitempty"`
+	Fields []*FieldStats `json:"fields"`
+}
+
+// mappedFieldTypes returns the field types of an index mapping keyed
+// by field path, across the default and all the type mappings.
+func mappedFieldTypes(m mapping.IndexMapping) map[string]string {
+	rv := map[string]string{}
+
+	im, ok := m.(*mapping.IndexMappingImpl)
+	if !ok {
+		return rv
+	}
+
+	var walk func(dm *mapping.DocumentMapping, path string)
+	walk = func(dm *mapping.DocumentMapping, path string) {
+		if dm == nil || !dm.Enabled {
+			return
+		}
+		for name, sub := range dm.Properties {
+			subPath := name
+			if path != "" {
+				subPath = path + "." + name
+			}
+			for _, fm := range sub.Fields {
+				fieldPath := subPath
+				if fm.Name != "" && fm.Name != name {
+					fieldPath = fm.Name
+					if path != "" {
+						fieldPath = path + "." + fm.Name
+					}
+				}
+				if _, exists := rv[fieldPath]; !exists {
+					rv[fieldPath] = fm.Type
+				}
+			}
+			walk(sub, subPath)
+		}
+	}
+
+	walk(im.DefaultMapping, "")
+	for _, dm := range im.TypeMapping {
+		walk(dm, "")
+	}
+
+	return rv
+}
+
+// isNumericTerm returns true for the full precision terms of numeric
+// and datetime fields, which sort ahead of their lower precision
+// terms.
+func isNumericTerm(term string) bool {
+	shift, err := numeric.PrefixCoded(term).Shift()
+	return err == nil && shift == 0
+}
+
+// fieldStatsFromDict reads a field's term dictionary into its stats,
+// other than the document count.  The mappedType is the field's type
+// in the index mapping, or empty for dynamically mapped fields, which
+// are numeric when their first term is numerically encoded.
+func fieldStatsFromDict(ctx context.Context, fd index.FieldDict,
+	field, mappedType string, size, maxTerms int) (*FieldStats, error) {
+	rv := &FieldStats{Field: field}
+
+	switch mappedType {
+	case "number", "datetime", "geopoint":
+		rv.Type = mappedType
+	}
+
+	h := make(suggestionHeap, 0, size)
+
+	for n := 0; ; n++ {
+		if n >= maxTerms {
+			rv.Partial = true
+			break
+		}
+
+		if n%1000 == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		entry, err := fd.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+
+		term := entry.Term
+
+		if n == 0 && mappedType == "" && isNumericTerm(term) {
+			rv.Type = "number"
+		}
+
+		if rv.Type != "" {
+			if !isNumericTerm(term) {
+				break // The rest are lower precision terms.
+			}
+
+			rv.UniqueTerms++
+
+			if rv.Type == "geopoint" {
+				continue // The terms are hashes of the locations.
+			}
+
+			i64, err := numeric.PrefixCoded(term).Int64()
+			if err != nil {
+				return nil, err
+			}
+
+			if rv.Type == "datetime" {
+				t := time.Unix(0, i64).UTC()
+				if rv.MinDate == nil {
+					rv.MinDate = &t
+				}
+				rv.MaxDate = &t
+				term = t.Format(time.RFC3339Nano)
+			} else {
+				f := numeric.Int64ToFloat64(i64)
+				if rv.Min == nil {
+					rv.Min = &f
+				}
+				rv.Max = &f
+				term = strconv.FormatFloat(f, 'g', -1, 64)
+			}
+		} else {
+			rv.UniqueTerms++
+		}
+
+		h.offer(&Suggestion{Term: term, Count: entry.Count}, size)
+	}
+
+	rv.TopTerms = h.sorted()
+
+	return rv, nil
+}
+
+// fieldDocCount returns the number of documents that have a field,
+// by searching for any of the field's terms, or nil when that's too
+// costly, or not possible, for the field.
+func fieldDocCount(ctx context.Context, targets []bleve.Index,
+	fs *FieldStats) (*uint64, error) {
+	var q query.FieldableQuery
+	switch fs.Type {
+	case "number", "datetime":
+		// The unbounded numeric range needs a bounded number of terms
+		// of the various precisions, and each document is counted by
+		// the single term of each precision.
+		q = query.NewNumericRangeInclusiveQuery(nil, nil, nil, nil)
+	case "":
+		maxTerms := FieldStatsDocCountMaxTerms
+		if searcher.DisjunctionMaxClauseCount > 0 &&
+			searcher.DisjunctionMaxClauseCount < maxTerms {
+			maxTerms = searcher.DisjunctionMaxClauseCount
+		}
+		if fs.Partial || fs.UniqueTerms > uint64(maxTerms) {
+			return nil, nil
+		}
+		q = query.NewTermRangeQueryInclusive("", "\U0010FFFF", nil, nil)
+	default:
+		return nil, nil // The geopoint terms are hashes of the locations.
+	}
+	q.SetField(fs.Field)
+
+	alias := bleve.NewIndexAlias()
+	for _, target := range targets {
+		if _, ok := target.(*MissingPIndex); !ok {
+			alias.Add(target)
+		}
+	}
+
+	res, err := alias.SearchInContext(ctx,
+		bleve.NewSearchRequestOptions(q, 0, 0, false))
+	if err != nil {
+		return nil, err
+	}
+
+	return &res.Total, nil
+}
+
+// samplePIndexNames returns an evenly spread fraction of the pindexes
+// of an index, or nil for all of them, along with the factor that
+// scales up the counts of the sampled pindexes to the whole index.
+func samplePIndexNames(mgr *cbgt.Manager, indexName string,
+	sample float64) ([]string, float64, error) {
+	if sample <= 0 || sample >= 1 {
+		return nil, 1, nil
+	}
+
+	planPIndexes, _, err := mgr.GetPlanPIndexes(false)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var names []string
+	if planPIndexes != nil {
+		for name, planPIndex := range planPIndexes.PlanPIndexes {
+			if planPIndex.IndexName == indexName {
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) <= 0 {
+		return nil, 0, fmt.Errorf("no planPIndexes for indexName: %s",
+			indexName)
+	}
+	sort.Strings(names)
+
+	n := int(math.Ceil(float64(len(names)) * sample))
+
+	rv := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		rv = append(rv, names[i*len(names)/n])
+	}
+
+	return rv, float64(len(names)) / float64(n), nil
+}
+
+// scaleFieldStats scales up the document and term counts of field
+// stats that were gathered from a sample of the pindexes.
+func scaleFieldStats(fs *FieldStats, scale float64) {
+	scaleCount := func(v uint64) uint64 {
+		return uint64(math.Round(float64(v) * scale))
+	}
+
+	if fs.DocCount != nil {
+		docCount := scaleCount(*fs.DocCount)
+		fs.DocCount = &docCount
+	}
+	for _, t := range fs.TopTerms {
+		t.Count = scaleCount(t.Count)
+	}
+}
+
+// FieldStatsHandler is a REST handler that reports the statistics of
+// the indexed fields of an index, across all its pindexes.
+type FieldStatsHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewFieldStatsHandler(mgr *cbgt.Manager) *FieldStatsHandler {
+	return &FieldStatsHandler{mgr: mgr}
+}
+
+func (h *FieldStatsHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := rest.IndexNameLookup(req)
+	if indexName == "" {
+		rest.ShowError(w, req, "index name is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	size := FieldStatsDefaultSize
+	if v := req.FormValue("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			rest.ShowError(w, req, fmt.Sprintf("fieldStats, invalid size: %q",
+				v), http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+
+	sample := 0.0
+	if v := req.FormValue("sample"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 || f > 1 {
+			rest.ShowError(w, req, fmt.Sprintf("fieldStats, sample must be"+
+				" greater than 0 and at most 1, got: %q", v),
+				http.StatusBadRequest)
+			return
+		}
+		if f < 1 {
+			sample = f
+		}
+	}
+
+	timeout := int(cbgt.QUERY_CTL_DEFAULT_TIMEOUT_MS)
+	if v := req.FormValue("timeout"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			rest.ShowError(w, req, fmt.Sprintf("fieldStats,"+
+				" invalid timeout: %q", v), http.StatusBadRequest)
+			return
+		}
+		timeout = n
+	}
+
+	m, err := bleveIndexMapping(h.mgr, indexName)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("fieldStats,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return
+	}
+	fieldTypes := mappedFieldTypes(m)
+
+	pindexNames, scale, err := samplePIndexNames(h.mgr, indexName, sample)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("fieldStats,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	targets, err := indexTargets(h.mgr, indexName, pindexNames)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("fieldStats,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(),
+		time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+
+	fields := []string{req.FormValue("field")}
+	if fields[0] == "" {
+		fields, err = aliasFields(ctx, targets)
+		if err != nil {
+			rest.ShowError(w, req, fmt.Sprintf("fieldStats,"+
+				" indexName: %s, err: %v", indexName, err),
+				http.StatusInternalServerError)
+			return
+		}
+	}
+
+	rv := &FieldStatsResult{
+		Status: "ok",
+		Sample: sample,
+		Fields: make([]*FieldStats, 0, len(fields)),
+	}
+
+	for _, field := range fields {
+		if field == "_all" {
+			continue // The composite field repeats the other fields.
+		}
+
+		fs, err := h.fieldStats(ctx, targets, field,
+			fieldTypes[field], size)
+		if err != nil {
+			rest.ShowError(w, req, fmt.Sprintf("fieldStats,"+
+				" indexName: %s, field: %s, err: %v", indexName, field, err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		if sample > 0 {
+			scaleFieldStats(fs, scale)
+		}
+
+		rv.Fields = append(rv.Fields, fs)
+	}
+
+	rest.MustEncode(w, rv)
+}
+
+func (h *FieldStatsHandler) fieldStats(ctx context.Context,
+	targets []bleve.Index, field, mappedType string, size int) (
+	*FieldStats, error) {
+	fd, err := aliasFieldDict(ctx, targets, &FieldDictRequest{Field: field})
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	fs, err := fieldStatsFromDict(ctx, fd, field, mappedType, size,
+		FieldStatsMaxTerms)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.DocCount, err = fieldDocCount(ctx, targets, fs)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
@@ -0,0 +1,169 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/index"
+	"github.com/blevesearch/bleve/numeric"
+
+	"github.com/couchbase/cbgt"
+)
+
+func TestFieldStatsFromDict(t *testing.T) {
+	ctx := context.Background()
+
+	fs, err := fieldStatsFromDict(ctx, &testFieldDict{entries: []index.DictEntry{
+		{Term: "ale", Count: 4}, {Term: "lager", Count: 7}, {Term: "stout", Count: 1},
+	}}, "style", "text", 2, 100)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if fs.Type != "" || fs.UniqueTerms != 3 || fs.Partial ||
+		len(fs.TopTerms) != 2 || fs.TopTerms[0].Term != "lager" ||
+		fs.TopTerms[1].Term != "ale" || fs.Min != nil {
+		t.Errorf("unexpected text field stats: %+v", fs)
+	}
+
+	numericTerm := func(f float64, shift uint) string {
+		return string(numeric.MustNewPrefixCodedInt64(
+			numeric.Float64ToInt64(f), shift))
+	}
+
+	// the full precision terms sort ahead of the lower precision ones
+	entries := []index.DictEntry{
+		{Term: numericTerm(-5, 0), Count: 2},
+		{Term: numericTerm(10, 0), Count: 3},
+		{Term: numericTerm(10, 4), Count: 5},
+	}
+
+	fs, err = fieldStatsFromDict(ctx, &testFieldDict{entries: entries},
+		"abv", "", 10, 100)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if fs.Type != "number" || fs.UniqueTerms != 2 ||
+		fs.Min == nil || *fs.Min != -5 || fs.Max == nil || *fs.Max != 10 ||
+		len(fs.TopTerms) != 2 || fs.TopTerms[0].Term != "10" ||
+		fs.TopTerms[1].Term != "-5" {
+		t.Errorf("unexpected numeric field stats: %+v", fs)
+	}
+
+	t0 := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	t1 := t0.Add(time.Hour)
+	fs, err = fieldStatsFromDict(ctx, &testFieldDict{entries: []index.DictEntry{
+		{Term: string(numeric.MustNewPrefixCodedInt64(t0.UnixNano(), 0)), Count: 1},
+		{Term: string(numeric.MustNewPrefixCodedInt64(t1.UnixNano(), 0)), Count: 1},
+	}}, "updated", "datetime", 10, 1)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if fs.Type != "datetime" || !fs.Partial || fs.UniqueTerms != 1 ||
+		fs.MinDate == nil || !fs.MinDate.Equal(t0) ||
+		fs.TopTerms[0].Term != "2018-01-02T03:04:05Z" {
+		t.Errorf("unexpected datetime field stats: %+v", fs)
+	}
+}
+
+func TestScaleFieldStats(t *testing.T) {
+	docCount := uint64(30)
+	fs := &FieldStats{
+		DocCount:    &docCount,
+		UniqueTerms: 7,
+		TopTerms:    []*Suggestion{{Term: "x", Count: 3}},
+	}
+	scaleFieldStats(fs, 1.5)
+	if *fs.DocCount != 45 || fs.UniqueTerms != 7 || fs.TopTerms[0].Count != 5 {
+		t.Errorf("unexpected scaled field stats: %+v", fs)
+	}
+
+	fs = &FieldStats{TopTerms: []*Suggestion{{Term: "x", Count: 3}}}
+	scaleFieldStats(fs, 2)
+	if fs.DocCount != nil || fs.TopTerms[0].Count != 6 {
+		t.Errorf("unexpected scaled field stats: %+v", fs)
+	}
+}
+
+func TestSamplePIndexNames(t *testing.T) {
+	mgr := cbgt.NewManager(cbgt.VERSION, cbgt.NewCfgMem(), cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", "", "some-datasource", nil)
+
+	planPIndexes := cbgt.NewPlanPIndexes(cbgt.VERSION)
+	for _, name := range []string{"p0", "p1", "p2"} {
+		planPIndexes.PlanPIndexes[name] = &cbgt.PlanPIndex{
+			Name:      name,
+			IndexName: "idx",
+		}
+	}
+	_, err := cbgt.CfgSetPlanPIndexes(mgr.Cfg(), planPIndexes, 0)
+	if err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes() to work, err: %v", err)
+	}
+
+	names, scale, err := samplePIndexNames(mgr, "idx", 0.5)
+	if err != nil || len(names) != 2 || scale != 1.5 {
+		t.Errorf("expected 2 of 3 pindexes, got: %v, scale: %v, err: %v",
+			names, scale, err)
+	}
+
+	names, scale, err = samplePIndexNames(mgr, "idx", 0)
+	if err != nil || names != nil || scale != 1 {
+		t.Errorf("expected all pindexes, got: %v, scale: %v, err: %v",
+			names, scale, err)
+	}
+}
+
+func TestFieldDocCount(t *testing.T) {
+	idx, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	for i := 0; i < 2000; i++ {
+		err = idx.Index(strconv.Itoa(i), map[string]interface{}{
+			"name": "n" + strconv.Itoa(i),
+			"abv":  float64(i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx.Index("empty", map[string]interface{}{"other": "x"})
+
+	targets := []bleve.Index{idx}
+	ctx := context.Background()
+
+	docCount, err := fieldDocCount(ctx, targets,
+		&FieldStats{Field: "abv", Type: "number", UniqueTerms: 2000})
+	if err != nil || docCount == nil || *docCount != 2000 {
+		t.Errorf("expected numeric doc count, got: %v, err: %v", docCount, err)
+	}
+
+	// too many distinct terms for the count
+	docCount, err = fieldDocCount(ctx, targets,
+		&FieldStats{Field: "name", UniqueTerms: 2000})
+	if err != nil || docCount != nil {
+		t.Errorf("expected no text doc count, got: %v, err: %v", docCount, err)
+	}
+
+	docCount, err = fieldDocCount(ctx, targets,
+		&FieldStats{Field: "other", UniqueTerms: 1})
+	if err != nil || docCount == nil || *docCount != 1 {
+		t.Errorf("expected text doc count, got: %v, err: %v", docCount, err)
+	}
+}
@@ -354,6 +354,25 @@ func (h *NsStatsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	topLevelStats["pct_cpu_gc"] = rd.memStats.GCCPUFraction
 	topLevelStats["tot_remote_http"] = atomic.LoadUint64(&totRemoteHttp)
 	topLevelStats["tot_remote_http2"] = atomic.LoadUint64(&totRemoteHttp2)
+	topLevelStats["tot_remote_prefetch"] = atomic.LoadUint64(&totRemotePrefetch)
+	topLevelStats["tot_remote_prefetch_wasted"] =
+		atomic.LoadUint64(&totRemotePrefetchWasted)
+	topLevelStats["tot_remote_hedges"] = atomic.LoadUint64(&totRemoteHedges)
+	topLevelStats["tot_remote_hedge_wins"] = atomic.LoadUint64(&totRemoteHedgeWins)
+	topLevelStats["tot_remote_hedge_budget_exceeded"] =
+		atomic.LoadUint64(&totRemoteHedgeBudgetExceeded)
+	topLevelStats["tot_remote_fallbacks"] = atomic.LoadUint64(&totRemoteFallbacks)
+	topLevelStats["tot_remote_fallback_failures"] =
+		atomic.LoadUint64(&totRemoteFallbackFailures)
+	topLevelStats["tot_remote_breaker_opened"] =
+		atomic.LoadUint64(&totRemoteBreakerOpened)
+	topLevelStats["tot_remote_breaker_rejected"] =
+		atomic.LoadUint64(&totRemoteBreakerRejected)
+	topLevelStats["num_remote_breakers_open"] = numRemoteBreakersOpen()
+
+	topLevelStats["tot_tls_reloads"] = atomic.LoadUint64(&totTLSReloads)
+	topLevelStats["tot_tls_reload_errors"] =
+		atomic.LoadUint64(&totTLSReloadErrors)
 
 	topLevelStats["tot_http_limitlisteners_opened"] =
 		atomic.LoadUint64(&TotHTTPLimitListenersOpened)
@@ -12,15 +12,20 @@
 package cbft
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
+	"sort"
 	"strings"
 
 	"github.com/blevesearch/bleve"
 	"github.com/blevesearch/bleve/search/query"
 
 	"github.com/couchbase/cbgt"
-	"github.com/couchbase/cbgt/rest"
+	log "github.com/couchbase/clog"
 )
 
 var maxAliasTargets = 100
@@ -55,8 +60,40 @@ type AliasParams struct {
 	Targets map[string]*AliasParamsTarget `json:"targets"` // Keyed by indexName.
 }
 
+// AliasParamsTarget optionally pins the UUID of an alias target, and
+// can give a view of the target, where the filter query restricts the
+// hits of every query sent to the target without affecting their
+// scores (e.g., a term query on a tenant field), and the scores of the target's hits are multiplied by the
+// boost (e.g., to prefer the target of recent data).  A target with a
+// remote is an index of another cbft cluster instead of a local index.
 type AliasParamsTarget struct {
 	IndexUUID string `json:"indexUUID"` // Optional.
+
+	Filter json.RawMessage `json:"filter,omitempty"` // Optional.
+	Boost  float64         `json:"boost,omitempty"`  // Optional.
+
+	Remote *AliasParamsRemote `json:"remote,omitempty"` // Optional.
+}
+
+// CurrentIndexDefsFetcher, when set, provides the current index
+// definitions to ValidateAlias, which checks the graph of an alias
+// against them during creation.
+var CurrentIndexDefsFetcher *IndexDefsFetcher
+
+type IndexDefsFetcher struct {
+	mgr *cbgt.Manager
+}
+
+func (idf *IndexDefsFetcher) SetManager(mgr *cbgt.Manager) {
+	idf.mgr = mgr
+}
+
+func (idf *IndexDefsFetcher) Get() (map[string]*cbgt.IndexDef, error) {
+	if idf.mgr != nil {
+		_, indexDefsByName, err := idf.mgr.GetIndexDefs(true)
+		return indexDefsByName, err
+	}
+	return nil, fmt.Errorf("IndexDefsFetcher Get(): mgr is nil!")
 }
 
 func ValidateAlias(indexType, indexName, indexParams string) error {
@@ -67,69 +104,406 @@ func ValidateAlias(indexType, indexName, indexParams string) error {
 			return fmt.Errorf("ValidateAlias: cannot create index alias" +
 				" because no index targets were specified")
 		}
+		for targetName, targetSpec := range params.Targets {
+			_, err = newAliasTargetView(targetSpec)
+			if err == nil && targetSpec != nil && targetSpec.Remote != nil {
+				err = targetSpec.Remote.validate()
+			}
+			if err != nil {
+				return fmt.Errorf("ValidateAlias: invalid target: %s,"+
+					" err: %v", targetName, err)
+			}
+		}
+
+		if CurrentIndexDefsFetcher != nil {
+			indexDefsByName, err := CurrentIndexDefsFetcher.Get()
+			if err != nil {
+				return fmt.Errorf("ValidateAlias: could not get indexDefs,"+
+					" err: %v", err)
+			}
+
+			warnings, err := validateAliasTargets(indexName, &params,
+				indexDefsByName)
+			if err != nil {
+				return err
+			}
+			for _, warning := range warnings {
+				log.Warnf("ValidateAlias: indexName: %s, %s",
+					indexName, warning)
+			}
+		}
 	}
 	return err
 }
 
+// validateAliasTargets checks the graph of an alias, whose params are
+// those being validated, against the current index definitions.  It
+// rejects cycles, unknown targets, mismatched target UUIDs and
+// unsupported target types, and returns warnings about the fields
+// that have different types in the mappings of the target indexes.
+func validateAliasTargets(indexName string, params *AliasParams,
+	indexDefsByName map[string]*cbgt.IndexDef) ([]string, error) {
+	leaves := map[string]*cbgt.IndexDef{}
+
+	// the aliases whose targets were all validated
+	done := map[string]bool{}
+
+	var visit func(path []string, params *AliasParams) error
+
+	visit = func(path []string, params *AliasParams) error {
+		targetNames := make([]string, 0, len(params.Targets))
+		for targetName := range params.Targets {
+			targetNames = append(targetNames, targetName)
+		}
+		sort.Strings(targetNames)
+
+		for _, targetName := range targetNames {
+			targetSpec := params.Targets[targetName]
+			if targetSpec != nil && targetSpec.Remote != nil {
+				continue // Not a local index.
+			}
+
+			targetPath := append(append([]string(nil), path...), targetName)
+
+			for _, name := range path {
+				if name == targetName {
+					return fmt.Errorf("ValidateAlias: the alias has"+
+						" a cycle, path: %s", strings.Join(targetPath, " -> "))
+				}
+			}
+
+			targetDef := indexDefsByName[targetName]
+			if targetDef == nil {
+				return fmt.Errorf("ValidateAlias: the alias depends upon"+
+					" a target index that does not exist, targetName: %q,"+
+					" path: %s", targetName, strings.Join(targetPath, " -> "))
+			}
+			if targetSpec != nil && targetSpec.IndexUUID != "" &&
+				targetSpec.IndexUUID != targetDef.UUID {
+				return fmt.Errorf("ValidateAlias: mismatched indexUUID: %s,"+
+					" targetDef.UUID: %s, path: %s", targetSpec.IndexUUID,
+					targetDef.UUID, strings.Join(targetPath, " -> "))
+			}
+
+			if targetDef.Type == "fulltext-alias" {
+				if done[targetName] {
+					continue
+				}
+				targetParams, err := parseAliasParams(targetDef.Params)
+				if err != nil {
+					return fmt.Errorf("ValidateAlias: could not parse"+
+						" params, path: %s, err: %v",
+						strings.Join(targetPath, " -> "), err)
+				}
+				err = visit(targetPath, targetParams)
+				if err != nil {
+					return err
+				}
+				done[targetName] = true
+			} else if strings.HasPrefix(targetDef.Type, "fulltext-index") {
+				leaves[targetName] = targetDef
+			} else {
+				return fmt.Errorf("ValidateAlias: unsupported target type: %s,"+
+					" path: %s", targetDef.Type, strings.Join(targetPath, " -> "))
+			}
+		}
+
+		return nil
+	}
+
+	err := visit([]string{indexName}, params)
+	if err != nil {
+		return nil, err
+	}
+
+	return aliasMappingConflicts(leaves), nil
+}
+
+// aliasMappingConflicts returns a warning for each field that has
+// different types in the mappings of the target indexes of an alias.
+func aliasMappingConflicts(indexDefs map[string]*cbgt.IndexDef) []string {
+	indexNames := make([]string, 0, len(indexDefs))
+	for indexName := range indexDefs {
+		indexNames = append(indexNames, indexName)
+	}
+	sort.Strings(indexNames)
+
+	// keyed by field, then by type, with values of index names
+	fieldTypes := map[string]map[string][]string{}
+
+	for _, indexName := range indexNames {
+		m, err := bleveIndexDefMapping(indexDefs[indexName])
+		if err != nil || m == nil {
+			continue
+		}
+		for field, fieldType := range mappedFieldTypes(m) {
+			types := fieldTypes[field]
+			if types == nil {
+				types = map[string][]string{}
+				fieldTypes[field] = types
+			}
+			types[fieldType] = append(types[fieldType], indexName)
+		}
+	}
+
+	fields := make([]string, 0, len(fieldTypes))
+	for field, types := range fieldTypes {
+		if len(types) > 1 {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	rv := make([]string, 0, len(fields))
+	for _, field := range fields {
+		var parts []string
+		for fieldType, names := range fieldTypes[field] {
+			parts = append(parts, fmt.Sprintf("%s in %s",
+				fieldType, strings.Join(names, ", ")))
+		}
+		sort.Strings(parts)
+
+		rv = append(rv, fmt.Sprintf("incompatible mappings of field: %s,"+
+			" types: %s", field, strings.Join(parts, "; ")))
+	}
+
+	return rv
+}
+
+// aliasLeafIndexDef returns the first local target index of an alias,
+// in name order, whose definition stands for those of all the targets,
+// such as for their mappings, as their conflicts are reported when the
+// alias is defined.
+func aliasLeafIndexDef(aliasDef *cbgt.IndexDef,
+	indexDefsByName map[string]*cbgt.IndexDef) (*cbgt.IndexDef, error) {
+	visited := map[string]bool{}
+
+	var visit func(aliasDef *cbgt.IndexDef) (*cbgt.IndexDef, error)
+
+	visit = func(aliasDef *cbgt.IndexDef) (*cbgt.IndexDef, error) {
+		if visited[aliasDef.Name] {
+			return nil, nil
+		}
+		visited[aliasDef.Name] = true
+
+		params, err := parseAliasParams(aliasDef.Params)
+		if err != nil {
+			return nil, fmt.Errorf("alias: could not parse aliasDef.Params: %s,"+
+				" aliasName: %s, err: %v", aliasDef.Params, aliasDef.Name, err)
+		}
+
+		targetNames := make([]string, 0, len(params.Targets))
+		for targetName := range params.Targets {
+			targetNames = append(targetNames, targetName)
+		}
+		sort.Strings(targetNames)
+
+		for _, targetName := range targetNames {
+			targetSpec := params.Targets[targetName]
+			if targetSpec != nil && targetSpec.Remote != nil {
+				continue // Not a local index.
+			}
+
+			targetDef := indexDefsByName[targetName]
+			if targetDef == nil {
+				continue
+			}
+
+			if targetDef.Type == "fulltext-alias" {
+				leaf, err := visit(targetDef)
+				if err != nil || leaf != nil {
+					return leaf, err
+				}
+			} else if strings.HasPrefix(targetDef.Type, "fulltext-index") {
+				return targetDef, nil
+			}
+		}
+
+		return nil, nil
+	}
+
+	leaf, err := visit(aliasDef)
+	if err != nil {
+		return nil, err
+	}
+	if leaf == nil {
+		return nil, fmt.Errorf("alias: no local target index,"+
+			" aliasName: %s", aliasDef.Name)
+	}
+
+	return leaf, nil
+}
+
+// aliasWarnings returns the warnings about the targets of an index
+// alias, such as the fields that have different types in the mappings
+// of the target indexes, or nil when the index isn't an alias.
+func aliasWarnings(mgr *cbgt.Manager, indexName string) []string {
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return nil
+	}
+
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil || indexDef.Type != "fulltext-alias" {
+		return nil
+	}
+
+	params, err := parseAliasParams(indexDef.Params)
+	if err != nil {
+		return nil
+	}
+
+	warnings, _ := validateAliasTargets(indexName, params, indexDefsByName)
+
+	return warnings
+}
+
+// aliasWarningsWriter holds back the response of an index definition
+// request, so that the warnings about the targets of an index alias
+// can be added to it, as a "warnings" array.
+type aliasWarningsWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func newAliasWarningsWriter(w http.ResponseWriter) *aliasWarningsWriter {
+	return &aliasWarningsWriter{ResponseWriter: w}
+}
+
+func (w *aliasWarningsWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *aliasWarningsWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+// finish sends the response, with the warnings of the index, when it
+// was defined successfully and is an alias.
+func (w *aliasWarningsWriter) finish(mgr *cbgt.Manager, indexName string) {
+	body := w.buf.Bytes()
+
+	if w.status == 0 || w.status == http.StatusOK {
+		warnings := aliasWarnings(mgr, indexName)
+		if len(warnings) > 0 {
+			var rv map[string]interface{}
+			err := json.Unmarshal(body, &rv)
+			if err == nil && rv["status"] == "ok" {
+				rv["warnings"] = warnings
+				b, err := json.Marshal(rv)
+				if err == nil {
+					body = b
+				}
+			}
+		}
+	}
+
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	w.ResponseWriter.Write(body)
+}
+
 func CountAlias(mgr *cbgt.Manager,
 	indexName, indexUUID string) (uint64, error) {
-	alias, err := bleveIndexAliasForUserIndexAlias(mgr,
+	alias, _, _, err := bleveIndexAliasForUserIndexAlias(mgr,
 		indexName, indexUUID, false, nil, nil, false)
 	if err != nil {
-		return 0, fmt.Errorf("alias: CountAlias indexAlias error,"+
-			" indexName: %s, indexUUID: %s, err: %v",
-			indexName, indexUUID, err)
+		if _, ok := err.(*cbgt.ErrorLocalPIndexHealth); !ok {
+			return 0, fmt.Errorf("alias: CountAlias indexAlias error,"+
+				" indexName: %s, indexUUID: %s, err: %v",
+				indexName, indexUUID, err)
+		}
 	}
 
 	return alias.DocCount()
 }
 
+// QueryAlias runs a query against the target indexes of an index
+// alias, through the same query pipeline as QueryBleve.
 func QueryAlias(mgr *cbgt.Manager, indexName, indexUUID string,
 	req []byte, res io.Writer) error {
-	queryCtlParams := cbgt.QueryCtlParams{
-		Ctl: cbgt.QueryCtl{
-			Timeout: cbgt.QUERY_CTL_DEFAULT_TIMEOUT_MS,
-		},
+	return queryBleve(mgr, indexName, indexUUID, req, res,
+		bleveIndexAliasForUserIndexAliasPrefetch)
+}
+
+// aliasTargetView is the part of an alias for a target that has a
+// filter or boost, which rewrites the search requests that are sent
+// to the target's own targets.  The filter only restricts the hits of
+// the rewritten query, and doesn't contribute to their scores.
+type aliasTargetView struct {
+	*indexAliasTargets
+
+	filter query.Query // Optional.
+	boost  float64     // Optional, where 0 means no boost.
+}
+
+// newAliasTargetView returns nil when the target has neither a filter
+// nor a boost.
+func newAliasTargetView(spec *AliasParamsTarget) (*aliasTargetView, error) {
+	if spec == nil || (len(spec.Filter) <= 0 && spec.Boost == 0) {
+		return nil, nil
 	}
 
-	err := UnmarshalJSON(req, &queryCtlParams)
-	if err != nil {
-		return fmt.Errorf("alias: QueryAlias"+
-			" parsing queryCtlParams, err: %v", err)
+	if spec.Boost < 0 {
+		return nil, fmt.Errorf("negative boost: %v", spec.Boost)
+	}
+
+	var filter query.Query
+	if len(spec.Filter) > 0 {
+		var err error
+		filter, err = query.ParseQuery(spec.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse filter: %s, err: %v",
+				spec.Filter, err)
+		}
 	}
 
-	searchRequest := &bleve.SearchRequest{}
+	return &aliasTargetView{
+		indexAliasTargets: &indexAliasTargets{IndexAlias: bleve.NewIndexAlias()},
+		filter:            filter,
+		boost:             spec.Boost,
+	}, nil
+}
 
-	err = UnmarshalJSON(req, searchRequest)
-	if err != nil {
-		return fmt.Errorf("alias: QueryAlias"+
-			" parsing searchRequest, err: %v", err)
+func (v *aliasTargetView) Search(req *bleve.SearchRequest) (
+	*bleve.SearchResult, error) {
+	return v.SearchInContext(context.Background(), req)
+}
+
+func (v *aliasTargetView) SearchInContext(ctx context.Context,
+	req *bleve.SearchRequest) (*bleve.SearchResult, error) {
+	if v.filter != nil {
+		r := *req
+		r.Query = newFilteredQuery(req.Query, v.filter)
+		req = &r
 	}
 
-	if srqv, ok := searchRequest.Query.(query.ValidatableQuery); ok {
-		err = srqv.Validate()
-		if err != nil {
-			return err
+	res, err := v.indexAliasTargets.SearchInContext(ctx, req)
+	if res != nil && v.boost != 0 {
+		for _, hit := range res.Hits {
+			hit.Score *= v.boost
 		}
+		res.MaxScore *= v.boost
 	}
 
-	cancelCh := cbgt.TimeoutCancelChan(queryCtlParams.Ctl.Timeout)
+	return res, err
+}
 
-	alias, err := bleveIndexAliasForUserIndexAlias(mgr,
-		indexName, indexUUID, true,
-		queryCtlParams.Ctl.Consistency, cancelCh, true)
-	if err != nil {
-		return err
+// DocCount returns the number of documents that match the filter.
+func (v *aliasTargetView) DocCount() (uint64, error) {
+	if v.filter == nil {
+		return v.indexAliasTargets.DocCount()
 	}
 
-	searchResponse, err := alias.Search(searchRequest)
+	res, err := v.indexAliasTargets.SearchInContext(context.Background(),
+		bleve.NewSearchRequestOptions(v.filter, 0, 0, false))
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	rest.MustEncode(res, searchResponse)
-
-	return nil
+	return res.Total, nil
 }
 
 func parseAliasParams(aliasDefParams string) (*AliasParams, error) {
@@ -141,27 +515,60 @@ func parseAliasParams(aliasDefParams string) (*AliasParams, error) {
 	return &params, nil
 }
 
-// The indexName/indexUUID is for a user-defined index alias.
+// The indexName/indexUUID is for a user-defined index alias.  The
+// returned alias has the local and remote targets of all the target
+// indexes, where the remote clients and the number of pindexes are
+// totalled across the target indexes.  Targets in remote clusters are
+// searched as a whole, without remote clients or pindexes.  As with
+// bleveIndexAlias(), an ErrorLocalPIndexHealth error is returned along
+// with a usable alias.
 //
 // TODO: One day support user-defined aliases for non-bleve indexes.
 func bleveIndexAliasForUserIndexAlias(mgr *cbgt.Manager,
 	indexName, indexUUID string, ensureCanRead bool,
 	consistencyParams *cbgt.ConsistencyParams,
 	cancelCh <-chan bool, groupByNode bool) (
-	bleve.IndexAlias, error) {
-	alias := bleve.NewIndexAlias()
+	bleve.IndexAlias, []*IndexClient, int, error) {
+	return bleveIndexAliasForUserIndexAliasPrefetch(nil, nil, mgr,
+		indexName, indexUUID, ensureCanRead, consistencyParams, cancelCh,
+		groupByNode, nil)
+}
+
+// bleveIndexAliasForUserIndexAliasPrefetch is like
+// bleveIndexAliasForUserIndexAlias(), but prefetches the search
+// request from the remote targets, like bleveIndexAliasPrefetch().
+// The targets behind a filter or boost are not prefetched, as their
+// view rewrites the request.  A non-nil onlyPIndexes limits the
+// pindexes of the target indexes that are searched.
+func bleveIndexAliasForUserIndexAliasPrefetch(ctx context.Context,
+	req *bleve.SearchRequest, mgr *cbgt.Manager,
+	indexName, indexUUID string, ensureCanRead bool,
+	consistencyParams *cbgt.ConsistencyParams,
+	cancelCh <-chan bool, groupByNode bool, onlyPIndexes map[string]bool) (
+	bleve.IndexAlias, []*IndexClient, int, error) {
+	alias := &indexAliasTargets{
+		IndexAlias:  bleve.NewIndexAlias(),
+		prefetchCtx: ctx,
+		prefetchReq: req,
+	}
+
+	var remoteClients []*IndexClient
+	var numPIndexes int
+	var healthErr *cbgt.ErrorLocalPIndexHealth
 
 	indexDefs, _, err := mgr.GetIndexDefs(false)
 	if err != nil {
-		return nil, fmt.Errorf("alias: could not get indexDefs,"+
+		return nil, nil, 0, fmt.Errorf("alias: could not get indexDefs,"+
 			" indexName: %s, err: %v", indexName, err)
 	}
 
 	num := 0
 
-	var fillAlias func(aliasName, aliasUUID string) error
+	var fillAlias func(aliasName, aliasUUID string,
+		into *indexAliasTargets) error
 
-	fillAlias = func(aliasName, aliasUUID string) error {
+	fillAlias = func(aliasName, aliasUUID string,
+		into *indexAliasTargets) error {
 		aliasDef := indexDefs.IndexDefs[aliasName]
 		if aliasDef == nil {
 			return fmt.Errorf("alias: could not get aliasDef,"+
@@ -195,6 +602,38 @@ func bleveIndexAliasForUserIndexAlias(mgr *cbgt.Manager,
 					" aliasName: %s, indexName: %s",
 					aliasName, indexName)
 			}
+
+			// A target with a filter or boost is filled into its own
+			// view, which is then added to the alias being filled.
+			targetInto := into
+			view, err := newAliasTargetView(targetSpec)
+			if err != nil {
+				return fmt.Errorf("alias: invalid target: %s,"+
+					" aliasName: %s, indexName: %s, err: %v",
+					targetName, aliasName, indexName, err)
+			}
+			if view != nil {
+				view.SetName(targetName)
+				targetInto = view.indexAliasTargets
+			}
+
+			if targetSpec != nil && targetSpec.Remote != nil {
+				rc, err := newRemoteClusterIndex(mgr, targetName,
+					targetSpec.Remote)
+				if err != nil {
+					return fmt.Errorf("alias: invalid remote target: %s,"+
+						" aliasName: %s, indexName: %s, err: %v",
+						targetName, aliasName, indexName, err)
+				}
+				targetInto.addRemoteCluster(rc)
+				num += 1
+
+				if view != nil {
+					into.addView(view)
+				}
+				continue
+			}
+
 			targetDef := indexDefs.IndexDefs[targetName]
 			if targetDef == nil {
 				return fmt.Errorf("alias: the alias depends upon"+
@@ -213,34 +652,54 @@ func bleveIndexAliasForUserIndexAlias(mgr *cbgt.Manager,
 
 			// TODO: Convert to registered callbacks instead of if-else-if.
 			if targetDef.Type == "fulltext-alias" {
-				err = fillAlias(targetName, targetSpec.IndexUUID)
+				err = fillAlias(targetName, targetSpec.IndexUUID, targetInto)
 				if err != nil {
 					return err
 				}
 			} else if strings.HasPrefix(targetDef.Type, "fulltext-index") {
-				var subAlias bleve.IndexAlias
-				subAlias, _, _, err = bleveIndexAlias(mgr,
+				targetClients, targetPIndexes, err := bleveIndexTargets(mgr,
 					targetName, targetSpec.IndexUUID, ensureCanRead,
-					consistencyParams, cancelCh, true, nil)
+					consistencyParams, cancelCh, groupByNode, onlyPIndexes,
+					targetInto)
 				if err != nil {
-					return err
+					e, ok := err.(*cbgt.ErrorLocalPIndexHealth)
+					if !ok {
+						return err
+					}
+					if healthErr == nil {
+						healthErr = &cbgt.ErrorLocalPIndexHealth{
+							IndexErrMap: map[string]error{},
+						}
+					}
+					for pindexName, pindexErr := range e.IndexErrMap {
+						healthErr.IndexErrMap[pindexName] = pindexErr
+					}
 				}
-				alias.Add(subAlias)
+				remoteClients = append(remoteClients, targetClients...)
+				numPIndexes += targetPIndexes
 				num += 1
 			} else {
 				return fmt.Errorf("alias: unsupported target type: %s,"+
 					" targetName: %s, aliasName: %s, indexName: %s",
 					targetDef.Type, targetName, aliasName, indexName)
 			}
+
+			if view != nil {
+				into.addView(view)
+			}
 		}
 
 		return nil
 	}
 
-	err = fillAlias(indexName, indexUUID)
+	err = fillAlias(indexName, indexUUID, alias)
 	if err != nil {
-		return nil, err
+		return nil, nil, 0, err
+	}
+
+	if healthErr != nil {
+		return alias, remoteClients, numPIndexes, healthErr
 	}
 
-	return alias, nil
+	return alias, remoteClients, numPIndexes, nil
 }
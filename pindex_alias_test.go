@@ -0,0 +1,508 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+
+	"github.com/couchbase/cbgt"
+)
+
+func TestQueryAliasMaxResultWindow(t *testing.T) {
+	mgr := cbgt.NewManagerEx(cbgt.VERSION, cbgt.NewCfgMem(), cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", "", "some-datasource", nil,
+		map[string]string{"bleveMaxResultWindow": "10"})
+
+	var res bytes.Buffer
+	err := QueryAlias(mgr, "alias", "",
+		[]byte(`{"query":{"match_all":{}},"from":5,"size":10}`), &res)
+	if err == nil ||
+		!strings.Contains(err.Error(), "bleveMaxResultWindow exceeded") {
+		t.Errorf("expected bleveMaxResultWindow err, got: %v", err)
+	}
+
+	err = QueryAlias(mgr, "alias", "",
+		[]byte(`{"query":{"match_all":{}},"size":10}`), &res)
+	if err == nil ||
+		strings.Contains(err.Error(), "bleveMaxResultWindow") {
+		t.Errorf("expected missing alias err, got: %v", err)
+	}
+}
+
+func TestNewAliasTargetView(t *testing.T) {
+	tests := []struct {
+		spec     *AliasParamsTarget
+		wantView bool
+		wantErr  bool
+	}{
+		{nil, false, false},
+		{&AliasParamsTarget{IndexUUID: "x"}, false, false},
+		{&AliasParamsTarget{Boost: 2}, true, false},
+		{&AliasParamsTarget{Boost: -1}, false, true},
+		{&AliasParamsTarget{Filter: []byte(`{"term":"a","field":"f"}`)},
+			true, false},
+		{&AliasParamsTarget{Filter: []byte(`{"nope":1}`)}, false, true},
+	}
+
+	for i, test := range tests {
+		view, err := newAliasTargetView(test.spec)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%d: expected err: %t, got: %v", i, test.wantErr, err)
+		}
+		if (view != nil) != test.wantView {
+			t.Errorf("%d: expected view: %t, got: %+v", i, test.wantView, view)
+		}
+	}
+
+	err := ValidateAlias("fulltext-alias", "a",
+		`{"targets":{"x":{"filter":{"nope":1}}}}`)
+	if err == nil {
+		t.Errorf("expected ValidateAlias() err for an invalid filter")
+	}
+}
+
+func TestAliasTargetView(t *testing.T) {
+	idx, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	docs := map[string]interface{}{
+		"a": map[string]interface{}{"tenant": "t1", "text": "beer"},
+		"b": map[string]interface{}{"tenant": "t2", "text": "beer"},
+		"c": map[string]interface{}{"tenant": "t1", "text": "wine"},
+	}
+	for id, doc := range docs {
+		if err = idx.Index(id, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := bleve.NewSearchRequest(bleve.NewMatchQuery("beer"))
+
+	unboosted, err := idx.Search(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	view, err := newAliasTargetView(&AliasParamsTarget{
+		Filter: []byte(`{"term":"t1","field":"tenant"}`),
+		Boost:  2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	view.Add(idx)
+
+	res, err := view.Search(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 1 || res.Hits[0].ID != "a" {
+		t.Errorf("expected only the filtered hit, got: %v", res)
+	}
+	if res.MaxScore <= unboosted.MaxScore {
+		t.Errorf("expected boosted scores, got: %v, unboosted: %v",
+			res.MaxScore, unboosted.MaxScore)
+	}
+	if _, ok := req.Query.(*query.MatchQuery); !ok {
+		t.Errorf("expected the request to be unchanged, got: %#v", req.Query)
+	}
+
+	n, err := view.DocCount()
+	if err != nil || n != 2 {
+		t.Errorf("expected the filtered doc count, got: %d, err: %v", n, err)
+	}
+
+	alias := &indexAliasTargets{IndexAlias: bleve.NewIndexAlias()}
+	alias.addView(view)
+	if targets := alias.Targets(); len(targets) != 1 || targets[0] != idx {
+		t.Errorf("expected the view's targets, got: %v", targets)
+	}
+}
+
+func TestAliasTargetViewFilterScores(t *testing.T) {
+	idx, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	docs := map[string]interface{}{
+		"a": map[string]interface{}{"tenant": "t1", "text": "beer"},
+		"b": map[string]interface{}{"tenant": "t2", "text": "beer beer ale"},
+		"c": map[string]interface{}{"tenant": "t1", "text": "beer and wine"},
+		"d": map[string]interface{}{"tenant": "t1", "text": "wine"},
+	}
+	for id, doc := range docs {
+		if err = idx.Index(id, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := bleve.NewSearchRequest(bleve.NewMatchQuery("beer"))
+
+	unfiltered, err := idx.Search(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scores := map[string]float64{}
+	for _, hit := range unfiltered.Hits {
+		scores[hit.ID] = hit.Score
+	}
+
+	tests := []struct {
+		filter string
+		ids    []string
+	}{
+		{`{"match_all":{}}`, []string{"a", "b", "c"}},
+		{`{"term":"t1","field":"tenant"}`, []string{"a", "c"}},
+		{`{"term":"t3","field":"tenant"}`, nil},
+	}
+
+	for i, test := range tests {
+		view, err := newAliasTargetView(&AliasParamsTarget{
+			Filter: []byte(test.filter),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		view.Add(idx)
+
+		res, err := view.Search(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(res.Total) != len(test.ids) || len(res.Hits) != len(test.ids) {
+			t.Errorf("%d: expected hits: %v, got: %v", i, test.ids, res.Hits)
+			continue
+		}
+		for _, hit := range res.Hits {
+			if hit.Score != scores[hit.ID] {
+				t.Errorf("%d: expected the filter not to change the score"+
+					" of %s: %v, got: %v", i, hit.ID, scores[hit.ID], hit.Score)
+			}
+		}
+	}
+
+	// remote nodes receive the filters as conjuncts, with a flag to
+	// apply them without scoring
+	q := newFilteredQuery(newFilteredQuery(bleve.NewMatchQuery("beer"),
+		bleve.NewTermQuery("t1")), bleve.NewMatchAllQuery())
+	buf, err := json.Marshal(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := query.ParseQuery(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fq, ok := unwrapFilteredQuery(parsed).(*filteredQuery)
+	if !ok || len(fq.filters) != 2 {
+		t.Fatalf("expected a query with 2 filters, got: %#v", parsed)
+	}
+	if _, ok = fq.query.(*query.MatchQuery); !ok {
+		t.Errorf("expected the scoring query first, got: %#v", fq.query)
+	}
+}
+
+func TestValidateAliasTargets(t *testing.T) {
+	mappingParams := func(fieldType string) string {
+		return `{"mapping":{"default_mapping":{"enabled":true,` +
+			`"properties":{"f":{"enabled":true,"fields":[` +
+			`{"name":"f","type":"` + fieldType + `"}]}}}}}`
+	}
+
+	indexDefsByName := map[string]*cbgt.IndexDef{
+		"a": {Name: "a", UUID: "aUUID", Type: "fulltext-index",
+			Params: mappingParams("text")},
+		"b": {Name: "b", UUID: "bUUID", Type: "fulltext-index",
+			Params: mappingParams("number")},
+		"c": {Name: "c", UUID: "cUUID", Type: "fulltext-index",
+			Params: mappingParams("text")},
+		"x": {Name: "x", UUID: "xUUID", Type: "fulltext-alias",
+			Params: `{"targets":{"y":{}}}`},
+		"y": {Name: "y", UUID: "yUUID", Type: "fulltext-alias",
+			Params: `{"targets":{"me":{}}}`},
+		"z": {Name: "z", UUID: "zUUID", Type: "fulltext-alias",
+			Params: `{"targets":{"a":{},"c":{}}}`},
+		"kv": {Name: "kv", UUID: "kvUUID", Type: "blackhole"},
+	}
+
+	errTests := []struct {
+		params string
+		errMsg string
+	}{
+		{`{"targets":{"x":{}}}`, "me -> x -> y -> me"},
+		{`{"targets":{"nope":{}}}`, "nope"},
+		{`{"targets":{"z":{},"a":{"indexUUID":"oldUUID"}}}`, "oldUUID"},
+		{`{"targets":{"kv":{}}}`, "blackhole"},
+	}
+
+	for i, test := range errTests {
+		params, err := parseAliasParams(test.params)
+		if err != nil {
+			t.Fatalf("%d: expected params to parse, err: %v", i, err)
+		}
+		_, err = validateAliasTargets("me", params, indexDefsByName)
+		if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+			t.Errorf("%d: expected err with %q, got: %v", i, test.errMsg, err)
+		}
+	}
+
+	params, _ := parseAliasParams(`{"targets":{"z":{},` +
+		`"a":{"indexUUID":"aUUID"},"remote":{"remote":{"cluster":"east"}}}}`)
+	warnings, err := validateAliasTargets("me", params, indexDefsByName)
+	if err != nil || len(warnings) != 0 {
+		t.Errorf("expected no warnings, got: %v, err: %v", warnings, err)
+	}
+
+	params, _ = parseAliasParams(`{"targets":{"z":{},"b":{}}}`)
+	warnings, err = validateAliasTargets("me", params, indexDefsByName)
+	if err != nil || len(warnings) != 1 ||
+		!strings.Contains(warnings[0], "number in b; text in a, c") {
+		t.Errorf("expected a field f warning, got: %v, err: %v", warnings, err)
+	}
+}
+
+func TestAliasLeafIndexDef(t *testing.T) {
+	indexDefsByName := map[string]*cbgt.IndexDef{
+		"yb": {Name: "yb", Type: "fulltext-index",
+			Params: `{"mapping":{"default_analyzer":"keyword"}}`},
+		"zz": {Name: "zz", Type: "fulltext-index"},
+		"x": {Name: "x", Type: "fulltext-alias",
+			Params: `{"targets":{"y":{},"zz":{}}}`},
+		"y": {Name: "y", Type: "fulltext-alias",
+			Params: `{"targets":{"r":{"remote":{"cluster":"east"}},` +
+				`"x":{},"yb":{}}}`},
+		"z": {Name: "z", Type: "fulltext-alias",
+			Params: `{"targets":{"nope":{}}}`},
+	}
+
+	leaf, err := aliasLeafIndexDef(indexDefsByName["x"], indexDefsByName)
+	if err != nil || leaf.Name != "yb" {
+		t.Errorf("expected yb, got: %+v, err: %v", leaf, err)
+	}
+
+	m, err := bleveIndexDefMapping(leaf)
+	if err != nil || m.AnalyzerNameForPath("f") != "keyword" {
+		t.Errorf("expected the mapping of yb, got: %v, err: %v", m, err)
+	}
+
+	_, err = aliasLeafIndexDef(indexDefsByName["z"], indexDefsByName)
+	if err == nil {
+		t.Errorf("expected an err for an alias without local targets")
+	}
+}
+
+func TestAliasWarningsWriter(t *testing.T) {
+	mappingParams := func(fieldType string) string {
+		return `{"mapping":{"default_mapping":{"enabled":true,` +
+			`"properties":{"f":{"enabled":true,"fields":[` +
+			`{"name":"f","type":"` + fieldType + `"}]}}}}}`
+	}
+
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", "", "some-datasource", nil)
+
+	indexDefs := cbgt.NewIndexDefs(cbgt.VERSION)
+	indexDefs.IndexDefs["a"] = &cbgt.IndexDef{Name: "a", UUID: "aUUID",
+		Type: "fulltext-index", Params: mappingParams("text")}
+	indexDefs.IndexDefs["b"] = &cbgt.IndexDef{Name: "b", UUID: "bUUID",
+		Type: "fulltext-index", Params: mappingParams("number")}
+	indexDefs.IndexDefs["ab"] = &cbgt.IndexDef{Name: "ab", UUID: "abUUID",
+		Type: "fulltext-alias", Params: `{"targets":{"a":{},"b":{}}}`}
+	_, err := cbgt.CfgSetIndexDefs(cfg, indexDefs, 0)
+	if err != nil {
+		t.Fatalf("expected CfgSetIndexDefs() to work, err: %v", err)
+	}
+
+	tests := []struct {
+		indexName string
+		status    int
+		warnings  bool
+	}{
+		{"ab", 0, true},
+		{"ab", http.StatusBadRequest, false},
+		{"a", 0, false},
+	}
+
+	for i, test := range tests {
+		rr := httptest.NewRecorder()
+		w := newAliasWarningsWriter(rr)
+		if test.status != 0 {
+			w.WriteHeader(test.status)
+		}
+		w.Write([]byte(`{"status":"ok","uuid":"x"}`))
+		w.finish(mgr, test.indexName)
+
+		var rv struct {
+			Status   string   `json:"status"`
+			Warnings []string `json:"warnings"`
+		}
+		err = json.Unmarshal(rr.Body.Bytes(), &rv)
+		if err != nil || rv.Status != "ok" {
+			t.Fatalf("%d: expected an ok body, got: %s, err: %v",
+				i, rr.Body.Bytes(), err)
+		}
+		if test.status != 0 && rr.Code != test.status {
+			t.Errorf("%d: expected status %d, got: %d", i, test.status, rr.Code)
+		}
+		if test.warnings != (len(rv.Warnings) == 1 &&
+			strings.Contains(rv.Warnings[0], "number in b; text in a")) {
+			t.Errorf("%d: expected warnings %t, got: %v",
+				i, test.warnings, rv.Warnings)
+		}
+	}
+}
+
+// testAliasQueryManager returns a manager whose cfg has an alias of
+// target indexes a, b and c, where the pindexes of a and b are on a
+// remote node at hostPort, and the pindex of c is on a node that's
+// gone.
+func testAliasQueryManager(t *testing.T, hostPort string) *cbgt.Manager {
+	cfg := cbgt.NewCfgMem()
+	mgr := cbgt.NewManager(cbgt.VERSION, cfg, cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", "", "some-datasource", nil)
+
+	nodeDefs := cbgt.NewNodeDefs(cbgt.VERSION)
+	nodeDefs.NodeDefs["remote"] = &cbgt.NodeDef{
+		HostPort:    hostPort,
+		UUID:        "remote",
+		ImplVersion: cbgt.VERSION,
+	}
+	_, err := cbgt.CfgSetNodeDefs(cfg, cbgt.NODE_DEFS_WANTED, nodeDefs, 0)
+	if err != nil {
+		t.Fatalf("expected CfgSetNodeDefs() to work, err: %v", err)
+	}
+
+	indexDefs := cbgt.NewIndexDefs(cbgt.VERSION)
+	planPIndexes := cbgt.NewPlanPIndexes(cbgt.VERSION)
+	for _, name := range []string{"a", "b", "c"} {
+		indexDefs.IndexDefs[name] = &cbgt.IndexDef{
+			Type: "fulltext-index",
+			Name: name,
+			UUID: name + "UUID",
+		}
+
+		nodeUUID := "remote"
+		if name == "c" {
+			nodeUUID = "gone"
+		}
+		planPIndexes.PlanPIndexes[name+"_p"] = &cbgt.PlanPIndex{
+			Name:      name + "_p",
+			IndexType: "fulltext-index",
+			IndexName: name,
+			IndexUUID: name + "UUID",
+			Nodes: map[string]*cbgt.PlanPIndexNode{
+				nodeUUID: {CanRead: true, CanWrite: true},
+			},
+		}
+	}
+	for name, params := range map[string]string{
+		"ab": `{"targets":{"a":{},"b":{}}}`,
+		"ac": `{"targets":{"a":{},"c":{}}}`,
+	} {
+		indexDefs.IndexDefs[name] = &cbgt.IndexDef{
+			Type:   "fulltext-alias",
+			Name:   name,
+			UUID:   name + "UUID",
+			Params: params,
+		}
+	}
+
+	_, err = cbgt.CfgSetIndexDefs(cfg, indexDefs, 0)
+	if err != nil {
+		t.Fatalf("expected CfgSetIndexDefs() to work, err: %v", err)
+	}
+	_, err = cbgt.CfgSetPlanPIndexes(cfg, planPIndexes, 0)
+	if err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes() to work, err: %v", err)
+	}
+
+	return mgr
+}
+
+func TestQueryAliasConsistencyWait(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// the path is /api/index/{indexName}/query
+			indexName := strings.Split(r.URL.Path, "/")[3]
+			w.WriteHeader(http.StatusPreconditionFailed)
+			w.Write([]byte(`{"status":"consistency wait failed",` +
+				`"startEndSeqs":{"` + indexName + `_p":[1,2]}}`))
+		}))
+	defer ts.Close()
+
+	mgr := testAliasQueryManager(t, strings.TrimPrefix(ts.URL, "http://"))
+
+	var res bytes.Buffer
+	err := QueryAlias(mgr, "ab", "",
+		[]byte(`{"query":{"match_all":{}}}`), &res)
+
+	cwErr, ok := err.(*cbgt.ErrorConsistencyWait)
+	if !ok {
+		t.Fatalf("expected a consistency wait err, got: %v", err)
+	}
+	if len(cwErr.StartEndSeqs) != 2 ||
+		cwErr.StartEndSeqs["a_p"] == nil || cwErr.StartEndSeqs["b_p"] == nil {
+		t.Errorf("expected the 412s of a and b collated, got: %v",
+			cwErr.StartEndSeqs)
+	}
+}
+
+func TestQueryAliasPartialResults(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status":{"total":1,"failed":0,"successful":1},` +
+				`"hits":[{"index":"a_p","id":"doc1","score":1}],` +
+				`"total_hits":1,"max_score":1,"took":1}`))
+		}))
+	defer ts.Close()
+
+	mgr := testAliasQueryManager(t, strings.TrimPrefix(ts.URL, "http://"))
+
+	var res bytes.Buffer
+	err := QueryAlias(mgr, "ac", "",
+		[]byte(`{"query":{"match_all":{}}}`), &res)
+	if err != nil {
+		t.Fatalf("expected partial results, err: %v", err)
+	}
+
+	var rv struct {
+		Status struct {
+			Total  int               `json:"total"`
+			Failed int               `json:"failed"`
+			Errors map[string]string `json:"errors"`
+		} `json:"status"`
+		TotalHits int `json:"total_hits"`
+	}
+	err = json.Unmarshal(res.Bytes(), &rv)
+	if err != nil {
+		t.Fatalf("expected a JSON result, got: %s, err: %v", res.Bytes(), err)
+	}
+	if rv.TotalHits != 1 || rv.Status.Failed != 1 ||
+		rv.Status.Errors["c_p"] == "" {
+		t.Errorf("expected c_p reported as failed, got: %s", res.Bytes())
+	}
+}
@@ -41,6 +41,7 @@ import (
 	"github.com/blevesearch/bleve/index/upsidedown"
 	"github.com/blevesearch/bleve/mapping"
 	bleveRegistry "github.com/blevesearch/bleve/registry"
+	"github.com/blevesearch/bleve/search/query"
 
 	log "github.com/couchbase/clog"
 
@@ -277,6 +278,8 @@ func init() {
 		DiagHandlers: []cbgt.DiagHandler{
 			{Name: "/api/pindex-bleve", Handler: bleveHttp.NewListIndexesHandler(),
 				HandlerFunc: nil},
+			{Name: "/api/remoteNodeStats", Handler: NewRemoteNodeStatsHandler(),
+				HandlerFunc: nil},
 		},
 		MetaExtra: BleveMetaExtra,
 		UI: map[string]string{
@@ -633,14 +636,44 @@ func fireQueryEvent(kind QueryEventKind, dur time.Duration, size uint64) error {
 
 func QueryBleve(mgr *cbgt.Manager, indexName, indexUUID string,
 	req []byte, res io.Writer) error {
+	return queryBleve(mgr, indexName, indexUUID, req, res,
+		bleveIndexAliasPrefetch)
+}
+
+// queryAliasBuilder builds the alias of the targets that a query
+// searches, where a non-nil req may be prefetched from the remote
+// targets, like bleveIndexAliasPrefetch() does for the pindexes of a
+// bleve index.
+type queryAliasBuilder func(ctx context.Context, req *bleve.SearchRequest,
+	mgr *cbgt.Manager, indexName, indexUUID string,
+	ensureCanRead bool, consistencyParams *cbgt.ConsistencyParams,
+	cancelCh <-chan bool, groupByNode bool, onlyPIndexes map[string]bool) (
+	bleve.IndexAlias, []*IndexClient, int, error)
+
+// queryBleve is the query pipeline of both bleve indexes and index
+// aliases, which differ only in how the alias of targets is built.
+func queryBleve(mgr *cbgt.Manager, indexName, indexUUID string,
+	req []byte, res io.Writer, buildAlias queryAliasBuilder) error {
 	// phase 0 - parsing/validating query
 	// could return err 400
+
+	// the binary request of a coordinator node carries only the
+	// sections of a remote search, leaving the others at their defaults
+	binaryRequest, err := parseSearchRequestBinary(req)
+	if err != nil {
+		return fmt.Errorf("bleve: QueryBleve"+
+			" parsing binary request, err: %v", err)
+	}
+	if binaryRequest != nil {
+		req = []byte("{}")
+	}
+
 	queryCtlParams := cbgt.QueryCtlParams{
 		Ctl: cbgt.QueryCtl{
 			Timeout: cbgt.QUERY_CTL_DEFAULT_TIMEOUT_MS,
 		},
 	}
-	err := UnmarshalJSON(req, &queryCtlParams)
+	err = UnmarshalJSON(req, &queryCtlParams)
 	if err != nil {
 		return fmt.Errorf("bleve: QueryBleve"+
 			" parsing queryCtlParams, err: %v", err)
@@ -653,11 +686,100 @@ func QueryBleve(mgr *cbgt.Manager, indexName, indexUUID string,
 			" parsing queryPIndexes, err: %v", err)
 	}
 
+	// the more_like_this queries are replaced by placeholders, which
+	// are rewritten once the targets of the query are known
+	req, mlts, err := extractMoreLikeThis(req)
+	if err != nil {
+		return fmt.Errorf("bleve: QueryBleve"+
+			" parsing more_like_this, err: %v", err)
+	}
+
 	searchRequest := &bleve.SearchRequest{}
-	err = UnmarshalJSON(req, searchRequest)
+	if binaryRequest != nil {
+		searchRequest = binaryRequest.req
+	} else {
+		err = UnmarshalJSON(req, searchRequest)
+		if err != nil {
+			return fmt.Errorf("bleve: QueryBleve"+
+				" parsing searchRequest, err: %v", err)
+		}
+	}
+
+	queryRescore := QueryRescore{}
+	err = UnmarshalJSON(req, &queryRescore)
 	if err != nil {
 		return fmt.Errorf("bleve: QueryBleve"+
-			" parsing searchRequest, err: %v", err)
+			" parsing queryRescore, err: %v", err)
+	}
+
+	queryTwoPhase := QueryTwoPhase{}
+	err = UnmarshalJSON(req, &queryTwoPhase)
+	if err != nil {
+		return fmt.Errorf("bleve: QueryBleve"+
+			" parsing queryTwoPhase, err: %v", err)
+	}
+
+	queryFacetShardSizes := QueryFacetShardSizes{}
+	err = UnmarshalJSON(req, &queryFacetShardSizes)
+	if err != nil {
+		return fmt.Errorf("bleve: QueryBleve"+
+			" parsing queryFacetShardSizes, err: %v", err)
+	}
+
+	queryCollapse := QueryCollapse{}
+	err = UnmarshalJSON(req, &queryCollapse)
+	if err != nil {
+		return fmt.Errorf("bleve: QueryBleve"+
+			" parsing queryCollapse, err: %v", err)
+	}
+
+	querySuggest := QuerySuggest{}
+	err = UnmarshalJSON(req, &querySuggest)
+	if err != nil {
+		return fmt.Errorf("bleve: QueryBleve"+
+			" parsing querySuggest, err: %v", err)
+	}
+
+	queryCaller := QueryCaller{}
+	err = UnmarshalJSON(req, &queryCaller)
+	if err != nil {
+		return fmt.Errorf("bleve: QueryBleve"+
+			" parsing queryCaller, err: %v", err)
+	}
+
+	queryResultEncoding := QueryResultEncoding{}
+	err = UnmarshalJSON(req, &queryResultEncoding)
+	if err != nil {
+		return fmt.Errorf("bleve: QueryBleve"+
+			" parsing queryResultEncoding, err: %v", err)
+	}
+
+	queryAliasFilter := QueryAliasFilter{}
+	err = UnmarshalJSON(req, &queryAliasFilter)
+	if err != nil {
+		return fmt.Errorf("bleve: QueryBleve"+
+			" parsing queryAliasFilter, err: %v", err)
+	}
+
+	queryTermStats := QueryTermStats{}
+	err = UnmarshalJSON(req, &queryTermStats)
+	if err != nil {
+		return fmt.Errorf("bleve: QueryBleve"+
+			" parsing queryTermStats, err: %v", err)
+	}
+
+	if binaryRequest != nil {
+		queryCtlParams.Ctl.Timeout = binaryRequest.ctl.Ctl.Timeout
+		queryCtlParams.Ctl.Consistency = binaryRequest.ctl.Ctl.Consistency
+		queryPIndexes = binaryRequest.pindexes
+		queryCaller = binaryRequest.caller
+		queryResultEncoding = binaryRequest.encoding
+		queryAliasFilter = binaryRequest.aliasFilter
+		queryTermStats = binaryRequest.termStats
+	}
+
+	if queryAliasFilter.AliasFilter {
+		searchRequest.Query = unwrapFilteredQuery(searchRequest.Query)
 	}
 
 	if queryCtlParams.Ctl.Consistency != nil {
@@ -674,20 +796,56 @@ func QueryBleve(mgr *cbgt.Manager, indexName, indexUUID string,
 			" validating request, err: %v", err)
 	}
 
-	v, exists := mgr.Options()["bleveMaxResultWindow"]
-	if exists {
-		var bleveMaxResultWindow int
-		bleveMaxResultWindow, err = strconv.Atoi(v)
+	err = checkMaxResultWindow(mgr, searchRequest)
+	if err != nil {
+		return err
+	}
+
+	// the rescore window is retrieved from the pindexes in place of
+	// the client's from/size, and trimmed back after rescoring
+	var rs *rescorer
+	if queryRescore.Rescore != nil {
+		var maxWindow int
+		maxWindow, err = maxResultWindow(mgr)
+		if err != nil {
+			return err
+		}
+
+		rs, err = newRescorer(queryRescore.Rescore, searchRequest, maxWindow)
 		if err != nil {
 			return fmt.Errorf("bleve: QueryBleve"+
-				" atoi: %v, err: %v", v, err)
+				" validating rescore, err: %v", err)
 		}
+	}
 
-		if searchRequest.From+searchRequest.Size > bleveMaxResultWindow {
-			return fmt.Errorf("bleve: bleveMaxResultWindow exceeded,"+
-				" from: %d, size: %d, bleveMaxResultWindow: %d",
-				searchRequest.From, searchRequest.Size, bleveMaxResultWindow)
+	// when collapsing, from/size paginate over groups, and windows of
+	// merged hits are retrieved until the page of groups is filled
+	var cl *collapser
+	if queryCollapse.Collapse != nil {
+		if rs != nil {
+			return fmt.Errorf("bleve: QueryBleve" +
+				" collapse is not supported along with rescore")
 		}
+		cl, err = newCollapser(queryCollapse.Collapse, searchRequest)
+		if err != nil {
+			return fmt.Errorf("bleve: QueryBleve"+
+				" validating collapse, err: %v", err)
+		}
+	}
+
+	var sg *querySuggester
+	if querySuggest.Suggest != nil {
+		sg, err = newQuerySuggester(querySuggest.Suggest)
+		if err != nil {
+			return fmt.Errorf("bleve: QueryBleve"+
+				" validating suggest, err: %v", err)
+		}
+	}
+
+	shardSizes, err := facetShardSizes(mgr.Options(), searchRequest,
+		&queryFacetShardSizes)
+	if err != nil {
+		return err
 	}
 
 	// phase 1 - set up timeouts, wait for local consistency reqiurements
@@ -699,12 +857,36 @@ func QueryBleve(mgr *cbgt.Manager, indexName, indexUUID string,
 	// setupContextAndCancelCh always exits
 	defer cancel()
 
+	// the remote queries are sent on behalf of the caller
+	if queryCaller.Caller != nil {
+		ctx = context.WithValue(ctx, CallerContextKey, queryCaller.Caller)
+	}
+
 	var onlyPIndexes map[string]bool
 	if len(queryPIndexes.PIndexNames) > 0 {
 		onlyPIndexes = cbgt.StringsToMap(queryPIndexes.PIndexNames)
 	}
 
-	alias, remoteClients, numPIndexes, er := bleveIndexAlias(mgr, indexName, indexUUID, true,
+	// oversampled term facets widen the request's facet sizes, which
+	// is done up front so that the prefetched remote searches match
+	var fb *facetBounds
+	var facetOrigSizes map[string]int
+	if len(shardSizes) > 0 {
+		fb = newFacetBounds(shardSizes)
+		facetOrigSizes = fb.prepare(searchRequest)
+	}
+
+	// the remote queries are kicked off while the local consistency
+	// waits proceed, unless a later query phase changes the request
+	// that's sent to the remote nodes
+	var prefetchReq *bleve.SearchRequest
+	if cl == nil && len(mlts) <= 0 && !queryTwoPhase.TwoPhase &&
+		(queryTermStats.TermStats != nil || !queryTermStats.GlobalTermStats) {
+		prefetchReq = searchRequest
+	}
+
+	alias, remoteClients, numPIndexes, er := buildAlias(ctx, prefetchReq,
+		mgr, indexName, indexUUID, true,
 		queryCtlParams.Ctl.Consistency, cancelCh, true, onlyPIndexes)
 	if er != nil {
 		if _, ok := er.(*cbgt.ErrorLocalPIndexHealth); !ok {
@@ -712,6 +894,29 @@ func QueryBleve(mgr *cbgt.Manager, indexName, indexUUID string,
 		}
 	}
 
+	// the facet error bounds and the fetch phase work on the targets
+	// of the alias directly, which bypasses the alias targets that
+	// have a filter, a boost or are in a remote cluster
+	rewrites := aliasRewrites(alias)
+	if fb != nil && rewrites {
+		return fmt.Errorf("bleve: QueryBleve" +
+			" facet shard_size is not supported for alias targets" +
+			" with a filter, boost or remote cluster")
+	}
+
+	// the more_like_this queries are built from the indexed terms of
+	// their source documents, which are looked up through the alias
+	if len(mlts) > 0 {
+		searchRequest.Query, err = rewriteMoreLikeThis(searchRequest.Query,
+			mlts, func(mlt *moreLikeThis) (query.Query, error) {
+				return mlt.query(ctx, mgr, indexName, alias)
+			})
+		if err != nil {
+			return fmt.Errorf("bleve: QueryBleve"+
+				" more_like_this, err: %v", err)
+		}
+	}
+
 	// estimate memory needed for merging search results from all
 	// the pindexes
 	mergeEstimate := uint64(numPIndexes) * bleve.MemoryNeededForSearchResult(searchRequest)
@@ -722,18 +927,7 @@ func QueryBleve(mgr *cbgt.Manager, indexName, indexUUID string,
 
 	defer fireQueryEvent(EventQueryEnd, 0, mergeEstimate)
 
-	// set query start/end callbacks
-	queryStartCallback := func(size uint64) error {
-		return fireQueryEvent(EventQueryStart, 0, size)
-	}
-	ctx = context.WithValue(ctx, bleve.SearchQueryStartCallbackKey,
-		bleve.SearchQueryStartCallbackFn(queryStartCallback))
-
-	queryEndCallback := func(size uint64) error {
-		return fireQueryEvent(EventQueryEnd, 0, size)
-	}
-	ctx = context.WithValue(ctx, bleve.SearchQueryEndCallbackKey,
-		bleve.SearchQueryEndCallbackFn(queryEndCallback))
+	ctx = withQueryEventCallbacks(ctx)
 
 	// register with the QuerySupervisor
 	id := querySupervisor.AddEntry(&QuerySupervisorContext{
@@ -745,79 +939,217 @@ func QueryBleve(mgr *cbgt.Manager, indexName, indexUUID string,
 	})
 	defer querySupervisor.DeleteEntry(id)
 
-	searchResult, err := alias.SearchInContext(ctx, searchRequest)
+	// optional DFS-style pre-phase, which gathers index-wide term
+	// statistics so that every pindex scores hits the same way
+	termStats := queryTermStats.TermStats
+	if termStats == nil && queryTermStats.GlobalTermStats {
+		termStats, err = gatherQueryTermStats(ctx, mgr, indexName,
+			searchRequest.Query, alias)
+		if err != nil {
+			return err
+		}
+	}
+
+	// oversampled term facets are searched through wrapped targets,
+	// which record each target's facets for the error bounds
+	searchAlias := alias
+	if fb != nil {
+		searchAlias = bleve.NewIndexAlias(fb.wrap(aliasTargets(alias))...)
+	}
+
+	searchFn := func(ctx context.Context, sr *bleve.SearchRequest) (
+		*bleve.SearchResult, error) {
+		if fb != nil {
+			fb.reset()
+		}
+		if termStats != nil {
+			r := *sr
+			r.Query = newTermStatsQuery(sr.Query, termStats)
+			sr = &r
+		}
+		if queryTwoPhase.TwoPhase && len(remoteClients) > 0 && !rewrites {
+			return searchTwoPhase(ctx, searchAlias, aliasTargets(alias), sr)
+		}
+		return searchAlias.SearchInContext(ctx, sr)
+	}
+
+	var searchResult *bleve.SearchResult
+	var collapseResult *CollapseResult
+	if cl != nil {
+		searchResult, collapseResult, err =
+			cl.search(ctx, searchFn, searchRequest)
+	} else {
+		searchResult, err = searchFn(ctx, searchRequest)
+	}
 	if searchResult != nil {
-		// check to see if any of the remote searches returned anything
-		// other than 0, 200 or 412, these are returned to the user as
-		// error status 400, and appear as phase 0 errors detected late.
-		// 0 means we never heard anything back, and that is dealt with
-		// in the following section
-		for _, remoteClient := range remoteClients {
-			lastStatus, lastErrBody := remoteClient.GetLast()
-			if lastStatus != http.StatusOK &&
-				lastStatus != http.StatusPreconditionFailed &&
-				lastStatus != 0 {
-				return fmt.Errorf("bleve: QueryBleve remote client"+
-					" returned status: %d body: %s", lastStatus, lastErrBody)
-			}
+		if err := checkSearchResultStatus(searchResult, remoteClients,
+			queryCtlParams.Ctl.Consistency, er); err != nil {
+			return err
 		}
-		// now see if any of the remote searches returned 412; these should be
-		// collated into a single 412 response at this level and will
-		// be presented as phase 1 errors detected late
-		remoteConsistencyWaitError := cbgt.ErrorConsistencyWait{
-			Status:       "remote consistency error",
-			StartEndSeqs: make(map[string][]uint64),
-		}
-		numRemoteSilent := 0
-		for _, remoteClient := range remoteClients {
-			lastStatus, lastErrBody := remoteClient.GetLast()
-			if lastStatus == 0 {
-				numRemoteSilent++
-			}
-			if lastStatus == http.StatusPreconditionFailed {
-				var remoteConsistencyErr = struct {
-					StartEndSeqs map[string][]uint64 `json:"startEndSeqs"`
-				}{}
-				err = UnmarshalJSON(lastErrBody, &remoteConsistencyErr)
-				if err == nil {
-					for k, v := range remoteConsistencyErr.StartEndSeqs {
-						remoteConsistencyWaitError.StartEndSeqs[k] = v
-					}
-				}
+
+		if rs != nil {
+			err = rs.apply(ctx, alias, searchRequest, searchResult)
+			if err != nil {
+				return err
 			}
 		}
-		// if we had any explicitly returned consistency errors, return those
-		if len(remoteConsistencyWaitError.StartEndSeqs) > 0 {
-			return &remoteConsistencyWaitError
+
+		extras := &searchResultExtras{
+			SearchResult:     searchResult,
+			Collapse:         collapseResult,
+			FallbackPIndexes: aliasFallbacks(alias),
 		}
 
-		// we had *some* consistency requirements, but we never heard back
-		// from some of the remote pindexes; just punt for now and return
-		// a mostly empty 412 indicating we aren't sure
-		if queryCtlParams.Ctl.Consistency != nil &&
-			len(queryCtlParams.Ctl.Consistency.Vectors) > 0 &&
-			numRemoteSilent > 0 {
-			return &remoteConsistencyWaitError
+		// spelling corrections are best-effort, so that the hits are
+		// still returned when they can't be looked up
+		if sg != nil && sg.wanted(searchResult) {
+			extras.Suggest, err = sg.suggest(ctx, mgr, indexName,
+				searchRequest.Query, alias)
+			if err != nil {
+				log.Printf("bleve: QueryBleve suggest, indexName: %s,"+
+					" err: %v", indexName, err)
+				err = nil
+			}
 		}
 
-		if er != nil {
-			if err, ok := er.(*cbgt.ErrorLocalPIndexHealth); ok && len(err.IndexErrMap) > 0 {
-				// populate the searchResuls with the details of
-				// pindexes not searched/covered in this query.
-				if searchResult.Status.Errors == nil {
-					searchResult.Status.Errors = make(map[string]error)
-				}
-				for pi, e := range err.IndexErrMap {
-					searchResult.Status.Errors[pi] = e
-					searchResult.Status.Failed++
-					searchResult.Status.Total++
+		if fb != nil {
+			extras.FacetErrorBounds =
+				fb.finish(searchRequest, searchResult, facetOrigSizes)
+		}
+
+		extras.encode(res, queryResultEncoding.ResultEncoding)
+	}
+
+	return err
+}
+
+// checkMaxResultWindow enforces the optional bleveMaxResultWindow
+// manager option on the from/size of a search request.
+func checkMaxResultWindow(mgr *cbgt.Manager,
+	searchRequest *bleve.SearchRequest) error {
+	bleveMaxResultWindow, err := maxResultWindow(mgr)
+	if err != nil {
+		return err
+	}
+
+	if bleveMaxResultWindow > 0 &&
+		searchRequest.From+searchRequest.Size > bleveMaxResultWindow {
+		return fmt.Errorf("bleve: bleveMaxResultWindow exceeded,"+
+			" from: %d, size: %d, bleveMaxResultWindow: %d",
+			searchRequest.From, searchRequest.Size, bleveMaxResultWindow)
+	}
+
+	return nil
+}
+
+// maxResultWindow returns the bleveMaxResultWindow manager option, or
+// 0 when there's no limit.
+func maxResultWindow(mgr *cbgt.Manager) (int, error) {
+	v, exists := mgr.Options()["bleveMaxResultWindow"]
+	if !exists {
+		return 0, nil
+	}
+
+	bleveMaxResultWindow, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("bleve: bleveMaxResultWindow"+
+			" atoi: %v, err: %v", v, err)
+	}
+
+	return bleveMaxResultWindow, nil
+}
+
+// withQueryEventCallbacks returns a context that has the searches of
+// the pindexes fire query start/end events.
+func withQueryEventCallbacks(ctx context.Context) context.Context {
+	queryStartCallback := func(size uint64) error {
+		return fireQueryEvent(EventQueryStart, 0, size)
+	}
+	ctx = context.WithValue(ctx, bleve.SearchQueryStartCallbackKey,
+		bleve.SearchQueryStartCallbackFn(queryStartCallback))
+
+	queryEndCallback := func(size uint64) error {
+		return fireQueryEvent(EventQueryEnd, 0, size)
+	}
+	return context.WithValue(ctx, bleve.SearchQueryEndCallbackKey,
+		bleve.SearchQueryEndCallbackFn(queryEndCallback))
+}
+
+// checkSearchResultStatus checks the statuses of the remote searches
+// behind a merged search result, and adds the pindexes that couldn't
+// be searched, from the non-fatal error of building the alias, to the
+// errors of the result.
+func checkSearchResultStatus(searchResult *bleve.SearchResult,
+	remoteClients []*IndexClient, consistency *cbgt.ConsistencyParams,
+	er error) error {
+	// check to see if any of the remote searches returned anything
+	// other than 0, 200 or 412, these are returned to the user as
+	// error status 400, and appear as phase 0 errors detected late.
+	// 0 means we never heard anything back, and that is dealt with
+	// in the following section
+	for _, remoteClient := range remoteClients {
+		lastStatus, lastErrBody := remoteClient.GetLast()
+		if lastStatus != http.StatusOK &&
+			lastStatus != http.StatusPreconditionFailed &&
+			lastStatus != 0 {
+			return fmt.Errorf("bleve: remote client"+
+				" returned status: %d body: %s", lastStatus, lastErrBody)
+		}
+	}
+	// now see if any of the remote searches returned 412; these should be
+	// collated into a single 412 response at this level and will
+	// be presented as phase 1 errors detected late
+	remoteConsistencyWaitError := cbgt.ErrorConsistencyWait{
+		Status:       "remote consistency error",
+		StartEndSeqs: make(map[string][]uint64),
+	}
+	numRemoteSilent := 0
+	for _, remoteClient := range remoteClients {
+		lastStatus, lastErrBody := remoteClient.GetLast()
+		if lastStatus == 0 {
+			numRemoteSilent++
+		}
+		if lastStatus == http.StatusPreconditionFailed {
+			var remoteConsistencyErr = struct {
+				StartEndSeqs map[string][]uint64 `json:"startEndSeqs"`
+			}{}
+			err := UnmarshalJSON(lastErrBody, &remoteConsistencyErr)
+			if err == nil {
+				for k, v := range remoteConsistencyErr.StartEndSeqs {
+					remoteConsistencyWaitError.StartEndSeqs[k] = v
 				}
 			}
 		}
-		mustEncode(res, searchResult)
+	}
+	// if we had any explicitly returned consistency errors, return those
+	if len(remoteConsistencyWaitError.StartEndSeqs) > 0 {
+		return &remoteConsistencyWaitError
 	}
 
-	return err
+	// we had *some* consistency requirements, but we never heard back
+	// from some of the remote pindexes; just punt for now and return
+	// a mostly empty 412 indicating we aren't sure
+	if consistency != nil && len(consistency.Vectors) > 0 &&
+		numRemoteSilent > 0 {
+		return &remoteConsistencyWaitError
+	}
+
+	if er != nil {
+		if err, ok := er.(*cbgt.ErrorLocalPIndexHealth); ok && len(err.IndexErrMap) > 0 {
+			// populate the searchResuls with the details of
+			// pindexes not searched/covered in this query.
+			if searchResult.Status.Errors == nil {
+				searchResult.Status.Errors = make(map[string]error)
+			}
+			for pi, e := range err.IndexErrMap {
+				searchResult.Status.Errors[pi] = e
+				searchResult.Status.Failed++
+				searchResult.Status.Total++
+			}
+		}
+	}
+
+	return nil
 }
 
 // ---------------------------------------------------------
@@ -987,6 +1319,13 @@ func (t *BleveDest) Query(pindex *cbgt.PIndex, req []byte, res io.Writer,
 		return fmt.Errorf("bleve: BleveDest.Query"+
 			" parsing searchRequest, err: %v", err)
 	}
+
+	queryResultEncoding := QueryResultEncoding{}
+	err = UnmarshalJSON(req, &queryResultEncoding)
+	if err != nil {
+		return fmt.Errorf("bleve: BleveDest.Query"+
+			" parsing queryResultEncoding, err: %v", err)
+	}
 	err = searchRequest.Validate()
 	if err != nil {
 		return fmt.Errorf("bleve: BleveDest.Query"+
@@ -1047,6 +1386,11 @@ func (t *BleveDest) Query(pindex *cbgt.PIndex, req []byte, res io.Writer,
 		return nil
 	}
 
+	if queryResultEncoding.ResultEncoding == "binary" &&
+		writeSearchResultBinary(res, searchResponse) {
+		return nil
+	}
+
 	rest.MustEncode(res, searchResponse)
 	return nil
 }
@@ -1075,6 +1419,36 @@ func makeSearchResultErr(req *bleve.SearchRequest,
 	return rv
 }
 
+// searchResultExtras wraps a bleve.SearchResult with the optional
+// sections of a query response that are computed by the coordinator.
+type searchResultExtras struct {
+	*bleve.SearchResult
+
+	FacetErrorBounds map[string]*FacetErrorBound `json:"facetErrorBounds,omitempty"`
+	Collapse         *CollapseResult             `json:"collapse,omitempty"`
+	Suggest          *QuerySuggestResult         `json:"suggest,omitempty"`
+
+	// Pindexes that were served by replica nodes after a failure,
+	// keyed by pindex name, with the HostPort of the replica node.
+	FallbackPIndexes map[string]string `json:"fallbackPIndexes,omitempty"`
+}
+
+// encode writes the search result, along with any extra sections.
+// Plain search results can also be sent in the binary encoding, which
+// has no room for the extra sections.
+func (e *searchResultExtras) encode(w io.Writer, resultEncoding string) {
+	if len(e.FacetErrorBounds) <= 0 && e.Collapse == nil &&
+		e.Suggest == nil && len(e.FallbackPIndexes) <= 0 {
+		if resultEncoding == "binary" &&
+			writeSearchResultBinary(w, e.SearchResult) {
+			return
+		}
+		mustEncode(w, e.SearchResult)
+		return
+	}
+	mustEncode(w, e)
+}
+
 // ---------------------------------------------------------
 
 func setupContextAndCancelCh(queryCtlParams cbgt.QueryCtlParams, parentCancelCh <-chan bool) (ctx context.Context, cancel context.CancelFunc, cancelChRv <-chan bool) {
@@ -1667,6 +2041,12 @@ func (t *BleveDestPartition) incRev() {
 var totRemoteHttp uint64
 var totRemoteHttp2 uint64
 
+// Atomic counters that keep track of the number of remote searches that
+// were started ahead of local consistency waits, and of those that had
+// to be discarded as the final search request turned out different.
+var totRemotePrefetch uint64
+var totRemotePrefetchWasted uint64
+
 // ---------------------------------------------------------
 
 // Returns a bleve.IndexAlias that represents all the PIndexes for the
@@ -1683,7 +2063,24 @@ func bleveIndexAlias(mgr *cbgt.Manager, indexName, indexUUID string,
 	ensureCanRead bool, consistencyParams *cbgt.ConsistencyParams,
 	cancelCh <-chan bool, groupByNode bool, onlyPIndexes map[string]bool) (
 	bleve.IndexAlias, []*IndexClient, int, error) {
-	alias := bleve.NewIndexAlias()
+	return bleveIndexAliasPrefetch(nil, nil, mgr, indexName, indexUUID,
+		ensureCanRead, consistencyParams, cancelCh, groupByNode, onlyPIndexes)
+}
+
+// bleveIndexAliasPrefetch is like bleveIndexAlias(), but when a
+// search request is provided, it's sent to the remote targets as
+// soon as they're known, so that the remote queries proceed
+// concurrently with the waits for local consistency.
+func bleveIndexAliasPrefetch(ctx context.Context, req *bleve.SearchRequest,
+	mgr *cbgt.Manager, indexName, indexUUID string,
+	ensureCanRead bool, consistencyParams *cbgt.ConsistencyParams,
+	cancelCh <-chan bool, groupByNode bool, onlyPIndexes map[string]bool) (
+	bleve.IndexAlias, []*IndexClient, int, error) {
+	alias := &indexAliasTargets{
+		IndexAlias:  bleve.NewIndexAlias(),
+		prefetchCtx: ctx,
+		prefetchReq: req,
+	}
 
 	remoteClients, numPIndexes, err := bleveIndexTargets(mgr, indexName, indexUUID,
 		ensureCanRead, consistencyParams, cancelCh,
@@ -1706,6 +2103,94 @@ type BleveIndexCollector interface {
 	Add(i ...bleve.Index)
 }
 
+// indexAliasTargets is a bleve.IndexAlias that also remembers the
+// targets that were added to it, so that query phases other than the
+// search itself (like gathering term statistics) can reach the
+// individual local and remote targets.
+type indexAliasTargets struct {
+	bleve.IndexAlias
+
+	m       sync.Mutex
+	targets []bleve.Index
+
+	// Optional, search request that's prefetched from remote targets
+	// as they're added.
+	prefetchCtx context.Context
+	prefetchReq *bleve.SearchRequest
+
+	// When true, some of the searched indexes are views or remote
+	// clusters rather than targets.
+	rewrites bool
+}
+
+func (a *indexAliasTargets) Add(i ...bleve.Index) {
+	a.m.Lock()
+	a.targets = append(a.targets, i...)
+	a.m.Unlock()
+
+	if a.prefetchReq != nil {
+		for _, target := range i {
+			if indexClient, ok := target.(*IndexClient); ok {
+				indexClient.Prefetch(a.prefetchCtx, a.prefetchReq)
+			}
+		}
+	}
+
+	a.IndexAlias.Add(i...)
+}
+
+// Targets returns a copy of the targets added to the alias.
+func (a *indexAliasTargets) Targets() []bleve.Index {
+	a.m.Lock()
+	rv := append([]bleve.Index(nil), a.targets...)
+	a.m.Unlock()
+	return rv
+}
+
+// addView adds the view of an alias target, whose targets are also
+// remembered as targets of the alias, so that the per-target helpers
+// like term stats and field dictionaries cover the view's targets
+// without its filter.
+func (a *indexAliasTargets) addView(v *aliasTargetView) {
+	a.m.Lock()
+	a.targets = append(a.targets, v.Targets()...)
+	a.rewrites = true
+	a.m.Unlock()
+
+	a.IndexAlias.Add(v)
+}
+
+// addRemoteCluster adds an index of a remote cluster, which is only
+// searched, so it's not remembered as a target of the alias.
+func (a *indexAliasTargets) addRemoteCluster(r *remoteClusterIndex) {
+	a.m.Lock()
+	a.rewrites = true
+	a.m.Unlock()
+
+	a.IndexAlias.Add(r)
+}
+
+// aliasRewrites returns true when an alias built by bleveIndexAlias()
+// searches more than its targets as they are, so that query phases
+// which work on the targets would not match the alias's search.
+func aliasRewrites(alias bleve.IndexAlias) bool {
+	if a, ok := alias.(*indexAliasTargets); ok {
+		a.m.Lock()
+		defer a.m.Unlock()
+		return a.rewrites
+	}
+	return false
+}
+
+// aliasTargets returns the targets of an alias built by
+// bleveIndexAlias(), or nil for other kinds of aliases.
+func aliasTargets(alias bleve.IndexAlias) []bleve.Index {
+	if a, ok := alias.(*indexAliasTargets); ok {
+		return a.Targets()
+	}
+	return nil
+}
+
 func bleveIndexTargets(mgr *cbgt.Manager, indexName, indexUUID string,
 	ensureCanRead bool, consistencyParams *cbgt.ConsistencyParams,
 	cancelCh <-chan bool, groupByNode bool, onlyPIndexes map[string]bool,
@@ -1736,69 +2221,52 @@ func bleveIndexTargets(mgr *cbgt.Manager, indexName, indexUUID string,
 		}
 	}
 
+	chooser := newRemoteTargetChooser(mgr, planPIndexFilterName)
+
+	replicas := newRemoteReplicas(mgr, chooser,
+		func(pindexName string, nodeDef *cbgt.NodeDef) *IndexClient {
+			return newRemoteIndexClient(mgr, indexName, indexUUID,
+				consistencyParams, pindexName, nodeDef)
+		})
+
 	for _, missingPIndexName := range missingPIndexNames {
 		if onlyPIndexes == nil || onlyPIndexes[missingPIndexName] {
-			collector.Add(&MissingPIndex{
+			missingPIndex := &MissingPIndex{
 				name: missingPIndexName,
-			})
+			}
+			if replicas != nil && replicas.fallback {
+				collector.Add(&fallbackPIndex{
+					MissingPIndex: missingPIndex,
+					replicas:      replicas,
+				})
+			} else {
+				collector.Add(missingPIndex)
+			}
 		}
 	}
 
-	prefix := mgr.Options()["urlPrefix"]
-
 	remoteClients := make([]*IndexClient, 0, len(remotePlanPIndexes))
 	for _, remotePlanPIndex := range remotePlanPIndexes {
 		if onlyPIndexes != nil && !onlyPIndexes[remotePlanPIndex.PlanPIndex.Name] {
 			continue
 		}
 
-		delimiterPos := strings.LastIndex(remotePlanPIndex.NodeDef.HostPort, ":")
-		if delimiterPos < 0 || delimiterPos >= len(remotePlanPIndex.NodeDef.HostPort)-1 {
+		nodeDef := chooser.choose(remotePlanPIndex)
+
+		indexClient := newRemoteIndexClient(mgr, indexName, indexUUID,
+			consistencyParams, remotePlanPIndex.PlanPIndex.Name, nodeDef)
+		if indexClient == nil {
 			// No port available
 			log.Warnf("bleveIndexTargets: IndexClient with no possible port into: %v",
-				remotePlanPIndex.NodeDef.HostPort)
+				nodeDef.HostPort)
 			continue
 		}
-		host := remotePlanPIndex.NodeDef.HostPort[:delimiterPos]
-		port := remotePlanPIndex.NodeDef.HostPort[delimiterPos+1:]
-
-		proto := "http://"
-
-		http2Enabled := false
-		extrasBindHTTPS, er := remotePlanPIndex.NodeDef.GetFromParsedExtras("bindHTTPS")
-		if er == nil && extrasBindHTTPS != nil {
-			if bindHTTPSstr, ok := extrasBindHTTPS.(string); ok {
-				portPos := strings.LastIndex(bindHTTPSstr, ":") + 1
-				if portPos > 0 && portPos < len(bindHTTPSstr) {
-					port = bindHTTPSstr[portPos:]
-					proto = "https://"
-					http2Enabled = true
-				}
-			}
-		}
-
-		baseURL := proto + host + ":" + port + prefix +
-			"/api/pindex/" + remotePlanPIndex.PlanPIndex.Name
 
-		indexClient := &IndexClient{
-			mgr:         mgr,
-			name:        fmt.Sprintf("IndexClient - %s", baseURL),
-			HostPort:    host + ":" + port,
-			IndexName:   indexName,
-			IndexUUID:   indexUUID,
-			PIndexNames: []string{remotePlanPIndex.PlanPIndex.Name},
-			QueryURL:    baseURL + "/query",
-			CountURL:    baseURL + "/count",
-			Consistency: consistencyParams,
-			httpClient:  HttpClient,
-			// TODO: Propagate auth to remote client.
-		}
+		atomic.AddUint64(&remoteNodeStatsFor(indexClient.HostPort).TotChosen, 1)
 
-		if http2Enabled {
-			indexClient.httpClient = Http2Client
-			atomic.AddUint64(&totRemoteHttp2, 1)
-		} else {
-			atomic.AddUint64(&totRemoteHttp, 1)
+		if replicas != nil {
+			replicas.add(remotePlanPIndex.PlanPIndex)
+			indexClient.replicas = replicas
 		}
 
 		remoteClients = append(remoteClients, indexClient)
@@ -1811,12 +2279,13 @@ func bleveIndexTargets(mgr *cbgt.Manager, indexName, indexUUID string,
 		}
 	}
 
+	// remote clients are added ahead of the local consistency waits, so
+	// that a collector can kickoff the remote queries concurrently, as
+	// the remote nodes handle their own consistency requirements
 	for _, remoteClient := range remoteClients {
 		collector.Add(remoteClient)
 	}
 
-	// TODO: Should kickoff remote queries concurrently before we wait.
-
 	return remoteClients, numPIndexes, cbgt.ConsistencyWaitGroup(indexName, consistencyParams,
 		cancelCh, localPIndexes,
 		func(localPIndex *cbgt.PIndex) error {
@@ -1858,6 +2327,44 @@ func bleveIndexTargets(mgr *cbgt.Manager, indexName, indexUUID string,
 		})
 }
 
+// newRemoteIndexClient returns an IndexClient for querying a pindex
+// on a remote node, or nil when the node has no usable address.
+func newRemoteIndexClient(mgr *cbgt.Manager, indexName, indexUUID string,
+	consistencyParams *cbgt.ConsistencyParams, pindexName string,
+	nodeDef *cbgt.NodeDef) *IndexClient {
+	hostPort, proto, http2Enabled, ok := remoteNodeHostPort(nodeDef)
+	if !ok {
+		return nil
+	}
+
+	baseURL := proto + hostPort + mgr.Options()["urlPrefix"] +
+		"/api/pindex/" + pindexName
+
+	indexClient := &IndexClient{
+		mgr:         mgr,
+		name:        fmt.Sprintf("IndexClient - %s", baseURL),
+		HostPort:    hostPort,
+		IndexName:   indexName,
+		IndexUUID:   indexUUID,
+		PIndexNames: []string{pindexName},
+		QueryURL:    baseURL + "/query",
+		CountURL:    baseURL + "/count",
+		Consistency: consistencyParams,
+		httpClient:  HttpClient,
+		// The caller's identity is added per request, from the
+		// context, on top of the node's own credentials.
+	}
+
+	if http2Enabled {
+		indexClient.httpClient = Http2Client
+		atomic.AddUint64(&totRemoteHttp2, 1)
+	} else {
+		atomic.AddUint64(&totRemoteHttp, 1)
+	}
+
+	return indexClient
+}
+
 // ---------------------------------------------------------
 
 var BleveRouteMethods map[string]string
@@ -1941,6 +2448,30 @@ func BleveInitRouter(r *mux.Router, phase string,
 		r.Handle(prefix+"/api/pindex-bleve/{pindexName}/fields",
 			listFieldsHandler).Methods("GET")
 		BleveRouteMethods[prefix+"/api/pindex-bleve/{pindexName}/fields"] = "GET"
+
+		handleAuthRoute(r, mgr, "GET", "/api/index/{indexName}/suggest",
+			NewSuggestHandler(mgr))
+		handleAuthRoute(r, mgr, "GET", "/api/index/{indexName}/fieldStats",
+			NewFieldStatsHandler(mgr))
+		handleAuthRoute(r, mgr, "POST", "/api/index/{indexName}/reindex",
+			NewReindexHandler(mgr))
+		handleAuthRoute(r, mgr, "GET", "/api/index/{indexName}/reindex",
+			NewReindexStatusHandler(mgr))
+		handleAuthRoute(r, mgr, "POST", "/api/index/{indexName}/reindex/cancel",
+			NewReindexCancelHandler(mgr))
+
+		// Internal endpoints used by query coordinators.
+		//
+		handleAuthRoute(r, mgr, "POST", "/api/index/{indexName}/termStats",
+			NewTermStatsHandler(mgr))
+		handleAuthRoute(r, mgr, "POST", "/api/index/{indexName}/fields",
+			NewFieldsHandler(mgr))
+		handleAuthRoute(r, mgr, "POST", "/api/index/{indexName}/fieldDict",
+			NewFieldDictHandler(mgr))
+		handleAuthRoute(r, mgr, "POST", "/api/index/{indexName}/document",
+			NewDocumentHandler(mgr))
+		handleAuthRoute(r, mgr, "GET", "/api/remoteNodeStats",
+			NewRemoteNodeStatsHandler())
 	}
 }
 
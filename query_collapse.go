@@ -0,0 +1,217 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+// CollapseOverfetchFactor is the initial number of hits retrieved per
+// requested group when collapsing results.
+var CollapseOverfetchFactor = 4
+
+// CollapseMaxWindow caps the number of merged hits that are scanned
+// to fill the requested page of groups.
+var CollapseMaxWindow = 10000
+
+// QueryCollapse defines the part of the JSON query request that asks
+// the coordinator to collapse the merged hits into groups by the value
+// of a stored field.  A JSON'ified CollapseRequest looks like...
+//     {
+//        "field": "family",
+//        "inner_hits": 3
+//     }
+// When collapsing, the from/size of the search request paginate over
+// groups instead of hits.
+type QueryCollapse struct {
+	Collapse *CollapseRequest `json:"collapse,omitempty"`
+}
+
+type CollapseRequest struct {
+	Field     string `json:"field"`
+	InnerHits int    `json:"inner_hits,omitempty"` // Max hits per group.
+}
+
+// CollapseResult is the "collapse" section of a query response.  The
+// hits of the response are the top hit of each group.
+type CollapseResult struct {
+	Field  string           `json:"field"`
+	Groups []*CollapseGroup `json:"groups"`
+
+	// True when CollapseMaxWindow was reached before all the matching
+	// hits were scanned, so groups beyond the window might be missing.
+	Partial bool `json:"partial,omitempty"`
+}
+
+type CollapseGroup struct {
+	Value     interface{}                    `json:"value"`
+	InnerHits search.DocumentMatchCollection `json:"inner_hits,omitempty"`
+}
+
+// collapser retrieves windows of merged hits until there are enough
+// groups to fill the requested page of groups.
+type collapser struct {
+	c *CollapseRequest
+
+	origFrom   int
+	origSize   int
+	origFields []string
+}
+
+func newCollapser(c *CollapseRequest, sr *bleve.SearchRequest) (
+	*collapser, error) {
+	if c.Field == "" {
+		return nil, fmt.Errorf("collapse: field is required")
+	}
+	if c.InnerHits < 0 {
+		return nil, fmt.Errorf("collapse: negative inner_hits: %d",
+			c.InnerHits)
+	}
+
+	return &collapser{
+		c:          c,
+		origFrom:   sr.From,
+		origSize:   sr.Size,
+		origFields: sr.Fields,
+	}, nil
+}
+
+// search runs the searchFn over widening windows of merged hits, and
+// returns the result with its hits collapsed into the requested page
+// of groups.
+func (cl *collapser) search(ctx context.Context,
+	searchFn func(context.Context, *bleve.SearchRequest) (
+		*bleve.SearchResult, error),
+	sr *bleve.SearchRequest) (*bleve.SearchResult, *CollapseResult, error) {
+	needGroups := cl.origFrom + cl.origSize
+
+	window := needGroups * CollapseOverfetchFactor
+	if window <= 0 {
+		window = CollapseOverfetchFactor
+	}
+
+	sr.From = 0
+	sr.Fields = appendFieldIfMissing(append([]string(nil),
+		cl.origFields...), cl.c.Field)
+
+	defer func() {
+		sr.From, sr.Size, sr.Fields = cl.origFrom, cl.origSize, cl.origFields
+	}()
+
+	for {
+		if window > CollapseMaxWindow {
+			window = CollapseMaxWindow
+		}
+		sr.Size = window
+
+		res, err := searchFn(ctx, sr)
+		if err != nil || res == nil {
+			return res, nil, err
+		}
+
+		groups, tops := cl.group(res.Hits)
+
+		scannedAll := uint64(len(res.Hits)) >= res.Total ||
+			len(res.Hits) < window
+		if len(groups) >= needGroups || scannedAll ||
+			window >= CollapseMaxWindow {
+			return cl.page(res, groups, tops,
+				!scannedAll && len(groups) < needGroups), nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+
+		window *= 2
+	}
+}
+
+// group partitions the merged hits by the collapse field value,
+// returning the groups in the order of their top hit.
+func (cl *collapser) group(hits search.DocumentMatchCollection) (
+	[]*CollapseGroup, []*search.DocumentMatch) {
+	var groups []*CollapseGroup
+	var tops []*search.DocumentMatch
+
+	byKey := map[string]*CollapseGroup{}
+
+	for _, hit := range hits {
+		v, exists := hit.Fields[cl.c.Field]
+
+		key := "\x00" + hit.ID // Hits missing the field aren't grouped.
+		if exists {
+			key = fmt.Sprintf("%v", v)
+		}
+
+		g := byKey[key]
+		if g == nil {
+			g = &CollapseGroup{Value: v}
+			byKey[key] = g
+			groups = append(groups, g)
+			tops = append(tops, hit)
+		}
+
+		if len(g.InnerHits) < cl.c.InnerHits {
+			g.InnerHits = append(g.InnerHits, hit)
+		}
+	}
+
+	return groups, tops
+}
+
+func (cl *collapser) page(res *bleve.SearchResult,
+	groups []*CollapseGroup, tops []*search.DocumentMatch,
+	partial bool) (*bleve.SearchResult, *CollapseResult) {
+	start := cl.origFrom
+	if start > len(groups) {
+		start = len(groups)
+	}
+	end := start + cl.origSize
+	if end > len(groups) {
+		end = len(groups)
+	}
+
+	res.Hits = tops[start:end]
+
+	cr := &CollapseResult{
+		Field:   cl.c.Field,
+		Groups:  groups[start:end],
+		Partial: partial,
+	}
+
+	if !fieldRequested(cl.origFields, cl.c.Field) {
+		for _, hit := range res.Hits {
+			delete(hit.Fields, cl.c.Field)
+		}
+		for _, g := range cr.Groups {
+			for _, hit := range g.InnerHits {
+				delete(hit.Fields, cl.c.Field)
+			}
+		}
+	}
+
+	return res, cr
+}
+
+func fieldRequested(fields []string, field string) bool {
+	for _, f := range fields {
+		if f == field || f == "*" {
+			return true
+		}
+	}
+	return false
+}
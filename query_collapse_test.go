@@ -0,0 +1,81 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+func TestCollapse(t *testing.T) {
+	families := []string{"a", "a", "b", "a", "c", "b", "d"}
+
+	var sizes []int
+
+	searchFn := func(ctx context.Context, sr *bleve.SearchRequest) (
+		*bleve.SearchResult, error) {
+		sizes = append(sizes, sr.Size)
+		res := &bleve.SearchResult{Total: uint64(len(families))}
+		for i, family := range families {
+			if i >= sr.Size {
+				break
+			}
+			res.Hits = append(res.Hits, &search.DocumentMatch{
+				ID:     string('0' + rune(i)),
+				Score:  float64(len(families) - i),
+				Fields: map[string]interface{}{"family": family},
+			})
+		}
+		return res, nil
+	}
+
+	sr := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 2, 1, false)
+
+	cl, err := newCollapser(&CollapseRequest{Field: "family", InnerHits: 2}, sr)
+	if err != nil {
+		t.Fatalf("expected newCollapser to work, err: %v", err)
+	}
+
+	saved := CollapseOverfetchFactor
+	CollapseOverfetchFactor = 1
+	defer func() { CollapseOverfetchFactor = saved }()
+
+	res, cr, err := cl.search(context.Background(), searchFn, sr)
+	if err != nil {
+		t.Fatalf("expected search to work, err: %v", err)
+	}
+
+	if len(sizes) != 2 || sizes[0] != 3 || sizes[1] != 6 {
+		t.Errorf("expected widening windows, got: %v", sizes)
+	}
+	if len(res.Hits) != 2 || res.Hits[0].ID != "2" || res.Hits[1].ID != "4" {
+		t.Errorf("unexpected group top hits: %v", res.Hits)
+	}
+	if len(cr.Groups) != 2 || cr.Groups[0].Value != "b" ||
+		len(cr.Groups[0].InnerHits) != 2 || cr.Partial {
+		t.Errorf("unexpected collapse result: %+v", cr)
+	}
+	if res.Hits[0].Fields["family"] != nil {
+		t.Errorf("expected collapse-only field to be stripped")
+	}
+	if sr.From != 1 || sr.Size != 2 || sr.Fields != nil {
+		t.Errorf("expected search request to be restored")
+	}
+
+	_, err = newCollapser(&CollapseRequest{}, sr)
+	if err == nil {
+		t.Errorf("expected error on missing collapse field")
+	}
+}
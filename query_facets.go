@@ -0,0 +1,187 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+// QueryFacetShardSizes defines the part of the JSON query request
+// that allows the client to ask for term facets to be oversampled,
+// via an optional "shard_size" in each facet request.  Each pindex
+// (and remote node) then returns its local top shard_size terms, so
+// that the merged top size terms are more accurate.
+type QueryFacetShardSizes struct {
+	Facets map[string]*facetRequest `json:"facets"`
+}
+
+// FacetErrorBound describes the accuracy of a merged term facet.  The
+// DocCountErrorUpperBound is the maximum count that any term missing
+// from the merged result might have, where 0 means the merged term
+// counts are exact.
+type FacetErrorBound struct {
+	ShardSize               int `json:"shard_size"`
+	DocCountErrorUpperBound int `json:"doc_count_error_upper_bound"`
+}
+
+// facetShardSizes returns the shard size for each term facet of a
+// search request, keyed by facet name.  A facet without an explicit
+// shard_size is oversampled when the bleveFacetShardSizeFactor
+// manager option is set, following the size * factor + 10 heuristic.
+func facetShardSizes(options map[string]string,
+	sr *bleve.SearchRequest, qfss *QueryFacetShardSizes) (
+	map[string]int, error) {
+	factor := 0.0
+	if v, exists := options["bleveFacetShardSizeFactor"]; exists && v != "" {
+		var err error
+		factor, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bleve: bleveFacetShardSizeFactor"+
+				" parse float: %v, err: %v", v, err)
+		}
+	}
+
+	rv := map[string]int{}
+
+	for name, fr := range sr.Facets {
+		if len(fr.NumericRanges) > 0 || len(fr.DateTimeRanges) > 0 {
+			continue // Range facets are already merged exactly.
+		}
+
+		shardSize := 0
+		if qfss != nil && qfss.Facets[name] != nil {
+			shardSize = qfss.Facets[name].ShardSize
+		}
+		if shardSize <= 0 && factor > 0 {
+			shardSize = int(float64(fr.Size)*factor) + 10
+		}
+		if shardSize < 0 {
+			return nil, fmt.Errorf("bleve: negative facet shard_size,"+
+				" facet: %s", name)
+		}
+		if shardSize > fr.Size {
+			rv[name] = shardSize
+		}
+	}
+
+	return rv, nil
+}
+
+// facetBounds accumulates the per-target contributions to the error
+// bounds of oversampled term facets.
+type facetBounds struct {
+	m          sync.Mutex
+	shardSizes map[string]int
+	bounds     map[string]int
+}
+
+func newFacetBounds(shardSizes map[string]int) *facetBounds {
+	return &facetBounds{
+		shardSizes: shardSizes,
+		bounds:     make(map[string]int, len(shardSizes)),
+	}
+}
+
+// add records the error bound contribution of a single target's facet
+// results, which is the count of its last returned term whenever the
+// target had more terms than it returned.
+func (fb *facetBounds) add(facets search.FacetResults) {
+	fb.m.Lock()
+	for name := range fb.shardSizes {
+		fr := facets[name]
+		if fr == nil || fr.Other <= 0 || len(fr.Terms) <= 0 {
+			continue
+		}
+		fb.bounds[name] += fr.Terms[len(fr.Terms)-1].Count
+	}
+	fb.m.Unlock()
+}
+
+// reset clears the recorded error bounds, ahead of a search.
+func (fb *facetBounds) reset() {
+	fb.m.Lock()
+	fb.bounds = make(map[string]int, len(fb.shardSizes))
+	fb.m.Unlock()
+}
+
+// wrap returns the targets wrapped so that their facet results are
+// recorded into the facetBounds.
+func (fb *facetBounds) wrap(targets []bleve.Index) []bleve.Index {
+	rv := make([]bleve.Index, 0, len(targets))
+	for _, target := range targets {
+		rv = append(rv, &facetBoundsIndex{Index: target, fb: fb})
+	}
+	return rv
+}
+
+// prepare widens the facet sizes of the search request to the shard
+// sizes, returning the original sizes.
+func (fb *facetBounds) prepare(sr *bleve.SearchRequest) map[string]int {
+	origSizes := make(map[string]int, len(fb.shardSizes))
+	for name, shardSize := range fb.shardSizes {
+		origSizes[name] = sr.Facets[name].Size
+		sr.Facets[name].Size = shardSize
+	}
+	return origSizes
+}
+
+// finish trims the merged facets back to their original sizes and
+// returns the error bounds, keyed by facet name.
+func (fb *facetBounds) finish(sr *bleve.SearchRequest,
+	res *bleve.SearchResult, origSizes map[string]int) map[string]*FacetErrorBound {
+	rv := make(map[string]*FacetErrorBound, len(fb.shardSizes))
+
+	fb.m.Lock()
+	for name, shardSize := range fb.shardSizes {
+		size := origSizes[name]
+		sr.Facets[name].Size = size
+
+		if res.Facets != nil && res.Facets[name] != nil {
+			res.Facets.Fixup(name, size)
+		}
+
+		rv[name] = &FacetErrorBound{
+			ShardSize:               shardSize,
+			DocCountErrorUpperBound: fb.bounds[name],
+		}
+	}
+	fb.m.Unlock()
+
+	return rv
+}
+
+// facetBoundsIndex wraps an index alias target, recording the facet
+// results of each search into a facetBounds.
+type facetBoundsIndex struct {
+	bleve.Index
+	fb *facetBounds
+}
+
+func (f *facetBoundsIndex) Search(req *bleve.SearchRequest) (
+	*bleve.SearchResult, error) {
+	return f.SearchInContext(context.Background(), req)
+}
+
+func (f *facetBoundsIndex) SearchInContext(ctx context.Context,
+	req *bleve.SearchRequest) (*bleve.SearchResult, error) {
+	res, err := f.Index.SearchInContext(ctx, req)
+	if err == nil && res != nil && res.Facets != nil {
+		f.fb.add(res.Facets)
+	}
+	return res, err
+}
@@ -0,0 +1,113 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+func TestFacetShardSizes(t *testing.T) {
+	sr := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+	sr.AddFacet("types", bleve.NewFacetRequest("type", 3))
+	sr.AddFacet("styles", bleve.NewFacetRequest("style", 5))
+	min := 0.0
+	ranges := bleve.NewFacetRequest("abv", 2)
+	ranges.AddNumericRange("low", &min, nil)
+	sr.AddFacet("abv", ranges)
+
+	qfss := &QueryFacetShardSizes{
+		Facets: map[string]*facetRequest{
+			"types": {ShardSize: 20},
+			"abv":   {ShardSize: 20},
+		},
+	}
+
+	shardSizes, err := facetShardSizes(map[string]string{}, sr, qfss)
+	if err != nil {
+		t.Fatalf("expected facetShardSizes to work, err: %v", err)
+	}
+	if len(shardSizes) != 1 || shardSizes["types"] != 20 {
+		t.Errorf("unexpected shardSizes: %v", shardSizes)
+	}
+
+	shardSizes, err = facetShardSizes(map[string]string{
+		"bleveFacetShardSizeFactor": "2",
+	}, sr, qfss)
+	if err != nil {
+		t.Fatalf("expected facetShardSizes to work, err: %v", err)
+	}
+	if len(shardSizes) != 2 || shardSizes["styles"] != 20 {
+		t.Errorf("unexpected shardSizes: %v", shardSizes)
+	}
+
+	_, err = facetShardSizes(map[string]string{
+		"bleveFacetShardSizeFactor": "bogus",
+	}, sr, qfss)
+	if err == nil {
+		t.Errorf("expected error on bogus bleveFacetShardSizeFactor")
+	}
+}
+
+func TestFacetBounds(t *testing.T) {
+	sr := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+	sr.AddFacet("types", bleve.NewFacetRequest("type", 1))
+
+	fb := newFacetBounds(map[string]int{"types": 2})
+	origSizes := fb.prepare(sr)
+	if sr.Facets["types"].Size != 2 {
+		t.Errorf("expected facet size to be widened")
+	}
+
+	fb.add(search.FacetResults{
+		"types": &search.FacetResult{
+			Field: "type",
+			Total: 10,
+			Other: 3,
+			Terms: []*search.TermFacet{{Term: "a", Count: 5}, {Term: "b", Count: 2}},
+		},
+	})
+	fb.add(search.FacetResults{
+		"types": &search.FacetResult{
+			Field: "type",
+			Total: 4,
+			Terms: []*search.TermFacet{{Term: "a", Count: 3}, {Term: "c", Count: 1}},
+		},
+	})
+
+	res := &bleve.SearchResult{
+		Facets: search.FacetResults{
+			"types": &search.FacetResult{
+				Field: "type",
+				Total: 14,
+				Other: 3,
+				Terms: []*search.TermFacet{
+					{Term: "a", Count: 8}, {Term: "b", Count: 2}, {Term: "c", Count: 1},
+				},
+			},
+		},
+	}
+
+	bounds := fb.finish(sr, res, origSizes)
+	if sr.Facets["types"].Size != 1 {
+		t.Errorf("expected facet size to be restored")
+	}
+	if len(res.Facets["types"].Terms) != 1 || res.Facets["types"].Other != 6 {
+		t.Errorf("unexpected merged facet: %+v", res.Facets["types"])
+	}
+	if bounds["types"].DocCountErrorUpperBound != 2 ||
+		bounds["types"].ShardSize != 2 {
+		t.Errorf("unexpected bounds: %+v", bounds["types"])
+	}
+}
@@ -0,0 +1,172 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// QueryTwoPhase defines the part of the JSON query request that asks
+// the coordinator for a two-phase query-then-fetch scatter-gather.
+// The first phase collects only the IDs, scores and sort keys of hits
+// from every pindex, and the second phase fetches the stored fields,
+// highlights and locations of just the final hits from the pindexes
+// that own them.
+type QueryTwoPhase struct {
+	TwoPhase bool `json:"twoPhase,omitempty"`
+}
+
+// needsFetch returns true when a search request asks for any hit
+// details that the first phase of a two-phase search leaves out.
+func needsFetch(req *bleve.SearchRequest) bool {
+	return len(req.Fields) > 0 || req.Highlight != nil ||
+		req.IncludeLocations || req.Explain
+}
+
+// searchTwoPhase executes a search request as a query phase followed
+// by a fetch phase.  The targets are the local and remote targets of
+// the alias, which are used to route the fetch phase to just the
+// pindexes that own the final hits.
+func searchTwoPhase(ctx context.Context, alias bleve.IndexAlias,
+	targets []bleve.Index, req *bleve.SearchRequest) (
+	*bleve.SearchResult, error) {
+	if !needsFetch(req) {
+		return alias.SearchInContext(ctx, req)
+	}
+
+	queryReq := *req
+	queryReq.Fields = nil
+	queryReq.Highlight = nil
+	queryReq.IncludeLocations = false
+	queryReq.Explain = false
+
+	res, err := alias.SearchInContext(ctx, &queryReq)
+	if err != nil || res == nil || len(res.Hits) <= 0 {
+		if res != nil {
+			res.Request = req
+		}
+		return res, err
+	}
+
+	res.Request = req
+
+	ids := make([]string, 0, len(res.Hits))
+	owners := map[string]bool{}
+	for _, hit := range res.Hits {
+		ids = append(ids, hit.ID)
+		owners[pindexNameForHitIndex(hit.Index)] = true
+	}
+
+	fetchAlias := bleve.NewIndexAlias()
+	fetchAlias.Add(fetchTargets(targets, owners)...)
+
+	fetchReq := &bleve.SearchRequest{
+		Query: query.NewConjunctionQuery([]query.Query{
+			req.Query, query.NewDocIDQuery(ids),
+		}),
+		Size:             len(ids),
+		Fields:           req.Fields,
+		Highlight:        req.Highlight,
+		IncludeLocations: req.IncludeLocations,
+		Explain:          req.Explain,
+		Sort:             req.Sort,
+	}
+
+	fetchRes, err := fetchAlias.SearchInContext(ctx, fetchReq)
+	if err != nil {
+		return nil, err
+	}
+
+	fetched := make(map[string]*search.DocumentMatch, len(fetchRes.Hits))
+	for _, hit := range fetchRes.Hits {
+		fetched[hit.ID] = hit
+	}
+
+	for _, hit := range res.Hits {
+		if f, exists := fetched[hit.ID]; exists {
+			hit.Fields = f.Fields
+			hit.Fragments = f.Fragments
+			hit.Locations = f.Locations
+			hit.Expl = f.Expl
+		}
+	}
+
+	if fetchRes.Status != nil && len(fetchRes.Status.Errors) > 0 {
+		if res.Status.Errors == nil {
+			res.Status.Errors = make(map[string]error)
+		}
+		for k, v := range fetchRes.Status.Errors {
+			res.Status.Errors[k] = v
+		}
+	}
+
+	return res, nil
+}
+
+// pindexNameForHitIndex maps the index name of a hit, which is the
+// name of the bleve index of a pindex (its path), to the pindex name.
+func pindexNameForHitIndex(hitIndex string) string {
+	return strings.TrimSuffix(filepath.Base(hitIndex), ".pindex")
+}
+
+// fetchTargets narrows the targets to the pindexes that own hits,
+// falling back to all the targets when some hit owner isn't known.
+func fetchTargets(targets []bleve.Index,
+	owners map[string]bool) []bleve.Index {
+	known := map[string]bool{}
+	for _, target := range targets {
+		switch t := target.(type) {
+		case *cacheBleveIndex:
+			known[t.pindex.Name] = true
+			known[pindexNameForHitIndex(t.Name())] = true
+		case *IndexClient:
+			for _, pindexName := range t.PIndexNames {
+				known[pindexName] = true
+			}
+		}
+	}
+	for owner := range owners {
+		if !known[owner] {
+			return targets
+		}
+	}
+
+	rv := make([]bleve.Index, 0, len(targets))
+
+	for _, target := range targets {
+		switch t := target.(type) {
+		case *cacheBleveIndex:
+			if owners[t.pindex.Name] ||
+				owners[pindexNameForHitIndex(t.Name())] {
+				rv = append(rv, t)
+			}
+		case *IndexClient:
+			var pindexNames []string
+			for _, pindexName := range t.PIndexNames {
+				if owners[pindexName] {
+					pindexNames = append(pindexNames, pindexName)
+				}
+			}
+			if len(pindexNames) > 0 {
+				rv = append(rv, t.withPIndexNames(pindexNames))
+			}
+		}
+	}
+
+	return rv
+}
@@ -0,0 +1,53 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+)
+
+func TestPIndexNameForHitIndex(t *testing.T) {
+	tests := map[string]string{
+		"/data/@fts/beers_1234_abcd.pindex": "beers_1234_abcd",
+		"beers_1234_abcd.pindex":            "beers_1234_abcd",
+		"beers_1234_abcd":                   "beers_1234_abcd",
+	}
+	for hitIndex, exp := range tests {
+		if got := pindexNameForHitIndex(hitIndex); got != exp {
+			t.Errorf("hitIndex: %s, expected: %s, got: %s", hitIndex, exp, got)
+		}
+	}
+}
+
+func TestFetchTargets(t *testing.T) {
+	a := &IndexClient{HostPort: "a:8094", PIndexNames: []string{"p1", "p2"}}
+	b := &IndexClient{HostPort: "b:8094", PIndexNames: []string{"p3"}}
+	targets := []bleve.Index{a, b}
+
+	rv := fetchTargets(targets, map[string]bool{"p2": true})
+	if len(rv) != 1 {
+		t.Fatalf("expected 1 fetch target, got: %d", len(rv))
+	}
+	ic, ok := rv[0].(*IndexClient)
+	if !ok || ic.HostPort != "a:8094" ||
+		!reflect.DeepEqual(ic.PIndexNames, []string{"p2"}) {
+		t.Errorf("unexpected fetch target: %#v", rv[0])
+	}
+
+	rv = fetchTargets(targets, map[string]bool{"unknown": true})
+	if len(rv) != 2 {
+		t.Errorf("expected fallback to all targets, got: %d", len(rv))
+	}
+}
@@ -0,0 +1,214 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"encoding/json"
+
+	"github.com/blevesearch/bleve/index"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// QueryAliasFilter defines the part of the JSON query request that a
+// coordinator sends to remote nodes when the query is a conjunction
+// of the client's query and the filters of alias targets.  When set,
+// the conjuncts after the first only filter the hits, and don't
+// contribute to their scores.  Nodes that don't know of the flag
+// still apply the filters, as conjuncts.
+type QueryAliasFilter struct {
+	AliasFilter bool `json:"aliasFilter,omitempty"`
+}
+
+// filteredQuery is a query whose hits must also match each of the
+// filters, which don't contribute to the scores of the hits.
+type filteredQuery struct {
+	query   query.Query
+	filters []query.Query
+}
+
+// newFilteredQuery returns a query for the hits of q that match the
+// filter, keeping the filters of q when it's already filtered.
+func newFilteredQuery(q, filter query.Query) *filteredQuery {
+	if fq, ok := q.(*filteredQuery); ok {
+		filters := make([]query.Query, 0, len(fq.filters)+1)
+		filters = append(filters, fq.filters...)
+		return &filteredQuery{query: fq.query, filters: append(filters, filter)}
+	}
+
+	return &filteredQuery{query: q, filters: []query.Query{filter}}
+}
+
+// isFilteredQuery returns true when q has to be sent along with the
+// QueryAliasFilter flag.
+func isFilteredQuery(q query.Query) bool {
+	_, ok := q.(*filteredQuery)
+	return ok
+}
+
+// unwrapFilteredQuery turns the conjunction that a filtered query was
+// marshaled as back into the filtered query.
+func unwrapFilteredQuery(q query.Query) query.Query {
+	cq, ok := q.(*query.ConjunctionQuery)
+	if !ok || len(cq.Conjuncts) < 2 {
+		return q
+	}
+
+	return &filteredQuery{query: cq.Conjuncts[0], filters: cq.Conjuncts[1:]}
+}
+
+func (q *filteredQuery) conjunction() *query.ConjunctionQuery {
+	return query.NewConjunctionQuery(
+		append([]query.Query{q.query}, q.filters...))
+}
+
+func (q *filteredQuery) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.conjunction())
+}
+
+func (q *filteredQuery) Validate() error {
+	return q.conjunction().Validate()
+}
+
+func (q *filteredQuery) Searcher(i index.IndexReader, m mapping.IndexMapping,
+	options search.SearcherOptions) (search.Searcher, error) {
+	s, err := q.query.Searcher(i, m, options)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &filteredSearcher{
+		Searcher: s,
+		filters:  make([]search.Searcher, 0, len(q.filters)),
+		currs:    make([]*search.DocumentMatch, len(q.filters)),
+	}
+
+	// the filters aren't scored, so there's nothing to explain
+	options.Explain = false
+
+	for _, filter := range q.filters {
+		fs, err := filter.Searcher(i, m, options)
+		if err != nil {
+			rv.Close()
+			return nil, err
+		}
+		rv.filters = append(rv.filters, fs)
+	}
+
+	return rv, nil
+}
+
+// filteredSearcher returns the hits of the embedded searcher, which
+// scores them, that the searchers of the filters also match.
+type filteredSearcher struct {
+	search.Searcher
+
+	filters []search.Searcher
+	currs   []*search.DocumentMatch // The current match of each filter.
+	done    bool                    // A filter has no more matches.
+}
+
+func (s *filteredSearcher) Next(ctx *search.SearchContext) (
+	*search.DocumentMatch, error) {
+	if s.done {
+		return nil, nil
+	}
+
+	dm, err := s.Searcher.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.filter(ctx, dm)
+}
+
+func (s *filteredSearcher) Advance(ctx *search.SearchContext,
+	ID index.IndexInternalID) (*search.DocumentMatch, error) {
+	if s.done {
+		return nil, nil
+	}
+
+	dm, err := s.Searcher.Advance(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.filter(ctx, dm)
+}
+
+// filter returns the first hit of the embedded searcher, starting
+// from dm, that every filter matches, leapfrogging the embedded
+// searcher past the documents that a filter skips.
+func (s *filteredSearcher) filter(ctx *search.SearchContext,
+	dm *search.DocumentMatch) (*search.DocumentMatch, error) {
+	var err error
+
+OUTER:
+	for dm != nil {
+		for i, f := range s.filters {
+			curr := s.currs[i]
+			if curr == nil || curr.IndexInternalID.Compare(dm.IndexInternalID) < 0 {
+				if curr != nil {
+					ctx.DocumentMatchPool.Put(curr)
+				}
+
+				curr, err = f.Advance(ctx, dm.IndexInternalID)
+				if err != nil {
+					return nil, err
+				}
+
+				s.currs[i] = curr
+				if curr == nil {
+					s.done = true
+					ctx.DocumentMatchPool.Put(dm)
+					return nil, nil
+				}
+			}
+
+			if curr.IndexInternalID.Compare(dm.IndexInternalID) > 0 {
+				ctx.DocumentMatchPool.Put(dm)
+
+				dm, err = s.Searcher.Advance(ctx, curr.IndexInternalID)
+				if err != nil {
+					return nil, err
+				}
+
+				continue OUTER
+			}
+		}
+
+		return dm, nil
+	}
+
+	return nil, nil
+}
+
+func (s *filteredSearcher) Close() error {
+	err := s.Searcher.Close()
+	for _, f := range s.filters {
+		if ferr := f.Close(); err == nil {
+			err = ferr
+		}
+	}
+
+	return err
+}
+
+func (s *filteredSearcher) DocumentMatchPoolSize() int {
+	rv := s.Searcher.DocumentMatchPoolSize()
+	for _, f := range s.filters {
+		rv += f.DocumentMatchPoolSize()
+	}
+
+	return rv
+}
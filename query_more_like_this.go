@@ -0,0 +1,548 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search/query"
+
+	"github.com/couchbase/cbgt"
+)
+
+// MoreLikeThisDefaultMaxTerms is the number of distinctive terms of
+// the source document that are searched for, when the request
+// doesn't specify max_terms.
+var MoreLikeThisDefaultMaxTerms = 25
+
+// MoreLikeThisDefaultMinDocFreq is the number of documents that must
+// have a term for it to be searched for, when the request doesn't
+// specify min_doc_freq.  The source document is one of them, so its
+// unique terms are skipped by default.
+var MoreLikeThisDefaultMinDocFreq = uint64(2)
+
+// MoreLikeThisQuery is the JSON form of the more_like_this query
+// type, which matches the documents that are like a source document
+// of the index, and can be used wherever a query can, including in
+// the conjuncts, disjuncts and must/should/must_not clauses of other
+// queries.  A JSON'ified MoreLikeThisQuery looks like...
+//     {
+//        "more_like_this": {
+//           "id": "beer-123",
+//           "fields": ["name", "description"],
+//           "max_terms": 25,
+//           "min_term_freq": 1,
+//           "min_doc_freq": 2
+//        },
+//        "boost": 1.5
+//     }
+// The most distinctive indexed terms of the source document's text
+// fields, by tf-idf, are searched for as a weighted disjunction that
+// excludes the source document.  As bleve doesn't know of the query
+// type, the coordinator replaces it with a placeholder before the
+// search request is parsed, and rewrites the placeholder once the
+// index targets are known.
+type MoreLikeThisQuery struct {
+	MoreLikeThis *MoreLikeThisRequest `json:"more_like_this"`
+	Boost        *float64             `json:"boost,omitempty"`
+}
+
+type MoreLikeThisRequest struct {
+	ID          string   `json:"id"`
+	Fields      []string `json:"fields,omitempty"` // Default is all fields.
+	MaxTerms    int      `json:"max_terms,omitempty"`
+	MinTermFreq int      `json:"min_term_freq,omitempty"`
+	MinDocFreq  uint64   `json:"min_doc_freq,omitempty"`
+}
+
+// moreLikeThis builds the query for the documents like the source
+// document of a more_like_this query.
+type moreLikeThis struct {
+	r     *MoreLikeThisRequest
+	boost *float64
+}
+
+func newMoreLikeThis(r *MoreLikeThisRequest) (*moreLikeThis, error) {
+	if r == nil {
+		return nil, fmt.Errorf("more_like_this: missing request")
+	}
+	if r.ID == "" {
+		return nil, fmt.Errorf("more_like_this: id is required")
+	}
+	if r.MaxTerms < 0 {
+		return nil, fmt.Errorf("more_like_this: negative max_terms: %d",
+			r.MaxTerms)
+	}
+	if r.MinTermFreq < 0 {
+		return nil, fmt.Errorf("more_like_this: negative min_term_freq: %d",
+			r.MinTermFreq)
+	}
+
+	c := *r
+	if c.MaxTerms == 0 {
+		c.MaxTerms = MoreLikeThisDefaultMaxTerms
+	}
+	if c.MinTermFreq == 0 {
+		c.MinTermFreq = 1
+	}
+	if c.MinDocFreq == 0 {
+		c.MinDocFreq = MoreLikeThisDefaultMinDocFreq
+	}
+
+	return &moreLikeThis{r: &c}, nil
+}
+
+// mltTerm is a term of the source document, weighted by tf-idf.
+type mltTerm struct {
+	field string
+	term  string
+	score float64
+}
+
+// query returns the query for the documents like the source
+// document, which matches nothing when the source document has no
+// distinctive terms.  It's an error when the source document isn't
+// found or has no indexed terms in its text fields.
+func (mlt *moreLikeThis) query(ctx context.Context, mgr *cbgt.Manager,
+	indexName string, alias bleve.IndexAlias) (query.Query, error) {
+	m, err := bleveIndexMapping(mgr, indexName)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := aliasTargets(alias)
+
+	termFreqs, err := aliasDocTermFreqs(ctx, targets, mlt.r.ID, mlt.r.Fields)
+	if err != nil {
+		return nil, err
+	}
+	if termFreqs == nil {
+		return nil, fmt.Errorf("more_like_this: no document, id: %s",
+			mlt.r.ID)
+	}
+
+	termFreqs = textFieldTermFreqs(termFreqs, m, mlt.r.Fields)
+	if len(termFreqs) <= 0 {
+		return nil, fmt.Errorf("more_like_this: no indexed terms in"+
+			" the text fields of the document, id: %s, fields: %v",
+			mlt.r.ID, mlt.r.Fields)
+	}
+
+	fields := make(map[string][]string, len(termFreqs))
+	for field, freqs := range termFreqs {
+		for term := range freqs {
+			fields[field] = append(fields[field], term)
+		}
+	}
+
+	ts, err := gatherTermStats(ctx, targets, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	terms := mlt.selectTerms(termFreqs, ts)
+	if len(terms) <= 0 {
+		return query.NewMatchNoneQuery(), nil
+	}
+
+	should := make([]query.Query, 0, len(terms))
+	for _, t := range terms {
+		tq := query.NewTermQuery(t.term)
+		tq.SetField(t.field)
+		tq.SetBoost(t.score)
+		should = append(should, tq)
+	}
+
+	rv := query.NewBooleanQuery(nil, should,
+		[]query.Query{query.NewDocIDQuery([]string{mlt.r.ID})})
+	rv.SetMinShould(1)
+	if mlt.boost != nil {
+		rv.SetBoost(*mlt.boost)
+	}
+
+	return rv, nil
+}
+
+// selectTerms returns the terms of the source document that pass the
+// frequency thresholds, highest tf-idf first, up to max_terms.
+func (mlt *moreLikeThis) selectTerms(termFreqs map[string]map[string]int,
+	ts *TermStats) []*mltTerm {
+	var rv []*mltTerm
+
+	for field, freqs := range termFreqs {
+		for term, tf := range freqs {
+			if tf < mlt.r.MinTermFreq {
+				continue
+			}
+
+			df := ts.Fields[field][term]
+			if df < mlt.r.MinDocFreq {
+				continue
+			}
+
+			idf := math.Log(float64(ts.DocCount) / float64(df))
+			if idf <= 0 {
+				continue // The term is in every document.
+			}
+
+			rv = append(rv, &mltTerm{
+				field: field,
+				term:  term,
+				score: float64(tf) * idf,
+			})
+		}
+	}
+
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].score != rv[j].score {
+			return rv[i].score > rv[j].score
+		}
+		if rv[i].field != rv[j].field {
+			return rv[i].field < rv[j].field
+		}
+		return rv[i].term < rv[j].term
+	})
+
+	if len(rv) > mlt.r.MaxTerms {
+		rv = rv[:mlt.r.MaxTerms]
+	}
+
+	return rv
+}
+
+// textFieldTermFreqs narrows the term frequencies of a document to
+// its text fields, leaving out the fields that the mapping has as
+// another type, whose indexed terms are encoded values rather than
+// words, and the composite _all field unless it's asked for.
+func textFieldTermFreqs(termFreqs map[string]map[string]int,
+	m mapping.IndexMapping, fields []string) map[string]map[string]int {
+	fieldTypes := mappedFieldTypes(m)
+
+	var onlyFields map[string]bool
+	if len(fields) > 0 {
+		onlyFields = cbgt.StringsToMap(fields)
+	}
+
+	rv := make(map[string]map[string]int, len(termFreqs))
+	for field, freqs := range termFreqs {
+		if onlyFields != nil && !onlyFields[field] {
+			continue
+		}
+		if onlyFields == nil && field == "_all" {
+			continue
+		}
+		if fieldType, exists := fieldTypes[field]; exists && fieldType != "text" {
+			continue
+		}
+		if len(freqs) > 0 {
+			rv[field] = freqs
+		}
+	}
+
+	return rv
+}
+
+// localDocTermFreqs returns the frequencies of the indexed terms of a
+// document in a bleve index, keyed by field name then by term, or nil
+// when the index doesn't have the document.  A non-empty fields limits
+// the fields whose terms are returned.
+func localDocTermFreqs(bindex bleve.Index, id string, fields []string) (
+	map[string]map[string]int, error) {
+	idx, _, err := bindex.Advanced()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := idx.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	internalID, err := r.InternalID(id)
+	if err != nil || internalID == nil {
+		return nil, err
+	}
+
+	if len(fields) <= 0 {
+		fields, err = r.Fields()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var terms []fieldTerm
+	err = r.DocumentVisitFieldTerms(internalID, fields,
+		func(field string, term []byte) {
+			terms = append(terms, fieldTerm{field, string(term)})
+		})
+	if err != nil {
+		return nil, err
+	}
+	if len(terms) <= 0 {
+		return nil, nil
+	}
+
+	rv := map[string]map[string]int{}
+
+	for _, ft := range terms {
+		tfr, err := r.TermFieldReader([]byte(ft.term), ft.field,
+			true, false, false)
+		if err != nil {
+			return nil, err
+		}
+
+		tfd, err := tfr.Advance(internalID, nil)
+		tfr.Close()
+		if err != nil {
+			return nil, err
+		}
+		if tfd == nil || !tfd.ID.Equals(internalID) {
+			continue
+		}
+
+		freqs := rv[ft.field]
+		if freqs == nil {
+			freqs = map[string]int{}
+			rv[ft.field] = freqs
+		}
+		freqs[ft.term] = int(tfd.Freq)
+	}
+
+	if len(rv) <= 0 {
+		return nil, nil
+	}
+
+	return rv, nil
+}
+
+type fieldTerm struct {
+	field string
+	term  string
+}
+
+// aliasDocTermFreqs looks up the indexed term frequencies of a
+// document across the local and remote targets of an index alias,
+// returning nil when no target has the document.
+func aliasDocTermFreqs(ctx context.Context, targets []bleve.Index,
+	id string, fields []string) (map[string]map[string]int, error) {
+	var rv map[string]map[string]int
+
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+
+	for _, target := range targets {
+		var get func() (map[string]map[string]int, error)
+
+		switch t := target.(type) {
+		case *cacheBleveIndex:
+			get = func() (map[string]map[string]int, error) {
+				return localDocTermFreqs(t.bindex, id, fields)
+			}
+		case *IndexClient:
+			get = func() (map[string]map[string]int, error) {
+				return t.DocTermFreqs(ctx, id, fields)
+			}
+		default:
+			continue // Ex: a MissingPIndex has no documents.
+		}
+
+		wg.Add(1)
+		go func() {
+			termFreqs, err := get()
+
+			m.Lock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+			} else if termFreqs != nil && rv == nil {
+				rv = termFreqs
+			}
+			m.Unlock()
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+
+	// a document lives in just one pindex, so it's found even when
+	// some other target failed
+	if rv == nil && firstErr != nil {
+		return nil, firstErr
+	}
+
+	return rv, nil
+}
+
+// ---------------------------------------------------------
+
+// moreLikeThisPlaceholderPrefix starts the doc ID of the placeholder
+// of a more_like_this query, followed by the query's position.
+const moreLikeThisPlaceholderPrefix = "\x00more_like_this:"
+
+// extractMoreLikeThis replaces the more_like_this queries in the query
+// of a JSON search request with placeholders that bleve can parse,
+// returning the rewritten request and the more_like_this queries in
+// the order of their placeholders.  The request is returned as is when
+// it has no more_like_this queries.
+func extractMoreLikeThis(req []byte) ([]byte, []*moreLikeThis, error) {
+	var r map[string]json.RawMessage
+	err := UnmarshalJSON(req, &r)
+	if err != nil || len(r["query"]) <= 0 ||
+		!bytes.Contains(r["query"], []byte(`"more_like_this"`)) {
+		return req, nil, nil // Parse errors are reported later.
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(r["query"]))
+	dec.UseNumber()
+
+	var q interface{}
+	err = dec.Decode(&q)
+	if err != nil {
+		return req, nil, nil
+	}
+
+	var mlts []*moreLikeThis
+
+	var visit func(v interface{}) (interface{}, error)
+
+	visit = func(v interface{}) (interface{}, error) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if _, exists := v["more_like_this"]; exists {
+				b, err := json.Marshal(v)
+				if err != nil {
+					return nil, err
+				}
+
+				var mltq MoreLikeThisQuery
+				err = UnmarshalJSON(b, &mltq)
+				if err != nil {
+					return nil, err
+				}
+
+				mlt, err := newMoreLikeThis(mltq.MoreLikeThis)
+				if err != nil {
+					return nil, err
+				}
+				mlt.boost = mltq.Boost
+
+				mlts = append(mlts, mlt)
+
+				return map[string]interface{}{
+					"ids": []string{moreLikeThisPlaceholderPrefix +
+						strconv.Itoa(len(mlts)-1)},
+				}, nil
+			}
+
+			for k, c := range v {
+				c, err := visit(c)
+				if err != nil {
+					return nil, err
+				}
+				v[k] = c
+			}
+		case []interface{}:
+			for i, c := range v {
+				c, err := visit(c)
+				if err != nil {
+					return nil, err
+				}
+				v[i] = c
+			}
+		}
+
+		return v, nil
+	}
+
+	q, err = visit(q)
+	if err != nil || len(mlts) <= 0 {
+		return req, nil, err
+	}
+
+	r["query"], err = json.Marshal(q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err = json.Marshal(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return req, mlts, nil
+}
+
+// rewriteMoreLikeThis replaces the placeholders of the more_like_this
+// queries in a parsed query with the queries for the documents like
+// their source documents.
+func rewriteMoreLikeThis(q query.Query, mlts []*moreLikeThis,
+	build func(mlt *moreLikeThis) (query.Query, error)) (query.Query, error) {
+	var visit func(q query.Query) (query.Query, error)
+
+	visit = func(q query.Query) (query.Query, error) {
+		switch q := q.(type) {
+		case *query.DocIDQuery:
+			if len(q.IDs) == 1 &&
+				strings.HasPrefix(q.IDs[0], moreLikeThisPlaceholderPrefix) {
+				i, err := strconv.Atoi(
+					q.IDs[0][len(moreLikeThisPlaceholderPrefix):])
+				if err != nil || i < 0 || i >= len(mlts) {
+					return nil, fmt.Errorf("more_like_this:"+
+						" unknown placeholder: %q", q.IDs[0])
+				}
+				return build(mlts[i])
+			}
+		case *query.ConjunctionQuery:
+			for i, c := range q.Conjuncts {
+				c, err := visit(c)
+				if err != nil {
+					return nil, err
+				}
+				q.Conjuncts[i] = c
+			}
+		case *query.DisjunctionQuery:
+			for i, c := range q.Disjuncts {
+				c, err := visit(c)
+				if err != nil {
+					return nil, err
+				}
+				q.Disjuncts[i] = c
+			}
+		case *query.BooleanQuery:
+			for _, c := range []query.Query{q.Must, q.Should, q.MustNot} {
+				if c != nil {
+					_, err := visit(c)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+
+		return q, nil
+	}
+
+	return visit(q)
+}
@@ -0,0 +1,171 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+func TestNewMoreLikeThis(t *testing.T) {
+	if _, err := newMoreLikeThis(&MoreLikeThisRequest{}); err == nil {
+		t.Errorf("expected err when id is missing")
+	}
+	if _, err := newMoreLikeThis(&MoreLikeThisRequest{
+		ID: "a", MaxTerms: -1,
+	}); err == nil {
+		t.Errorf("expected err on negative max_terms")
+	}
+
+	r := &MoreLikeThisRequest{ID: "a"}
+	mlt, err := newMoreLikeThis(r)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+	if mlt.r.MaxTerms != MoreLikeThisDefaultMaxTerms ||
+		mlt.r.MinTermFreq != 1 ||
+		mlt.r.MinDocFreq != MoreLikeThisDefaultMinDocFreq ||
+		r.MaxTerms != 0 {
+		t.Errorf("unexpected defaults: %+v, request: %+v", mlt.r, r)
+	}
+}
+
+func TestMoreLikeThisSelectTerms(t *testing.T) {
+	mlt, _ := newMoreLikeThis(&MoreLikeThisRequest{ID: "a", MaxTerms: 2})
+
+	termFreqs := map[string]map[string]int{
+		"name": {"hoppy": 2, "ale": 1, "unique": 3},
+		"desc": {"the": 5, "citrus": 1},
+	}
+	ts := &TermStats{
+		DocCount: 100,
+		Fields: map[string]map[string]uint64{
+			"name": {"hoppy": 3, "ale": 40, "unique": 1},
+			"desc": {"the": 100, "citrus": 3},
+		},
+	}
+
+	var got []string
+	for _, term := range mlt.selectTerms(termFreqs, ts) {
+		got = append(got, term.field+":"+term.term)
+	}
+
+	// unique is only in the source document, and the is in every one
+	exp := []string{"name:hoppy", "desc:citrus"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+}
+
+func TestLocalDocTermFreqs(t *testing.T) {
+	idx, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	err = idx.Index("a", map[string]interface{}{
+		"name": "Hoppy hoppy ale",
+		"desc": "citrus",
+		"abv":  5.5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := localDocTermFreqs(idx, "a", []string{"name"})
+	exp := map[string]map[string]int{
+		"name": {"hoppy": 2, "ale": 1},
+	}
+	if err != nil || !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %v, got: %v, err: %v", exp, got, err)
+	}
+
+	got, err = localDocTermFreqs(idx, "a", nil)
+	if err != nil || got["desc"]["citrus"] != 1 || len(got["abv"]) <= 0 {
+		t.Errorf("expected the terms of all fields, got: %v, err: %v", got, err)
+	}
+
+	got, err = localDocTermFreqs(idx, "nope", nil)
+	if err != nil || got != nil {
+		t.Errorf("expected nil for a missing doc, got: %v, err: %v", got, err)
+	}
+}
+
+func TestTextFieldTermFreqs(t *testing.T) {
+	m := bleve.NewIndexMapping()
+	dm := bleve.NewDocumentMapping()
+	dm.AddFieldMappingsAt("abv", bleve.NewNumericFieldMapping())
+	m.DefaultMapping = dm
+
+	termFreqs := map[string]map[string]int{
+		"name": {"hoppy": 2},
+		"abv":  {"\x00encoded": 1},
+		"_all": {"hoppy": 2},
+	}
+
+	got := textFieldTermFreqs(termFreqs, m, nil)
+	exp := map[string]map[string]int{"name": {"hoppy": 2}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+
+	got = textFieldTermFreqs(termFreqs, m, []string{"_all", "abv"})
+	exp = map[string]map[string]int{"_all": {"hoppy": 2}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+}
+
+func TestExtractMoreLikeThis(t *testing.T) {
+	req := []byte(`{"query":{"conjuncts":[{"match":"ale"},` +
+		`{"more_like_this":{"id":"a"},"boost":2}]},"size":5}`)
+
+	got, mlts, err := extractMoreLikeThis(req)
+	if err != nil || len(mlts) != 1 || mlts[0].r.ID != "a" ||
+		mlts[0].boost == nil || *mlts[0].boost != 2 {
+		t.Fatalf("expected one more_like_this, got: %+v, err: %v", mlts, err)
+	}
+
+	sr := &bleve.SearchRequest{}
+	err = UnmarshalJSON(got, sr)
+	if err != nil || sr.Size != 5 {
+		t.Fatalf("expected a parsable request, got: %s, err: %v", got, err)
+	}
+
+	q, err := rewriteMoreLikeThis(sr.Query, mlts,
+		func(mlt *moreLikeThis) (query.Query, error) {
+			return query.NewMatchNoneQuery(), nil
+		})
+	cq, ok := q.(*query.ConjunctionQuery)
+	if err != nil || !ok || len(cq.Conjuncts) != 2 {
+		t.Fatalf("expected a conjunction, got: %#v, err: %v", q, err)
+	}
+	if _, ok := cq.Conjuncts[1].(*query.MatchNoneQuery); !ok {
+		t.Errorf("expected the placeholder rewritten, got: %#v",
+			cq.Conjuncts[1])
+	}
+
+	unchanged := []byte(`{"query":{"match":"more_like_this"}}`)
+	got, mlts, err = extractMoreLikeThis(unchanged)
+	if err != nil || mlts != nil || string(got) != string(unchanged) {
+		t.Errorf("expected the request as is, got: %s, err: %v", got, err)
+	}
+
+	_, _, err = extractMoreLikeThis([]byte(`{"query":{"more_like_this":{}}}`))
+	if err == nil {
+		t.Errorf("expected err when id is missing")
+	}
+}
@@ -0,0 +1,445 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/index"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search/query"
+
+	"github.com/couchbase/cbgt"
+)
+
+// QuerySuggestDefaultFuzziness is the edit distance used for "did you
+// mean" corrections when the request doesn't specify a fuzziness.
+var QuerySuggestDefaultFuzziness = 2
+
+// QuerySuggestDefaultSize is the number of corrections returned per
+// query term, and of corrected query strings, when the request
+// doesn't specify a size.
+var QuerySuggestDefaultSize = 3
+
+// QuerySuggest defines the part of the JSON query request that asks
+// the coordinator for "did you mean" spelling corrections of the
+// query terms that few or no documents have.  A JSON'ified
+// QuerySuggestRequest looks like...
+//     {
+//        "max_hits": 0,
+//        "max_term_docs": 0,
+//        "fuzziness": 2,
+//        "size": 3
+//     }
+// The corrections are only looked up when the search has at most
+// max_hits total hits, and only for the query terms that are in at
+// most max_term_docs documents.
+type QuerySuggest struct {
+	Suggest *QuerySuggestRequest `json:"suggest,omitempty"`
+}
+
+type QuerySuggestRequest struct {
+	MaxHits     uint64 `json:"max_hits,omitempty"`
+	MaxTermDocs uint64 `json:"max_term_docs,omitempty"`
+	Fuzziness   int    `json:"fuzziness,omitempty"`
+	Size        int    `json:"size,omitempty"`
+}
+
+// QuerySuggestResult is the "suggest" section of a query response.
+// The corrected query strings are only provided for query string,
+// match and match phrase queries.
+type QuerySuggestResult struct {
+	Queries []string          `json:"queries,omitempty"`
+	Terms   []*TermCorrection `json:"terms"`
+
+	// True when SuggestMaxTerms was reached before all the terms of
+	// a field dictionary were considered.
+	Partial bool `json:"partial,omitempty"`
+}
+
+// TermCorrection holds the corrections of a query term, where Count
+// is the number of documents that have the query term.
+type TermCorrection struct {
+	Field       string        `json:"field"`
+	Term        string        `json:"term"`
+	Count       uint64        `json:"count"`
+	Suggestions []*Suggestion `json:"suggestions"`
+}
+
+// querySuggester looks up the corrections of the query terms after
+// the search, across the targets of the index alias.
+type querySuggester struct {
+	r *QuerySuggestRequest
+}
+
+func newQuerySuggester(r *QuerySuggestRequest) (*querySuggester, error) {
+	if r.Fuzziness < 0 || r.Fuzziness > SuggestMaxFuzziness {
+		return nil, fmt.Errorf("suggest: fuzziness must be between 0 and %d,"+
+			" got: %d", SuggestMaxFuzziness, r.Fuzziness)
+	}
+	if r.Size < 0 || r.Size > SuggestMaxSize {
+		return nil, fmt.Errorf("suggest: size must be between 0 and %d,"+
+			" got: %d", SuggestMaxSize, r.Size)
+	}
+
+	c := *r
+	if c.Fuzziness == 0 {
+		c.Fuzziness = QuerySuggestDefaultFuzziness
+	}
+	if c.Size == 0 {
+		c.Size = QuerySuggestDefaultSize
+	}
+
+	return &querySuggester{r: &c}, nil
+}
+
+// wanted returns true when the search had few enough hits for the
+// corrections to be looked up.
+func (s *querySuggester) wanted(searchResult *bleve.SearchResult) bool {
+	return searchResult.Total <= s.r.MaxHits
+}
+
+func (s *querySuggester) suggest(ctx context.Context, mgr *cbgt.Manager,
+	indexName string, q query.Query, alias bleve.IndexAlias) (
+	*QuerySuggestResult, error) {
+	m, err := bleveIndexMapping(mgr, indexName)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := queryFieldTerms(q, m)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := aliasTargets(alias)
+
+	ts, err := gatherTermStats(ctx, targets, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &QuerySuggestResult{Terms: []*TermCorrection{}}
+
+	fieldNames := make([]string, 0, len(fields))
+	for field := range fields {
+		fieldNames = append(fieldNames, field)
+	}
+	sort.Strings(fieldNames)
+
+	replacements := map[string]map[string][]*Suggestion{}
+
+	for _, field := range fieldNames {
+		terms := map[string]uint64{}
+		for _, term := range fields[field] {
+			if count := ts.Fields[field][term]; count <= s.r.MaxTermDocs {
+				terms[term] = count
+			}
+		}
+		if len(terms) <= 0 {
+			continue
+		}
+
+		fd, err := aliasFieldDict(ctx, targets, &FieldDictRequest{Field: field})
+		if err != nil {
+			return nil, err
+		}
+
+		corrections, partial, err := termCorrections(ctx, fd, terms,
+			s.r.Fuzziness, s.r.Size, SuggestMaxTerms)
+		fd.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		rv.Partial = rv.Partial || partial
+
+		seen := map[string]bool{}
+		for _, term := range fields[field] {
+			if _, ok := terms[term]; !ok || seen[term] {
+				continue
+			}
+			seen[term] = true
+
+			rv.Terms = append(rv.Terms, &TermCorrection{
+				Field:       field,
+				Term:        term,
+				Count:       terms[term],
+				Suggestions: corrections[term],
+			})
+
+			if len(corrections[term]) > 0 {
+				if replacements[field] == nil {
+					replacements[field] = map[string][]*Suggestion{}
+				}
+				replacements[field][term] = corrections[term]
+			}
+		}
+	}
+
+	text, analyzerName, ok := queryText(q)
+	if ok && len(replacements) > 0 {
+		rv.Queries = correctedQueries(text,
+			wordCorrections(m, analyzerName, fieldNames, replacements),
+			s.r.Size)
+	}
+
+	return rv, nil
+}
+
+// ---------------------------------------------------------
+
+// correctionWorse returns true when correction a ranks below b, by
+// edit distance, then by document frequency, then by term.
+func correctionWorse(a, b *Suggestion) bool {
+	if a.Distance != b.Distance {
+		return a.Distance > b.Distance
+	}
+	if a.Count != b.Count {
+		return a.Count < b.Count
+	}
+	return a.Term > b.Term
+}
+
+// editDistance returns the edit distance between a and b, or false
+// when that's more than max.
+func editDistance(a, b []rune, max int) (int, bool) {
+	if len(a)-len(b) > max || len(b)-len(a) > max {
+		return 0, false
+	}
+
+	row := make([]int, len(a)+1)
+	for i := range row {
+		row[i] = i
+	}
+
+	for j, r := range b {
+		diag := row[0]
+		row[0] = j + 1
+		rowMin := row[0]
+
+		for i := 1; i <= len(a); i++ {
+			cost := 1
+			if a[i-1] == r {
+				cost = 0
+			}
+			v := diag + cost
+			if row[i]+1 < v {
+				v = row[i] + 1
+			}
+			if row[i-1]+1 < v {
+				v = row[i-1] + 1
+			}
+			diag = row[i]
+			row[i] = v
+			if v < rowMin {
+				rowMin = v
+			}
+		}
+
+		if rowMin > max {
+			return 0, false
+		}
+	}
+
+	return row[len(a)], row[len(a)] <= max
+}
+
+// termCorrections scans a field's term dictionary once for the
+// corrections of several query terms, which are keyed by term with
+// values of their document counts.  A correction must be within the
+// fuzziness of the query term, and be in more documents than it.
+func termCorrections(ctx context.Context, fd index.FieldDict,
+	terms map[string]uint64, fuzziness, size, maxTerms int) (
+	map[string][]*Suggestion, bool, error) {
+	termRunes := make(map[string][]rune, len(terms))
+	for term := range terms {
+		termRunes[term] = []rune(term)
+	}
+
+	rv := map[string][]*Suggestion{}
+
+	for n := 0; ; n++ {
+		if n >= maxTerms {
+			return rv, true, nil
+		}
+
+		if n%1000 == 0 && ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+
+		entry, err := fd.Next()
+		if err != nil {
+			return nil, false, err
+		}
+		if entry == nil {
+			return rv, false, nil
+		}
+
+		var entryRunes []rune
+
+		for term, count := range terms {
+			if entry.Term == term || entry.Count <= count {
+				continue
+			}
+
+			if entryRunes == nil {
+				entryRunes = []rune(entry.Term)
+			}
+
+			distance, ok := editDistance(termRunes[term], entryRunes, fuzziness)
+			if !ok {
+				continue
+			}
+
+			s := &Suggestion{
+				Term:     entry.Term,
+				Count:    entry.Count,
+				Distance: distance,
+			}
+
+			c := rv[term]
+			if len(c) >= size {
+				if size <= 0 || !correctionWorse(c[len(c)-1], s) {
+					continue
+				}
+				c = c[:len(c)-1]
+			}
+
+			i := sort.Search(len(c), func(i int) bool {
+				return correctionWorse(c[i], s)
+			})
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = s
+
+			rv[term] = c
+		}
+	}
+}
+
+// queryText returns the text of a query string, match or match
+// phrase query, along with the analyzer that the query asks for, if
+// any, or false for other kinds of queries.
+func queryText(q query.Query) (string, string, bool) {
+	switch q := q.(type) {
+	case *query.QueryStringQuery:
+		return q.Query, "", true
+	case *query.MatchQuery:
+		return q.Match, q.Analyzer, true
+	case *query.MatchPhraseQuery:
+		return q.MatchPhrase, q.Analyzer, true
+	}
+	return "", "", false
+}
+
+// wordCorrections returns a func that looks up the corrections of a
+// word of the query text.  The corrections are keyed by field, then
+// by analyzed term, so the word is analyzed like the query terms of
+// each field were, with the field's analyzer unless the query names
+// one, and the first field that has a correction for one of the
+// word's terms wins.
+func wordCorrections(m mapping.IndexMapping, analyzerName string,
+	fields []string, replacements map[string]map[string][]*Suggestion) func(
+	word string) []*Suggestion {
+	return func(word string) []*Suggestion {
+		for _, field := range fields {
+			terms := replacements[field]
+			if len(terms) <= 0 {
+				continue
+			}
+
+			name := analyzerName
+			if name == "" {
+				name = m.AnalyzerNameForPath(field)
+			}
+			analyzer := m.AnalyzerNamed(name)
+			if analyzer == nil {
+				continue
+			}
+
+			for _, token := range analyzer.Analyze([]byte(word)) {
+				if c := terms[string(token.Term)]; len(c) > 0 {
+					return c
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// correctedQueries returns up to size corrected variants of the query
+// text, where the i'th variant replaces the words of the text that
+// have corrections with their i'th correction, or with their last one
+// when they have fewer corrections.
+func correctedQueries(text string,
+	corrections func(word string) []*Suggestion, size int) []string {
+	var rv []string
+	seen := map[string]bool{text: true}
+
+	cache := map[string][]*Suggestion{}
+
+	for i := 0; i < size; i++ {
+		corrected := replaceWords(text, func(word string) string {
+			c, ok := cache[word]
+			if !ok {
+				c = corrections(word)
+				cache[word] = c
+			}
+			if len(c) <= 0 {
+				return word
+			}
+			if i < len(c) {
+				return c[i].Term
+			}
+			return c[len(c)-1].Term
+		})
+
+		if !seen[corrected] {
+			seen[corrected] = true
+			rv = append(rv, corrected)
+		}
+	}
+
+	return rv
+}
+
+// replaceWords returns the text with each run of letters and digits
+// replaced by the result of the replace func.
+func replaceWords(text string, replace func(word string) string) string {
+	var b strings.Builder
+
+	start := -1
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			b.WriteString(replace(text[start:i]))
+			start = -1
+		}
+		b.WriteRune(r)
+	}
+	if start >= 0 {
+		b.WriteString(replace(text[start:]))
+	}
+
+	return b.String()
+}
@@ -0,0 +1,120 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/index"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b        string
+		max         int
+		expDistance int
+		expOk       bool
+	}{
+		{"wine", "wine", 0, 0, true},
+		{"wien", "wine", 2, 2, true},
+		{"wien", "wine", 1, 0, false},
+		{"beer", "beers", 1, 1, true},
+		{"beer", "be", 1, 0, false},
+		{"café", "cafe", 1, 1, true},
+		{"", "ab", 2, 2, true},
+	}
+
+	for _, test := range tests {
+		d, ok := editDistance([]rune(test.a), []rune(test.b), test.max)
+		if ok != test.expOk || (ok && d != test.expDistance) {
+			t.Errorf("test: %+v, got distance: %d, ok: %v", test, d, ok)
+		}
+	}
+}
+
+func TestTermCorrections(t *testing.T) {
+	fd := &testFieldDict{entries: []index.DictEntry{
+		{Term: "bear", Count: 2},
+		{Term: "beer", Count: 10},
+		{Term: "bier", Count: 1},
+		{Term: "wien", Count: 1},
+		{Term: "wine", Count: 20},
+		{Term: "wines", Count: 5},
+	}}
+
+	got, partial, err := termCorrections(context.Background(), fd,
+		map[string]uint64{"beir": 0, "wien": 1}, 2, 2, 100)
+	if err != nil || partial {
+		t.Fatalf("expected no err, got: %v, partial: %v", err, partial)
+	}
+
+	// bier ranks below the closer corrections of beir
+	exp := map[string][]*Suggestion{
+		"beir": {
+			{Term: "beer", Count: 10, Distance: 1},
+			{Term: "bear", Count: 2, Distance: 1},
+		},
+		"wien": {
+			{Term: "wine", Count: 20, Distance: 2},
+			{Term: "wines", Count: 5, Distance: 2},
+		},
+	}
+
+	if !reflect.DeepEqual(got, exp) {
+		for term, c := range got {
+			for _, s := range c {
+				t.Logf("term: %s, correction: %+v", term, *s)
+			}
+		}
+		t.Errorf("unexpected corrections")
+	}
+}
+
+func TestCorrectedQueries(t *testing.T) {
+	m := bleve.NewIndexMapping()
+	nameMapping := bleve.NewTextFieldMapping()
+	nameMapping.Analyzer = "keyword"
+	m.DefaultMapping.AddFieldMappingsAt("name", nameMapping)
+
+	// the corrections are keyed by the terms that each field's analyzer
+	// produced, like the lowercased terms of _all and the unchanged
+	// terms of the keyword analyzed name
+	replacements := map[string]map[string][]*Suggestion{
+		"_all": {"wien": {{Term: "wine"}, {Term: "wines"}}},
+		"name": {"Beir": {{Term: "Beer"}}},
+	}
+	fields := []string{"_all", "name"}
+
+	got := correctedQueries("Red WIEN +name:Beir",
+		wordCorrections(m, "", fields, replacements), 3)
+	exp := []string{"Red wine +name:Beer", "Red wines +name:Beer"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+
+	// a query that names its analyzer is analyzed with it for all fields
+	got = correctedQueries("Red WIEN +name:Beir",
+		wordCorrections(m, "keyword", fields, replacements), 3)
+	exp = []string{"Red WIEN +name:Beer"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+
+	got = correctedQueries("red wine",
+		wordCorrections(m, "", fields, replacements), 3)
+	if got != nil {
+		t.Errorf("expected no queries, got: %v", got)
+	}
+}
@@ -0,0 +1,1141 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/couchbase/clog"
+
+	"github.com/couchbase/cbgt"
+	"github.com/couchbase/cbgt/rest"
+)
+
+// ReindexPollInterval is how often the build progress of the shadow
+// index of a reindex is checked.
+var ReindexPollInterval = 5 * time.Second
+
+// ReindexDefaultMaxPendingMutations is the number of mutations that
+// may remain to be indexed, across all the pindexes of the shadow
+// index, for the alias to be swapped over to it, when the request
+// doesn't specify maxPendingMutations.
+var ReindexDefaultMaxPendingMutations = uint64(100)
+
+const (
+	ReindexStateBuilding  = "building"
+	ReindexStateWaiting   = "waiting" // Swapped, awaiting the old index delete.
+	ReindexStateDone      = "done"
+	ReindexStateCancelled = "cancelled"
+	ReindexStateFailed    = "failed"
+)
+
+// ReindexesCfgKey is the cfg key of the records of the latest reindex
+// of each alias, so that a reindex is resumed when the node running it
+// restarts, and can be seen and cancelled from any node.
+const ReindexesCfgKey = "reindexes"
+
+var errReindexIndexDeleted = fmt.Errorf("reindex: the index was deleted")
+
+var errReindexRunning = fmt.Errorf("reindex: already running for the alias")
+
+var errReindexNotFound = fmt.Errorf("reindex: no reindex for the alias")
+
+// ReindexRequest is the JSON request body that starts a blue/green
+// reindex of a fulltext-alias, which looks like...
+//     {
+//        "indexDef": {"params": {...}},
+//        "indexName": "beers_v2",
+//        "from": "beers_v1",
+//        "maxPendingMutations": 100,
+//        "deleteOldIndexAfter": "1h"
+//     }
+// A shadow index named indexName is created from the indexDef, whose
+// missing type, params, planParams and source fields are inherited
+// from the old index.  The shadow index must have the same source as
+// the old index.  Once the shadow index is built, the alias is
+// repointed from the old index to the shadow index, and the old index
+// is deleted after the deleteOldIndexAfter duration, if any.
+type ReindexRequest struct {
+	IndexDef *ReindexIndexDef `json:"indexDef"`
+
+	// Default is the alias name suffixed by the current unix time.
+	IndexName string `json:"indexName,omitempty"`
+
+	// The alias target to replace, which is optional when the alias
+	// has a single target.
+	From string `json:"from,omitempty"`
+
+	MaxPendingMutations *uint64 `json:"maxPendingMutations,omitempty"`
+
+	// A duration like "30m", where empty keeps the old index.
+	DeleteOldIndexAfter string `json:"deleteOldIndexAfter,omitempty"`
+}
+
+// ReindexIndexDef is the definition of the shadow index of a reindex,
+// where the params are JSON objects like in the index create request.
+type ReindexIndexDef struct {
+	Type         string           `json:"type,omitempty"`
+	Params       json.RawMessage  `json:"params,omitempty"`
+	PlanParams   *cbgt.PlanParams `json:"planParams,omitempty"`
+	SourceType   string           `json:"sourceType,omitempty"`
+	SourceName   string           `json:"sourceName,omitempty"`
+	SourceUUID   string           `json:"sourceUUID,omitempty"`
+	SourceParams json.RawMessage  `json:"sourceParams,omitempty"`
+}
+
+// ReindexProgress is the build progress of the shadow index, totalled
+// across the nodes of the cluster, where the pindexes of each replica
+// are counted.
+type ReindexProgress struct {
+	PendingMutations  uint64 `json:"pendingMutations"`
+	NumPIndexes       int    `json:"numPIndexes"`
+	NumPIndexesTarget int    `json:"numPIndexesTarget"`
+
+	// True when a node with pindexes of the shadow index did not yet
+	// report its pending mutations.
+	Unknown bool `json:"unknown,omitempty"`
+}
+
+// built returns true when all the planned pindexes of the shadow
+// index, including the replicas, are running and have at most maxPending mutations left.
+func (p *ReindexProgress) built(maxPending uint64) bool {
+	return p.NumPIndexesTarget > 0 &&
+		p.NumPIndexes >= p.NumPIndexesTarget &&
+		!p.Unknown &&
+		p.PendingMutations <= maxPending
+}
+
+// add totals the nsstats of the shadow index from a node, where
+// needSeqs is true when the index's source reports its partition
+// seqs, so that the node has a num_mutations_to_index stat.
+func (p *ReindexProgress) add(nsIndexStat map[string]interface{},
+	needSeqs bool) {
+	n, _ := nsIndexStat["num_pindexes_actual"].(float64)
+	if n <= 0 {
+		return
+	}
+	p.NumPIndexes += int(n)
+
+	pending, ok := nsIndexStat["num_mutations_to_index"].(float64)
+	if !ok {
+		p.Unknown = p.Unknown || needSeqs
+		return
+	}
+	p.PendingMutations += uint64(pending)
+}
+
+// ReindexStatus is the JSON response of the reindex REST endpoints.
+type ReindexStatus struct {
+	Alias    string          `json:"alias"`
+	From     string          `json:"from"`
+	To       string          `json:"to"`
+	State    string          `json:"state"`
+	Swapped  bool            `json:"swapped"`
+	Progress ReindexProgress `json:"progress"`
+	Err      string          `json:"err,omitempty"`
+
+	StartTime  time.Time `json:"startTime"`
+	UpdateTime time.Time `json:"updateTime"`
+}
+
+// ---------------------------------------------------------
+
+// reindex is a blue/green reindex of a fulltext-alias, which runs on
+// the node that received the request, or that resumed it on restart.
+type reindex struct {
+	mgr         *cbgt.Manager
+	def         *cbgt.IndexDef // Of the shadow index, without a UUID.
+	fromUUID    string
+	maxPending  uint64
+	deleteAfter time.Duration
+	needSeqs    bool
+
+	// Overridable for testability.
+	progress func(ctx context.Context) (*ReindexProgress, error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	doneCh chan struct{}
+
+	m        sync.Mutex
+	toUUID   string
+	swapTime time.Time
+	status   ReindexStatus
+}
+
+// reindexRecord is the cfg record of a reindex.  A cancel requested on
+// another node is seen by the running node as it polls the record.
+type reindexRecord struct {
+	NodeUUID        string         `json:"nodeUUID"` // Of the running node.
+	Def             *cbgt.IndexDef `json:"def"`
+	FromUUID        string         `json:"fromUUID"`
+	ToUUID          string         `json:"toUUID,omitempty"`
+	MaxPending      uint64         `json:"maxPending"`
+	DeleteAfter     time.Duration  `json:"deleteAfter,omitempty"`
+	NeedSeqs        bool           `json:"needSeqs,omitempty"`
+	SwapTime        time.Time      `json:"swapTime"`
+	CancelRequested bool           `json:"cancelRequested,omitempty"`
+	Status          ReindexStatus  `json:"status"`
+}
+
+func (rec *reindexRecord) running() bool {
+	return rec.Status.State == ReindexStateBuilding ||
+		rec.Status.State == ReindexStateWaiting
+}
+
+func newReindex(mgr *cbgt.Manager, aliasName string,
+	r *ReindexRequest) (*reindex, error) {
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err != nil {
+		return nil, err
+	}
+
+	aliasDef := indexDefsByName[aliasName]
+	if aliasDef == nil || aliasDef.Type != "fulltext-alias" {
+		return nil, fmt.Errorf("reindex: not a fulltext-alias: %s", aliasName)
+	}
+
+	params, err := parseAliasParams(aliasDef.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	from := r.From
+	if from == "" {
+		if len(params.Targets) != 1 {
+			return nil, fmt.Errorf("reindex: from is required, as the alias"+
+				" has %d targets", len(params.Targets))
+		}
+		for targetName := range params.Targets {
+			from = targetName
+		}
+	}
+	if _, ok := params.Targets[from]; !ok {
+		return nil, fmt.Errorf("reindex: the alias does not target: %s", from)
+	}
+
+	fromDef := indexDefsByName[from]
+	if fromDef == nil || !strings.HasPrefix(fromDef.Type, "fulltext-index") {
+		return nil, fmt.Errorf("reindex: not a fulltext-index: %s", from)
+	}
+
+	if r.IndexDef == nil {
+		return nil, fmt.Errorf("reindex: indexDef is required")
+	}
+
+	def := &cbgt.IndexDef{
+		Type:         r.IndexDef.Type,
+		Name:         r.IndexName,
+		Params:       string(r.IndexDef.Params),
+		SourceType:   r.IndexDef.SourceType,
+		SourceName:   r.IndexDef.SourceName,
+		SourceUUID:   r.IndexDef.SourceUUID,
+		SourceParams: string(r.IndexDef.SourceParams),
+	}
+	if def.Name == "" {
+		def.Name = aliasName + "_" + strconv.FormatInt(time.Now().Unix(), 10)
+	}
+	if indexDefsByName[def.Name] != nil {
+		return nil, fmt.Errorf("reindex: index already exists: %s", def.Name)
+	}
+	if def.Type == "" {
+		def.Type = fromDef.Type
+	}
+	if !strings.HasPrefix(def.Type, "fulltext-index") {
+		return nil, fmt.Errorf("reindex: not a fulltext-index type: %s",
+			def.Type)
+	}
+	if def.Params == "" {
+		def.Params = fromDef.Params
+	}
+	if r.IndexDef.PlanParams != nil {
+		def.PlanParams = *r.IndexDef.PlanParams
+	} else {
+		def.PlanParams = fromDef.PlanParams
+	}
+	if def.SourceName == "" {
+		def.SourceType = fromDef.SourceType
+		def.SourceName = fromDef.SourceName
+		def.SourceUUID = fromDef.SourceUUID
+		def.SourceParams = fromDef.SourceParams
+	}
+	if def.SourceType == "" {
+		def.SourceType = fromDef.SourceType
+	}
+	if def.SourceType != fromDef.SourceType ||
+		def.SourceName != fromDef.SourceName {
+		return nil, fmt.Errorf("reindex: the source of the new index,"+
+			" sourceName: %s, must be the same as the source of %s,"+
+			" sourceName: %s", def.SourceName, from, fromDef.SourceName)
+	}
+
+	maxPending := ReindexDefaultMaxPendingMutations
+	if r.MaxPendingMutations != nil {
+		maxPending = *r.MaxPendingMutations
+	}
+
+	var deleteAfter time.Duration
+	if r.DeleteOldIndexAfter != "" {
+		deleteAfter, err = time.ParseDuration(r.DeleteOldIndexAfter)
+		if err != nil || deleteAfter <= 0 {
+			return nil, fmt.Errorf("reindex: invalid deleteOldIndexAfter: %q",
+				r.DeleteOldIndexAfter)
+		}
+	}
+
+	feedType := cbgt.FeedTypes[def.SourceType]
+
+	now := time.Now()
+
+	return newReindexFromRecord(mgr, &reindexRecord{
+		NodeUUID:    mgr.UUID(),
+		Def:         def,
+		FromUUID:    fromDef.UUID,
+		MaxPending:  maxPending,
+		DeleteAfter: deleteAfter,
+		NeedSeqs:    feedType != nil && feedType.PartitionSeqs != nil,
+		Status: ReindexStatus{
+			Alias:      aliasName,
+			From:       from,
+			To:         def.Name,
+			State:      ReindexStateBuilding,
+			StartTime:  now,
+			UpdateTime: now,
+		},
+	}), nil
+}
+
+// newReindexFromRecord returns a reindex that's cancellable right away,
+// before it's started or resumed.
+func newReindexFromRecord(mgr *cbgt.Manager, rec *reindexRecord) *reindex {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ri := &reindex{
+		mgr:         mgr,
+		def:         rec.Def,
+		fromUUID:    rec.FromUUID,
+		maxPending:  rec.MaxPending,
+		deleteAfter: rec.DeleteAfter,
+		needSeqs:    rec.NeedSeqs,
+		ctx:         ctx,
+		cancel:      cancel,
+		doneCh:      make(chan struct{}),
+		toUUID:      rec.ToUUID,
+		swapTime:    rec.SwapTime,
+		status:      rec.Status,
+	}
+	ri.progress = ri.clusterProgress
+
+	return ri
+}
+
+func (ri *reindex) record() *reindexRecord {
+	ri.m.Lock()
+	defer ri.m.Unlock()
+
+	return &reindexRecord{
+		NodeUUID:    ri.mgr.UUID(),
+		Def:         ri.def,
+		FromUUID:    ri.fromUUID,
+		ToUUID:      ri.toUUID,
+		MaxPending:  ri.maxPending,
+		DeleteAfter: ri.deleteAfter,
+		NeedSeqs:    ri.needSeqs,
+		SwapTime:    ri.swapTime,
+		Status:      ri.status,
+	}
+}
+
+// isFor returns true when the record is of the reindex.
+func (rec *reindexRecord) isFor(ri *reindex) bool {
+	return rec != nil && rec.Def != nil && rec.Def.Name == ri.def.Name &&
+		rec.NodeUUID == ri.mgr.UUID()
+}
+
+// save updates the cfg record of the reindex, keeping any cancel
+// request, where errors are only logged, as the reindex carries on.
+func (ri *reindex) save() {
+	rec := ri.record()
+
+	err := cfgUpdateReindexes(ri.mgr.Cfg(),
+		func(recs map[string]*reindexRecord) error {
+			if prev := recs[rec.Status.Alias]; prev.isFor(ri) {
+				rec.CancelRequested = prev.CancelRequested
+			}
+			recs[rec.Status.Alias] = rec
+			return nil
+		})
+	if err != nil {
+		log.Warnf("reindex: could not save, alias: %s, to: %s, err: %v",
+			rec.Status.Alias, rec.Status.To, err)
+	}
+}
+
+// cancelRequested returns true when the reindex was cancelled from
+// another node, through its cfg record.
+func (ri *reindex) cancelRequested() bool {
+	recs, _, err := cfgGetReindexes(ri.mgr.Cfg())
+	if err != nil {
+		return false
+	}
+	rec := recs[ri.status.Alias]
+	return rec.isFor(ri) && rec.CancelRequested
+}
+
+// start creates the shadow index and then builds, swaps and deletes
+// in the background.
+func (ri *reindex) start() error {
+	def := ri.def
+
+	err := ri.mgr.CreateIndex(def.SourceType, def.SourceName,
+		def.SourceUUID, def.SourceParams, def.Type, def.Name,
+		def.Params, def.PlanParams, "")
+	if err != nil {
+		err = fmt.Errorf("reindex: could not create index: %s, err: %v",
+			def.Name, err)
+		ri.finish(err)
+		close(ri.doneCh)
+		return err
+	}
+
+	_, indexDefsByName, err := ri.mgr.GetIndexDefs(true)
+	if err == nil && indexDefsByName[def.Name] == nil {
+		err = errReindexIndexDeleted
+	}
+	if err != nil {
+		ri.finish(err)
+		close(ri.doneCh)
+		return err
+	}
+
+	ri.m.Lock()
+	ri.toUUID = indexDefsByName[def.Name].UUID
+	ri.m.Unlock()
+
+	ri.save()
+
+	go ri.run()
+
+	return nil
+}
+
+// run builds and swaps, unless a resumed reindex already swapped, and
+// then deletes the old index.
+func (ri *reindex) run() {
+	defer close(ri.doneCh)
+
+	ri.m.Lock()
+	swapped := ri.status.Swapped
+	ri.m.Unlock()
+
+	var err error
+	if !swapped {
+		err = ri.waitBuilt(ri.ctx)
+		if err == nil {
+			err = ri.swap()
+		}
+	}
+	if err == nil && ri.deleteAfter > 0 {
+		ri.setState(ReindexStateWaiting)
+		err = ri.deleteOld(ri.ctx)
+	}
+
+	ri.finish(err)
+}
+
+// stop cancels the reindex and waits for it to finish.  Before the
+// swap, the shadow index is deleted.  After the swap, the old index is
+// no longer deleted.
+func (ri *reindex) stop() {
+	ri.cancel()
+	<-ri.doneCh
+}
+
+func (ri *reindex) finish(err error) {
+	ri.m.Lock()
+	swapped := ri.status.Swapped
+	ri.m.Unlock()
+
+	state := ReindexStateDone
+	if err == context.Canceled {
+		state = ReindexStateCancelled
+		err = nil
+
+		if !swapped {
+			err = ri.mgr.DeleteIndex(ri.def.Name)
+		}
+	} else if err != nil {
+		state = ReindexStateFailed
+	}
+
+	if err != nil {
+		log.Warnf("reindex: alias: %s, from: %s, to: %s, err: %v",
+			ri.status.Alias, ri.status.From, ri.status.To, err)
+	}
+
+	ri.m.Lock()
+	ri.status.State = state
+	if err != nil {
+		ri.status.Err = err.Error()
+	}
+	ri.status.UpdateTime = time.Now()
+	ri.m.Unlock()
+
+	ri.save()
+}
+
+func (ri *reindex) setState(state string) {
+	ri.m.Lock()
+	ri.status.State = state
+	ri.status.UpdateTime = time.Now()
+	ri.m.Unlock()
+
+	ri.save()
+}
+
+func (ri *reindex) getStatus() ReindexStatus {
+	ri.m.Lock()
+	rv := ri.status
+	ri.m.Unlock()
+	return rv
+}
+
+func (ri *reindex) finished() bool {
+	select {
+	case <-ri.doneCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitBuilt polls the build progress of the shadow index until it's
+// built, where errors other than the index being deleted are retried.
+func (ri *reindex) waitBuilt(ctx context.Context) error {
+	ticker := time.NewTicker(ReindexPollInterval)
+	defer ticker.Stop()
+
+	for {
+		p, err := ri.progress(ctx)
+		if err == errReindexIndexDeleted {
+			return err
+		}
+
+		ri.m.Lock()
+		if err != nil {
+			ri.status.Err = err.Error()
+		} else {
+			ri.status.Progress = *p
+			ri.status.Err = ""
+		}
+		ri.status.UpdateTime = time.Now()
+		ri.m.Unlock()
+
+		if err == nil && p.built(ri.maxPending) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		if ri.cancelRequested() {
+			return context.Canceled
+		}
+	}
+}
+
+// clusterProgress totals the nsstats of the shadow index across the
+// wanted nodes of the cluster.
+func (ri *reindex) clusterProgress(ctx context.Context) (
+	*ReindexProgress, error) {
+	ri.m.Lock()
+	toUUID := ri.toUUID
+	ri.m.Unlock()
+
+	_, indexDefsByName, err := ri.mgr.GetIndexDefs(false)
+	if err != nil {
+		return nil, err
+	}
+	indexDef := indexDefsByName[ri.def.Name]
+	if indexDef == nil || indexDef.UUID != toUUID {
+		return nil, errReindexIndexDeleted
+	}
+
+	planPIndexes, _, err := ri.mgr.GetPlanPIndexes(false)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &ReindexProgress{
+		NumPIndexesTarget: numPlannedPIndexes(planPIndexes, indexDef),
+	}
+
+	nodeDefs, _, err := cbgt.CfgGetNodeDefs(ri.mgr.Cfg(),
+		cbgt.NODE_DEFS_WANTED)
+	if err != nil {
+		return nil, err
+	}
+	if nodeDefs == nil {
+		return nil, fmt.Errorf("reindex: no nodeDefs")
+	}
+
+	statKey := indexDef.SourceName + ":" + indexDef.Name
+
+	for _, nodeDef := range nodeDefs.NodeDefs {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		nsStats, err := ri.nodeNsStats(nodeDef)
+		if err != nil {
+			return nil, err
+		}
+
+		nsIndexStat, _ := nsStats[statKey].(map[string]interface{})
+		rv.add(nsIndexStat, ri.needSeqs)
+	}
+
+	return rv, nil
+}
+
+// numPlannedPIndexes returns the number of pindexes of an index that
+// are planned across the nodes, counting each replica, to match the
+// num_pindexes_actual stats of the nodes.
+func numPlannedPIndexes(planPIndexes *cbgt.PlanPIndexes,
+	indexDef *cbgt.IndexDef) int {
+	rv := 0
+	if planPIndexes != nil {
+		for _, planPIndex := range planPIndexes.PlanPIndexes {
+			if planPIndex.IndexName == indexDef.Name &&
+				planPIndex.IndexUUID == indexDef.UUID {
+				rv += len(planPIndex.Nodes)
+			}
+		}
+	}
+	return rv
+}
+
+func (ri *reindex) nodeNsStats(nodeDef *cbgt.NodeDef) (
+	map[string]interface{}, error) {
+	hostPort, proto, _, ok := remoteNodeHostPort(nodeDef)
+	if !ok {
+		return nil, fmt.Errorf("reindex: no hostPort for node: %s",
+			nodeDef.UUID)
+	}
+
+	urlStr := proto + hostPort + ri.mgr.Options()["urlPrefix"] +
+		"/api/nsstats"
+
+	u, err := UrlWithAuth(ri.mgr.Options()["authType"], urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := HttpGet(HttpClient, u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBuf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reindex: nsstats got status code: %d,"+
+			" url: %s, respBuf: %s", resp.StatusCode, urlStr, respBuf)
+	}
+
+	var rv map[string]interface{}
+	err = UnmarshalJSON(respBuf, &rv)
+	if err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+// swap repoints the alias from the old index to the shadow index, in
+// a single cfg update that fails if the alias was concurrently
+// changed.
+func (ri *reindex) swap() error {
+	ri.m.Lock()
+	toUUID := ri.toUUID
+	ri.m.Unlock()
+
+	err := swapAliasTarget(ri.mgr, ri.status.Alias,
+		ri.status.From, ri.def.Name, toUUID)
+	if err != nil {
+		return err
+	}
+
+	ri.m.Lock()
+	ri.status.Swapped = true
+	ri.status.UpdateTime = time.Now()
+	ri.swapTime = ri.status.UpdateTime
+	ri.m.Unlock()
+
+	ri.save()
+
+	return nil
+}
+
+// swapAliasTarget replaces the from target of an alias with the to
+// index, keeping the from target's spec.  The to index's UUID is only
+// pinned when the from target's UUID was.
+func swapAliasTarget(mgr *cbgt.Manager, aliasName, from, to,
+	toUUID string) error {
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return err
+	}
+
+	aliasDef := indexDefsByName[aliasName]
+	if aliasDef == nil || aliasDef.Type != "fulltext-alias" {
+		return fmt.Errorf("reindex: not a fulltext-alias: %s", aliasName)
+	}
+
+	params, err := parseAliasParams(aliasDef.Params)
+	if err != nil {
+		return err
+	}
+
+	fromSpec, ok := params.Targets[from]
+	if !ok {
+		return fmt.Errorf("reindex: the alias no longer targets: %s", from)
+	}
+
+	toSpec := AliasParamsTarget{}
+	if fromSpec != nil {
+		toSpec = *fromSpec
+	}
+	if toSpec.IndexUUID != "" {
+		toSpec.IndexUUID = toUUID
+	}
+
+	delete(params.Targets, from)
+	params.Targets[to] = &toSpec
+
+	buf, err := MarshalJSON(params)
+	if err != nil {
+		return err
+	}
+
+	return mgr.CreateIndex(aliasDef.SourceType, aliasDef.SourceName,
+		aliasDef.SourceUUID, aliasDef.SourceParams, aliasDef.Type,
+		aliasDef.Name, string(buf), aliasDef.PlanParams, aliasDef.UUID)
+}
+
+// deleteOld deletes the old index after the grace period from the
+// swap, unless it was recreated or is still a target of another alias.
+func (ri *reindex) deleteOld(ctx context.Context) error {
+	ri.m.Lock()
+	deleteTime := ri.swapTime.Add(ri.deleteAfter)
+	ri.m.Unlock()
+
+	ticker := time.NewTicker(ReindexPollInterval)
+	defer ticker.Stop()
+
+	for time.Now().Before(deleteTime) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		if ri.cancelRequested() {
+			return context.Canceled
+		}
+	}
+
+	from := ri.status.From
+
+	_, indexDefsByName, err := ri.mgr.GetIndexDefs(true)
+	if err != nil {
+		return err
+	}
+
+	fromDef := indexDefsByName[from]
+	if fromDef == nil || fromDef.UUID != ri.fromUUID {
+		return nil // Already deleted.
+	}
+
+	if aliases := aliasesTargeting(indexDefsByName, from); len(aliases) > 0 {
+		return fmt.Errorf("reindex: not deleting index: %s,"+
+			" which is a target of aliases: %v", from, aliases)
+	}
+
+	return ri.mgr.DeleteIndex(from)
+}
+
+// aliasesTargeting returns the names of the aliases that directly
+// target an index.
+func aliasesTargeting(indexDefsByName map[string]*cbgt.IndexDef,
+	indexName string) []string {
+	var rv []string
+	for name, indexDef := range indexDefsByName {
+		if indexDef == nil || indexDef.Type != "fulltext-alias" {
+			continue
+		}
+		params, err := parseAliasParams(indexDef.Params)
+		if err != nil {
+			continue
+		}
+		if _, ok := params.Targets[indexName]; ok {
+			rv = append(rv, name)
+		}
+	}
+	return rv
+}
+
+// ---------------------------------------------------------
+
+// cfgGetReindexes returns the cfg records of the reindexes, keyed by
+// alias name.
+func cfgGetReindexes(cfg cbgt.Cfg) (map[string]*reindexRecord, uint64, error) {
+	v, cas, err := cfg.Get(ReindexesCfgKey, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rv := map[string]*reindexRecord{}
+	if len(v) > 0 {
+		err = UnmarshalJSON(v, &rv)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return rv, cas, nil
+}
+
+// cfgUpdateReindexes applies an update to the cfg records of the
+// reindexes, retrying on concurrent cfg changes.
+func cfgUpdateReindexes(cfg cbgt.Cfg,
+	update func(recs map[string]*reindexRecord) error) error {
+	for i := 0; i < 100; i++ {
+		recs, cas, err := cfgGetReindexes(cfg)
+		if err != nil {
+			return err
+		}
+
+		err = update(recs)
+		if err != nil {
+			return err
+		}
+
+		buf, err := MarshalJSON(recs)
+		if err != nil {
+			return err
+		}
+
+		_, err = cfg.Set(ReindexesCfgKey, buf, cas)
+		if _, ok := err.(*cbgt.CfgCASError); ok {
+			continue
+		}
+
+		return err
+	}
+
+	return fmt.Errorf("reindex: too many concurrent cfg updates")
+}
+
+// ---------------------------------------------------------
+
+// reindexRegistry tracks the reindexes that run on this node, keyed by
+// alias name, while the cfg records track them across the cluster.
+type reindexRegistry struct {
+	m         sync.Mutex
+	reindexes map[string]*reindex // Keyed by alias name.
+}
+
+var reindexes = &reindexRegistry{reindexes: map[string]*reindex{}}
+
+// add registers a reindex, unless the alias has one that's running on
+// any node.
+func (rr *reindexRegistry) add(ri *reindex) error {
+	rr.m.Lock()
+	defer rr.m.Unlock()
+
+	rec := ri.record()
+
+	err := cfgUpdateReindexes(ri.mgr.Cfg(),
+		func(recs map[string]*reindexRecord) error {
+			if prev := recs[rec.Status.Alias]; prev != nil && prev.running() {
+				return errReindexRunning
+			}
+			recs[rec.Status.Alias] = rec
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	rr.reindexes[rec.Status.Alias] = ri
+
+	return nil
+}
+
+// get returns the reindex of an alias that this node runs, or ran,
+// when it's the reindex of the cfg record.
+func (rr *reindexRegistry) get(alias string,
+	rec *reindexRecord) *reindex {
+	rr.m.Lock()
+	defer rr.m.Unlock()
+
+	ri := rr.reindexes[alias]
+	if ri != nil && rec.isFor(ri) {
+		return ri
+	}
+	return nil
+}
+
+// StartReindexes resumes the reindexes that were running on this node
+// before it restarted, from their cfg records.
+func StartReindexes(mgr *cbgt.Manager) error {
+	recs, _, err := cfgGetReindexes(mgr.Cfg())
+	if err != nil {
+		return err
+	}
+
+	for alias, rec := range recs {
+		if rec.NodeUUID != mgr.UUID() || rec.Def == nil || !rec.running() {
+			continue
+		}
+
+		if rec.ToUUID == "" {
+			// The node restarted as the shadow index was created.
+			_, indexDefsByName, err := mgr.GetIndexDefs(false)
+			if err != nil {
+				return err
+			}
+			if toDef := indexDefsByName[rec.Def.Name]; toDef != nil {
+				rec.ToUUID = toDef.UUID
+			}
+		}
+
+		log.Printf("reindex: resuming, alias: %s, from: %s, to: %s,"+
+			" state: %s", alias, rec.Status.From, rec.Status.To,
+			rec.Status.State)
+
+		ri := newReindexFromRecord(mgr, rec)
+
+		reindexes.m.Lock()
+		reindexes.reindexes[alias] = ri
+		reindexes.m.Unlock()
+
+		go ri.run()
+	}
+
+	return nil
+}
+
+// cancelReindexRecord cancels a reindex that runs on another node, by
+// requesting the cancel in its cfg record.  When that node is no
+// longer in the cluster, the reindex is cancelled here instead, where
+// the shadow index is deleted if the alias was not yet swapped.
+func cancelReindexRecord(mgr *cbgt.Manager, alias string) (
+	*ReindexStatus, error) {
+	nodeDefs, _, err := cbgt.CfgGetNodeDefs(mgr.Cfg(), cbgt.NODE_DEFS_WANTED)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv ReindexStatus
+	var toDelete string
+
+	err = cfgUpdateReindexes(mgr.Cfg(),
+		func(recs map[string]*reindexRecord) error {
+			rec := recs[alias]
+			if rec == nil || rec.Def == nil {
+				return errReindexNotFound
+			}
+
+			toDelete = ""
+
+			if rec.running() {
+				if nodeDefs != nil && nodeDefs.NodeDefs[rec.NodeUUID] != nil {
+					rec.CancelRequested = true
+				} else {
+					if !rec.Status.Swapped {
+						toDelete = rec.Def.Name
+					}
+					rec.Status.State = ReindexStateCancelled
+					rec.Status.UpdateTime = time.Now()
+				}
+			}
+
+			rv = rec.Status
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	if toDelete != "" {
+		err = mgr.DeleteIndex(toDelete)
+		if err != nil {
+			log.Warnf("reindex: could not delete index: %s, alias: %s,"+
+				" err: %v", toDelete, alias, err)
+		}
+	}
+
+	return &rv, nil
+}
+
+// ---------------------------------------------------------
+
+// ReindexHandler is a REST handler that starts a blue/green reindex
+// of a fulltext-alias.
+type ReindexHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewReindexHandler(mgr *cbgt.Manager) *ReindexHandler {
+	return &ReindexHandler{mgr: mgr}
+}
+
+func (h *ReindexHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	var r ReindexRequest
+	aliasName, ok := readInternalRequest(w, req, &r)
+	if !ok {
+		return
+	}
+
+	ri, err := newReindex(h.mgr, aliasName, &r)
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = reindexes.add(ri)
+	if err == errReindexRunning {
+		rest.ShowError(w, req, fmt.Sprintf("%v, alias: %s", err, aliasName),
+			http.StatusConflict)
+		return
+	}
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = ri.start()
+	if err != nil {
+		rest.ShowError(w, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rest.MustEncode(w, ri.getStatus())
+}
+
+// ReindexStatusHandler is a REST handler that reports the status of
+// the latest reindex of a fulltext-alias.  The build progress is
+// reported live by the node that runs the reindex, and as of the
+// latest state change by the other nodes.
+type ReindexStatusHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewReindexStatusHandler(mgr *cbgt.Manager) *ReindexStatusHandler {
+	return &ReindexStatusHandler{mgr: mgr}
+}
+
+func (h *ReindexStatusHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	aliasName, rec := reindexLookup(h.mgr, w, req)
+	if rec == nil {
+		return
+	}
+
+	if ri := reindexes.get(aliasName, rec); ri != nil {
+		rest.MustEncode(w, ri.getStatus())
+		return
+	}
+
+	rest.MustEncode(w, rec.Status)
+}
+
+// ReindexCancelHandler is a REST handler that cancels the running
+// reindex of a fulltext-alias.  A reindex that runs on another node is
+// cancelled asynchronously, as that node sees the cancel request.
+type ReindexCancelHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewReindexCancelHandler(mgr *cbgt.Manager) *ReindexCancelHandler {
+	return &ReindexCancelHandler{mgr: mgr}
+}
+
+func (h *ReindexCancelHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	aliasName, rec := reindexLookup(h.mgr, w, req)
+	if rec == nil {
+		return
+	}
+
+	if ri := reindexes.get(aliasName, rec); ri != nil {
+		ri.stop()
+		rest.MustEncode(w, ri.getStatus())
+		return
+	}
+
+	status, err := cancelReindexRecord(h.mgr, aliasName)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("reindex: could not cancel,"+
+			" alias: %s, err: %v", aliasName, err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	rest.MustEncode(w, status)
+}
+
+// reindexLookup returns the cfg record of the latest reindex of the
+// requested alias.
+func reindexLookup(mgr *cbgt.Manager, w http.ResponseWriter,
+	req *http.Request) (string, *reindexRecord) {
+	aliasName := rest.IndexNameLookup(req)
+	if aliasName == "" {
+		rest.ShowError(w, req, "index name is required",
+			http.StatusBadRequest)
+		return "", nil
+	}
+
+	recs, _, err := cfgGetReindexes(mgr.Cfg())
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("reindex: could not get reindexes,"+
+			" err: %v", err), http.StatusInternalServerError)
+		return "", nil
+	}
+
+	rec := recs[aliasName]
+	if rec == nil || rec.Def == nil {
+		rest.ShowError(w, req, fmt.Sprintf("%v, alias: %s",
+			errReindexNotFound, aliasName), http.StatusNotFound)
+		return "", nil
+	}
+
+	return aliasName, rec
+}
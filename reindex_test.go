@@ -0,0 +1,351 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/couchbase/cbgt"
+)
+
+func TestReindexProgress(t *testing.T) {
+	p := &ReindexProgress{NumPIndexesTarget: 3}
+	p.add(nil, true)
+	p.add(map[string]interface{}{
+		"num_pindexes_actual":    float64(2),
+		"num_mutations_to_index": float64(50),
+	}, true)
+	if p.built(100) {
+		t.Errorf("expected not built with missing pindexes, got: %+v", p)
+	}
+
+	p.add(map[string]interface{}{
+		"num_pindexes_actual": float64(1),
+	}, true)
+	if !p.Unknown || p.built(100) {
+		t.Errorf("expected unknown progress, got: %+v", p)
+	}
+
+	p = &ReindexProgress{NumPIndexesTarget: 3}
+	p.add(map[string]interface{}{
+		"num_pindexes_actual":    float64(3),
+		"num_mutations_to_index": float64(50),
+	}, true)
+	if p.PendingMutations != 50 || !p.built(100) || p.built(10) {
+		t.Errorf("expected built with 50 pending, got: %+v", p)
+	}
+
+	p = &ReindexProgress{NumPIndexesTarget: 1}
+	p.add(map[string]interface{}{
+		"num_pindexes_actual": float64(1),
+	}, false)
+	if !p.built(0) {
+		t.Errorf("expected built without partition seqs, got: %+v", p)
+	}
+}
+
+func testReindexManager(t *testing.T) *cbgt.Manager {
+	mgr := cbgt.NewManager(cbgt.VERSION, cbgt.NewCfgMem(), cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", "", "some-datasource", nil)
+
+	err := mgr.CreateIndex("primary", "sourceName", "sourceUUID", "",
+		"fulltext-index", "foo", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+
+	err = mgr.CreateIndex("nil", "", "", "",
+		"fulltext-alias", "alias", `{"targets":{"foo":{}}}`,
+		cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndex() of alias to work, err: %v", err)
+	}
+
+	return mgr
+}
+
+func testAliasTargets(t *testing.T,
+	mgr *cbgt.Manager) map[string]*AliasParamsTarget {
+	_, indexDefsByName, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		t.Fatalf("expected GetIndexDefs() to work, err: %v", err)
+	}
+	params, err := parseAliasParams(indexDefsByName["alias"].Params)
+	if err != nil {
+		t.Fatalf("expected alias params, err: %v", err)
+	}
+	return params.Targets
+}
+
+func TestNewReindex(t *testing.T) {
+	mgr := testReindexManager(t)
+
+	tests := []struct {
+		alias string
+		r     *ReindexRequest
+	}{
+		{"foo", &ReindexRequest{IndexDef: &ReindexIndexDef{}}},
+		{"alias", &ReindexRequest{}},
+		{"alias", &ReindexRequest{IndexDef: &ReindexIndexDef{}, From: "bar"}},
+		{"alias", &ReindexRequest{IndexDef: &ReindexIndexDef{},
+			IndexName: "foo"}},
+		{"alias", &ReindexRequest{IndexDef: &ReindexIndexDef{
+			SourceName: "otherSourceName"}}},
+		{"alias", &ReindexRequest{IndexDef: &ReindexIndexDef{},
+			DeleteOldIndexAfter: "soon"}},
+	}
+
+	for i, test := range tests {
+		_, err := newReindex(mgr, test.alias, test.r)
+		if err == nil {
+			t.Errorf("%d: expected err, r: %+v", i, test.r)
+		}
+	}
+
+	ri, err := newReindex(mgr, "alias", &ReindexRequest{
+		IndexDef:            &ReindexIndexDef{},
+		IndexName:           "bar",
+		DeleteOldIndexAfter: "1h",
+	})
+	if err != nil {
+		t.Fatalf("expected newReindex() to work, err: %v", err)
+	}
+	if ri.status.From != "foo" || ri.status.To != "bar" ||
+		ri.def.SourceName != "sourceName" ||
+		ri.def.Type != "fulltext-index" ||
+		ri.deleteAfter != time.Hour ||
+		ri.maxPending != ReindexDefaultMaxPendingMutations {
+		t.Errorf("unexpected reindex, status: %+v, def: %+v",
+			ri.status, ri.def)
+	}
+}
+
+func TestSwapAliasTarget(t *testing.T) {
+	mgr := testReindexManager(t)
+
+	err := swapAliasTarget(mgr, "alias", "bar", "baz", "bazUUID")
+	if err == nil {
+		t.Errorf("expected err when the alias doesn't target bar")
+	}
+
+	err = swapAliasTarget(mgr, "alias", "foo", "bar", "barUUID")
+	if err != nil {
+		t.Fatalf("expected swapAliasTarget() to work, err: %v", err)
+	}
+
+	targets := testAliasTargets(t, mgr)
+	if len(targets) != 1 || targets["bar"] == nil ||
+		targets["bar"].IndexUUID != "" {
+		t.Errorf("expected unpinned bar target, got: %+v", targets)
+	}
+}
+
+func TestReindexRun(t *testing.T) {
+	defer func(d time.Duration) { ReindexPollInterval = d }(ReindexPollInterval)
+	ReindexPollInterval = time.Millisecond
+
+	// A cancelled reindex deletes the shadow index.
+	mgr := testReindexManager(t)
+
+	ri, err := newReindex(mgr, "alias", &ReindexRequest{
+		IndexDef:  &ReindexIndexDef{},
+		IndexName: "bar",
+	})
+	if err != nil {
+		t.Fatalf("expected newReindex() to work, err: %v", err)
+	}
+	ri.progress = func(ctx context.Context) (*ReindexProgress, error) {
+		return &ReindexProgress{NumPIndexesTarget: 1}, nil
+	}
+	if err = ri.start(); err != nil {
+		t.Fatalf("expected start() to work, err: %v", err)
+	}
+
+	ri.stop()
+
+	status := ri.getStatus()
+	if status.State != ReindexStateCancelled || status.Swapped {
+		t.Errorf("expected cancelled reindex, got: %+v", status)
+	}
+	_, indexDefsByName, _ := mgr.GetIndexDefs(true)
+	if indexDefsByName["bar"] != nil {
+		t.Errorf("expected the shadow index to be deleted")
+	}
+
+	// A built shadow index is swapped into the alias.
+	ri, err = newReindex(mgr, "alias", &ReindexRequest{
+		IndexDef:  &ReindexIndexDef{},
+		IndexName: "bar",
+	})
+	if err != nil {
+		t.Fatalf("expected newReindex() to work, err: %v", err)
+	}
+	ri.progress = func(ctx context.Context) (*ReindexProgress, error) {
+		return &ReindexProgress{NumPIndexes: 1, NumPIndexesTarget: 1}, nil
+	}
+	if err = ri.start(); err != nil {
+		t.Fatalf("expected start() to work, err: %v", err)
+	}
+
+	<-ri.doneCh
+
+	status = ri.getStatus()
+	if status.State != ReindexStateDone || !status.Swapped {
+		t.Errorf("expected swapped reindex, got: %+v", status)
+	}
+	if targets := testAliasTargets(t, mgr); targets["bar"] == nil ||
+		targets["foo"] != nil {
+		t.Errorf("expected the alias to target bar, got: %+v", targets)
+	}
+	_, indexDefsByName, _ = mgr.GetIndexDefs(true)
+	if indexDefsByName["foo"] == nil {
+		t.Errorf("expected the old index to be kept")
+	}
+}
+
+func TestNumPlannedPIndexes(t *testing.T) {
+	indexDef := &cbgt.IndexDef{Name: "bar", UUID: "barUUID"}
+
+	planPIndexes := cbgt.NewPlanPIndexes(cbgt.VERSION)
+	planPIndexes.PlanPIndexes["p0"] = &cbgt.PlanPIndex{
+		IndexName: "bar", IndexUUID: "barUUID",
+		Nodes: map[string]*cbgt.PlanPIndexNode{"n0": {}, "n1": {}},
+	}
+	planPIndexes.PlanPIndexes["p1"] = &cbgt.PlanPIndex{
+		IndexName: "bar", IndexUUID: "barUUID",
+		Nodes: map[string]*cbgt.PlanPIndexNode{"n1": {}, "n2": {}},
+	}
+	planPIndexes.PlanPIndexes["p2"] = &cbgt.PlanPIndex{
+		IndexName: "bar", IndexUUID: "oldUUID",
+		Nodes: map[string]*cbgt.PlanPIndexNode{"n0": {}},
+	}
+
+	// a single replica's pindexes must not make up for a missing pindex
+	if n := numPlannedPIndexes(planPIndexes, indexDef); n != 4 {
+		t.Errorf("expected 4 planned pindexes with replicas, got: %d", n)
+	}
+}
+
+func TestReindexRecords(t *testing.T) {
+	defer func(d time.Duration) { ReindexPollInterval = d }(ReindexPollInterval)
+	ReindexPollInterval = time.Millisecond
+
+	mgr := testReindexManager(t)
+
+	newTestReindex := func() *reindex {
+		ri, err := newReindex(mgr, "alias", &ReindexRequest{
+			IndexDef:  &ReindexIndexDef{},
+			IndexName: "bar",
+		})
+		if err != nil {
+			t.Fatalf("expected newReindex() to work, err: %v", err)
+		}
+		ri.progress = func(ctx context.Context) (*ReindexProgress, error) {
+			return &ReindexProgress{NumPIndexesTarget: 1}, nil
+		}
+		return ri
+	}
+
+	ri := newTestReindex()
+	if err := reindexes.add(ri); err != nil {
+		t.Fatalf("expected add() to work, err: %v", err)
+	}
+	if err := reindexes.add(newTestReindex()); err != errReindexRunning {
+		t.Errorf("expected a running reindex, err: %v", err)
+	}
+
+	// a cancel requested from another node is seen by the running node
+	if err := ri.start(); err != nil {
+		t.Fatalf("expected start() to work, err: %v", err)
+	}
+
+	err := cfgUpdateReindexes(mgr.Cfg(),
+		func(recs map[string]*reindexRecord) error {
+			recs["alias"].CancelRequested = true
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("expected cfgUpdateReindexes() to work, err: %v", err)
+	}
+
+	<-ri.doneCh
+
+	recs, _, _ := cfgGetReindexes(mgr.Cfg())
+	if rec := recs["alias"]; rec == nil || rec.ToUUID == "" ||
+		rec.Status.State != ReindexStateCancelled || !rec.CancelRequested {
+		t.Errorf("expected a cancelled record, got: %+v", rec)
+	}
+
+	// a reindex of a node that restarted is resumed from its record
+	ri = newTestReindex()
+	if err = reindexes.add(ri); err != nil {
+		t.Fatalf("expected add() to work, err: %v", err)
+	}
+	if err = ri.start(); err != nil {
+		t.Fatalf("expected start() to work, err: %v", err)
+	}
+	ri.stop()
+
+	// as if the node restarted as the shadow index was created
+	err = mgr.CreateIndex("primary", "sourceName", "sourceUUID", "",
+		"fulltext-index", "bar", "", cbgt.PlanParams{}, "")
+	if err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	err = cfgUpdateReindexes(mgr.Cfg(),
+		func(recs map[string]*reindexRecord) error {
+			recs["alias"].Status.State = ReindexStateBuilding
+			recs["alias"].ToUUID = ""
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("expected cfgUpdateReindexes() to work, err: %v", err)
+	}
+
+	if err = StartReindexes(mgr); err != nil {
+		t.Fatalf("expected StartReindexes() to work, err: %v", err)
+	}
+
+	recs, _, _ = cfgGetReindexes(mgr.Cfg())
+	resumed := reindexes.get("alias", recs["alias"])
+	if resumed == nil || resumed == ri || resumed.toUUID == "" {
+		t.Fatalf("expected a resumed reindex, got: %+v", resumed)
+	}
+	resumed.stop()
+
+	if status := resumed.getStatus(); status.State != ReindexStateCancelled {
+		t.Errorf("expected cancelled resumed reindex, got: %+v", status)
+	}
+
+	// a reindex of a node that left the cluster is cancelled here
+	err = cfgUpdateReindexes(mgr.Cfg(),
+		func(recs map[string]*reindexRecord) error {
+			recs["alias"].NodeUUID = "goneNodeUUID"
+			recs["alias"].Status.State = ReindexStateBuilding
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("expected cfgUpdateReindexes() to work, err: %v", err)
+	}
+
+	status, err := cancelReindexRecord(mgr, "alias")
+	if err != nil || status.State != ReindexStateCancelled {
+		t.Errorf("expected cancelled record, got: %+v, err: %v", status, err)
+	}
+
+	_, err = cancelReindexRecord(mgr, "noSuchAlias")
+	if err != errReindexNotFound {
+		t.Errorf("expected no reindex, err: %v", err)
+	}
+}
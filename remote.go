@@ -12,7 +12,7 @@ package cbft
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blevesearch/bleve"
@@ -32,27 +33,15 @@ import (
 	"github.com/couchbase/cbgt/rest"
 )
 
-const RemoteRequestOverhead = 500 * time.Millisecond
+// RemoteRequestOverhead is the default ceiling of the time that's held
+// back from the timeout of a remote query for the round-trip and
+// serialization, and the time held back for remote nodes that weren't
+// measured yet.  See remoteRequestOverhead().
+var RemoteRequestOverhead = 500 * time.Millisecond
 
 var HttpClient = http.DefaultClient  // Overridable for testability / advanced needs.
 var Http2Client = http.DefaultClient // Overridable for testability / advanced needs.
 
-// For HTTPS, HTTP2 clients
-var TLSConfig *tls.Config
-
-func InitTLSConfig(certFile, keyFile string) error {
-	if certFile != "" && keyFile != "" {
-		// Placeholder for adding x509 authentication with provided
-		// certificates for scatter gather
-
-		TLSConfig = &tls.Config{
-			InsecureSkipVerify: true,
-		}
-	}
-
-	return nil
-}
-
 // Overridable for testability / advanced needs.
 var HttpPost = func(client *http.Client,
 	url string, bodyType string, body io.Reader) (*http.Response, error) {
@@ -66,13 +55,17 @@ var HttpGet = func(client *http.Client, url string) (*http.Response, error) {
 
 var indexClientUnimplementedErr = errors.New("unimplemented")
 
-// IndexClient implements the Search() and DocCount() subset of the
-// bleve.Index interface by accessing a remote cbft server via REST
-// protocol.  This allows callers to add a IndexClient as a target of
-// a bleve.IndexAlias, and implements cbft protocol features like
-// query consistency and auth.
+// IndexClient implements the Search(), DocCount(), Document(),
+// Fields() and FieldDict() subset of the bleve.Index interface by
+// accessing a remote cbft server via REST protocol.  This allows
+// callers to add a IndexClient as a target of a bleve.IndexAlias, and
+// implements cbft protocol features like query consistency and auth.
 //
-// TODO: Implement propagating auth info in IndexClient.
+// Requests use the node's own credentials, and requests made with a
+// context, such as searches, term stats, fetches, field dictionaries
+// and documents, also carry a caller token for the user on whose
+// behalf the query runs, when the context has a caller.  DocCount()
+// has no context, so counts use only the node's credentials.
 type IndexClient struct {
 	mgr         *cbgt.Manager
 	name        string
@@ -85,9 +78,17 @@ type IndexClient struct {
 	Consistency *cbgt.ConsistencyParams
 	httpClient  *http.Client
 
+	// Optional, replica nodes of the remote pindexes, for hedging and
+	// fallback.
+	replicas *remoteReplicas
+
 	lastMutex        sync.RWMutex
 	lastSearchStatus int
 	lastErrBody      []byte
+	lastFinal        bool // When true, the last status is not updated.
+
+	prefetchMutex sync.Mutex
+	prefetch      *indexClientPrefetch
 }
 
 func (r *IndexClient) GetLast() (int, []byte) {
@@ -96,6 +97,16 @@ func (r *IndexClient) GetLast() (int, []byte) {
 	return r.lastSearchStatus, r.lastErrBody
 }
 
+// setLastFinal sets the last status, which later responses of the
+// remote node no longer update.
+func (r *IndexClient) setLastFinal(status int) {
+	r.lastMutex.Lock()
+	r.lastSearchStatus = status
+	r.lastErrBody = nil
+	r.lastFinal = true
+	r.lastMutex.Unlock()
+}
+
 func (r *IndexClient) Name() string {
 	return r.name
 }
@@ -117,10 +128,96 @@ func (r *IndexClient) Batch(b *bleve.Batch) error {
 }
 
 func (r *IndexClient) Document(id string) (*document.Document, error) {
-	return nil, indexClientUnimplementedErr
+	return r.DocumentInContext(context.Background(), id)
+}
+
+// DocumentInContext retrieves the stored fields of a document from
+// the remote pindexes, returning nil when it's not found.
+func (r *IndexClient) DocumentInContext(ctx context.Context,
+	id string) (*document.Document, error) {
+	if r.QueryURL == "" {
+		return nil, fmt.Errorf("remote: no QueryURL provided")
+	}
+
+	buf, err := MarshalJSON(&DocumentRequest{
+		QueryPIndexes: QueryPIndexes{PIndexNames: r.PIndexNames},
+		ID:            id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	respBuf, err := r.post(ctx, r.indexURL()+"/document", buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var rd *RemoteDocument
+	err = UnmarshalJSON(respBuf, &rd)
+	if err != nil {
+		return nil, fmt.Errorf("remote: document error parsing respBuf: %s,"+
+			" hostPort: %s, err: %v", respBuf, r.HostPort, err)
+	}
+	if rd == nil {
+		return nil, nil
+	}
+
+	return rd.Document()
+}
+
+// DocTermFreqs returns the frequencies of the indexed terms of a
+// document from the remote pindexes, keyed by field name then by term,
+// or nil when the remote pindexes don't have the document.
+func (r *IndexClient) DocTermFreqs(ctx context.Context,
+	id string, fields []string) (map[string]map[string]int, error) {
+	if r.QueryURL == "" {
+		return nil, fmt.Errorf("remote: no QueryURL provided")
+	}
+
+	buf, err := MarshalJSON(&DocumentRequest{
+		QueryPIndexes: QueryPIndexes{PIndexNames: r.PIndexNames},
+		ID:            id,
+		Terms:         true,
+		Fields:        fields,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	respBuf, err := r.post(ctx, r.indexURL()+"/document", buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var rd *RemoteDocument
+	err = UnmarshalJSON(respBuf, &rd)
+	if err != nil {
+		return nil, fmt.Errorf("remote: document terms error parsing"+
+			" respBuf: %s, hostPort: %s, err: %v", respBuf, r.HostPort, err)
+	}
+	if rd == nil {
+		return nil, nil
+	}
+	if rd.Terms == nil {
+		return nil, fmt.Errorf("remote: no document terms from"+
+			" hostPort: %s, perhaps the node is of an older version",
+			r.HostPort)
+	}
+
+	return rd.Terms, nil
 }
 
 func (r *IndexClient) DocCount() (uint64, error) {
+	var rv uint64
+	err := withRemoteBreaker(context.Background(), r.HostPort,
+		func() (err error) {
+			rv, err = r.docCount()
+			return err
+		})
+	return rv, err
+}
+
+func (r *IndexClient) docCount() (uint64, error) {
 	if r.CountURL == "" {
 		return 0, fmt.Errorf("remote: no CountURL provided")
 	}
@@ -177,6 +274,54 @@ func (r *IndexClient) SearchInContext(ctx context.Context,
 		return nil, fmt.Errorf("remote: no QueryURL provided")
 	}
 
+	resultCh, sent, cancel := r.takePrefetch(req)
+	if resultCh == nil {
+		var searchCtx context.Context
+		searchCtx, cancel = context.WithCancel(ctx)
+
+		var err error
+		resultCh, sent, err = r.startSearch(searchCtx, req)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	defer cancel()
+
+	var rv *bleve.SearchResult
+	if r.replicas != nil && r.replicas.hedgePercentile > 0 {
+		rv = r.searchHedged(ctx, req, resultCh, sent)
+	} else {
+		rv = r.waitSearch(ctx, req, resultCh)
+	}
+
+	if r.replicas != nil && r.replicas.fallback && !searchResultOk(rv) {
+		rv = r.replicas.searchFallback(ctx, req, rv, r.HostPort)
+		if searchResultOk(rv) {
+			// the replicas served the failed pindexes, so errors from
+			// the remote node are not reported
+			r.setLastFinal(http.StatusOK)
+		}
+	}
+
+	return rv, nil
+}
+
+func (r *IndexClient) waitSearch(ctx context.Context,
+	req *bleve.SearchRequest, resultCh chan *bleve.SearchResult) *bleve.SearchResult {
+	select {
+	case <-ctx.Done():
+		return makeSearchResultErr(req, r.PIndexNames, ctx.Err())
+	case rv := <-resultCh:
+		return rv
+	}
+}
+
+// startSearch sends the search request to the remote node in the
+// background, returning a channel that receives the result, and the
+// time that the request was sent.
+func (r *IndexClient) startSearch(ctx context.Context,
+	req *bleve.SearchRequest) (chan *bleve.SearchResult, time.Time, error) {
 	queryCtlParams := &cbgt.QueryCtlParams{
 		Ctl: cbgt.QueryCtl{
 			Consistency: r.Consistency,
@@ -187,37 +332,66 @@ func (r *IndexClient) SearchInContext(ctx context.Context,
 		PIndexNames: r.PIndexNames,
 	}
 
-	// if timeout was set, compute time remaining
+	queryAliasFilter := &QueryAliasFilter{
+		AliasFilter: isFilteredQuery(req.Query),
+	}
+
+	queryTermStats := &QueryTermStats{
+		TermStats: termStatsOf(req.Query),
+	}
+
+	startTime := time.Now()
+
+	// if timeout was set, compute time remaining, less the time that the
+	// round-trip to the remote node is expected to take, to increase the
+	// likelihood that a live system replies before we give up on the
+	// request externally
 	if deadline, ok := ctx.Deadline(); ok {
-		remaining := deadline.Sub(time.Now())
-		// FIXME arbitrarily reducing the timeout, to increase the liklihood
-		// that a live system replies via HTTP round-trip before we give up
-		// on the request externally
-		remaining -= RemoteRequestOverhead
-		if remaining < 0 {
+		remaining := deadline.Sub(startTime)
+		remaining -= remoteRequestOverhead(r.mgr, r.HostPort, remaining)
+		if remaining <= 0 {
 			// not enough time left
-			return nil, context.DeadlineExceeded
+			return nil, startTime, context.DeadlineExceeded
 		}
 		queryCtlParams.Ctl.Timeout = int64(remaining / time.Millisecond)
+
+		ctx = withRemoteTimeoutForwarded(ctx)
 	}
 
-	buf, err := MarshalJSON(struct {
-		*cbgt.QueryCtlParams
-		*QueryPIndexes
-		*bleve.SearchRequest
-	}{
-		queryCtlParams,
-		queryPIndexes,
-		req,
-	})
+	var buf []byte
+	var err error
+	if remoteEncoding(r.mgr) == "binary" {
+		buf, err = encodeSearchRequestBinary(&searchRequestBinary{
+			ctl:         *queryCtlParams,
+			pindexes:    *queryPIndexes,
+			encoding:    QueryResultEncoding{ResultEncoding: "binary"},
+			aliasFilter: *queryAliasFilter,
+			termStats:   *queryTermStats,
+			req:         req,
+		})
+	} else {
+		buf, err = MarshalJSON(struct {
+			*cbgt.QueryCtlParams
+			*QueryPIndexes
+			*QueryAliasFilter
+			*QueryTermStats
+			*bleve.SearchRequest
+		}{
+			queryCtlParams,
+			queryPIndexes,
+			queryAliasFilter,
+			queryTermStats,
+			req,
+		})
+	}
 	if err != nil {
-		return nil, err
+		return nil, startTime, err
 	}
 
 	resultCh := make(chan *bleve.SearchResult, 1)
 
 	go func() {
-		respBuf, err := r.Query(buf)
+		respBuf, header, err := r.queryInContext(ctx, buf)
 		if err != nil {
 			resultCh <- makeSearchResultErr(req, r.PIndexNames, err)
 			return
@@ -228,41 +402,257 @@ func (r *IndexClient) SearchInContext(ctx context.Context,
 				Errors: make(map[string]error),
 			},
 		}
-		err = UnmarshalJSON(respBuf, rv)
+		err = parseSearchResult(respBuf, header.Get("Content-Type"), rv)
 		if err != nil {
 			resultCh <- makeSearchResultErr(req, r.PIndexNames,
 				fmt.Errorf("remote: search error parsing respBuf: %s,"+
-					" queryURL: %s, err: %v", respBuf, r.QueryURL, err))
+					" queryURL: %s, err: %v", remoteBufString(respBuf,
+					strings.HasPrefix(header.Get("Content-Type"),
+						SearchResultBinaryContentType)), r.QueryURL, err))
 			return
 		}
 
+		// the overhead is the time not spent executing the query on
+		// the remote node, including (de)serialization on both ends
+		if execTime, ok := parseServerTiming(header); ok {
+			remoteNodeStatsFor(r.HostPort).addOverhead(
+				time.Since(startTime) - execTime)
+		}
+
 		resultCh <- rv
 	}()
 
-	select {
-	case <-ctx.Done():
-		return makeSearchResultErr(req, r.PIndexNames, ctx.Err()), nil
-	case rv := <-resultCh:
-		return rv, nil
+	return resultCh, startTime, nil
+}
+
+// indexClientPrefetch tracks a search that was sent to the remote
+// node ahead of the caller's SearchInContext().
+type indexClientPrefetch struct {
+	key      []byte // Identifies the search request, sans timeout.
+	resultCh chan *bleve.SearchResult
+	sent     time.Time
+	cancel   context.CancelFunc
+}
+
+// Prefetch sends the search request to the remote node right away,
+// so that the remote query makes progress while the caller is busy
+// with other work, such as waiting for the local pindexes to satisfy
+// consistency requirements.  A later SearchInContext() with an
+// identical request picks up the prefetched result, while a
+// differing request cancels the prefetch and is sent anew.
+func (r *IndexClient) Prefetch(ctx context.Context,
+	req *bleve.SearchRequest) {
+	if req == nil || r.QueryURL == "" {
+		return
 	}
+
+	key, err := r.searchKey(req)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	resultCh, sent, err := r.startSearch(ctx, req)
+	if err != nil {
+		cancel()
+		return
+	}
+
+	r.prefetchMutex.Lock()
+	prev := r.prefetch
+	r.prefetch = &indexClientPrefetch{
+		key:      key,
+		resultCh: resultCh,
+		sent:     sent,
+		cancel:   cancel,
+	}
+	r.prefetchMutex.Unlock()
+
+	if prev != nil {
+		prev.cancel()
+	}
+
+	atomic.AddUint64(&totRemotePrefetch, 1)
+}
+
+// takePrefetch returns the result channel, send time and cancel func
+// of a prefetched search that matches the request, or nil.  The
+// prefetch is consumed either way.
+func (r *IndexClient) takePrefetch(req *bleve.SearchRequest) (
+	chan *bleve.SearchResult, time.Time, context.CancelFunc) {
+	r.prefetchMutex.Lock()
+	p := r.prefetch
+	r.prefetch = nil
+	r.prefetchMutex.Unlock()
+
+	if p == nil {
+		return nil, time.Time{}, nil
+	}
+
+	key, err := r.searchKey(req)
+	if err != nil || !bytes.Equal(key, p.key) {
+		p.cancel()
+		atomic.AddUint64(&totRemotePrefetchWasted, 1)
+		return nil, time.Time{}, nil
+	}
+
+	return p.resultCh, p.sent, p.cancel
+}
+
+// searchKey returns the parts of the remote search request that
+// don't depend on when the request is sent.
+func (r *IndexClient) searchKey(req *bleve.SearchRequest) ([]byte, error) {
+	return MarshalJSON(struct {
+		Consistency *cbgt.ConsistencyParams `json:"consistency"`
+		*QueryPIndexes
+		*QueryAliasFilter
+		*QueryTermStats
+		*bleve.SearchRequest
+	}{
+		r.Consistency,
+		&QueryPIndexes{PIndexNames: r.PIndexNames},
+		&QueryAliasFilter{AliasFilter: isFilteredQuery(req.Query)},
+		&QueryTermStats{TermStats: termStatsOf(req.Query)},
+		req,
+	})
 }
 
 func (r *IndexClient) Fields() ([]string, error) {
-	return nil, indexClientUnimplementedErr
+	return r.FieldsInContext(context.Background())
+}
+
+// FieldsInContext retrieves the fields of the remote pindexes.
+func (r *IndexClient) FieldsInContext(ctx context.Context) (
+	[]string, error) {
+	if r.QueryURL == "" {
+		return nil, fmt.Errorf("remote: no QueryURL provided")
+	}
+
+	buf, err := MarshalJSON(&FieldsRequest{
+		QueryPIndexes: QueryPIndexes{PIndexNames: r.PIndexNames},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	respBuf, err := r.post(ctx, r.indexURL()+"/fields", buf)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := struct {
+		Fields []string `json:"fields"`
+	}{}
+	err = UnmarshalJSON(respBuf, &rv)
+	if err != nil {
+		return nil, fmt.Errorf("remote: fields error parsing respBuf: %s,"+
+			" hostPort: %s, err: %v", respBuf, r.HostPort, err)
+	}
+
+	return rv.Fields, nil
 }
 
 func (r *IndexClient) FieldDict(field string) (index.FieldDict, error) {
-	return nil, indexClientUnimplementedErr
+	return r.FieldDictInContext(context.Background(),
+		&FieldDictRequest{Field: field})
 }
 
 func (r *IndexClient) FieldDictRange(field string,
 	startTerm []byte, endTerm []byte) (index.FieldDict, error) {
-	return nil, indexClientUnimplementedErr
+	return r.FieldDictInContext(context.Background(),
+		&FieldDictRequest{
+			Field:     field,
+			StartTerm: string(startTerm),
+			EndTerm:   string(endTerm),
+		})
 }
 
 func (r *IndexClient) FieldDictPrefix(field string,
 	termPrefix []byte) (index.FieldDict, error) {
-	return nil, indexClientUnimplementedErr
+	return r.FieldDictInContext(context.Background(),
+		&FieldDictRequest{Field: field, Prefix: string(termPrefix)})
+}
+
+// FieldDictInContext streams the term dictionary of a field from the
+// remote node, with the counts merged across the remote pindexes.  The
+// entries are read from the remote node as they're consumed, and the
+// stream is cancelled on Close() or when the context is done.
+func (r *IndexClient) FieldDictInContext(ctx context.Context,
+	fdr *FieldDictRequest) (index.FieldDict, error) {
+	if r.QueryURL == "" {
+		return nil, fmt.Errorf("remote: no QueryURL provided")
+	}
+
+	req := *fdr
+	req.PIndexNames = r.PIndexNames
+
+	buf, err := MarshalJSON(&req)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	resp, err := r.postStream(ctx, r.indexURL()+"/fieldDict", buf)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &remoteFieldDict{
+		hostPort: r.HostPort,
+		field:    fdr.Field,
+		cancel:   cancel,
+		body:     resp.Body,
+		dec:      json.NewDecoder(resp.Body),
+	}, nil
+}
+
+// remoteFieldDict reads the term dictionary entries that are streamed
+// by a remote node.
+type remoteFieldDict struct {
+	hostPort string
+	field    string
+	cancel   context.CancelFunc
+	body     io.ReadCloser
+	dec      *json.Decoder
+	done     bool
+}
+
+func (d *remoteFieldDict) Next() (*index.DictEntry, error) {
+	if d.done {
+		return nil, nil
+	}
+
+	var line fieldDictLine
+	err := d.dec.Decode(&line)
+	if err != nil {
+		d.done = true
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF // The stream ended without a Done.
+		}
+		return nil, fmt.Errorf("remote: fieldDict error reading stream,"+
+			" hostPort: %s, field: %s, err: %v", d.hostPort, d.field, err)
+	}
+
+	if line.Err != "" {
+		d.done = true
+		return nil, fmt.Errorf("remote: fieldDict error,"+
+			" hostPort: %s, field: %s, err: %s", d.hostPort, d.field, line.Err)
+	}
+
+	if line.Done {
+		d.done = true
+		return nil, nil
+	}
+
+	return &index.DictEntry{Term: line.Term, Count: line.Count}, nil
+}
+
+func (d *remoteFieldDict) Close() error {
+	d.cancel()
+	return d.body.Close()
 }
 
 func (r *IndexClient) DumpAll() chan interface{} {
@@ -316,50 +706,252 @@ func (r *IndexClient) Count() (uint64, error) {
 }
 
 func (r *IndexClient) Query(buf []byte) ([]byte, error) {
+	return r.QueryInContext(context.Background(), buf)
+}
+
+func (r *IndexClient) QueryInContext(ctx context.Context,
+	buf []byte) ([]byte, error) {
+	respBuf, _, err := r.queryInContext(ctx, buf)
+	return respBuf, err
+}
+
+// queryInContext is like QueryInContext, but also returns the headers
+// of the response.
+func (r *IndexClient) queryInContext(ctx context.Context,
+	buf []byte) (respBuf []byte, header http.Header, err error) {
+	err = withRemoteBreaker(ctx, r.HostPort, func() (err error) {
+		done := remoteNodeStatsFor(r.HostPort).start()
+		respBuf, header, err = r.query(ctx, buf)
+		done(err)
+		return err
+	})
+	return respBuf, header, err
+}
+
+func (r *IndexClient) query(ctx context.Context,
+	buf []byte) ([]byte, http.Header, error) {
 	u, err := UrlWithAuth(r.AuthType(), r.QueryURL)
 	if err != nil {
-		return nil, fmt.Errorf("remote: auth for query,"+
+		return nil, nil, fmt.Errorf("remote: auth for query,"+
 			" queryURL: %s, authType: %s, err: %v",
 			r.QueryURL, r.AuthType(), err)
 	}
 
-	req, err := http.NewRequest("POST", u, bytes.NewReader(buf))
+	req, err := r.newRequest(ctx, u, buf)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	req.Header.Add(rest.CLUSTER_ACTION, "fts/scatter-gather")
-	req.Header.Add("Content-Type", "application/json")
 
 	resp, err := r.httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
-	respBuf, err := ioutil.ReadAll(resp.Body)
+	respBuf, err := readRemoteResponse(r.HostPort, resp)
 	if err != nil {
-		return nil, fmt.Errorf("remote: query error reading resp.Body,"+
+		return nil, nil, fmt.Errorf("remote: query error reading resp.Body,"+
 			" queryURL: %s, resp: %#v, err: %v", r.QueryURL, resp, err)
 	}
 
 	r.lastMutex.Lock()
 	defer r.lastMutex.Unlock()
 
-	r.lastSearchStatus = resp.StatusCode
+	if !r.lastFinal {
+		r.lastSearchStatus = resp.StatusCode
+	}
 	if resp.StatusCode != http.StatusOK {
-		r.lastErrBody = respBuf
-		return nil, fmt.Errorf("remote: query got status code: %d,"+
-			" queryURL: %s, buf: %s, resp: %#v, err: %v",
-			resp.StatusCode, r.QueryURL, buf, resp, err)
+		if !r.lastFinal {
+			r.lastErrBody = respBuf
+		}
+		return nil, nil, &remoteQueryError{
+			status: resp.StatusCode,
+			body:   respBuf,
+			msg: fmt.Sprintf("remote: query got status code: %d,"+
+				" queryURL: %s, buf: %s, resp: %#v, err: %v",
+				resp.StatusCode, r.QueryURL,
+				remoteBufString(buf, isSearchRequestBinary(buf)), resp, err),
+		}
 	}
 
-	return respBuf, err
+	return respBuf, resp.Header, err
+}
+
+// remoteQueryError is returned by IndexClient queries that got a non
+// 200 status code from the remote node.
+type remoteQueryError struct {
+	status int
+	body   []byte
+	msg    string
+}
+
+func (e *remoteQueryError) Error() string {
+	return e.msg
 }
 
 func (r *IndexClient) Advanced() (index.Index, store.KVStore, error) {
 	return nil, nil, indexClientUnimplementedErr
 }
 
+// withPIndexNames returns a copy of the IndexClient that targets
+// only the given subset of its remote pindexes, without any
+// consistency requirements as those were already satisfied.
+func (r *IndexClient) withPIndexNames(pindexNames []string) *IndexClient {
+	return &IndexClient{
+		mgr:         r.mgr,
+		name:        r.name,
+		HostPort:    r.HostPort,
+		IndexName:   r.IndexName,
+		IndexUUID:   r.IndexUUID,
+		PIndexNames: pindexNames,
+		QueryURL:    r.QueryURL,
+		CountURL:    r.CountURL,
+		httpClient:  r.httpClient,
+		replicas:    r.replicas,
+	}
+}
+
+// TermStats retrieves the term statistics of the remote pindexes for
+// the given terms, keyed by field name.
+func (r *IndexClient) TermStats(ctx context.Context,
+	fields map[string][]string) (*TermStats, error) {
+	buf, err := MarshalJSON(&TermStatsRequest{
+		QueryPIndexes: QueryPIndexes{PIndexNames: r.PIndexNames},
+		Fields:        fields,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	respBuf, err := r.post(ctx, r.indexURL()+"/termStats", buf)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &TermStats{}
+	err = UnmarshalJSON(respBuf, rv)
+	if err != nil {
+		return nil, fmt.Errorf("remote: termStats error parsing respBuf: %s,"+
+			" hostPort: %s, err: %v", respBuf, r.HostPort, err)
+	}
+
+	return rv, nil
+}
+
+// newRequest returns a scatter-gather POST request to the remote node,
+// which carries the caller's identity from the context, and whose
+// body is compressed when that's worthwhile.
+func (r *IndexClient) newRequest(ctx context.Context, urlStr string,
+	buf []byte) (*http.Request, error) {
+	body, encoding := encodeRemoteBody(r.mgr, r.HostPort, buf)
+
+	req, err := http.NewRequest("POST", urlStr, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Add(rest.CLUSTER_ACTION, "fts/scatter-gather")
+	if isSearchRequestBinary(buf) {
+		req.Header.Add("Content-Type", SearchRequestBinaryContentType)
+	} else {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	setRemoteEncodingHeaders(r.mgr, req, encoding)
+
+	err = addCallerToken(ctx, r.mgr, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// post sends a JSON request to an internal REST endpoint of the
+// remote node, returning the response body on a 200 status code.
+func (r *IndexClient) post(ctx context.Context, urlStr string,
+	buf []byte) ([]byte, error) {
+	u, err := UrlWithAuth(r.AuthType(), urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("remote: auth for post,"+
+			" url: %s, authType: %s, err: %v",
+			urlStr, r.AuthType(), err)
+	}
+
+	req, err := r.newRequest(ctx, u, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBuf, err := readRemoteResponse(r.HostPort, resp)
+	if err != nil {
+		return nil, fmt.Errorf("remote: post error reading resp.Body,"+
+			" url: %s, err: %v", urlStr, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote: post got status code: %d,"+
+			" url: %s, respBuf: %s", resp.StatusCode, urlStr, respBuf)
+	}
+
+	return respBuf, nil
+}
+
+// postStream is like post(), but returns the response for the caller
+// to read incrementally and close.  The response is asked for
+// uncompressed, as the remote node buffers compressed responses.
+func (r *IndexClient) postStream(ctx context.Context, urlStr string,
+	buf []byte) (*http.Response, error) {
+	u, err := UrlWithAuth(r.AuthType(), urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("remote: auth for post,"+
+			" url: %s, authType: %s, err: %v",
+			urlStr, r.AuthType(), err)
+	}
+
+	req, err := r.newRequest(ctx, u, buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		respBuf, _ := readRemoteResponse(r.HostPort, resp)
+		resp.Body.Close()
+		return nil, fmt.Errorf("remote: post got status code: %d,"+
+			" url: %s, respBuf: %s", resp.StatusCode, urlStr, respBuf)
+	}
+
+	return resp, nil
+}
+
+// indexURL returns the base URL of the index level REST endpoints of
+// the remote node.
+func (r *IndexClient) indexURL() string {
+	prefix := ""
+	if r.mgr != nil {
+		prefix = r.mgr.Options()["urlPrefix"]
+	}
+
+	proto := "http://"
+	if strings.Contains(r.QueryURL, "https") {
+		proto = "https://"
+	}
+
+	return proto + r.HostPort + prefix + "/api/index/" + r.IndexName
+}
+
 // -----------------------------------------------------
 
 func (r *IndexClient) AuthType() string {
@@ -383,18 +975,7 @@ func GroupIndexClientsByHostPort(clients []*IndexClient) (rv []*IndexClient, err
 
 		c, exists := m[groupByKey]
 		if !exists {
-			prefix := ""
-			if client.mgr != nil {
-				prefix = client.mgr.Options()["urlPrefix"]
-			}
-
-			proto := "http://"
-			if strings.Contains(client.QueryURL, "https") {
-				proto = "https://"
-			}
-
-			baseURL := proto + client.HostPort +
-				prefix + "/api/index/" + client.IndexName
+			baseURL := client.indexURL()
 
 			c = &IndexClient{
 				mgr:         client.mgr,
@@ -406,6 +987,7 @@ func GroupIndexClientsByHostPort(clients []*IndexClient) (rv []*IndexClient, err
 				CountURL:    baseURL + "/count",
 				Consistency: client.Consistency,
 				httpClient:  client.httpClient,
+				replicas:    client.replicas,
 			}
 
 			m[groupByKey] = c
@@ -0,0 +1,451 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/cbgt"
+	"github.com/couchbase/cbgt/rest"
+
+	log "github.com/couchbase/clog"
+)
+
+// RemoteLatencyEWMAAlpha is the weight given to the latest response
+// time of a remote node in its exponentially weighted moving average.
+var RemoteLatencyEWMAAlpha = 0.2
+
+// RemoteNodeStats tracks the scatter-gather activity of this node
+// towards a remote node, keyed by the remote HostPort.
+type RemoteNodeStats struct {
+	TotChosen   uint64 // Times chosen as the target of a remote pindex.
+	TotRequests uint64
+	TotErrors   uint64
+	TotHedged   uint64 // Requests hedged to replicas for being slow.
+	Outstanding int64  // Requests currently in flight.
+
+	// Payload sizes on the wire, and before compression.
+	TotBytesSent    uint64
+	TotBytesSentRaw uint64
+	TotBytesRecv    uint64
+	TotBytesRecvRaw uint64
+
+	TotCompressNS   uint64 // Time spent compressing requests.
+	TotDecompressNS uint64 // Time spent decompressing responses.
+
+	m            sync.Mutex
+	latencyEWMA  float64  // In milliseconds, 0 until the first response.
+	overheadEWMA float64  // In milliseconds, 0 until the first measurement.
+	encodings    []string // Encodings that the remote node accepts.
+
+	latencies remoteLatencyTracker // Recent response times, for hedging.
+}
+
+var remoteNodeStatsM sync.Mutex
+var remoteNodeStats = map[string]*RemoteNodeStats{}
+
+// remoteNodeStatsFor returns the stats of a remote node, creating
+// them on first use.
+func remoteNodeStatsFor(hostPort string) *RemoteNodeStats {
+	remoteNodeStatsM.Lock()
+	s, exists := remoteNodeStats[hostPort]
+	if !exists {
+		s = &RemoteNodeStats{}
+		remoteNodeStats[hostPort] = s
+	}
+	remoteNodeStatsM.Unlock()
+	return s
+}
+
+// start records the start of a request, returning a func that records
+// its completion.
+func (s *RemoteNodeStats) start() func(err error) {
+	atomic.AddUint64(&s.TotRequests, 1)
+	atomic.AddInt64(&s.Outstanding, 1)
+
+	startTime := time.Now()
+
+	return func(err error) {
+		atomic.AddInt64(&s.Outstanding, -1)
+		if err != nil {
+			atomic.AddUint64(&s.TotErrors, 1)
+			return
+		}
+
+		ms := float64(time.Since(startTime)) / float64(time.Millisecond)
+
+		s.latencies.add(ms)
+
+		s.m.Lock()
+		if s.latencyEWMA <= 0 {
+			s.latencyEWMA = ms
+		} else {
+			s.latencyEWMA += RemoteLatencyEWMAAlpha * (ms - s.latencyEWMA)
+		}
+		s.m.Unlock()
+	}
+}
+
+// LatencyEWMA returns the moving average of the response times of the
+// remote node in milliseconds, or 0 if there weren't any responses.
+func (s *RemoteNodeStats) LatencyEWMA() float64 {
+	s.m.Lock()
+	rv := s.latencyEWMA
+	s.m.Unlock()
+	return rv
+}
+
+// addOverhead records the time that a request to the remote node took,
+// beyond the execution time that the remote node reported.
+func (s *RemoteNodeStats) addOverhead(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	if ms < 0 {
+		ms = 0
+	}
+
+	s.m.Lock()
+	if s.overheadEWMA <= 0 {
+		s.overheadEWMA = ms
+	} else {
+		s.overheadEWMA += RemoteLatencyEWMAAlpha * (ms - s.overheadEWMA)
+	}
+	s.m.Unlock()
+}
+
+// OverheadEWMA returns the moving average of the round-trip and
+// serialization overhead of requests to the remote node in
+// milliseconds, or 0 if there weren't any measurements.
+func (s *RemoteNodeStats) OverheadEWMA() float64 {
+	s.m.Lock()
+	rv := s.overheadEWMA
+	s.m.Unlock()
+	return rv
+}
+
+// Encodings returns the encodings of request bodies that the remote
+// node advertised that it accepts.
+func (s *RemoteNodeStats) Encodings() []string {
+	s.m.Lock()
+	rv := s.encodings
+	s.m.Unlock()
+	return rv
+}
+
+func (s *RemoteNodeStats) setEncodings(encodings []string) {
+	s.m.Lock()
+	s.encodings = encodings
+	s.m.Unlock()
+}
+
+// CompressionRatio returns the ratio of the uncompressed to the
+// compressed payload sizes, or 0 if there weren't any payloads.
+func (s *RemoteNodeStats) CompressionRatio() float64 {
+	wire := atomic.LoadUint64(&s.TotBytesSent) +
+		atomic.LoadUint64(&s.TotBytesRecv)
+	if wire <= 0 {
+		return 0
+	}
+	raw := atomic.LoadUint64(&s.TotBytesSentRaw) +
+		atomic.LoadUint64(&s.TotBytesRecvRaw)
+	return float64(raw) / float64(wire)
+}
+
+// RemoteNodeStatsMap returns a JSON friendly snapshot of the stats of
+// all the remote nodes, keyed by HostPort.
+func RemoteNodeStatsMap() map[string]map[string]interface{} {
+	remoteNodeStatsM.Lock()
+	defer remoteNodeStatsM.Unlock()
+
+	rv := make(map[string]map[string]interface{}, len(remoteNodeStats))
+	for hostPort, s := range remoteNodeStats {
+		rv[hostPort] = map[string]interface{}{
+			"tot_chosen":       atomic.LoadUint64(&s.TotChosen),
+			"tot_requests":     atomic.LoadUint64(&s.TotRequests),
+			"tot_errors":       atomic.LoadUint64(&s.TotErrors),
+			"tot_hedged":       atomic.LoadUint64(&s.TotHedged),
+			"outstanding":      atomic.LoadInt64(&s.Outstanding),
+			"latency_ewma_ms":  s.LatencyEWMA(),
+			"overhead_ewma_ms": s.OverheadEWMA(),
+			"breaker_state":    remoteBreakerFor(hostPort).stateName(),
+
+			"tot_bytes_sent":     atomic.LoadUint64(&s.TotBytesSent),
+			"tot_bytes_sent_raw": atomic.LoadUint64(&s.TotBytesSentRaw),
+			"tot_bytes_recv":     atomic.LoadUint64(&s.TotBytesRecv),
+			"tot_bytes_recv_raw": atomic.LoadUint64(&s.TotBytesRecvRaw),
+			"compression_ratio":  s.CompressionRatio(),
+			"tot_compress_ns":    atomic.LoadUint64(&s.TotCompressNS),
+			"tot_decompress_ns":  atomic.LoadUint64(&s.TotDecompressNS),
+			"encodings":          s.Encodings(),
+		}
+	}
+	return rv
+}
+
+// ---------------------------------------------------------
+
+// RemoteTarget is a candidate node for serving a remote pindex.
+type RemoteTarget struct {
+	NodeDef  *cbgt.NodeDef
+	HostPort string // The host:port that scatter-gather requests use.
+	Stats    *RemoteNodeStats
+}
+
+// RemoteTargetPolicy chooses which of the candidate nodes, holding
+// either the primary or a replica of a pindex, should serve a query
+// for that pindex.  The candidates are sorted by HostPort and the
+// localNodeDef may be nil.
+type RemoteTargetPolicy func(pindexName string, candidates []*RemoteTarget,
+	localNodeDef *cbgt.NodeDef) *RemoteTarget
+
+// RemoteTargetPolicies is the registry of remote target policies,
+// where the "remoteTargetPolicy" manager option picks the policy.  When
+// the option is unset, the node chosen by CoveringPIndexesEx is used.
+var RemoteTargetPolicies = map[string]RemoteTargetPolicy{
+	"roundRobin":       RemoteTargetRoundRobin,
+	"leastOutstanding": RemoteTargetLeastOutstanding,
+	"latencyWeighted":  RemoteTargetLatencyWeighted,
+	"preferLocalZone":  RemoteTargetPreferLocalZone,
+}
+
+var remoteTargetRoundRobinCounter uint64
+
+func RemoteTargetRoundRobin(pindexName string, candidates []*RemoteTarget,
+	localNodeDef *cbgt.NodeDef) *RemoteTarget {
+	n := atomic.AddUint64(&remoteTargetRoundRobinCounter, 1)
+	return candidates[n%uint64(len(candidates))]
+}
+
+func RemoteTargetLeastOutstanding(pindexName string, candidates []*RemoteTarget,
+	localNodeDef *cbgt.NodeDef) *RemoteTarget {
+	var least []*RemoteTarget
+	var leastOutstanding int64
+	for _, c := range candidates {
+		outstanding := atomic.LoadInt64(&c.Stats.Outstanding)
+		if len(least) <= 0 || outstanding < leastOutstanding {
+			least = []*RemoteTarget{c}
+			leastOutstanding = outstanding
+		} else if outstanding == leastOutstanding {
+			least = append(least, c)
+		}
+	}
+	return RemoteTargetRoundRobin(pindexName, least, localNodeDef)
+}
+
+// RemoteTargetLatencyWeighted chooses randomly, weighing each
+// candidate by the inverse of its response time moving average.
+// Candidates without any responses yet get the weight of the fastest
+// candidate, so that they're explored.
+func RemoteTargetLatencyWeighted(pindexName string, candidates []*RemoteTarget,
+	localNodeDef *cbgt.NodeDef) *RemoteTarget {
+	latencies := make([]float64, len(candidates))
+	fastest := 0.0
+	for i, c := range candidates {
+		latencies[i] = c.Stats.LatencyEWMA()
+		if latencies[i] > 0 && (fastest <= 0 || latencies[i] < fastest) {
+			fastest = latencies[i]
+		}
+	}
+	if fastest <= 0 {
+		return RemoteTargetRoundRobin(pindexName, candidates, localNodeDef)
+	}
+
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	for i, latency := range latencies {
+		if latency <= 0 {
+			latency = fastest
+		}
+		weights[i] = 1.0 / latency
+		total += weights[i]
+	}
+
+	x := rand.Float64() * total
+	for i, weight := range weights {
+		x -= weight
+		if x < 0 {
+			return candidates[i]
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// RemoteTargetPreferLocalZone round-robins over the candidates in the
+// same zone as the local node, falling back to all the candidates.
+func RemoteTargetPreferLocalZone(pindexName string, candidates []*RemoteTarget,
+	localNodeDef *cbgt.NodeDef) *RemoteTarget {
+	if localNodeDef != nil {
+		localZone := NodeDefZone(localNodeDef)
+
+		var sameZone []*RemoteTarget
+		for _, c := range candidates {
+			if NodeDefZone(c.NodeDef) == localZone {
+				sameZone = append(sameZone, c)
+			}
+		}
+		if len(sameZone) > 0 {
+			return RemoteTargetRoundRobin(pindexName, sameZone, localNodeDef)
+		}
+	}
+	return RemoteTargetRoundRobin(pindexName, candidates, localNodeDef)
+}
+
+// NodeDefZone returns the zone of a node, from a "zone:<name>" node
+// tag, or else from the node's container (server group).
+func NodeDefZone(nodeDef *cbgt.NodeDef) string {
+	for _, tag := range nodeDef.Tags {
+		if strings.HasPrefix(tag, "zone:") {
+			return tag[len("zone:"):]
+		}
+	}
+	return nodeDef.Container
+}
+
+// ---------------------------------------------------------
+
+// remoteTargetChooser applies the configured remote target policy to
+// the remote pindexes of a query, and knows the candidate nodes that
+// hold the primary or replicas of each remote pindex.
+type remoteTargetChooser struct {
+	policy       RemoteTargetPolicy
+	planFilter   cbgt.PlanPIndexFilter
+	localUUID    string
+	nodeDefs     map[string]*cbgt.NodeDef
+	localNodeDef *cbgt.NodeDef
+}
+
+func newRemoteTargetChooser(mgr *cbgt.Manager,
+	planPIndexFilterName string) *remoteTargetChooser {
+	c := &remoteTargetChooser{
+		planFilter: cbgt.PlanPIndexFilters[planPIndexFilterName],
+		localUUID:  mgr.UUID(),
+	}
+
+	policyName := mgr.Options()["remoteTargetPolicy"]
+	if policyName != "" {
+		policy, exists := RemoteTargetPolicies[policyName]
+		if exists {
+			c.policy = policy
+		} else {
+			log.Warnf("remote_balance: unknown remoteTargetPolicy: %s",
+				policyName)
+		}
+	}
+
+	nodeDefs, err := mgr.GetNodeDefs(cbgt.NODE_DEFS_WANTED, false)
+	if err == nil && nodeDefs != nil {
+		c.nodeDefs = nodeDefs.NodeDefs
+		c.localNodeDef = nodeDefs.NodeDefs[c.localUUID]
+	}
+
+	return c
+}
+
+// choose returns the node that should serve the remote pindex.
+func (c *remoteTargetChooser) choose(
+	remotePlanPIndex *cbgt.RemotePlanPIndex) *cbgt.NodeDef {
+	if c.policy != nil {
+		candidates := c.candidates(remotePlanPIndex.PlanPIndex)
+		if len(candidates) > 1 {
+			chosen := c.policy(remotePlanPIndex.PlanPIndex.Name,
+				candidates, c.localNodeDef)
+			if chosen != nil {
+				return chosen.NodeDef
+			}
+		}
+	}
+
+	return remotePlanPIndex.NodeDef
+}
+
+// candidates returns the remote nodes that are planned to serve
+// queries for the plan pindex, sorted by HostPort.
+func (c *remoteTargetChooser) candidates(
+	planPIndex *cbgt.PlanPIndex) []*RemoteTarget {
+	var rv []*RemoteTarget
+	for nodeUUID, planPIndexNode := range planPIndex.Nodes {
+		if nodeUUID == c.localUUID {
+			continue
+		}
+		if c.planFilter != nil && !c.planFilter(planPIndexNode) {
+			continue
+		}
+		nodeDef := c.nodeDefs[nodeUUID]
+		if nodeDef == nil {
+			continue
+		}
+		hostPort, _, _, ok := remoteNodeHostPort(nodeDef)
+		if !ok || !remoteBreakerFor(hostPort).available() {
+			continue
+		}
+		rv = append(rv, &RemoteTarget{
+			NodeDef:  nodeDef,
+			HostPort: hostPort,
+			Stats:    remoteNodeStatsFor(hostPort),
+		})
+	}
+
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].HostPort < rv[j].HostPort
+	})
+
+	return rv
+}
+
+// remoteNodeHostPort returns the host:port and protocol for sending
+// scatter-gather requests to a remote node, preferring https when the
+// node advertises a bindHTTPS address.
+func remoteNodeHostPort(nodeDef *cbgt.NodeDef) (
+	hostPort, proto string, http2Enabled, ok bool) {
+	delimiterPos := strings.LastIndex(nodeDef.HostPort, ":")
+	if delimiterPos < 0 || delimiterPos >= len(nodeDef.HostPort)-1 {
+		return "", "", false, false // No port available.
+	}
+	host := nodeDef.HostPort[:delimiterPos]
+	port := nodeDef.HostPort[delimiterPos+1:]
+
+	proto = "http://"
+
+	extrasBindHTTPS, er := nodeDef.GetFromParsedExtras("bindHTTPS")
+	if er == nil && extrasBindHTTPS != nil {
+		if bindHTTPSstr, ok := extrasBindHTTPS.(string); ok {
+			portPos := strings.LastIndex(bindHTTPSstr, ":") + 1
+			if portPos > 0 && portPos < len(bindHTTPSstr) {
+				port = bindHTTPSstr[portPos:]
+				proto = "https://"
+				http2Enabled = true
+			}
+		}
+	}
+
+	return host + ":" + port, proto, http2Enabled, true
+}
+
+// ---------------------------------------------------------
+
+// RemoteNodeStatsHandler is a REST handler that returns the
+// scatter-gather stats of this node towards each remote node.
+type RemoteNodeStatsHandler struct{}
+
+func NewRemoteNodeStatsHandler() *RemoteNodeStatsHandler {
+	return &RemoteNodeStatsHandler{}
+}
+
+func (h *RemoteNodeStatsHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	rest.MustEncode(w, RemoteNodeStatsMap())
+}
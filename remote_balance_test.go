@@ -0,0 +1,89 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/couchbase/cbgt"
+)
+
+func testRemoteTargets(zones ...string) []*RemoteTarget {
+	var rv []*RemoteTarget
+	for i, zone := range zones {
+		hostPort := "host" + string('a'+rune(i)) + ":8094"
+		rv = append(rv, &RemoteTarget{
+			NodeDef:  &cbgt.NodeDef{HostPort: hostPort, Container: zone},
+			HostPort: hostPort,
+			Stats:    &RemoteNodeStats{},
+		})
+	}
+	return rv
+}
+
+func TestRemoteTargetPolicies(t *testing.T) {
+	candidates := testRemoteTargets("z1", "z2", "z2")
+
+	seen := map[string]bool{}
+	for i := 0; i < len(candidates); i++ {
+		seen[RemoteTargetRoundRobin("p", candidates, nil).HostPort] = true
+	}
+	if len(seen) != len(candidates) {
+		t.Errorf("expected round robin over all candidates, got: %v", seen)
+	}
+
+	candidates[0].Stats.Outstanding = 2
+	candidates[1].Stats.Outstanding = 1
+	candidates[2].Stats.Outstanding = 3
+	if RemoteTargetLeastOutstanding("p", candidates, nil) != candidates[1] {
+		t.Errorf("expected least outstanding candidate")
+	}
+
+	local := &cbgt.NodeDef{Tags: []string{"queryer", "zone:z1"}}
+	for i := 0; i < 3; i++ {
+		if RemoteTargetPreferLocalZone("p", candidates, local) != candidates[0] {
+			t.Errorf("expected local zone candidate")
+		}
+	}
+
+	candidates[0].Stats.latencyEWMA = 1000
+	candidates[1].Stats.latencyEWMA = 0.001
+	candidates[2].Stats.latencyEWMA = 1000
+	n := 0
+	for i := 0; i < 100; i++ {
+		if RemoteTargetLatencyWeighted("p", candidates, nil) == candidates[1] {
+			n++
+		}
+	}
+	if n < 90 {
+		t.Errorf("expected fastest candidate to be mostly chosen, got: %d", n)
+	}
+}
+
+func TestRemoteNodeStats(t *testing.T) {
+	s := &RemoteNodeStats{}
+
+	done := s.start()
+	if s.Outstanding != 1 {
+		t.Errorf("expected 1 outstanding")
+	}
+	done(nil)
+	if s.Outstanding != 0 || s.TotRequests != 1 || s.TotErrors != 0 {
+		t.Errorf("unexpected stats: %#v", s)
+	}
+
+	s.start()(errors.New("timeout"))
+	if s.TotErrors != 1 {
+		t.Errorf("expected 1 error")
+	}
+}
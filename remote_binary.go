@@ -0,0 +1,657 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/query"
+
+	"github.com/couchbase/cbgt"
+)
+
+// SearchResultBinaryContentType is the content type of search results
+// in the compact binary encoding that nodes use for scatter-gather.
+const SearchResultBinaryContentType = "application/x-cbft-search-result"
+
+// searchResultBinaryVersion is the first byte of a binary search
+// result, which is bumped on incompatible changes to the encoding.
+const searchResultBinaryVersion = 1
+
+// FeatureBinaryScatterGather is advertised in the node extras of the
+// nodes that accept scatter-gather search requests in the binary
+// encoding, and can respond with binary search results.
+const FeatureBinaryScatterGather = "binaryScatterGather"
+
+// SearchRequestBinaryContentType is the content type of scatter-gather
+// search requests in the binary encoding.
+const SearchRequestBinaryContentType = "application/x-cbft-search-request"
+
+// searchRequestBinaryMagic is the first byte of a binary search
+// request.  No JSON document starts with it, so that query handlers,
+// which only see the request body, can tell the encodings apart.
+const searchRequestBinaryMagic = 0
+
+// searchRequestBinaryVersion is the second byte of a binary search
+// request, which is bumped on incompatible changes to the encoding.
+const searchRequestBinaryVersion = 1
+
+// QueryResultEncoding defines the part of the JSON query request
+// through which a coordinator node asks for the binary encoding of
+// the search result.  Nodes that don't know about it ignore it and
+// respond with JSON, so the response's content type decides.
+type QueryResultEncoding struct {
+	ResultEncoding string `json:"resultEncoding,omitempty"`
+}
+
+// remoteEncoding returns the encoding of the search requests that a
+// coordinator sends to remote nodes, and of the results that it asks
+// for, which is "binary" once every node of the cluster advertises
+// FeatureBinaryScatterGather, so that a mixed-version cluster keeps
+// using JSON until all of its nodes are upgraded.  The
+// "remoteEncoding" manager option of "json" turns the binary encoding
+// off, such as for debugging.
+func remoteEncoding(mgr *cbgt.Manager) string {
+	if mgr == nil || mgr.Options()["remoteEncoding"] == "json" {
+		return ""
+	}
+
+	nodeDefs, err := mgr.GetNodeDefs(cbgt.NODE_DEFS_WANTED, false)
+	if err != nil || nodeDefs == nil ||
+		!cbgt.IsFeatureSupportedByCluster(FeatureBinaryScatterGather, nodeDefs) {
+		return ""
+	}
+
+	return "binary"
+}
+
+// writeSearchResultBinary sends a search result in the binary
+// encoding, returning false when the result can't be encoded, in which
+// case the caller falls back to JSON.
+func writeSearchResultBinary(w io.Writer, sr *bleve.SearchResult) bool {
+	var buf bytes.Buffer
+	err := encodeSearchResultBinary(&buf, sr)
+	if err != nil {
+		return false
+	}
+
+	if rw, ok := w.(http.ResponseWriter); ok {
+		rw.Header().Set("Cache-Control", "no-cache")
+		rw.Header().Set("Content-Type", SearchResultBinaryContentType)
+	}
+
+	w.Write(buf.Bytes())
+
+	return true
+}
+
+// parseSearchResult parses the response of a remote node by its
+// content type.
+func parseSearchResult(buf []byte, contentType string,
+	rv *bleve.SearchResult) error {
+	if strings.HasPrefix(contentType, SearchResultBinaryContentType) {
+		return decodeSearchResultBinary(buf, rv)
+	}
+	return UnmarshalJSON(buf, rv)
+}
+
+// remoteBufString returns a request or response body for error
+// messages and logs, where a body in one of the binary encodings is
+// summarized by its length and a hex prefix, instead of raw bytes that
+// would end up in the JSON of a search status.
+func remoteBufString(buf []byte, binary bool) string {
+	if !binary {
+		return string(buf)
+	}
+
+	prefix := buf
+	if len(prefix) > 16 {
+		prefix = prefix[:16]
+	}
+
+	return fmt.Sprintf("(binary, %d bytes, %x...)", len(buf), prefix)
+}
+
+// ---------------------------------------------------------
+
+// The binary encoding is a sequence of uvarints, float64 bits and
+// length-prefixed strings, holding the status, the totals and the
+// hits.  The rarely used parts of a result, like facets, explanations
+// and term locations, are embedded as length-prefixed JSON.
+
+const (
+	binaryFieldString = 's'
+	binaryFieldNumber = 'n'
+	binaryFieldJSON   = 'j'
+)
+
+type binaryHitExtras struct {
+	Expl      *search.Explanation         `json:"explanation,omitempty"`
+	Locations search.FieldTermLocationMap `json:"locations,omitempty"`
+}
+
+type binaryWriter struct {
+	w   *bytes.Buffer
+	tmp [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (b *binaryWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(b.tmp[:], v)
+	b.w.Write(b.tmp[:n])
+}
+
+func (b *binaryWriter) float64(v float64) {
+	binary.LittleEndian.PutUint64(b.tmp[:8], math.Float64bits(v))
+	b.w.Write(b.tmp[:8])
+}
+
+func (b *binaryWriter) bytes(v []byte) {
+	b.uvarint(uint64(len(v)))
+	b.w.Write(v)
+}
+
+func (b *binaryWriter) string(v string) {
+	b.uvarint(uint64(len(v)))
+	b.w.WriteString(v)
+}
+
+func (b *binaryWriter) json(v interface{}) {
+	buf, err := MarshalJSON(v)
+	if err != nil && b.err == nil {
+		b.err = err
+	}
+	b.bytes(buf)
+}
+
+func encodeSearchResultBinary(w *bytes.Buffer, sr *bleve.SearchResult) error {
+	b := &binaryWriter{w: w}
+
+	b.w.WriteByte(searchResultBinaryVersion)
+
+	status := sr.Status
+	if status == nil {
+		status = &bleve.SearchStatus{}
+	}
+	b.uvarint(uint64(status.Total))
+	b.uvarint(uint64(status.Failed))
+	b.uvarint(uint64(status.Successful))
+
+	errNames := make([]string, 0, len(status.Errors))
+	for name := range status.Errors {
+		errNames = append(errNames, name)
+	}
+	sort.Strings(errNames)
+	b.uvarint(uint64(len(errNames)))
+	for _, name := range errNames {
+		b.string(name)
+		b.string(status.Errors[name].Error())
+	}
+
+	b.uvarint(sr.Total)
+	b.float64(sr.MaxScore)
+	b.uvarint(uint64(sr.Took))
+
+	b.uvarint(uint64(len(sr.Hits)))
+	for _, hit := range sr.Hits {
+		b.string(hit.Index)
+		b.string(hit.ID)
+		b.float64(hit.Score)
+
+		b.uvarint(uint64(len(hit.Sort)))
+		for _, s := range hit.Sort {
+			b.string(s)
+		}
+
+		b.uvarint(uint64(len(hit.Fragments)))
+		for field, fragments := range hit.Fragments {
+			b.string(field)
+			b.uvarint(uint64(len(fragments)))
+			for _, fragment := range fragments {
+				b.string(fragment)
+			}
+		}
+
+		b.uvarint(uint64(len(hit.Fields)))
+		for field, v := range hit.Fields {
+			b.string(field)
+			switch v := v.(type) {
+			case string:
+				b.w.WriteByte(binaryFieldString)
+				b.string(v)
+			case float64:
+				b.w.WriteByte(binaryFieldNumber)
+				b.float64(v)
+			default:
+				b.w.WriteByte(binaryFieldJSON)
+				b.json(v)
+			}
+		}
+
+		if hit.Expl != nil || len(hit.Locations) > 0 {
+			b.json(&binaryHitExtras{Expl: hit.Expl, Locations: hit.Locations})
+		} else {
+			b.bytes(nil)
+		}
+	}
+
+	if len(sr.Facets) > 0 {
+		b.json(sr.Facets)
+	} else {
+		b.bytes(nil)
+	}
+
+	return b.err
+}
+
+// ---------------------------------------------------------
+
+var errBinaryTruncated = errors.New("binary search result truncated")
+
+type binaryReader struct {
+	buf []byte
+	err error
+}
+
+func (b *binaryReader) uvarint() uint64 {
+	if b.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(b.buf)
+	if n <= 0 {
+		b.err = errBinaryTruncated
+		return 0
+	}
+	b.buf = b.buf[n:]
+	return v
+}
+
+// count reads a number of items, each of which takes at least a byte.
+func (b *binaryReader) count() int {
+	v := b.uvarint()
+	if v > uint64(len(b.buf)) {
+		b.err = errBinaryTruncated
+		return 0
+	}
+	return int(v)
+}
+
+func (b *binaryReader) byte() byte {
+	if b.err != nil {
+		return 0
+	}
+	if len(b.buf) < 1 {
+		b.err = errBinaryTruncated
+		return 0
+	}
+	v := b.buf[0]
+	b.buf = b.buf[1:]
+	return v
+}
+
+func (b *binaryReader) float64() float64 {
+	if b.err != nil {
+		return 0
+	}
+	if len(b.buf) < 8 {
+		b.err = errBinaryTruncated
+		return 0
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(b.buf))
+	b.buf = b.buf[8:]
+	return v
+}
+
+func (b *binaryReader) bytes() []byte {
+	n := b.uvarint()
+	if b.err != nil {
+		return nil
+	}
+	if n > uint64(len(b.buf)) {
+		b.err = errBinaryTruncated
+		return nil
+	}
+	v := b.buf[:n]
+	b.buf = b.buf[n:]
+	return v
+}
+
+func (b *binaryReader) string() string {
+	return string(b.bytes())
+}
+
+func (b *binaryReader) json(v interface{}) {
+	buf := b.bytes()
+	if b.err != nil || len(buf) <= 0 {
+		return
+	}
+	b.err = UnmarshalJSON(buf, v)
+}
+
+func decodeSearchResultBinary(buf []byte, rv *bleve.SearchResult) error {
+	b := &binaryReader{buf: buf}
+
+	if version := b.byte(); version != searchResultBinaryVersion {
+		return fmt.Errorf("binary search result version: %d, err: %v",
+			version, b.err)
+	}
+
+	rv.Status = &bleve.SearchStatus{
+		Total:      int(b.uvarint()),
+		Failed:     int(b.uvarint()),
+		Successful: int(b.uvarint()),
+		Errors:     make(map[string]error),
+	}
+	for i := b.count(); i > 0 && b.err == nil; i-- {
+		name := b.string()
+		rv.Status.Errors[name] = errors.New(b.string())
+	}
+
+	rv.Total = b.uvarint()
+	rv.MaxScore = b.float64()
+	rv.Took = time.Duration(b.uvarint())
+
+	numHits := b.count()
+	rv.Hits = make(search.DocumentMatchCollection, 0, numHits)
+	for i := 0; i < numHits && b.err == nil; i++ {
+		hit := &search.DocumentMatch{
+			Index: b.string(),
+			ID:    b.string(),
+			Score: b.float64(),
+		}
+
+		if n := b.count(); n > 0 {
+			hit.Sort = make([]string, 0, n)
+			for ; n > 0 && b.err == nil; n-- {
+				hit.Sort = append(hit.Sort, b.string())
+			}
+		}
+
+		if n := b.count(); n > 0 {
+			hit.Fragments = make(search.FieldFragmentMap, n)
+			for ; n > 0 && b.err == nil; n-- {
+				field := b.string()
+				m := b.count()
+				fragments := make([]string, 0, m)
+				for ; m > 0 && b.err == nil; m-- {
+					fragments = append(fragments, b.string())
+				}
+				hit.Fragments[field] = fragments
+			}
+		}
+
+		if n := b.count(); n > 0 {
+			hit.Fields = make(map[string]interface{}, n)
+			for ; n > 0 && b.err == nil; n-- {
+				field := b.string()
+				switch kind := b.byte(); kind {
+				case binaryFieldString:
+					hit.Fields[field] = b.string()
+				case binaryFieldNumber:
+					hit.Fields[field] = b.float64()
+				case binaryFieldJSON:
+					var v interface{}
+					b.json(&v)
+					hit.Fields[field] = v
+				default:
+					if b.err == nil {
+						b.err = fmt.Errorf("binary search result field kind: %d",
+							kind)
+					}
+				}
+			}
+		}
+
+		var extras binaryHitExtras
+		b.json(&extras)
+		hit.Expl = extras.Expl
+		hit.Locations = extras.Locations
+
+		rv.Hits = append(rv.Hits, hit)
+	}
+
+	b.json(&rv.Facets)
+
+	if b.err == nil && len(b.buf) > 0 {
+		b.err = fmt.Errorf("binary search result has %d trailing bytes",
+			len(b.buf))
+	}
+
+	return b.err
+}
+
+// ---------------------------------------------------------
+
+// searchRequestBinary holds the sections of a scatter-gather search
+// request, which are all that a coordinator sends to remote nodes.
+//
+// The binary encoding starts with the magic and version bytes,
+// followed by the caller, which is kept up front so that it can be
+// replaced without decoding the rest of the request.  The query, sort,
+// facets and highlight of the search request are embedded as
+// length-prefixed JSON, like the rarely used parts of a binary search
+// result.  The alias filter flag and the term stats come last.
+type searchRequestBinary struct {
+	ctl         cbgt.QueryCtlParams
+	pindexes    QueryPIndexes
+	encoding    QueryResultEncoding
+	caller      QueryCaller
+	aliasFilter QueryAliasFilter
+	termStats   QueryTermStats
+	req         *bleve.SearchRequest
+}
+
+// isSearchRequestBinary returns true when a request body is a search
+// request in the binary encoding.
+func isSearchRequestBinary(buf []byte) bool {
+	return len(buf) > 0 && buf[0] == searchRequestBinaryMagic
+}
+
+func (b *binaryWriter) bool(v bool) {
+	if v {
+		b.w.WriteByte(1)
+	} else {
+		b.w.WriteByte(0)
+	}
+}
+
+func (b *binaryWriter) strings(v []string) {
+	b.uvarint(uint64(len(v)))
+	for _, s := range v {
+		b.string(s)
+	}
+}
+
+func encodeSearchRequestBinary(r *searchRequestBinary) ([]byte, error) {
+	b := &binaryWriter{w: &bytes.Buffer{}}
+
+	b.w.WriteByte(searchRequestBinaryMagic)
+	b.w.WriteByte(searchRequestBinaryVersion)
+
+	if r.caller.Caller != nil {
+		b.json(r.caller.Caller)
+	} else {
+		b.bytes(nil)
+	}
+
+	b.uvarint(uint64(r.ctl.Ctl.Timeout))
+	if r.ctl.Ctl.Consistency != nil {
+		b.json(r.ctl.Ctl.Consistency)
+	} else {
+		b.bytes(nil)
+	}
+
+	b.strings(r.pindexes.PIndexNames)
+	b.string(r.encoding.ResultEncoding)
+
+	req := r.req
+	b.uvarint(uint64(req.Size))
+	b.uvarint(uint64(req.From))
+	b.bool(req.Explain)
+	b.bool(req.IncludeLocations)
+	b.strings(req.Fields)
+
+	b.json(req.Query)
+
+	if len(req.Sort) > 0 {
+		b.json(req.Sort)
+	} else {
+		b.bytes(nil)
+	}
+
+	if len(req.Facets) > 0 {
+		b.json(req.Facets)
+	} else {
+		b.bytes(nil)
+	}
+
+	if req.Highlight != nil {
+		b.json(req.Highlight)
+	} else {
+		b.bytes(nil)
+	}
+
+	b.bool(r.aliasFilter.AliasFilter)
+
+	if r.termStats.TermStats != nil {
+		b.json(r.termStats.TermStats)
+	} else {
+		b.bytes(nil)
+	}
+
+	return b.w.Bytes(), b.err
+}
+
+func (b *binaryReader) bool() bool {
+	return b.byte() != 0
+}
+
+func (b *binaryReader) strings() []string {
+	n := b.count()
+	if n <= 0 {
+		return nil
+	}
+	rv := make([]string, 0, n)
+	for ; n > 0 && b.err == nil; n-- {
+		rv = append(rv, b.string())
+	}
+	return rv
+}
+
+// searchRequestBinaryHeader checks the magic and version bytes of a
+// binary search request.
+func (b *binaryReader) searchRequestBinaryHeader() {
+	magic, version := b.byte(), b.byte()
+	if b.err == nil && (magic != searchRequestBinaryMagic ||
+		version != searchRequestBinaryVersion) {
+		b.err = fmt.Errorf("binary search request version: %d", version)
+	}
+}
+
+func decodeSearchRequestBinary(buf []byte) (*searchRequestBinary, error) {
+	b := &binaryReader{buf: buf}
+
+	b.searchRequestBinaryHeader()
+
+	rv := &searchRequestBinary{}
+
+	b.json(&rv.caller.Caller)
+
+	rv.ctl.Ctl.Timeout = int64(b.uvarint())
+	b.json(&rv.ctl.Ctl.Consistency)
+
+	rv.pindexes.PIndexNames = b.strings()
+	rv.encoding.ResultEncoding = b.string()
+
+	req := &bleve.SearchRequest{
+		Size:             int(b.uvarint()),
+		From:             int(b.uvarint()),
+		Explain:          b.bool(),
+		IncludeLocations: b.bool(),
+		Fields:           b.strings(),
+	}
+
+	q := b.bytes()
+	if b.err == nil {
+		req.Query, b.err = query.ParseQuery(q)
+	}
+
+	// like the JSON encoding, a missing sort means by descending score
+	var sortOrder []json.RawMessage
+	b.json(&sortOrder)
+	if b.err == nil {
+		if len(sortOrder) > 0 {
+			req.Sort, b.err = search.ParseSortOrderJSON(sortOrder)
+		} else {
+			req.Sort = search.SortOrder{&search.SortScore{Desc: true}}
+		}
+	}
+
+	b.json(&req.Facets)
+	b.json(&req.Highlight)
+
+	rv.aliasFilter.AliasFilter = b.bool()
+	b.json(&rv.termStats.TermStats)
+
+	if b.err == nil && len(b.buf) > 0 {
+		b.err = fmt.Errorf("binary search request has %d trailing bytes",
+			len(b.buf))
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	rv.req = req
+
+	return rv, nil
+}
+
+// parseSearchRequestBinary decodes a request body when it's a binary
+// search request, or returns nil for a JSON request.
+func parseSearchRequestBinary(buf []byte) (*searchRequestBinary, error) {
+	if !isSearchRequestBinary(buf) {
+		return nil, nil
+	}
+	return decodeSearchRequestBinary(buf)
+}
+
+// setSearchRequestBinaryCaller returns the binary search request with
+// its caller replaced.
+func setSearchRequestBinaryCaller(buf []byte,
+	caller *CallerIdentity) ([]byte, error) {
+	r := &binaryReader{buf: buf}
+	r.searchRequestBinaryHeader()
+	r.bytes()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	b := &binaryWriter{w: bytes.NewBuffer(make([]byte, 0, len(buf)+256))}
+	b.w.WriteByte(searchRequestBinaryMagic)
+	b.w.WriteByte(searchRequestBinaryVersion)
+	b.json(caller)
+	b.w.Write(r.buf)
+
+	return b.w.Bytes(), b.err
+}
@@ -0,0 +1,252 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+
+	"github.com/couchbase/cbgt"
+)
+
+func TestSearchResultBinary(t *testing.T) {
+	sr := &bleve.SearchResult{
+		Status: &bleve.SearchStatus{
+			Total:      2,
+			Failed:     1,
+			Successful: 1,
+			Errors:     map[string]error{"p1": errors.New("pindex not available")},
+		},
+		Hits: search.DocumentMatchCollection{
+			{
+				Index:     "p0",
+				ID:        "doc-1",
+				Score:     1.5,
+				Sort:      []string{"_score"},
+				Fragments: search.FieldFragmentMap{"desc": {"a <mark>b</mark>"}},
+				Fields: map[string]interface{}{
+					"name":  "beer",
+					"abv":   5.5,
+					"tags":  []interface{}{"x", "y"},
+					"avail": true,
+				},
+				Locations: search.FieldTermLocationMap{
+					"desc": search.TermLocationMap{
+						"b": []*search.Location{{Pos: 2, Start: 2, End: 3}},
+					},
+				},
+			},
+			{
+				ID:    "doc-2",
+				Score: 0.5,
+			},
+		},
+		Total:    2,
+		MaxScore: 1.5,
+		Took:     3 * time.Millisecond,
+		Facets: search.FacetResults{
+			"type": &search.FacetResult{Field: "type", Total: 2},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	if !writeSearchResultBinary(w, sr) {
+		t.Fatalf("expected binary encoding")
+	}
+
+	contentType := w.Header().Get("Content-Type")
+	if contentType != SearchResultBinaryContentType {
+		t.Errorf("expected binary content type, got: %s", contentType)
+	}
+
+	rv := &bleve.SearchResult{}
+	err := parseSearchResult(w.Body.Bytes(), contentType, rv)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	if rv.Status.Failed != 1 || rv.Status.Errors["p1"].Error() != "pindex not available" ||
+		rv.Total != 2 || rv.MaxScore != 1.5 || rv.Took != sr.Took {
+		t.Errorf("unexpected status or totals: %#v", rv)
+	}
+
+	if len(rv.Hits) != 2 || rv.Hits[1].ID != "doc-2" || rv.Hits[1].Fields != nil {
+		t.Fatalf("unexpected hits: %#v", rv.Hits)
+	}
+
+	hit := rv.Hits[0]
+	if hit.Index != "p0" || hit.ID != "doc-1" || hit.Score != 1.5 ||
+		!reflect.DeepEqual(hit.Sort, sr.Hits[0].Sort) ||
+		!reflect.DeepEqual(hit.Fragments, sr.Hits[0].Fragments) ||
+		!reflect.DeepEqual(hit.Fields, sr.Hits[0].Fields) ||
+		hit.Locations["desc"]["b"][0].Pos != 2 {
+		t.Errorf("unexpected hit: %#v", hit)
+	}
+
+	if rv.Facets["type"] == nil || rv.Facets["type"].Total != 2 {
+		t.Errorf("unexpected facets: %#v", rv.Facets)
+	}
+
+	// truncated results are rejected rather than misread
+	buf := w.Body.Bytes()
+	err = decodeSearchResultBinary(buf[:len(buf)-1], &bleve.SearchResult{})
+	if err == nil {
+		t.Errorf("expected err on truncated result")
+	}
+
+	// results from nodes that only speak JSON are parsed as before
+	rv = &bleve.SearchResult{}
+	err = parseSearchResult([]byte(`{"total_hits":7}`), "application/json", rv)
+	if err != nil || rv.Total != 7 {
+		t.Errorf("expected JSON fallback, got: %#v, err: %v", rv, err)
+	}
+
+	var b bytes.Buffer
+	err = encodeSearchResultBinary(&b, &bleve.SearchResult{})
+	if err != nil {
+		t.Errorf("expected empty result to encode, err: %v", err)
+	}
+}
+
+func TestSearchRequestBinary(t *testing.T) {
+	req := &bleve.SearchRequest{}
+	err := UnmarshalJSON([]byte(`{"query":{"match":"beer","field":"desc"},`+
+		`"size":5,"from":10,"explain":true,"fields":["name","abv"],`+
+		`"sort":["-abv","_id"],"highlight":{"style":"html"},`+
+		`"facets":{"type":{"field":"type","size":3}}}`), req)
+	if err != nil {
+		t.Fatalf("expected request to parse, err: %v", err)
+	}
+
+	consistency := &cbgt.ConsistencyParams{Level: "at_plus",
+		Vectors: map[string]cbgt.ConsistencyVector{"beer": {"0": 7}}}
+
+	termStats := &TermStats{DocCount: 8,
+		Fields: map[string]map[string]uint64{"desc": {"beer": 4}}}
+
+	buf, err := encodeSearchRequestBinary(&searchRequestBinary{
+		ctl: cbgt.QueryCtlParams{
+			Ctl: cbgt.QueryCtl{Timeout: 1500, Consistency: consistency},
+		},
+		pindexes: QueryPIndexes{PIndexNames: []string{"p0", "p1"}},
+		encoding: QueryResultEncoding{ResultEncoding: "binary"},
+		caller: QueryCaller{Caller: &CallerIdentity{User: "admin",
+			Domain: "local", Perms: []string{"*"}}},
+		aliasFilter: QueryAliasFilter{AliasFilter: true},
+		termStats:   QueryTermStats{TermStats: termStats},
+		req:         req,
+	})
+	if err != nil || !isSearchRequestBinary(buf) {
+		t.Fatalf("expected binary request, err: %v", err)
+	}
+
+	// the caller is replaced, as by the REST auth handler
+	buf, err = setSearchRequestBinaryCaller(buf,
+		&CallerIdentity{User: "alice", Domain: "local"})
+	if err != nil {
+		t.Fatalf("expected caller to be set, err: %v", err)
+	}
+
+	rv, err := parseSearchRequestBinary(buf)
+	if err != nil || rv == nil {
+		t.Fatalf("expected binary request to parse, err: %v", err)
+	}
+
+	if rv.ctl.Ctl.Timeout != 1500 ||
+		!reflect.DeepEqual(rv.ctl.Ctl.Consistency, consistency) ||
+		!reflect.DeepEqual(rv.pindexes.PIndexNames, []string{"p0", "p1"}) ||
+		rv.encoding.ResultEncoding != "binary" ||
+		!rv.aliasFilter.AliasFilter ||
+		!reflect.DeepEqual(rv.termStats.TermStats, termStats) {
+		t.Errorf("unexpected sections: %#v", rv)
+	}
+
+	if rv.caller.Caller == nil || rv.caller.Caller.User != "alice" ||
+		len(rv.caller.Caller.Perms) != 0 {
+		t.Errorf("expected replaced caller, got: %#v", rv.caller.Caller)
+	}
+
+	expected, _ := MarshalJSON(req)
+	actual, _ := MarshalJSON(rv.req)
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("expected search request: %s, got: %s", expected, actual)
+	}
+
+	// truncated requests are rejected rather than misread
+	_, err = decodeSearchRequestBinary(buf[:len(buf)-1])
+	if err == nil {
+		t.Errorf("expected err on truncated request")
+	}
+
+	// error messages summarize binary requests, rather than embed them
+	msg := remoteBufString(buf, isSearchRequestBinary(buf))
+	if !strings.HasPrefix(msg, "(binary, ") || strings.ContainsRune(msg, 0) {
+		t.Errorf("expected a summary of the binary request, got: %q", msg)
+	}
+
+	// requests from nodes that only speak JSON are left to the JSON parsing
+	rv, err = parseSearchRequestBinary([]byte(`{"query":{"match_all":{}}}`))
+	if err != nil || rv != nil {
+		t.Errorf("expected no binary request, got: %#v, err: %v", rv, err)
+	}
+}
+
+func TestRemoteEncoding(t *testing.T) {
+	tests := []struct {
+		features []string
+		options  map[string]string
+		expected string
+	}{
+		// a node of an older version keeps the cluster on JSON
+		{[]string{FeatureBinaryScatterGather, cbgt.NodeFeatureLeanPlan},
+			nil, ""},
+		{[]string{FeatureBinaryScatterGather, FeatureBinaryScatterGather},
+			nil, "binary"},
+		{[]string{FeatureBinaryScatterGather, FeatureBinaryScatterGather},
+			map[string]string{"remoteEncoding": "json"}, ""},
+	}
+
+	for i, test := range tests {
+		cfg := cbgt.NewCfgMem()
+		mgr := cbgt.NewManagerEx(cbgt.VERSION, cfg, cbgt.NewUUID(),
+			nil, "", 1, "", ":1000", "", "some-datasource", nil,
+			test.options)
+
+		nodeDefs := cbgt.NewNodeDefs(cbgt.VERSION)
+		for j, features := range test.features {
+			uuid := fmt.Sprintf("n%d", j)
+			nodeDefs.NodeDefs[uuid] = &cbgt.NodeDef{
+				HostPort:    uuid + ":8094",
+				UUID:        uuid,
+				ImplVersion: cbgt.VERSION,
+				Extras:      `{"features":"` + features + `"}`,
+			}
+		}
+		_, err := cbgt.CfgSetNodeDefs(cfg, cbgt.NODE_DEFS_WANTED, nodeDefs, 0)
+		if err != nil {
+			t.Fatalf("%d: expected CfgSetNodeDefs() to work, err: %v", i, err)
+		}
+
+		if enc := remoteEncoding(mgr); enc != test.expected {
+			t.Errorf("%d: expected encoding %q, got: %q", i, test.expected, enc)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// RemoteBreakerFailures is the number of consecutive failed requests
+// to a remote node that opens its circuit breaker.
+var RemoteBreakerFailures = 5
+
+// RemoteBreakerCoolDown is how long an open circuit breaker rejects
+// requests, before letting a single probe request through.
+var RemoteBreakerCoolDown = 10 * time.Second
+
+// Atomic counters that keep track of circuit breaker activity.
+var totRemoteBreakerOpened uint64
+var totRemoteBreakerRejected uint64
+
+const (
+	remoteBreakerClosed = iota
+	remoteBreakerOpen
+	remoteBreakerHalfOpen
+)
+
+var remoteBreakerStateNames = map[int]string{
+	remoteBreakerClosed:   "closed",
+	remoteBreakerOpen:     "open",
+	remoteBreakerHalfOpen: "half-open",
+}
+
+// remoteBreakerOpenErr is returned for requests that are rejected
+// because the circuit breaker of the remote node is open.
+type remoteBreakerOpenErr struct {
+	hostPort string
+}
+
+func (e *remoteBreakerOpenErr) Error() string {
+	return fmt.Sprintf("remote: circuit breaker open, hostPort: %s",
+		e.hostPort)
+}
+
+// remoteBreaker is a circuit breaker around the requests to a remote
+// node.  When closed, requests are sent as usual.  After too many
+// consecutive failures, the breaker opens and requests are rejected
+// right away.  After the cool-down period, the breaker is half-open
+// and a single probe request decides whether it closes or reopens.
+type remoteBreaker struct {
+	hostPort string
+
+	m        sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+var remoteBreakersM sync.Mutex
+var remoteBreakers = map[string]*remoteBreaker{}
+
+// remoteBreakerFor returns the circuit breaker of a remote node,
+// creating it on first use.
+func remoteBreakerFor(hostPort string) *remoteBreaker {
+	remoteBreakersM.Lock()
+	b, exists := remoteBreakers[hostPort]
+	if !exists {
+		b = &remoteBreaker{hostPort: hostPort}
+		remoteBreakers[hostPort] = b
+	}
+	remoteBreakersM.Unlock()
+	return b
+}
+
+// allow returns nil when a request may be sent to the remote node,
+// which must then be followed by a call to done().
+func (b *remoteBreaker) allow() error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	switch b.state {
+	case remoteBreakerOpen:
+		if time.Since(b.openedAt) < RemoteBreakerCoolDown {
+			break
+		}
+		b.state = remoteBreakerHalfOpen
+		fallthrough
+	case remoteBreakerHalfOpen:
+		if b.probing {
+			break
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+
+	atomic.AddUint64(&totRemoteBreakerRejected, 1)
+
+	return &remoteBreakerOpenErr{hostPort: b.hostPort}
+}
+
+// done records the outcome of a request that was allowed, which was
+// sent with the given context.
+func (b *remoteBreaker) done(ctx context.Context, err error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.probing = false
+
+	if !remoteBreakerFailure(ctx, err) {
+		if !isContextErr(err) && ctx.Err() == nil {
+			b.state = remoteBreakerClosed
+			b.failures = 0
+		}
+		return
+	}
+
+	b.failures++
+
+	if b.state == remoteBreakerHalfOpen ||
+		(b.state == remoteBreakerClosed && b.failures >= RemoteBreakerFailures) {
+		if b.state == remoteBreakerClosed {
+			log.Warnf("remote_breaker: opened, hostPort: %s, failures: %d,"+
+				" err: %v", b.hostPort, b.failures, err)
+		}
+		b.state = remoteBreakerOpen
+		b.openedAt = time.Now()
+		atomic.AddUint64(&totRemoteBreakerOpened, 1)
+	}
+}
+
+// available returns false while the breaker rejects requests.
+func (b *remoteBreaker) available() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.state == remoteBreakerClosed ||
+		(b.state == remoteBreakerOpen &&
+			time.Since(b.openedAt) >= RemoteBreakerCoolDown) ||
+		(b.state == remoteBreakerHalfOpen && !b.probing)
+}
+
+func (b *remoteBreaker) stateName() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return remoteBreakerStateNames[b.state]
+}
+
+// remoteTimeoutForwardedKey marks the context of a request whose
+// remote node was given the context's deadline, less the expected
+// round-trip overhead, as its own timeout.
+type remoteTimeoutForwardedKey struct{}
+
+func withRemoteTimeoutForwarded(ctx context.Context) context.Context {
+	return context.WithValue(ctx, remoteTimeoutForwardedKey{}, true)
+}
+
+// remoteBreakerFailure returns true for errors that show the remote
+// node to be unhealthy, like refused connections and 5xx status codes.
+// A request that outlived the deadline that was forwarded to the
+// remote node is a failure too, as a healthy node responds within its
+// timeout, if only with a timeout error, while a node that hangs or
+// drops packets doesn't.  Cancellations by the coordinator, like a
+// hedge request losing or the client going away, and the deadlines of
+// requests that didn't forward them, are not failures.
+func remoteBreakerFailure(ctx context.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	// the deadline is checked directly, as the coordinator may cancel
+	// the request as its deadline passes
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) &&
+		ctx.Value(remoteTimeoutForwardedKey{}) != nil {
+		return true
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+
+	switch e := err.(type) {
+	case *remoteQueryError:
+		return e.status >= 500
+	case *url.Error:
+		return !isContextErr(e)
+	}
+	return false
+}
+
+func isContextErr(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// withRemoteBreaker runs a request to a remote node, which is sent
+// with the given context, through the node's circuit breaker.
+func withRemoteBreaker(ctx context.Context, hostPort string,
+	f func() error) error {
+	if hostPort == "" {
+		return f()
+	}
+
+	b := remoteBreakerFor(hostPort)
+
+	err := b.allow()
+	if err != nil {
+		return err
+	}
+
+	err = f()
+	b.done(ctx, err)
+	return err
+}
+
+// numRemoteBreakersOpen returns the number of remote nodes whose
+// circuit breakers currently reject requests.
+func numRemoteBreakersOpen() int {
+	remoteBreakersM.Lock()
+	breakers := make([]*remoteBreaker, 0, len(remoteBreakers))
+	for _, b := range remoteBreakers {
+		breakers = append(breakers, b)
+	}
+	remoteBreakersM.Unlock()
+
+	rv := 0
+	for _, b := range breakers {
+		if !b.available() {
+			rv++
+		}
+	}
+	return rv
+}
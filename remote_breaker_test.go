@@ -0,0 +1,183 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+func TestRemoteBreaker(t *testing.T) {
+	savedFailures, savedCoolDown := RemoteBreakerFailures, RemoteBreakerCoolDown
+	defer func() {
+		RemoteBreakerFailures, RemoteBreakerCoolDown = savedFailures, savedCoolDown
+	}()
+	RemoteBreakerFailures = 2
+	RemoteBreakerCoolDown = time.Hour
+
+	refused := &url.Error{Op: "Post", Err: errors.New("connection refused")}
+
+	b := &remoteBreaker{hostPort: "x:8094"}
+	for i := 0; i < 2; i++ {
+		if err := b.allow(); err != nil {
+			t.Fatalf("expected closed breaker to allow, err: %v", err)
+		}
+		b.done(context.Background(), refused)
+	}
+	if b.stateName() != "open" || b.allow() == nil || b.available() {
+		t.Fatalf("expected breaker to open, state: %s", b.stateName())
+	}
+
+	RemoteBreakerCoolDown = 0
+
+	if err := b.allow(); err != nil {
+		t.Fatalf("expected half-open breaker to allow a probe, err: %v", err)
+	}
+	if b.stateName() != "half-open" || b.allow() == nil {
+		t.Errorf("expected only a single probe")
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.done(cancelled, &url.Error{Op: "Post", Err: context.Canceled})
+	if b.stateName() != "half-open" {
+		t.Errorf("expected cancelled probe to leave breaker half-open")
+	}
+
+	b.allow()
+	b.done(context.Background(), &remoteQueryError{status: 412})
+	if b.stateName() != "closed" {
+		t.Errorf("expected responsive node to close breaker")
+	}
+}
+
+func TestRemoteBreakerFailure(t *testing.T) {
+	background := context.Background()
+
+	cancelled, cancel := context.WithCancel(background)
+	cancel()
+
+	expired, cancel := context.WithTimeout(background, 0)
+	defer cancel()
+	<-expired.Done()
+
+	tests := []struct {
+		ctx context.Context
+		err error
+		exp bool
+	}{
+		{background, &url.Error{Op: "Post", Err: errors.New("connection refused")}, true},
+		{background, &remoteQueryError{status: 503}, true},
+		{background, &remoteQueryError{status: 412}, false},
+		{background, nil, false},
+		// a hedge that lost, or a client that went away
+		{cancelled, &url.Error{Op: "Post", Err: context.Canceled}, false},
+		{withRemoteTimeoutForwarded(cancelled),
+			&url.Error{Op: "Post", Err: context.Canceled}, false},
+		// only a node that was given the deadline as its timeout failed
+		{expired, &url.Error{Op: "Post", Err: context.DeadlineExceeded}, false},
+		{withRemoteTimeoutForwarded(expired),
+			&url.Error{Op: "Post", Err: context.DeadlineExceeded}, true},
+		{withRemoteTimeoutForwarded(expired), context.DeadlineExceeded, true},
+	}
+	for i, test := range tests {
+		if got := remoteBreakerFailure(test.ctx, test.err); got != test.exp {
+			t.Errorf("test: %d, err: %v, expected: %v, got: %v",
+				i, test.err, test.exp, got)
+		}
+	}
+}
+
+func TestRemoteBreakerHangingNode(t *testing.T) {
+	savedFailures := RemoteBreakerFailures
+	defer func() { RemoteBreakerFailures = savedFailures }()
+	RemoteBreakerFailures = 2
+
+	// the node accepts connections, then never responds
+	hang := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-hang:
+			case <-r.Context().Done():
+			}
+		}))
+	defer ts.Close()
+	defer close(hang)
+
+	hostPort := strings.TrimPrefix(ts.URL, "http://")
+	bc := &IndexClient{
+		HostPort:    hostPort,
+		QueryURL:    ts.URL + "/api/index/indexA/query",
+		PIndexNames: []string{"a"},
+		httpClient:  ts.Client(),
+	}
+
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+
+	search := func(ctx context.Context) *bleve.SearchResult {
+		res, err := bc.SearchInContext(ctx, req)
+		if err != nil || res == nil {
+			t.Fatalf("expected a result, res: %v, err: %v", res, err)
+		}
+		return res
+	}
+
+	// the search returns on the context, ahead of the request's outcome
+	settle := func() {
+		stats := remoteNodeStatsFor(hostPort)
+		for i := 0; i < 100 && atomic.LoadInt64(&stats.Outstanding) > 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// coordinator side cancellations aren't held against the node
+	for i := 0; i < RemoteBreakerFailures; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		search(ctx)
+		settle()
+	}
+	if state := remoteBreakerFor(hostPort).stateName(); state != "closed" {
+		t.Fatalf("expected closed breaker after cancellations, got: %s", state)
+	}
+
+	for i := 0; i < RemoteBreakerFailures; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			100*time.Millisecond)
+		search(ctx)
+		cancel()
+		settle()
+	}
+	if state := remoteBreakerFor(hostPort).stateName(); state != "open" {
+		t.Fatalf("expected open breaker after timeouts, got: %s", state)
+	}
+
+	// later queries don't wait for the timeout on the hanging node
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	start := time.Now()
+	res := search(ctx)
+	if time.Since(start) > time.Second || searchResultOk(res) {
+		t.Errorf("expected a fast failure, took: %v, res: %+v",
+			time.Since(start), res.Status)
+	}
+}
@@ -0,0 +1,450 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/document"
+	"github.com/blevesearch/bleve/index"
+	"github.com/blevesearch/bleve/index/store"
+	"github.com/blevesearch/bleve/mapping"
+
+	"github.com/couchbase/cbgt"
+)
+
+// RemoteClusterDefaultTimeout bounds the searches of an alias target
+// in a remote cluster, when the target doesn't specify a timeoutMS.
+var RemoteClusterDefaultTimeout = 10 * time.Second
+
+var remoteClusterUnimplementedErr = errors.New("remote cluster: unimplemented")
+
+// RemoteClusterDef is an administrator's definition of a remote cbft
+// cluster, whose indexes may be alias targets.  The remote cluster is
+// queried through the public query endpoint of the node at the url,
+// like "https://host:18094", with the username and password.
+// Certificates of https nodes are verified, against the PEM encoded
+// caCert when provided, else against the system's roots.
+//
+// The remote clusters are defined by the "remoteClusters" manager
+// option, which holds a JSON object keyed by remote cluster name, so
+// that the urls and credentials are owned by the administrator and
+// are never part of an alias definition.  For example...
+//
+//     {"east": {"url": "https://east:18094",
+//               "username": "user", "password": "pass"}}
+type RemoteClusterDef struct {
+	URL      string `json:"url"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	CACert   string `json:"caCert,omitempty"`
+}
+
+func (d *RemoteClusterDef) validate() error {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return fmt.Errorf("remote cluster: invalid url: %q, err: %v",
+			d.URL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("remote cluster: url must be an http or https"+
+			" base url, url: %q", d.URL)
+	}
+	if u.User != nil {
+		return fmt.Errorf("remote cluster: url must not have credentials,"+
+			" url: %s", u.Host)
+	}
+	if d.CACert != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(d.CACert)) {
+		return fmt.Errorf("remote cluster: no certs in caCert, url: %s",
+			u.Host)
+	}
+	return nil
+}
+
+// parseRemoteClusterDefs parses and validates the value of the
+// "remoteClusters" manager option.
+func parseRemoteClusterDefs(s string) (map[string]*RemoteClusterDef, error) {
+	rv := map[string]*RemoteClusterDef{}
+	if s == "" {
+		return rv, nil
+	}
+
+	err := UnmarshalJSON([]byte(s), &rv)
+	if err != nil {
+		return nil, fmt.Errorf("remote cluster: could not parse"+
+			" remoteClusters, err: %v", err)
+	}
+
+	for name, d := range rv {
+		if d == nil {
+			return nil, fmt.Errorf("remote cluster: no definition,"+
+				" cluster: %s", name)
+		}
+		err = d.validate()
+		if err != nil {
+			return nil, fmt.Errorf("remote cluster: invalid definition,"+
+				" cluster: %s, err: %v", name, err)
+		}
+	}
+
+	return rv, nil
+}
+
+// AliasParamsRemote defines an alias target that's an index of a
+// remote cluster, which is named by the cluster, and defined by the
+// "remoteClusters" manager option.
+type AliasParamsRemote struct {
+	Cluster   string `json:"cluster"`
+	IndexName string `json:"indexName,omitempty"` // Default is the target name.
+	TimeoutMS int64  `json:"timeoutMS,omitempty"`
+}
+
+func (p *AliasParamsRemote) validate() error {
+	if p.Cluster == "" {
+		return fmt.Errorf("remote cluster: cluster must be specified")
+	}
+	if p.TimeoutMS < 0 {
+		return fmt.Errorf("remote cluster: negative timeoutMS: %d",
+			p.TimeoutMS)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------
+
+// remoteClusterIndex is a bleve.Index for an alias target in a remote
+// cluster, which supports just searches and counts.  As the remote
+// cluster does its own scatter-gather, the consistency params and the
+// per-pindex features of the local cluster, like term stats, do not
+// apply.  A failed search is reported as a partial result.
+type remoteClusterIndex struct {
+	name     string
+	queryURL string
+	countURL string
+	username string
+	password string
+	timeout  time.Duration
+	client   *http.Client
+}
+
+func newRemoteClusterIndex(mgr *cbgt.Manager, targetName string,
+	p *AliasParamsRemote) (*remoteClusterIndex, error) {
+	err := p.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	defs, err := parseRemoteClusterDefs(mgr.Options()["remoteClusters"])
+	if err != nil {
+		return nil, err
+	}
+
+	d := defs[p.Cluster]
+	if d == nil {
+		return nil, fmt.Errorf("remote cluster: unknown cluster: %s",
+			p.Cluster)
+	}
+
+	indexName := p.IndexName
+	if indexName == "" {
+		indexName = targetName
+	}
+
+	client, err := remoteClusterClient(d.CACert)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := RemoteClusterDefaultTimeout
+	if p.TimeoutMS > 0 {
+		timeout = time.Duration(p.TimeoutMS) * time.Millisecond
+	}
+
+	indexURL := strings.TrimSuffix(d.URL, "/") + "/api/index/" +
+		url.PathEscape(indexName)
+
+	return &remoteClusterIndex{
+		name:     p.Cluster + "/" + indexName,
+		queryURL: indexURL + "/query",
+		countURL: indexURL + "/count",
+		username: d.Username,
+		password: d.Password,
+		timeout:  timeout,
+		client:   client,
+	}, nil
+}
+
+// remoteClusterClients are the http clients for remote clusters,
+// keyed by CA cert, so that connections are reused across queries.
+var remoteClusterClients = struct {
+	m       sync.Mutex
+	clients map[string]*http.Client
+}{clients: map[string]*http.Client{}}
+
+func remoteClusterClient(caCert string) (*http.Client, error) {
+	remoteClusterClients.m.Lock()
+	defer remoteClusterClients.m.Unlock()
+
+	if c := remoteClusterClients.clients[caCert]; c != nil {
+		return c, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caCert != "" {
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM([]byte(caCert)) {
+			return nil, fmt.Errorf("remote cluster: no certs in caCert")
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+
+	c := &http.Client{Transport: transport}
+	remoteClusterClients.clients[caCert] = c
+
+	return c, nil
+}
+
+func (r *remoteClusterIndex) Name() string {
+	return r.name
+}
+
+func (r *remoteClusterIndex) SetName(name string) {
+	r.name = name
+}
+
+func (r *remoteClusterIndex) Search(req *bleve.SearchRequest) (
+	*bleve.SearchResult, error) {
+	return r.SearchInContext(context.Background(), req)
+}
+
+// SearchInContext sends the search to the remote cluster, where an
+// error is returned as a search result whose status reports the
+// remote index as failed.
+func (r *remoteClusterIndex) SearchInContext(ctx context.Context,
+	req *bleve.SearchRequest) (*bleve.SearchResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	rv, err := r.search(ctx, req)
+	if err != nil {
+		return makeSearchResultErr(req, []string{r.name}, err), nil
+	}
+
+	return rv, nil
+}
+
+func (r *remoteClusterIndex) search(ctx context.Context,
+	req *bleve.SearchRequest) (*bleve.SearchResult, error) {
+	queryCtlParams := &cbgt.QueryCtlParams{}
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		queryCtlParams.Ctl.Timeout = int64(remaining / time.Millisecond)
+	}
+
+	buf, err := MarshalJSON(struct {
+		*cbgt.QueryCtlParams
+		*bleve.SearchRequest
+	}{
+		queryCtlParams,
+		req,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	respBuf, header, err := r.do(ctx, "POST", r.queryURL, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &bleve.SearchResult{
+		Status: &bleve.SearchStatus{
+			Errors: make(map[string]error),
+		},
+	}
+	err = parseSearchResult(respBuf, header.Get("Content-Type"), rv)
+	if err != nil {
+		return nil, fmt.Errorf("remote cluster: search error parsing"+
+			" respBuf: %s, queryURL: %s, err: %v", respBuf, r.queryURL, err)
+	}
+
+	return rv, nil
+}
+
+func (r *remoteClusterIndex) DocCount() (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	respBuf, _, err := r.do(ctx, "GET", r.countURL, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	rv := struct {
+		Count uint64 `json:"count"`
+	}{}
+	err = UnmarshalJSON(respBuf, &rv)
+	if err != nil {
+		return 0, fmt.Errorf("remote cluster: count error parsing"+
+			" respBuf: %s, countURL: %s, err: %v", respBuf, r.countURL, err)
+	}
+
+	return rv.Count, nil
+}
+
+// do sends a request to the remote cluster, returning the response
+// body on a 200 status code.
+func (r *remoteClusterIndex) do(ctx context.Context, method, urlStr string,
+	buf []byte) ([]byte, http.Header, error) {
+	req, err := http.NewRequest(method, urlStr, bytes.NewReader(buf))
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	if buf != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBuf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("remote cluster: error reading"+
+			" resp.Body, url: %s, err: %v", urlStr, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("remote cluster: got status code: %d,"+
+			" url: %s, respBuf: %s", resp.StatusCode, urlStr, respBuf)
+	}
+
+	return respBuf, resp.Header, nil
+}
+
+func (r *remoteClusterIndex) Index(id string, data interface{}) error {
+	return remoteClusterUnimplementedErr
+}
+
+func (r *remoteClusterIndex) Delete(id string) error {
+	return remoteClusterUnimplementedErr
+}
+
+func (r *remoteClusterIndex) Batch(b *bleve.Batch) error {
+	return remoteClusterUnimplementedErr
+}
+
+func (r *remoteClusterIndex) Document(id string) (*document.Document, error) {
+	return nil, remoteClusterUnimplementedErr
+}
+
+func (r *remoteClusterIndex) Fields() ([]string, error) {
+	return nil, remoteClusterUnimplementedErr
+}
+
+func (r *remoteClusterIndex) FieldDict(field string) (index.FieldDict, error) {
+	return nil, remoteClusterUnimplementedErr
+}
+
+func (r *remoteClusterIndex) FieldDictRange(field string,
+	startTerm []byte, endTerm []byte) (index.FieldDict, error) {
+	return nil, remoteClusterUnimplementedErr
+}
+
+func (r *remoteClusterIndex) FieldDictPrefix(field string,
+	termPrefix []byte) (index.FieldDict, error) {
+	return nil, remoteClusterUnimplementedErr
+}
+
+func (r *remoteClusterIndex) DumpAll() chan interface{} {
+	return nil
+}
+
+func (r *remoteClusterIndex) DumpDoc(id string) chan interface{} {
+	return nil
+}
+
+func (r *remoteClusterIndex) DumpFields() chan interface{} {
+	return nil
+}
+
+func (r *remoteClusterIndex) Close() error {
+	return remoteClusterUnimplementedErr
+}
+
+func (r *remoteClusterIndex) Mapping() mapping.IndexMapping {
+	return nil
+}
+
+func (r *remoteClusterIndex) NewBatch() *bleve.Batch {
+	return nil
+}
+
+func (r *remoteClusterIndex) Stats() *bleve.IndexStat {
+	return nil
+}
+
+func (r *remoteClusterIndex) StatsMap() map[string]interface{} {
+	return nil
+}
+
+func (r *remoteClusterIndex) GetInternal(key []byte) ([]byte, error) {
+	return nil, remoteClusterUnimplementedErr
+}
+
+func (r *remoteClusterIndex) SetInternal(key, val []byte) error {
+	return remoteClusterUnimplementedErr
+}
+
+func (r *remoteClusterIndex) DeleteInternal(key []byte) error {
+	return remoteClusterUnimplementedErr
+}
+
+func (r *remoteClusterIndex) Advanced() (index.Index, store.KVStore, error) {
+	return nil, nil, remoteClusterUnimplementedErr
+}
@@ -0,0 +1,404 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/snappy"
+
+	"github.com/couchbase/cbgt"
+	"github.com/couchbase/cbgt/rest"
+)
+
+// RemoteCompressionMinSize is the default size in bytes below which
+// scatter-gather payloads are sent uncompressed, when the
+// "remoteCompressionMinSize" manager option is not set.
+var RemoteCompressionMinSize = 1024
+
+// RemoteMaxRequestBodySize is the default limit in bytes on the size
+// of a compressed scatter-gather request body, both before and after
+// it's decompressed, when the "remoteMaxRequestBodySize" manager
+// option is not set.
+var RemoteMaxRequestBodySize = 64 * 1024 * 1024
+
+// errRemoteBodyTooLarge is returned when a scatter-gather request body
+// exceeds the RemoteMaxRequestBodySize.
+var errRemoteBodyTooLarge = fmt.Errorf("request body too large")
+
+// RemoteAcceptEncodingHeader is the response header with which a node
+// advertises the encodings that it accepts for scatter-gather request
+// bodies, so that the requests are compressed only for nodes that
+// can handle them, such as during an upgrade.
+const RemoteAcceptEncodingHeader = "X-Cbft-Accept-Encoding"
+
+// remoteCodec compresses and decompresses scatter-gather payloads for
+// a Content-Encoding.  The decode func fails with errRemoteBodyTooLarge
+// when the decoded payload would be larger than a maxSize > 0.
+type remoteCodec struct {
+	encode func([]byte) ([]byte, error)
+	decode func(buf []byte, maxSize int) ([]byte, error)
+}
+
+var remoteCodecs = map[string]*remoteCodec{
+	"snappy": {
+		encode: func(buf []byte) ([]byte, error) {
+			return snappy.Encode(nil, buf), nil
+		},
+		decode: func(buf []byte, maxSize int) ([]byte, error) {
+			// the decoded length comes from the snappy header, so it's
+			// checked before snappy allocates the decoded buffer
+			n, err := snappy.DecodedLen(buf)
+			if err != nil {
+				return nil, err
+			}
+			if maxSize > 0 && n > maxSize {
+				return nil, errRemoteBodyTooLarge
+			}
+			return snappy.Decode(nil, buf)
+		},
+	},
+	"gzip": {
+		encode: func(buf []byte) ([]byte, error) {
+			var b bytes.Buffer
+			w := gzip.NewWriter(&b)
+			_, err := w.Write(buf)
+			if err != nil {
+				return nil, err
+			}
+			err = w.Close()
+			if err != nil {
+				return nil, err
+			}
+			return b.Bytes(), nil
+		},
+		decode: func(buf []byte, maxSize int) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(buf))
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			if maxSize <= 0 {
+				return ioutil.ReadAll(r)
+			}
+			return readAllMax(r, maxSize)
+		},
+	},
+}
+
+// remoteCompression returns the encodings that this node uses for
+// scatter-gather payloads, most preferred first, from the
+// "remoteCompression" manager option, which may be "snappy" (the
+// default), "gzip" or "none", along with the size threshold.
+func remoteCompression(mgr *cbgt.Manager) ([]string, int) {
+	if mgr == nil {
+		return nil, 0
+	}
+
+	options := mgr.Options()
+
+	var encodings []string
+	switch options["remoteCompression"] {
+	case "none":
+		return nil, 0
+	case "gzip":
+		encodings = []string{"gzip", "snappy"}
+	default:
+		encodings = []string{"snappy", "gzip"}
+	}
+
+	minSize := RemoteCompressionMinSize
+	if v, exists := options["remoteCompressionMinSize"]; exists && v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil {
+			minSize = n
+		}
+	}
+
+	return encodings, minSize
+}
+
+// remoteMaxRequestBodySize returns the limit on the size of a
+// compressed scatter-gather request body, from the
+// "remoteMaxRequestBodySize" manager option.
+func remoteMaxRequestBodySize(mgr *cbgt.Manager) int {
+	if mgr != nil {
+		v, exists := mgr.Options()["remoteMaxRequestBodySize"]
+		if exists && v != "" {
+			n, err := strconv.Atoi(v)
+			if err == nil && n > 0 {
+				return n
+			}
+		}
+	}
+	return RemoteMaxRequestBodySize
+}
+
+// readAllMax reads all of r, failing with errRemoteBodyTooLarge
+// instead of reading more than maxSize bytes.
+func readAllMax(r io.Reader, maxSize int) ([]byte, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > maxSize {
+		return nil, errRemoteBodyTooLarge
+	}
+	return buf, nil
+}
+
+// parseEncodings parses an Accept-Encoding style header value,
+// ignoring any quality values.
+func parseEncodings(s string) []string {
+	var rv []string
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(strings.SplitN(e, ";", 2)[0])
+		if e != "" {
+			rv = append(rv, e)
+		}
+	}
+	return rv
+}
+
+// ---------------------------------------------------------
+
+// encodeRemoteBody compresses the body of a scatter-gather request
+// when it's large enough and the remote node is known to accept one
+// of this node's encodings, returning the encoding used, if any.
+func encodeRemoteBody(mgr *cbgt.Manager, hostPort string,
+	buf []byte) ([]byte, string) {
+	encodings, minSize := remoteCompression(mgr)
+	if len(encodings) <= 0 || len(buf) < minSize {
+		return buf, ""
+	}
+
+	s := remoteNodeStatsFor(hostPort)
+
+	accepted := s.Encodings()
+	for _, encoding := range encodings {
+		for _, a := range accepted {
+			if a != encoding {
+				continue
+			}
+
+			startTime := time.Now()
+			rv, err := remoteCodecs[encoding].encode(buf)
+			atomic.AddUint64(&s.TotCompressNS, uint64(time.Since(startTime)))
+			if err != nil || len(rv) >= len(buf) {
+				break
+			}
+
+			atomic.AddUint64(&s.TotBytesSentRaw, uint64(len(buf)))
+			atomic.AddUint64(&s.TotBytesSent, uint64(len(rv)))
+
+			return rv, encoding
+		}
+	}
+
+	atomic.AddUint64(&s.TotBytesSentRaw, uint64(len(buf)))
+	atomic.AddUint64(&s.TotBytesSent, uint64(len(buf)))
+
+	return buf, ""
+}
+
+// setRemoteEncodingHeaders sets the Content-Encoding of a
+// scatter-gather request, and asks for a compressed response.
+func setRemoteEncodingHeaders(mgr *cbgt.Manager, req *http.Request,
+	encoding string) {
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+
+	encodings, _ := remoteCompression(mgr)
+	if len(encodings) > 0 {
+		// with an explicit Accept-Encoding, the http.Client leaves the
+		// decoding of the response to readRemoteResponse()
+		req.Header.Set("Accept-Encoding", strings.Join(encodings, ", "))
+	}
+}
+
+// readRemoteResponse reads and decompresses the body of a response
+// to a scatter-gather request, and learns the encodings that the
+// remote node accepts.
+func readRemoteResponse(hostPort string, resp *http.Response) (
+	[]byte, error) {
+	s := remoteNodeStatsFor(hostPort)
+
+	if accepted := resp.Header.Get(RemoteAcceptEncodingHeader); accepted != "" {
+		s.setEncodings(parseEncodings(accepted))
+	}
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddUint64(&s.TotBytesRecv, uint64(len(buf)))
+
+	encoding := resp.Header.Get("Content-Encoding")
+	if encoding != "" {
+		codec := remoteCodecs[encoding]
+		if codec == nil {
+			return nil, fmt.Errorf("remote: unsupported Content-Encoding: %s",
+				encoding)
+		}
+
+		startTime := time.Now()
+		buf, err = codec.decode(buf, 0)
+		atomic.AddUint64(&s.TotDecompressNS, uint64(time.Since(startTime)))
+		if err != nil {
+			return nil, fmt.Errorf("remote: decoding %s response, err: %v",
+				encoding, err)
+		}
+	}
+
+	atomic.AddUint64(&s.TotBytesRecvRaw, uint64(len(buf)))
+
+	return buf, nil
+}
+
+// ---------------------------------------------------------
+
+// decodeScatterGather decompresses the body of a scatter-gather
+// request from another node, which must only happen after the request
+// has passed the auth checks.  Both the compressed and decompressed
+// bodies are limited to the remoteMaxRequestBodySize(), and larger
+// bodies fail with errRemoteBodyTooLarge.
+func decodeScatterGather(mgr *cbgt.Manager, req *http.Request) error {
+	if req.Header.Get(rest.CLUSTER_ACTION) != "fts/scatter-gather" {
+		return nil
+	}
+
+	encoding := req.Header.Get("Content-Encoding")
+	if encoding == "" || req.Body == nil {
+		return nil
+	}
+
+	codec := remoteCodecs[encoding]
+	if codec == nil {
+		return fmt.Errorf("unsupported Content-Encoding: %s", encoding)
+	}
+
+	maxSize := remoteMaxRequestBodySize(mgr)
+
+	buf, err := readAllMax(req.Body, maxSize)
+	if err != nil {
+		return err
+	}
+
+	buf, err = codec.decode(buf, maxSize)
+	if err != nil {
+		if err == errRemoteBodyTooLarge {
+			return err
+		}
+		return fmt.Errorf("decoding %s request, err: %v", encoding, err)
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(buf))
+	req.ContentLength = int64(len(buf))
+	req.Header.Del("Content-Encoding")
+
+	return nil
+}
+
+// compressScatterGather supports compression for a scatter-gather
+// request from another node, after it has passed the auth checks, by
+// decompressing the request body, and advertising the encodings that
+// this node accepts.  When the other node accepts a compressed
+// response, the returned ResponseWriter buffers the response and
+// compresses it on Close().
+func compressScatterGather(mgr *cbgt.Manager, w http.ResponseWriter,
+	req *http.Request) (*compressResponseWriter, error) {
+	if req.Header.Get(rest.CLUSTER_ACTION) != "fts/scatter-gather" {
+		return nil, nil
+	}
+
+	err := decodeScatterGather(mgr, req)
+	if err != nil {
+		return nil, err
+	}
+
+	encodings, minSize := remoteCompression(mgr)
+	if len(encodings) <= 0 {
+		return nil, nil
+	}
+
+	w.Header().Set(RemoteAcceptEncodingHeader, strings.Join(encodings, ", "))
+
+	for _, accepted := range parseEncodings(req.Header.Get("Accept-Encoding")) {
+		for _, encoding := range encodings {
+			if accepted == encoding {
+				return &compressResponseWriter{
+					ResponseWriter: w,
+					encoding:       encoding,
+					minSize:        minSize,
+				}, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	status   int
+	buf      bytes.Buffer
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.buf.Write(b)
+}
+
+// Close sends the buffered response, compressed when it's large
+// enough for that to be worthwhile.
+func (w *compressResponseWriter) Close() error {
+	body := w.buf.Bytes()
+
+	h := w.ResponseWriter.Header()
+	if len(body) >= w.minSize && h.Get("Content-Encoding") == "" {
+		encoded, err := remoteCodecs[w.encoding].encode(body)
+		if err == nil && len(encoded) < len(body) {
+			body = encoded
+			h.Set("Content-Encoding", w.encoding)
+			h.Del("Content-Length")
+		}
+	}
+
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(body)
+	return err
+}
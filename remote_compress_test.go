@@ -0,0 +1,142 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/couchbase/cbgt"
+	"github.com/couchbase/cbgt/rest"
+)
+
+func TestRemoteCompression(t *testing.T) {
+	mgr := cbgt.NewManagerEx(cbgt.VERSION, cbgt.NewCfgMem(), cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", "", "some-datasource", nil,
+		map[string]string{"remoteCompressionMinSize": "100"})
+
+	var encodings []string
+
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			encodings = append(encodings, req.Header.Get("Content-Encoding"))
+
+			cw, err := compressScatterGather(mgr, w, req)
+			if err != nil {
+				t.Errorf("expected no err, got: %v", err)
+				return
+			}
+			if cw != nil {
+				defer cw.Close()
+				w = cw
+			}
+
+			body, _ := ioutil.ReadAll(req.Body)
+			w.Write(bytes.Repeat(body, 2))
+		}))
+	defer ts.Close()
+
+	bc := &IndexClient{
+		mgr:        mgr,
+		HostPort:   "compress-test:8094",
+		httpClient: ts.Client(),
+	}
+
+	buf := bytes.Repeat([]byte(`{"field":"some text"}`), 100)
+
+	for i := 0; i < 2; i++ {
+		respBuf, err := bc.post(context.Background(), ts.URL, buf)
+		if err != nil {
+			t.Fatalf("expected no err, got: %v", err)
+		}
+		if !bytes.Equal(respBuf, bytes.Repeat(buf, 2)) {
+			t.Errorf("expected decompressed response, got len: %d", len(respBuf))
+		}
+	}
+
+	// the first request learns the encodings that the node accepts
+	if encodings[0] != "" || encodings[1] != "snappy" {
+		t.Errorf("expected only the second request to be compressed,"+
+			" got: %v", encodings)
+	}
+
+	s := remoteNodeStatsFor(bc.HostPort)
+	if atomic.LoadUint64(&s.TotBytesRecv) >= atomic.LoadUint64(&s.TotBytesRecvRaw) ||
+		s.CompressionRatio() <= 1 {
+		t.Errorf("expected compressed responses, stats: %#v", s)
+	}
+
+	// small payloads are not compressed
+	respBuf, err := bc.post(context.Background(), ts.URL, []byte(`{}`))
+	if err != nil || string(respBuf) != `{}{}` {
+		t.Errorf("expected small response, got: %s, err: %v", respBuf, err)
+	}
+	if encodings[2] != "" {
+		t.Errorf("expected small request to be uncompressed")
+	}
+}
+
+func TestDecodeScatterGatherLimits(t *testing.T) {
+	mgr := cbgt.NewManagerEx(cbgt.VERSION, cbgt.NewCfgMem(), cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", "", "some-datasource", nil,
+		map[string]string{"remoteMaxRequestBodySize": "1000"})
+
+	newReq := func(encoding string, body []byte) *http.Request {
+		req := httptest.NewRequest("POST", "/api/index/x/query",
+			bytes.NewReader(body))
+		req.Header.Set(rest.CLUSTER_ACTION, "fts/scatter-gather")
+		req.Header.Set("Content-Encoding", encoding)
+		return req
+	}
+
+	small := bytes.Repeat([]byte("a"), 500)
+	large := bytes.Repeat([]byte("a"), 100000)
+
+	for encoding, codec := range remoteCodecs {
+		buf, _ := codec.encode(small)
+		req := newReq(encoding, buf)
+		err := decodeScatterGather(mgr, req)
+		body, _ := ioutil.ReadAll(req.Body)
+		if err != nil || !bytes.Equal(body, small) {
+			t.Errorf("%s: expected decoded body, err: %v", encoding, err)
+		}
+
+		// a small compressed body that decodes to a large one
+		buf, _ = codec.encode(large)
+		if len(buf) > 1000 {
+			t.Fatalf("%s: expected a small encoding, got: %d", encoding, len(buf))
+		}
+		err = decodeScatterGather(mgr, newReq(encoding, buf))
+		if err != errRemoteBodyTooLarge {
+			t.Errorf("%s: expected too large decoded body, err: %v",
+				encoding, err)
+		}
+
+		// a large compressed body
+		err = decodeScatterGather(mgr, newReq(encoding, large))
+		if err != errRemoteBodyTooLarge {
+			t.Errorf("%s: expected too large body, err: %v", encoding, err)
+		}
+	}
+
+	// a snappy header that declares a huge decoded length
+	err := decodeScatterGather(mgr,
+		newReq("snappy", []byte{0xff, 0xff, 0xff, 0xff, 0x0f}))
+	if err != errRemoteBodyTooLarge {
+		t.Errorf("expected too large snappy header, err: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/cbgt"
+)
+
+// RemoteRequestOverheadMin is the default floor of the time that's
+// held back from the timeout of a remote query for the round-trip and
+// serialization, when the "remoteRequestOverheadMin" manager option
+// (in milliseconds) is not set.  The default ceiling is
+// RemoteRequestOverhead, overridden by "remoteRequestOverheadMax".
+var RemoteRequestOverheadMin = 20 * time.Millisecond
+
+// RemoteRequestOverheadFactor is the safety margin applied to the
+// measured overhead of a remote node.
+var RemoteRequestOverheadFactor = 2.0
+
+// ServerTimingHeader is the standard response header through which a
+// node reports how long it took to execute a scatter-gather request.
+const ServerTimingHeader = "Server-Timing"
+
+// remoteRequestOverhead returns the time to hold back from the
+// remaining time of a query when forwarding it to a remote node, based
+// on the node's measured overhead, within the configured floor and
+// ceiling.  Short timeouts keep at least half of the remaining time
+// for the remote node, rather than being rejected up front.
+func remoteRequestOverhead(mgr *cbgt.Manager, hostPort string,
+	remaining time.Duration) time.Duration {
+	floor, ceiling := RemoteRequestOverheadMin, RemoteRequestOverhead
+	if mgr != nil {
+		options := mgr.Options()
+		floor = parseOptionsMillis(options, "remoteRequestOverheadMin", floor)
+		ceiling = parseOptionsMillis(options, "remoteRequestOverheadMax", ceiling)
+	}
+
+	rv := ceiling // Until there are measurements.
+	if ms := remoteNodeStatsFor(hostPort).OverheadEWMA(); ms > 0 {
+		rv = time.Duration(ms * RemoteRequestOverheadFactor *
+			float64(time.Millisecond))
+	}
+
+	if rv > ceiling {
+		rv = ceiling
+	}
+	if rv > remaining/2 {
+		rv = remaining / 2
+	}
+	if rv < floor {
+		rv = floor
+	}
+
+	return rv
+}
+
+func parseOptionsMillis(options map[string]string, name string,
+	defaultVal time.Duration) time.Duration {
+	v, exists := options[name]
+	if !exists || v == "" {
+		return defaultVal
+	}
+	ms, err := strconv.Atoi(v)
+	if err != nil || ms < 0 {
+		return defaultVal
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// parseServerTiming returns the execution time reported by a remote
+// node in a "Server-Timing: exec;dur=<ms>" response header.
+func parseServerTiming(h http.Header) (time.Duration, bool) {
+	for _, metric := range strings.Split(h.Get(ServerTimingHeader), ",") {
+		parts := strings.Split(strings.TrimSpace(metric), ";")
+		if parts[0] != "exec" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "dur=") {
+				continue
+			}
+			ms, err := strconv.ParseFloat(param[len("dur="):], 64)
+			if err != nil || ms < 0 {
+				return 0, false
+			}
+			return time.Duration(ms * float64(time.Millisecond)), true
+		}
+	}
+	return 0, false
+}
+
+// ---------------------------------------------------------
+
+// serverTimingWriter reports the execution time of a scatter-gather
+// request in the Server-Timing header, as of when the response starts
+// to be written.
+type serverTimingWriter struct {
+	http.ResponseWriter
+	startTime time.Time
+	wrote     bool
+}
+
+func newServerTimingWriter(w http.ResponseWriter) *serverTimingWriter {
+	return &serverTimingWriter{ResponseWriter: w, startTime: time.Now()}
+}
+
+func (w *serverTimingWriter) setHeader() {
+	if !w.wrote {
+		w.wrote = true
+		w.Header().Set(ServerTimingHeader, fmt.Sprintf("exec;dur=%.3f",
+			float64(time.Since(w.startTime))/float64(time.Millisecond)))
+	}
+}
+
+func (w *serverTimingWriter) WriteHeader(status int) {
+	w.setHeader()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *serverTimingWriter) Write(b []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush supports streamed responses.
+func (w *serverTimingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.setHeader()
+		f.Flush()
+	}
+}
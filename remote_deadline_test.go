@@ -0,0 +1,132 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/couchbase/cbgt"
+)
+
+func TestRemoteRequestOverhead(t *testing.T) {
+	mgr := cbgt.NewManagerEx(cbgt.VERSION, cbgt.NewCfgMem(), cbgt.NewUUID(),
+		nil, "", 1, "", ":1000", "", "some-datasource", nil,
+		map[string]string{
+			"remoteRequestOverheadMin": "10",
+			"remoteRequestOverheadMax": "300",
+		})
+
+	hostPort := "overhead-test:8094"
+
+	// nodes that weren't measured get the ceiling
+	d := remoteRequestOverhead(mgr, hostPort, 10*time.Second)
+	if d != 300*time.Millisecond {
+		t.Errorf("expected ceiling, got: %v", d)
+	}
+
+	remoteNodeStatsFor(hostPort).addOverhead(2 * time.Millisecond)
+	d = remoteRequestOverhead(mgr, hostPort, 10*time.Second)
+	if d != 10*time.Millisecond {
+		t.Errorf("expected floor, got: %v", d)
+	}
+
+	remoteNodeStatsFor(hostPort).addOverhead(102 * time.Millisecond)
+	d = remoteRequestOverhead(mgr, hostPort, 10*time.Second)
+	if d != time.Duration(2*22*float64(time.Millisecond)) {
+		t.Errorf("expected measured overhead, got: %v", d)
+	}
+
+	// short timeouts keep half of the remaining time for the remote node
+	d = remoteRequestOverhead(mgr, hostPort, 40*time.Millisecond)
+	if d != 20*time.Millisecond {
+		t.Errorf("expected half of the remaining time, got: %v", d)
+	}
+
+	d = remoteRequestOverhead(nil, "unknown:8094", 10*time.Second)
+	if d != RemoteRequestOverhead {
+		t.Errorf("expected default ceiling, got: %v", d)
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	tests := []struct {
+		header string
+		exp    time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"exec;dur=12.5", 12500 * time.Microsecond, true},
+		{"db;dur=3, exec;desc=\"search\";dur=7", 7 * time.Millisecond, true},
+		{"exec", 0, false},
+		{"exec;dur=-1", 0, false},
+	}
+	for i, test := range tests {
+		h := http.Header{}
+		h.Set(ServerTimingHeader, test.header)
+		d, ok := parseServerTiming(h)
+		if d != test.exp || ok != test.ok {
+			t.Errorf("test %d, header: %q, got: %v, %v", i, test.header, d, ok)
+		}
+	}
+}
+
+func TestRemoteSearchRecordsOverhead(t *testing.T) {
+	var gotTimeout bool
+
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			var q cbgt.QueryCtlParams
+			UnmarshalJSON(body, &q)
+			gotTimeout = q.Ctl.Timeout > 0 && q.Ctl.Timeout < 10000
+
+			w = newServerTimingWriter(w)
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte(`{"status":{"total":1,"successful":1},` +
+				`"total_hits":1}`))
+		}))
+	defer ts.Close()
+
+	bc := &IndexClient{
+		QueryURL:    ts.URL,
+		HostPort:    "overhead-search-test:8094",
+		PIndexNames: []string{"p0"},
+		httpClient:  ts.Client(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := bc.SearchInContext(ctx,
+		bleve.NewSearchRequest(bleve.NewMatchAllQuery()))
+	if err != nil || res.Total != 1 {
+		t.Fatalf("expected search result, got: %#v, err: %v", res, err)
+	}
+
+	if !gotTimeout {
+		t.Errorf("expected the remaining timeout to be forwarded")
+	}
+
+	// the sleep on the remote node is execution time, not overhead
+	overhead := remoteNodeStatsFor(bc.HostPort).OverheadEWMA()
+	if overhead <= 0 || overhead >= 50 {
+		t.Errorf("expected overhead without the execution time, got: %v",
+			overhead)
+	}
+}
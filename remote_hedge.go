@@ -0,0 +1,230 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+// RemoteHedgeBudgetDefault is the default fraction of remote requests
+// that may be hedged, when the "remoteHedgeBudget" manager option is
+// not set.
+var RemoteHedgeBudgetDefault = 0.1
+
+// RemoteHedgeBurst caps the number of hedges that can be sent in a
+// burst, so that hedging can't amplify load during an incident.
+var RemoteHedgeBurst = 10.0
+
+// RemoteHedgeMinSamples is the number of response times of a remote
+// node needed before its hedge delay is trusted.
+var RemoteHedgeMinSamples = 20
+
+// RemoteLatencySamples is the number of recent response times of a
+// remote node that its hedge delay percentile is computed from.
+var RemoteLatencySamples = 1000
+
+// Atomic counters that keep track of hedged remote requests.
+var totRemoteHedges uint64
+var totRemoteHedgeWins uint64
+var totRemoteHedgeBudgetExceeded uint64
+
+// remoteLatencyTracker tracks the recent response times of a remote
+// node, as part of its RemoteNodeStats.
+type remoteLatencyTracker struct {
+	m       sync.Mutex
+	samples []float64 // Ring buffer, in milliseconds.
+	next    int
+	sorted  []float64 // Cached sorted copy of the samples, or nil.
+}
+
+func (t *remoteLatencyTracker) add(ms float64) {
+	t.m.Lock()
+	if len(t.samples) < RemoteLatencySamples {
+		t.samples = append(t.samples, ms)
+	} else {
+		t.samples[t.next%len(t.samples)] = ms
+	}
+	t.next++
+	if t.next%(RemoteLatencySamples/20+1) == 0 {
+		t.sorted = nil
+	}
+	t.m.Unlock()
+}
+
+// percentile returns the response time at the given percentile, or
+// false when there aren't enough samples.
+func (t *remoteLatencyTracker) percentile(p float64) (time.Duration, bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if len(t.samples) < RemoteHedgeMinSamples {
+		return 0, false
+	}
+
+	if t.sorted == nil {
+		t.sorted = append([]float64(nil), t.samples...)
+		sort.Float64s(t.sorted)
+	}
+
+	i := int(float64(len(t.sorted)-1) * p / 100.0)
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(t.sorted) {
+		i = len(t.sorted) - 1
+	}
+
+	return time.Duration(t.sorted[i] * float64(time.Millisecond)), true
+}
+
+// remoteHedgeTokens is a token bucket, where each hedgeable request
+// earns a fraction of a token, and each hedge spends a token.
+var remoteHedgeTokens = &remoteHedgeBudget{}
+
+type remoteHedgeBudget struct {
+	m      sync.Mutex
+	tokens float64
+}
+
+func (b *remoteHedgeBudget) earn(budget float64) {
+	b.m.Lock()
+	b.tokens += budget
+	if b.tokens > RemoteHedgeBurst {
+		b.tokens = RemoteHedgeBurst
+	}
+	b.m.Unlock()
+}
+
+func (b *remoteHedgeBudget) take() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// hedgeDelay returns how much longer to wait for the response of a
+// remote node to a request that was sent at the given time, which is
+// before the caller asked for the result when the request was
+// prefetched, or false when the node doesn't have enough response
+// times yet.
+func hedgeDelay(hostPort string, percentile float64,
+	sent time.Time) (time.Duration, bool) {
+	delay, ok := remoteNodeStatsFor(hostPort).latencies.percentile(percentile)
+	if !ok {
+		return 0, false
+	}
+
+	delay -= time.Since(sent)
+	if delay < 0 {
+		delay = 0
+	}
+
+	return delay, true
+}
+
+// searchHedged waits for the result of the IndexClient's search, and
+// if the remote node hasn't responded within the hedge delay of the
+// request's send time, sends the same search to replica nodes,
+// returning whichever successful result arrives first.  The hedge
+// delay is a percentile of the remote node's own response times.  The
+// caller cancels the loser.
+func (r *IndexClient) searchHedged(ctx context.Context,
+	req *bleve.SearchRequest, resultCh chan *bleve.SearchResult,
+	sent time.Time) *bleve.SearchResult {
+	remoteHedgeTokens.earn(r.replicas.hedgeBudget)
+
+	delay, ok := hedgeDelay(r.HostPort, r.replicas.hedgePercentile, sent)
+	if !ok {
+		return r.waitSearch(ctx, req, resultCh)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return makeSearchResultErr(req, r.PIndexNames, ctx.Err())
+	case rv := <-resultCh:
+		return rv
+	case <-timer.C:
+		// a result that's ready along with the timer still wins
+		select {
+		case rv := <-resultCh:
+			return rv
+		default:
+		}
+	}
+
+	alt, _ := r.replicas.alternates(r.PIndexNames, r.HostPort)
+	if alt == nil {
+		return r.waitSearch(ctx, req, resultCh)
+	}
+
+	if !remoteHedgeTokens.take() {
+		atomic.AddUint64(&totRemoteHedgeBudgetExceeded, 1)
+		return r.waitSearch(ctx, req, resultCh)
+	}
+
+	atomic.AddUint64(&totRemoteHedges, 1)
+	atomic.AddUint64(&remoteNodeStatsFor(r.HostPort).TotHedged, 1)
+
+	hedgeCtx, hedgeCancel := context.WithCancel(ctx)
+	defer hedgeCancel()
+
+	hedgeCh := make(chan *bleve.SearchResult, 1)
+
+	go func() {
+		rv, err := alt.SearchInContext(hedgeCtx, req)
+		if err != nil {
+			rv = makeSearchResultErr(req, r.PIndexNames, err)
+		}
+		hedgeCh <- rv
+	}()
+
+	var rv *bleve.SearchResult
+	for pending := 2; pending > 0; pending-- {
+		select {
+		case <-ctx.Done():
+			return makeSearchResultErr(req, r.PIndexNames, ctx.Err())
+		case rv = <-resultCh:
+			resultCh = nil
+			if searchResultOk(rv) {
+				return rv
+			}
+		case rv = <-hedgeCh:
+			hedgeCh = nil
+			if searchResultOk(rv) {
+				atomic.AddUint64(&totRemoteHedgeWins, 1)
+				// the replicas served the request, so errors from
+				// the cancelled primary request are not reported
+				r.setLastFinal(http.StatusOK)
+				return rv
+			}
+		}
+	}
+
+	return rv
+}
+
+func searchResultOk(rv *bleve.SearchResult) bool {
+	return rv != nil && (rv.Status == nil || rv.Status.Failed <= 0)
+}
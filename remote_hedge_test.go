@@ -0,0 +1,92 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRemoteLatencyTracker(t *testing.T) {
+	tr := &remoteLatencyTracker{}
+
+	if _, ok := tr.percentile(95); ok {
+		t.Errorf("expected no percentile without samples")
+	}
+
+	for i := 1; i <= 100; i++ {
+		tr.add(float64(i))
+	}
+
+	d, ok := tr.percentile(95)
+	if !ok || d != 95*time.Millisecond {
+		t.Errorf("expected p95 of 95ms, got: %v, %v", d, ok)
+	}
+	d, ok = tr.percentile(0)
+	if !ok || d != time.Millisecond {
+		t.Errorf("expected p0 of 1ms, got: %v, %v", d, ok)
+	}
+}
+
+func TestHedgeDelay(t *testing.T) {
+	slow := remoteNodeStatsFor("hedge-slow:8094")
+	fast := remoteNodeStatsFor("hedge-fast:8094")
+	for i := 0; i < RemoteHedgeMinSamples; i++ {
+		slow.latencies.add(1000)
+		fast.latencies.add(10)
+	}
+
+	// each node's delay comes from its own response times
+	d, ok := hedgeDelay("hedge-slow:8094", 50, time.Now())
+	if !ok || d < 900*time.Millisecond || d > time.Second {
+		t.Errorf("expected a delay of about 1s, got: %v, %v", d, ok)
+	}
+	d, ok = hedgeDelay("hedge-fast:8094", 50, time.Now())
+	if !ok || d > 10*time.Millisecond {
+		t.Errorf("expected a delay of at most 10ms, got: %v, %v", d, ok)
+	}
+
+	if _, ok = hedgeDelay("hedge-new:8094", 50, time.Now()); ok {
+		t.Errorf("expected no delay for a node without samples")
+	}
+
+	// a request that was prefetched long ago is hedged right away
+	d, ok = hedgeDelay("hedge-slow:8094", 50, time.Now().Add(-time.Minute))
+	if !ok || d != 0 {
+		t.Errorf("expected no delay left, got: %v, %v", d, ok)
+	}
+}
+
+func TestRemoteHedgeBudget(t *testing.T) {
+	b := &remoteHedgeBudget{}
+	if b.take() {
+		t.Errorf("expected empty budget")
+	}
+
+	for i := 0; i < 4; i++ {
+		b.earn(0.25)
+	}
+	if !b.take() || b.take() {
+		t.Errorf("expected exactly 1 hedge from 4 requests")
+	}
+
+	for i := 0; i < 1000; i++ {
+		b.earn(1)
+	}
+	n := 0
+	for b.take() {
+		n++
+	}
+	if n != int(RemoteHedgeBurst) {
+		t.Errorf("expected budget capped at burst, got: %d", n)
+	}
+}
@@ -0,0 +1,348 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/couchbase/cbgt"
+
+	log "github.com/couchbase/clog"
+)
+
+// Atomic counters that keep track of the retries of failed pindexes
+// on replica nodes.
+var totRemoteFallbacks uint64
+var totRemoteFallbackFailures uint64
+
+// remoteReplicas knows the replica nodes of the remote pindexes of a
+// query, so that the sub-request of an IndexClient can be sent to
+// alternate nodes.  It's shared by the targets of a query.
+type remoteReplicas struct {
+	mgr       *cbgt.Manager
+	chooser   *remoteTargetChooser
+	newClient func(pindexName string, nodeDef *cbgt.NodeDef) *IndexClient
+
+	// Percentile of the recent response times of a remote node after
+	// which a hedge request is sent, or 0 when hedging is disabled.
+	hedgePercentile float64
+	hedgeBudget     float64
+
+	// When true, failed pindexes are retried once on replica nodes.
+	fallback bool
+
+	m            sync.Mutex
+	planPIndexes map[string]*cbgt.PlanPIndex
+	fallbacks    map[string]string // Pindex name => HostPort.
+}
+
+// newRemoteReplicas returns nil when none of the features that need
+// replica nodes are enabled.  Fallback is opt-in, and enabled when the
+// "remoteFallback" manager option is "true".
+func newRemoteReplicas(mgr *cbgt.Manager, chooser *remoteTargetChooser,
+	newClient func(string, *cbgt.NodeDef) *IndexClient) *remoteReplicas {
+	options := mgr.Options()
+
+	hedgePercentile := parseRemoteOptionFloat(options,
+		"remoteHedgePercentile", 0)
+	fallback := options["remoteFallback"] == "true"
+	if hedgePercentile <= 0 && !fallback {
+		return nil
+	}
+
+	return &remoteReplicas{
+		mgr:             mgr,
+		chooser:         chooser,
+		newClient:       newClient,
+		hedgePercentile: hedgePercentile,
+		hedgeBudget: parseRemoteOptionFloat(options,
+			"remoteHedgeBudget", RemoteHedgeBudgetDefault),
+		fallback:     fallback,
+		planPIndexes: map[string]*cbgt.PlanPIndex{},
+	}
+}
+
+func parseRemoteOptionFloat(options map[string]string,
+	name string, defaultVal float64) float64 {
+	v, exists := options[name]
+	if !exists || v == "" {
+		return defaultVal
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Warnf("remote_replicas: parse option: %s, val: %s, err: %v",
+			name, v, err)
+		return defaultVal
+	}
+	return f
+}
+
+func (rr *remoteReplicas) add(planPIndex *cbgt.PlanPIndex) {
+	rr.m.Lock()
+	rr.planPIndexes[planPIndex.Name] = planPIndex
+	rr.m.Unlock()
+}
+
+// planPIndex returns the plan of a pindex, re-reading the plan from
+// the cfg for pindexes that the query didn't resolve to a node, as
+// the plan might have moved on, such as during a rebalance.
+func (rr *remoteReplicas) planPIndex(pindexName string) *cbgt.PlanPIndex {
+	rr.m.Lock()
+	planPIndex := rr.planPIndexes[pindexName]
+	rr.m.Unlock()
+	if planPIndex != nil {
+		return planPIndex
+	}
+
+	planPIndexes, _, err := rr.mgr.GetPlanPIndexes(true)
+	if err != nil || planPIndexes == nil {
+		return nil
+	}
+
+	planPIndex = planPIndexes.PlanPIndexes[pindexName]
+	if planPIndex != nil {
+		rr.add(planPIndex)
+	}
+	return planPIndex
+}
+
+// alternates returns a target that covers the given pindexes using
+// nodes other than the excluded HostPort, along with the HostPort
+// chosen for each pindex, or nil when some pindex has no other node.
+// The fastest replica node is preferred.
+func (rr *remoteReplicas) alternates(pindexNames []string,
+	excludeHostPort string) (bleve.Index, map[string]string) {
+	clients := make([]*IndexClient, 0, len(pindexNames))
+	hostPorts := make(map[string]string, len(pindexNames))
+
+	for _, pindexName := range pindexNames {
+		planPIndex := rr.planPIndex(pindexName)
+		if planPIndex == nil {
+			return nil, nil
+		}
+
+		var best *RemoteTarget
+		var bestLatency float64
+		for _, c := range rr.chooser.candidates(planPIndex) {
+			if c.HostPort == excludeHostPort {
+				continue
+			}
+			latency := c.Stats.LatencyEWMA()
+			if best == nil || latency < bestLatency {
+				best, bestLatency = c, latency
+			}
+		}
+		if best == nil {
+			return nil, nil
+		}
+
+		client := rr.newClient(pindexName, best.NodeDef)
+		if client == nil {
+			return nil, nil
+		}
+
+		clients = append(clients, client)
+		hostPorts[pindexName] = client.HostPort
+	}
+
+	grouped, err := GroupIndexClientsByHostPort(clients)
+	if err != nil || len(grouped) <= 0 {
+		return nil, nil
+	}
+	if len(grouped) == 1 {
+		return grouped[0], hostPorts
+	}
+
+	alias := bleve.NewIndexAlias()
+	for _, client := range grouped {
+		alias.Add(client)
+	}
+	return alias, hostPorts
+}
+
+// searchFallback retries the failed pindexes of a search once on
+// replica nodes, returning the search result with any successfully
+// retried pindexes merged in.
+func (rr *remoteReplicas) searchFallback(ctx context.Context,
+	req *bleve.SearchRequest, rv *bleve.SearchResult,
+	excludeHostPort string) *bleve.SearchResult {
+	if rv == nil || rv.Status == nil || ctx.Err() != nil {
+		return rv
+	}
+
+	var failed []string
+	for name, err := range rv.Status.Errors {
+		if remoteErrRetryable(err) {
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) <= 0 {
+		return rv
+	}
+	sort.Strings(failed)
+
+	pindexNames := make([]string, 0, len(failed))
+	for _, name := range failed {
+		pindexNames = append(pindexNames, pindexNameForHitIndex(name))
+	}
+
+	alt, hostPorts := rr.alternates(pindexNames, excludeHostPort)
+	if alt == nil {
+		return rv
+	}
+
+	atomic.AddUint64(&totRemoteFallbacks, 1)
+
+	fallbackRV, err := alt.SearchInContext(ctx, req)
+	if err != nil || !searchResultOk(fallbackRV) {
+		atomic.AddUint64(&totRemoteFallbackFailures, 1)
+		return rv
+	}
+
+	rr.m.Lock()
+	if rr.fallbacks == nil {
+		rr.fallbacks = map[string]string{}
+	}
+	for pindexName, hostPort := range hostPorts {
+		rr.fallbacks[pindexName] = hostPort
+	}
+	rr.m.Unlock()
+
+	return mergeFallbackResult(req, rv, fallbackRV, failed)
+}
+
+// Fallbacks returns the pindexes that were served by replica nodes,
+// keyed by pindex name, with the HostPort of the replica node.
+func (rr *remoteReplicas) Fallbacks() map[string]string {
+	rr.m.Lock()
+	defer rr.m.Unlock()
+
+	if len(rr.fallbacks) <= 0 {
+		return nil
+	}
+
+	rv := make(map[string]string, len(rr.fallbacks))
+	for pindexName, hostPort := range rr.fallbacks {
+		rv[pindexName] = hostPort
+	}
+	return rv
+}
+
+// mergeFallbackResult replaces the failed pindexes of a search result
+// with the result of their fallback search.
+func mergeFallbackResult(req *bleve.SearchRequest,
+	rv, fallbackRV *bleve.SearchResult, failed []string) *bleve.SearchResult {
+	for _, name := range failed {
+		delete(rv.Status.Errors, name)
+	}
+	rv.Status.Total -= len(failed)
+	rv.Status.Failed -= len(failed)
+
+	rv.Merge(fallbackRV)
+
+	cachedScoring := req.Sort.CacheIsScore()
+	cachedDesc := req.Sort.CacheDescending()
+	sort.SliceStable(rv.Hits, func(i, j int) bool {
+		return req.Sort.Compare(cachedScoring, cachedDesc,
+			rv.Hits[i], rv.Hits[j]) < 0
+	})
+
+	if size := req.From + req.Size; len(rv.Hits) > size {
+		rv.Hits = rv.Hits[:size]
+	}
+
+	return rv
+}
+
+// remoteErrRetryable returns true for the errors of a pindex that a
+// replica node might not have, like a refused connection, a 5xx
+// status code or an unavailable pindex.
+func remoteErrRetryable(err error) bool {
+	switch e := err.(type) {
+	case *remoteQueryError:
+		return e.status >= 500 ||
+			strings.Contains(string(e.body), "pindex not available")
+	case *url.Error:
+		return !e.Timeout() &&
+			e.Err != context.Canceled && e.Err != context.DeadlineExceeded
+	case *remoteBreakerOpenErr:
+		return true
+	}
+	return err != nil && strings.Contains(err.Error(), "pindex not available")
+}
+
+// ---------------------------------------------------------
+
+// fallbackPIndex is a MissingPIndex that retries the search on the
+// replica nodes of the pindex.
+type fallbackPIndex struct {
+	*MissingPIndex
+	replicas *remoteReplicas
+}
+
+func (f *fallbackPIndex) Search(req *bleve.SearchRequest) (
+	*bleve.SearchResult, error) {
+	return f.SearchInContext(context.Background(), req)
+}
+
+func (f *fallbackPIndex) SearchInContext(ctx context.Context,
+	req *bleve.SearchRequest) (*bleve.SearchResult, error) {
+	rv, err := f.MissingPIndex.SearchInContext(ctx, req)
+	if err == nil {
+		return rv, nil
+	}
+
+	rv = f.replicas.searchFallback(ctx, req,
+		makeSearchResultErr(req, []string{f.Name()}, err), "")
+	if !searchResultOk(rv) {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// aliasFallbacks returns the pindexes of an alias built by
+// bleveIndexAlias() that were served by replica nodes.
+func aliasFallbacks(alias bleve.IndexAlias) map[string]string {
+	var rv map[string]string
+
+	seen := map[*remoteReplicas]bool{}
+	for _, target := range aliasTargets(alias) {
+		var rr *remoteReplicas
+		switch t := target.(type) {
+		case *IndexClient:
+			rr = t.replicas
+		case *fallbackPIndex:
+			rr = t.replicas
+		}
+		if rr == nil || seen[rr] {
+			continue
+		}
+		seen[rr] = true
+
+		for pindexName, hostPort := range rr.Fallbacks() {
+			if rv == nil {
+				rv = map[string]string{}
+			}
+			rv[pindexName] = hostPort
+		}
+	}
+
+	return rv
+}
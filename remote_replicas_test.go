@@ -0,0 +1,92 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+
+	"github.com/couchbase/cbgt"
+)
+
+func TestRemoteErrRetryable(t *testing.T) {
+	tests := []struct {
+		err error
+		exp bool
+	}{
+		{&remoteQueryError{status: 503}, true},
+		{&remoteQueryError{status: 412}, false},
+		{&remoteQueryError{status: 400,
+			body: []byte(`{"error":"pindex not available"}`)}, true},
+		{&url.Error{Op: "Post", Err: errors.New("connection refused")}, true},
+		{&url.Error{Op: "Post", Err: context.Canceled}, false},
+		{errors.New("pindex not available"), true},
+		{context.DeadlineExceeded, false},
+	}
+	for i, test := range tests {
+		if got := remoteErrRetryable(test.err); got != test.exp {
+			t.Errorf("test: %d, err: %v, expected: %v, got: %v",
+				i, test.err, test.exp, got)
+		}
+	}
+}
+
+func TestMergeFallbackResult(t *testing.T) {
+	req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 2, 0, false)
+
+	rv := makeSearchResultErr(req, []string{"p1"}, errors.New("pindex not available"))
+	rv.Status.Total++
+	rv.Status.Successful++
+	rv.Total = 1
+	rv.Hits = search.DocumentMatchCollection{{ID: "a", Score: 1}}
+
+	fallbackRV := &bleve.SearchResult{
+		Status: &bleve.SearchStatus{Total: 1, Successful: 1},
+		Total:  2,
+		Hits: search.DocumentMatchCollection{
+			{ID: "b", Score: 3}, {ID: "c", Score: 0.5},
+		},
+	}
+
+	rv = mergeFallbackResult(req, rv, fallbackRV, []string{"p1"})
+	if !searchResultOk(rv) || rv.Status.Total != 2 || rv.Status.Successful != 2 {
+		t.Errorf("unexpected status: %+v", rv.Status)
+	}
+	if rv.Total != 3 || len(rv.Hits) != 2 ||
+		rv.Hits[0].ID != "b" || rv.Hits[1].ID != "a" {
+		t.Errorf("unexpected merged hits: %v", rv.Hits)
+	}
+}
+
+func TestNewRemoteReplicasOptIn(t *testing.T) {
+	newMgr := func(options map[string]string) *cbgt.Manager {
+		return cbgt.NewManagerEx(cbgt.VERSION, cbgt.NewCfgMem(),
+			cbgt.NewUUID(), nil, "", 1, "", ":1000", "", "some-datasource",
+			nil, options)
+	}
+
+	if rr := newRemoteReplicas(newMgr(nil), nil, nil); rr != nil {
+		t.Errorf("expected no replicas by default, got: %+v", rr)
+	}
+
+	rr := newRemoteReplicas(newMgr(map[string]string{
+		"remoteFallback": "true",
+	}), nil, nil)
+	if rr == nil || !rr.fallback || rr.hedgePercentile != 0 {
+		t.Errorf("expected opted-in fallback, got: %+v", rr)
+	}
+}
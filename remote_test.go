@@ -12,8 +12,14 @@
 package cbft
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"sync/atomic"
 	"testing"
+
+	"github.com/blevesearch/bleve"
 )
 
 func TestNegativeIndexClient(t *testing.T) {
@@ -28,8 +34,8 @@ func TestNegativeIndexClient(t *testing.T) {
 		t.Errorf("expected unimplemented")
 	}
 	d, err := bc.Document("")
-	if err != indexClientUnimplementedErr || d != nil {
-		t.Errorf("expected unimplemented")
+	if err == nil || d != nil {
+		t.Errorf("expected document error on empty QueryURL")
 	}
 	c, err := bc.DocCount()
 	if err == nil || c != 0 {
@@ -40,8 +46,8 @@ func TestNegativeIndexClient(t *testing.T) {
 		t.Errorf("expected search error on empty QueryURL")
 	}
 	f, err := bc.Fields()
-	if err != indexClientUnimplementedErr || f != nil {
-		t.Errorf("expected unimplemented")
+	if err == nil || f != nil {
+		t.Errorf("expected fields error on empty QueryURL")
 	}
 	if bc.DumpAll() != nil {
 		t.Errorf("expected nil")
@@ -149,3 +155,43 @@ func TestGroupIndexClientsByHostPort(t *testing.T) {
 		t.Errorf("expect 0 hostPorts")
 	}
 }
+
+func TestIndexClientPrefetch(t *testing.T) {
+	var numRequests int32
+
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&numRequests, 1)
+			w.Write([]byte(`{"status":{"total":1,"successful":1},"total_hits":3}`))
+		}))
+	defer ts.Close()
+
+	bc := &IndexClient{
+		QueryURL:    ts.URL + "/api/index/indexA/query",
+		PIndexNames: []string{"a"},
+		httpClient:  ts.Client(),
+	}
+
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+
+	bc.Prefetch(context.Background(), req)
+
+	res, err := bc.SearchInContext(context.Background(), req)
+	if err != nil || res == nil || res.Total != 3 {
+		t.Fatalf("expected prefetched result, res: %v, err: %v", res, err)
+	}
+	if atomic.LoadInt32(&numRequests) != 1 {
+		t.Errorf("expected 1 request, got: %d", numRequests)
+	}
+
+	bc.Prefetch(context.Background(), req)
+
+	req2 := bleve.NewSearchRequest(bleve.NewMatchNoneQuery())
+	res, err = bc.SearchInContext(context.Background(), req2)
+	if err != nil || res == nil || res.Total != 3 {
+		t.Fatalf("expected result, res: %v, err: %v", res, err)
+	}
+	if resultCh, _, _ := bc.takePrefetch(req); resultCh != nil {
+		t.Errorf("expected prefetch to be consumed")
+	}
+}
@@ -0,0 +1,532 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// RescoreWindowSizeDefault is the number of top merged hits that are
+// rescored when a rescore request doesn't specify a window_size.
+var RescoreWindowSizeDefault = 100
+
+// QueryRescore defines the part of the JSON query request that
+// allows the client to ask the coordinator to rescore the top merged
+// hits, after the hits from all the pindexes have been merged.
+type QueryRescore struct {
+	Rescore *RescoreRequest `json:"rescore,omitempty"`
+}
+
+// RescoreRequest describes how the coordinator should adjust the
+// scores of the top window_size merged hits.  A JSON'ified
+// RescoreRequest looks like...
+//     {
+//        "window_size": 100,
+//        "field_boosts": [
+//           {"field": "popularity", "factor": 1.2, "modifier": "log1p"}
+//        ],
+//        "decays": [
+//           {"field": "updated", "function": "gauss",
+//            "origin": "now", "scale": "240h", "decay": 0.5}
+//        ],
+//        "pinned": ["doc-123", "doc-456"]
+//     }
+type RescoreRequest struct {
+	WindowSize  int                  `json:"window_size,omitempty"`
+	FieldBoosts []*RescoreFieldBoost `json:"field_boosts,omitempty"`
+	Decays      []*RescoreDecay      `json:"decays,omitempty"`
+	Pinned      []string             `json:"pinned,omitempty"`
+}
+
+// RescoreFieldBoost multiplies a hit's score by a function of the
+// numeric value of one of its stored fields.
+type RescoreFieldBoost struct {
+	Field    string   `json:"field"`
+	Factor   float64  `json:"factor,omitempty"`   // Defaults to 1.0.
+	Modifier string   `json:"modifier,omitempty"` // "", "none", "log1p", "sqrt".
+	Missing  *float64 `json:"missing,omitempty"`  // Value used when field is absent.
+}
+
+// RescoreDecay multiplies a hit's score by a decay function (linear,
+// exp or gauss) of the distance between a stored numeric or date
+// field value and an origin.  For date fields, the origin is either
+// "now" or an RFC3339 timestamp, and the scale and offset are
+// durations (e.g., "240h" or "10d").
+type RescoreDecay struct {
+	Field    string  `json:"field"`
+	Function string  `json:"function"`
+	Origin   string  `json:"origin"`
+	Scale    string  `json:"scale"`
+	Offset   string  `json:"offset,omitempty"`
+	Decay    float64 `json:"decay,omitempty"` // Defaults to 0.5.
+
+	isDate bool
+	origin float64
+	scale  float64
+	offset float64
+}
+
+// Validate checks the rescore request against the search request
+// that it's attached to, and prepares the decay functions.
+func (r *RescoreRequest) Validate(sr *bleve.SearchRequest) error {
+	if r.WindowSize < 0 {
+		return fmt.Errorf("rescore: negative window_size: %d", r.WindowSize)
+	}
+
+	if len(sr.Sort) != 1 {
+		return fmt.Errorf("rescore: only supported with sort by score")
+	}
+	if _, ok := sr.Sort[0].(*search.SortScore); !ok {
+		return fmt.Errorf("rescore: only supported with sort by score")
+	}
+
+	for _, fb := range r.FieldBoosts {
+		if fb.Field == "" {
+			return fmt.Errorf("rescore: field_boosts entry missing field")
+		}
+		switch fb.Modifier {
+		case "", "none", "log1p", "sqrt":
+		default:
+			return fmt.Errorf("rescore: unsupported modifier: %s,"+
+				" field: %s", fb.Modifier, fb.Field)
+		}
+	}
+
+	now := time.Now()
+	for _, d := range r.Decays {
+		err := d.prepare(now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *RescoreDecay) prepare(now time.Time) error {
+	if d.Field == "" {
+		return fmt.Errorf("rescore: decays entry missing field")
+	}
+
+	switch d.Function {
+	case "linear", "exp", "gauss":
+	default:
+		return fmt.Errorf("rescore: unsupported decay function: %s,"+
+			" field: %s", d.Function, d.Field)
+	}
+
+	if d.Decay == 0 {
+		d.Decay = 0.5
+	}
+	if d.Decay <= 0 || d.Decay >= 1 {
+		return fmt.Errorf("rescore: decay must be between 0 and 1,"+
+			" field: %s, decay: %v", d.Field, d.Decay)
+	}
+
+	var err error
+
+	origin, errNum := strconv.ParseFloat(d.Origin, 64)
+	if errNum == nil {
+		d.origin = origin
+		d.scale, err = strconv.ParseFloat(d.Scale, 64)
+		if err != nil {
+			return fmt.Errorf("rescore: could not parse scale: %q,"+
+				" field: %s, err: %v", d.Scale, d.Field, err)
+		}
+		if d.Offset != "" {
+			d.offset, err = strconv.ParseFloat(d.Offset, 64)
+			if err != nil {
+				return fmt.Errorf("rescore: could not parse offset: %q,"+
+					" field: %s, err: %v", d.Offset, d.Field, err)
+			}
+		}
+	} else {
+		d.isDate = true
+
+		t := now
+		if d.Origin != "" && d.Origin != "now" {
+			t, err = time.Parse(time.RFC3339, d.Origin)
+			if err != nil {
+				return fmt.Errorf("rescore: could not parse origin: %q,"+
+					" field: %s, err: %v", d.Origin, d.Field, err)
+			}
+		}
+		d.origin = float64(t.UnixNano())
+
+		scale, err := parseRescoreDuration(d.Scale)
+		if err != nil {
+			return fmt.Errorf("rescore: could not parse scale: %q,"+
+				" field: %s, err: %v", d.Scale, d.Field, err)
+		}
+		d.scale = float64(scale)
+
+		if d.Offset != "" {
+			offset, err := parseRescoreDuration(d.Offset)
+			if err != nil {
+				return fmt.Errorf("rescore: could not parse offset: %q,"+
+					" field: %s, err: %v", d.Offset, d.Field, err)
+			}
+			d.offset = float64(offset)
+		}
+	}
+
+	if d.scale <= 0 {
+		return fmt.Errorf("rescore: scale must be positive,"+
+			" field: %s, scale: %q", d.Field, d.Scale)
+	}
+
+	return nil
+}
+
+// parseRescoreDuration extends time.ParseDuration with a "d" (day)
+// unit, as day based scales are common for recency decays.
+func parseRescoreDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// factor returns the multiplier for a stored field value, where ok
+// is false if the value was missing or not usable.
+func (d *RescoreDecay) factor(v interface{}) (float64, bool) {
+	var x float64
+	if d.isDate {
+		s, ok := v.(string)
+		if !ok {
+			return 0, false
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return 0, false
+		}
+		x = float64(t.UnixNano())
+	} else {
+		f, ok := v.(float64)
+		if !ok {
+			return 0, false
+		}
+		x = f
+	}
+
+	dist := math.Max(0, math.Abs(x-d.origin)-d.offset)
+
+	switch d.Function {
+	case "linear":
+		s := d.scale / (1.0 - d.Decay)
+		return math.Max(0, (s-dist)/s), true
+	case "exp":
+		return math.Exp(math.Log(d.Decay) / d.scale * dist), true
+	case "gauss":
+		sigmaSquared := -(d.scale * d.scale) / (2.0 * math.Log(d.Decay))
+		return math.Exp(-(dist * dist) / (2.0 * sigmaSquared)), true
+	}
+
+	return 1.0, true
+}
+
+func (fb *RescoreFieldBoost) factor(v interface{}) float64 {
+	x, ok := v.(float64)
+	if !ok {
+		if fb.Missing == nil {
+			return 1.0
+		}
+		x = *fb.Missing
+	}
+
+	switch fb.Modifier {
+	case "log1p":
+		x = math.Log10(1 + x)
+	case "sqrt":
+		x = math.Sqrt(x)
+	}
+
+	factor := fb.Factor
+	if factor == 0 {
+		factor = 1.0
+	}
+
+	return factor * x
+}
+
+// ---------------------------------------------------------
+
+// rescorer tracks the adjustments made to a search request so that
+// the rescore window is retrieved from the pindexes, and restores the
+// client's from/size/fields when the merged result is rescored.
+type rescorer struct {
+	r *RescoreRequest
+
+	origFrom   int
+	origSize   int
+	origFields []string
+}
+
+// newRescorer validates the rescore request and widens the search
+// request so that the full rescore window is retrieved.  A maxWindow
+// > 0 caps the window, like bleveMaxResultWindow caps from+size, so
+// the default window is trimmed to it and a larger window_size is an
+// error.
+func newRescorer(r *RescoreRequest, sr *bleve.SearchRequest,
+	maxWindow int) (*rescorer, error) {
+	err := r.Validate(sr)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &rescorer{
+		r:          r,
+		origFrom:   sr.From,
+		origSize:   sr.Size,
+		origFields: sr.Fields,
+	}
+
+	windowSize := r.WindowSize
+	if windowSize <= 0 {
+		windowSize = RescoreWindowSizeDefault
+		if maxWindow > 0 && windowSize > maxWindow {
+			windowSize = maxWindow
+		}
+	}
+	if windowSize < sr.From+sr.Size {
+		windowSize = sr.From + sr.Size
+	}
+	if maxWindow > 0 && windowSize > maxWindow {
+		return nil, fmt.Errorf("rescore: bleveMaxResultWindow exceeded,"+
+			" window_size: %d, from: %d, size: %d, bleveMaxResultWindow: %d",
+			windowSize, sr.From, sr.Size, maxWindow)
+	}
+
+	sr.From = 0
+	sr.Size = windowSize
+
+	fields := append([]string(nil), sr.Fields...)
+	for _, fb := range r.FieldBoosts {
+		fields = appendFieldIfMissing(fields, fb.Field)
+	}
+	for _, d := range r.Decays {
+		fields = appendFieldIfMissing(fields, d.Field)
+	}
+	sr.Fields = fields
+
+	return rv, nil
+}
+
+func appendFieldIfMissing(fields []string, field string) []string {
+	for _, f := range fields {
+		if f == field || f == "*" {
+			return fields
+		}
+	}
+	return append(fields, field)
+}
+
+// apply rescores the merged window of hits, moves any pinned hits to
+// the top and then trims the result to the client's from/size.  The
+// searcher is used to retrieve pinned docs that weren't in the window.
+func (rs *rescorer) apply(ctx context.Context, searcher bleve.Index,
+	sr *bleve.SearchRequest, res *bleve.SearchResult) error {
+	for _, hit := range res.Hits {
+		hit.Score *= rs.factor(hit)
+	}
+
+	sort.SliceStable(res.Hits, func(i, j int) bool {
+		return res.Hits[i].Score > res.Hits[j].Score
+	})
+
+	err := rs.pin(ctx, searcher, sr, res)
+	if err != nil {
+		return err
+	}
+
+	res.MaxScore = 0
+	for _, hit := range res.Hits {
+		if hit.Score > res.MaxScore {
+			res.MaxScore = hit.Score
+		}
+	}
+
+	sr.From, sr.Size, sr.Fields = rs.origFrom, rs.origSize, rs.origFields
+
+	if rs.origFrom >= len(res.Hits) {
+		res.Hits = res.Hits[:0]
+	} else {
+		end := rs.origFrom + rs.origSize
+		if end > len(res.Hits) {
+			end = len(res.Hits)
+		}
+		res.Hits = res.Hits[rs.origFrom:end]
+	}
+
+	rs.stripFields(res)
+
+	return nil
+}
+
+func (rs *rescorer) factor(hit *search.DocumentMatch) float64 {
+	rv := 1.0
+	for _, fb := range rs.r.FieldBoosts {
+		rv *= fb.factor(hit.Fields[fb.Field])
+	}
+	for _, d := range rs.r.Decays {
+		if f, ok := d.factor(hit.Fields[d.Field]); ok {
+			rv *= f
+		}
+	}
+	return rv
+}
+
+// pin moves the pinned hits, in their requested order, to the top of
+// the result, retrieving any pinned docs that weren't in the window.
+// The pinned docs that the query doesn't match are added to the total
+// hits.
+func (rs *rescorer) pin(ctx context.Context, searcher bleve.Index,
+	sr *bleve.SearchRequest, res *bleve.SearchResult) error {
+	if len(rs.r.Pinned) == 0 {
+		return nil
+	}
+
+	hitsByID := make(map[string]*search.DocumentMatch, len(res.Hits))
+	for _, hit := range res.Hits {
+		hitsByID[hit.ID] = hit
+	}
+
+	var missing []string
+	for _, id := range rs.r.Pinned {
+		if _, exists := hitsByID[id]; !exists {
+			missing = append(missing, id)
+		}
+	}
+
+	if len(missing) > 0 && searcher != nil {
+		fetch := func(q query.Query, ids []string) (
+			search.DocumentMatchCollection, error) {
+			pinRes, err := searcher.SearchInContext(ctx, &bleve.SearchRequest{
+				Query:            q,
+				Size:             len(ids),
+				Fields:           sr.Fields,
+				Highlight:        sr.Highlight,
+				IncludeLocations: sr.IncludeLocations,
+				Sort:             sr.Sort,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("rescore: fetching pinned docs,"+
+					" err: %v", err)
+			}
+			return pinRes.Hits, nil
+		}
+
+		// the pinned docs that match the query, but rank below the
+		// window, are already counted in the total hits
+		matched, err := fetch(query.NewConjunctionQuery([]query.Query{
+			sr.Query, query.NewDocIDQuery(missing)}), missing)
+		if err != nil {
+			return err
+		}
+		for _, hit := range matched {
+			hitsByID[hit.ID] = hit
+		}
+
+		var unmatched []string
+		for _, id := range missing {
+			if _, exists := hitsByID[id]; !exists {
+				unmatched = append(unmatched, id)
+			}
+		}
+
+		if len(unmatched) > 0 {
+			extra, err := fetch(query.NewDocIDQuery(unmatched), unmatched)
+			if err != nil {
+				return err
+			}
+			for _, hit := range extra {
+				if _, exists := hitsByID[hit.ID]; !exists {
+					hitsByID[hit.ID] = hit
+					res.Total++
+				}
+			}
+		}
+	}
+
+	topScore := 0.0
+	if len(res.Hits) > 0 {
+		topScore = res.Hits[0].Score
+	}
+
+	pinned := make(map[string]bool, len(rs.r.Pinned))
+	hits := make(search.DocumentMatchCollection, 0, len(hitsByID))
+	for _, id := range rs.r.Pinned {
+		hit, exists := hitsByID[id]
+		if exists && !pinned[id] {
+			pinned[id] = true
+			hits = append(hits, hit)
+		}
+	}
+
+	// Keep the pinned hits' scores above the organic hits, while
+	// preserving the requested pin order.
+	for i, hit := range hits {
+		hit.Score = topScore + float64(len(hits)-i)
+	}
+
+	for _, hit := range res.Hits {
+		if !pinned[hit.ID] {
+			hits = append(hits, hit)
+		}
+	}
+
+	res.Hits = hits
+
+	return nil
+}
+
+// stripFields removes any fields that were only retrieved for
+// rescoring and that the client didn't ask for.
+func (rs *rescorer) stripFields(res *bleve.SearchResult) {
+	requested := make(map[string]bool, len(rs.origFields))
+	for _, f := range rs.origFields {
+		if f == "*" {
+			return
+		}
+		requested[f] = true
+	}
+
+	for _, hit := range res.Hits {
+		for _, fb := range rs.r.FieldBoosts {
+			if !requested[fb.Field] {
+				delete(hit.Fields, fb.Field)
+			}
+		}
+		for _, d := range rs.r.Decays {
+			if !requested[d.Field] {
+				delete(hit.Fields, d.Field)
+			}
+		}
+		if len(hit.Fields) == 0 {
+			hit.Fields = nil
+		}
+	}
+}
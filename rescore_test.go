@@ -0,0 +1,224 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+func TestRescoreDecayFunctions(t *testing.T) {
+	tests := []struct {
+		function string
+		value    float64
+		expect   float64
+	}{
+		{"linear", 0, 1.0},
+		{"linear", 10, 0.5},
+		{"exp", 10, 0.5},
+		{"gauss", 10, 0.5},
+		{"gauss", 0, 1.0},
+	}
+
+	for _, test := range tests {
+		d := &RescoreDecay{
+			Field:    "f",
+			Function: test.function,
+			Origin:   "0",
+			Scale:    "10",
+		}
+		err := d.prepare(time.Now())
+		if err != nil {
+			t.Fatalf("expected prepare to work, err: %v", err)
+		}
+		f, ok := d.factor(test.value)
+		if !ok {
+			t.Errorf("expected factor to be usable, test: %+v", test)
+		}
+		if math.Abs(f-test.expect) > 0.0001 {
+			t.Errorf("test: %+v, got factor: %v", test, f)
+		}
+	}
+}
+
+func TestRescoreDecayDate(t *testing.T) {
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	d := &RescoreDecay{
+		Field:    "updated",
+		Function: "exp",
+		Origin:   "now",
+		Scale:    "10d",
+	}
+	err := d.prepare(now)
+	if err != nil {
+		t.Fatalf("expected prepare to work, err: %v", err)
+	}
+	f, ok := d.factor(now.Add(-10 * 24 * time.Hour).Format(time.RFC3339))
+	if !ok || math.Abs(f-0.5) > 0.0001 {
+		t.Errorf("expected 0.5 decay, got: %v, %v", f, ok)
+	}
+	_, ok = d.factor(123.0)
+	if ok {
+		t.Errorf("expected non-date value to be unusable")
+	}
+}
+
+func TestRescoreValidate(t *testing.T) {
+	sr := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+
+	bad := []*RescoreRequest{
+		{WindowSize: -1},
+		{FieldBoosts: []*RescoreFieldBoost{{}}},
+		{FieldBoosts: []*RescoreFieldBoost{{Field: "a", Modifier: "bogus"}}},
+		{Decays: []*RescoreDecay{{Field: "a", Function: "bogus"}}},
+		{Decays: []*RescoreDecay{{Field: "a", Function: "exp",
+			Origin: "0", Scale: "0"}}},
+		{Decays: []*RescoreDecay{{Field: "a", Function: "exp",
+			Origin: "0", Scale: "1", Decay: 2}}},
+	}
+	for i, r := range bad {
+		if r.Validate(sr) == nil {
+			t.Errorf("%d - expected validate error: %+v", i, r)
+		}
+	}
+
+	sr.SortBy([]string{"name"})
+	if (&RescoreRequest{}).Validate(sr) == nil {
+		t.Errorf("expected validate error on non-score sort")
+	}
+}
+
+func TestRescoreMaxWindow(t *testing.T) {
+	defer func(n int) { RescoreWindowSizeDefault = n }(RescoreWindowSizeDefault)
+	RescoreWindowSizeDefault = 100
+
+	sr := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 10, 5, false)
+	_, err := newRescorer(&RescoreRequest{}, sr, 50)
+	if err != nil || sr.From != 0 || sr.Size != 50 {
+		t.Errorf("expected default window trimmed to 50, got: %d, %d, err: %v",
+			sr.From, sr.Size, err)
+	}
+
+	sr = bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 10, 5, false)
+	_, err = newRescorer(&RescoreRequest{WindowSize: 51}, sr, 50)
+	if err == nil {
+		t.Errorf("expected window_size over bleveMaxResultWindow to fail")
+	}
+
+	sr = bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 10, 5, false)
+	_, err = newRescorer(&RescoreRequest{WindowSize: 51}, sr, 0)
+	if err != nil || sr.Size != 51 {
+		t.Errorf("expected unlimited window, got: %d, err: %v", sr.Size, err)
+	}
+}
+
+func TestRescoreApply(t *testing.T) {
+	sr := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 2, 0, false)
+
+	rs, err := newRescorer(&RescoreRequest{
+		WindowSize: 3,
+		FieldBoosts: []*RescoreFieldBoost{
+			{Field: "popularity"},
+		},
+		Pinned: []string{"c"},
+	}, sr, 0)
+	if err != nil {
+		t.Fatalf("expected newRescorer to work, err: %v", err)
+	}
+	if sr.Size != 3 || sr.From != 0 {
+		t.Errorf("expected window sized request, got: %d, %d", sr.From, sr.Size)
+	}
+	if len(sr.Fields) != 1 || sr.Fields[0] != "popularity" {
+		t.Errorf("expected popularity field, got: %v", sr.Fields)
+	}
+
+	res := &bleve.SearchResult{
+		Total: 3,
+		Hits: search.DocumentMatchCollection{
+			{ID: "a", Score: 3, Fields: map[string]interface{}{"popularity": 1.0}},
+			{ID: "b", Score: 2, Fields: map[string]interface{}{"popularity": 4.0}},
+			{ID: "c", Score: 1, Fields: map[string]interface{}{"popularity": 1.0}},
+		},
+	}
+
+	err = rs.apply(context.Background(), nil, sr, res)
+	if err != nil {
+		t.Fatalf("expected apply to work, err: %v", err)
+	}
+	if len(res.Hits) != 2 {
+		t.Fatalf("expected 2 hits, got: %d", len(res.Hits))
+	}
+	if res.Hits[0].ID != "c" || res.Hits[1].ID != "b" {
+		t.Errorf("unexpected order: %s, %s", res.Hits[0].ID, res.Hits[1].ID)
+	}
+	if res.Hits[1].Fields != nil {
+		t.Errorf("expected rescore-only fields to be stripped")
+	}
+	if sr.Size != 2 || sr.Fields != nil {
+		t.Errorf("expected search request to be restored")
+	}
+}
+
+func TestRescorePinTotal(t *testing.T) {
+	idx, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatalf("expected NewMemOnly to work, err: %v", err)
+	}
+	defer idx.Close()
+
+	for id, typ := range map[string]string{
+		"a": "beer", "b": "beer", "c": "beer", "e": "wine",
+		"d": "beer lager ale stout porter",
+	} {
+		err = idx.Index(id, map[string]interface{}{"type": typ})
+		if err != nil {
+			t.Fatalf("expected Index to work, err: %v", err)
+		}
+	}
+
+	q := bleve.NewMatchQuery("beer")
+	q.SetField("type")
+	sr := bleve.NewSearchRequestOptions(q, 2, 0, false)
+
+	// d matches the query, but its longer field ranks it below the
+	// window, while e doesn't match the query at all
+	rs, err := newRescorer(&RescoreRequest{
+		WindowSize: 1,
+		Pinned:     []string{"d", "e"},
+	}, sr, 0)
+	if err != nil {
+		t.Fatalf("expected newRescorer to work, err: %v", err)
+	}
+
+	res, err := idx.Search(sr)
+	if err != nil || res.Total != 4 {
+		t.Fatalf("expected 4 matches, got: %v, err: %v", res, err)
+	}
+
+	err = rs.apply(context.Background(), idx, sr, res)
+	if err != nil {
+		t.Fatalf("expected apply to work, err: %v", err)
+	}
+
+	// only e adds to the matches
+	if res.Total != 5 {
+		t.Errorf("expected total hits of 5, got: %d", res.Total)
+	}
+	if len(res.Hits) != 2 || res.Hits[0].ID != "d" || res.Hits[1].ID != "e" {
+		t.Errorf("expected pinned d and e on top, got: %v", res.Hits)
+	}
+}
@@ -12,6 +12,7 @@
 package cbft
 
 import (
+	"fmt"
 	"net/http"
 	"strconv"
 
@@ -122,6 +123,10 @@ func NewRESTRouter(versionMain string, mgr *cbgt.Manager,
 		return &AuthVersionHandler{mgr: mgr, H: h, adtSvc: adtSvc}
 	}
 
+	// the routes of handleAuthRoute() are registered by the pindex
+	// implementations as the REST router is initialized
+	authRouteAdtSvc = adtSvc
+
 	var options = map[string]interface{}{
 		"auth":             wrapAuthVersionHandler,
 		"mapRESTPathStats": MapRESTPathStats,
@@ -157,10 +162,51 @@ func (c *AuthVersionHandler) ServeHTTP(
 
 	c.doAudit(req, path)
 
+	if !checkInternalTLS(w, req) {
+		return
+	}
+
 	if !CheckAPIAuth(c.mgr, w, req, path) {
 		return
 	}
 
+	req, ok := c.checkCaller(w, req, path)
+	if !ok {
+		return
+	}
+
+	// compressed scatter-gather request bodies are only decompressed
+	// after the auth checks, so that unauthenticated requests can't
+	// make this node decompress their bodies
+	cw, err := compressScatterGather(c.mgr, w, req)
+	if err != nil {
+		status := http.StatusUnsupportedMediaType
+		if err == errRemoteBodyTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		rest.PropagateError(w, nil, fmt.Sprintf("rest: scatter-gather"+
+			" compression, err: %v", err), status)
+		return
+	}
+	if cw != nil {
+		defer cw.Close()
+		w = cw
+	}
+
+	// remote nodes learn how long the request took to execute here, so
+	// that they can budget the rest of its timeout for the round-trip
+	if req.Header.Get(rest.CLUSTER_ACTION) == "fts/scatter-gather" {
+		w = newServerTimingWriter(w)
+	}
+
+	// the definitions of index aliases respond with the warnings
+	// about their targets, such as conflicting field mappings
+	if req.Method == "PUT" && path == "/api/index/{indexName}" {
+		aw := newAliasWarningsWriter(w)
+		defer aw.finish(c.mgr, rest.IndexNameLookup(req))
+		w = aw
+	}
+
 	if c.H != nil {
 		c.H.ServeHTTP(w, req)
 	}
@@ -176,3 +222,33 @@ func (c *AuthVersionHandler) doAudit(req *http.Request, path string) {
 		go c.adtSvc.Write(eventId, d)
 	}
 }
+
+// --------------------------------------------------
+
+// authRouteAdtSvc is the audit service of the routes registered by
+// handleAuthRoute(), as provided to NewRESTRouter().
+var authRouteAdtSvc *audit.AuditSvc
+
+// handleAuthRoute registers a cbft REST handler that goes through the
+// same API version, auth and audit checks as the cbgt REST API, unlike
+// the bleve pindex handlers registered by BleveInitRouter.  The path
+// is expected to have an entry in restPerms.
+func handleAuthRoute(r *mux.Router, mgr *cbgt.Manager,
+	method, path string, h http.Handler) {
+	prefix := ""
+	if mgr != nil {
+		prefix = mgr.Options()["urlPrefix"]
+	}
+
+	r.Handle(prefix+path, &AuthVersionHandler{
+		mgr:    mgr,
+		adtSvc: authRouteAdtSvc,
+		H: rest.NewHandlerWithRESTMeta(h, &rest.RESTMeta{
+			Path:   prefix + path,
+			Method: method,
+			Opts:   map[string]string{"_path": path},
+		}, nil, ""),
+	}).Methods(method)
+
+	BleveRouteMethods[prefix+path] = method
+}
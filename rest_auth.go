@@ -154,7 +154,13 @@ func sourceNamesForAlias(name string, indexDefsByName map[string]*cbgt.IndexDef,
 		if err != nil {
 			return nil, fmt.Errorf("error expanding fulltext-alias: %v", err)
 		}
-		for aliasIndexName := range aliasParams.Targets {
+		for aliasIndexName, aliasTarget := range aliasParams.Targets {
+			if aliasTarget != nil && aliasTarget.Remote != nil {
+				// a remote cluster's index has no local source, so
+				// the permission across all sources is needed
+				rv = append(rv, "")
+				continue
+			}
 			aliasIndexDef, exists := indexDefsByName[aliasIndexName]
 			// if alias target doesn't exist, do nothing
 			if exists {
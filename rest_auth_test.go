@@ -55,6 +55,10 @@ var testIndexDefsByName = map[string]*cbgt.IndexDef{
 		Type:   "fulltext-alias",
 		Params: `{"targets":{"a4":{},"i2":{}}}`,
 	},
+	"a5": {
+		Type:   "fulltext-alias",
+		Params: `{"targets":{"i1":{"remote":{"cluster":"east"}}}}`,
+	},
 }
 
 var testPIndexesByName = map[string]*cbgt.PIndex{
@@ -99,6 +103,11 @@ func TestSourceNamesForAlias(t *testing.T) {
 			alias: "a4",
 			err:   errAliasExpansionTooDeep,
 		},
+		// alias to a remote cluster's index
+		{
+			alias:   "a5",
+			sources: []string{""},
+		},
 	}
 
 	for i, test := range tests {
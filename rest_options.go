@@ -97,6 +97,14 @@ func NewManagerOptionsExt(mgr *cbgt.Manager) *ManagerOptionsExt {
 			}
 		}
 
+		// Validate remoteClusters
+		if options["remoteClusters"] != "" {
+			_, err := parseRemoteClusterDefs(options["remoteClusters"])
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		return options, nil
 	}
 
@@ -42,6 +42,17 @@ POST /api/index/{indexName}/queryControl/{op}
 cluster.bucket[<sourceName>].fts!manage
 24579
 
+POST /api/index/{indexName}/reindex
+cluster.bucket[<sourceName>].fts!manage
+24579
+
+GET /api/index/{indexName}/reindex
+cluster.bucket[<sourceName>].fts!read
+
+POST /api/index/{indexName}/reindex/cancel
+cluster.bucket[<sourceName>].fts!manage
+24579
+
 GET /api/stats
 cluster.bucket[].stats.fts!read
 
@@ -57,6 +68,24 @@ cluster.bucket[<sourceName>].fts!read
 POST /api/index/{indexName}/query
 cluster.bucket[<sourceName>].fts!read
 
+GET /api/index/{indexName}/suggest
+cluster.bucket[<sourceName>].fts!read
+
+GET /api/index/{indexName}/fieldStats
+cluster.bucket[<sourceName>].fts!read
+
+POST /api/index/{indexName}/termStats
+cluster.bucket[<sourceName>].fts!read
+
+POST /api/index/{indexName}/fields
+cluster.bucket[<sourceName>].fts!read
+
+POST /api/index/{indexName}/fieldDict
+cluster.bucket[<sourceName>].fts!read
+
+POST /api/index/{indexName}/document
+cluster.bucket[<sourceName>].fts!read
+
 GET /api/cfg
 cluster.settings.fts!read
 
@@ -113,6 +142,9 @@ cluster.stats.fts!read
 GET /api/runtime/statsMem
 cluster.stats.fts!read
 
+GET /api/remoteNodeStats
+cluster.stats.fts!read
+
 GET /api/pindex
 cluster.bucket[].fts!read
 
@@ -26,6 +26,7 @@ type dateTimeRange struct {
 // built.
 type facetRequest struct {
 	Size           int              `json:"size"`
+	ShardSize      int              `json:"shard_size,omitempty"`
 	Field          string           `json:"field"`
 	NumericRanges  []*numericRange  `json:"numeric_ranges,omitempty"`
 	DateTimeRanges []*dateTimeRange `json:"date_ranges,omitempty"`
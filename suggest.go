@@ -0,0 +1,517 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/index"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search/query"
+
+	"github.com/couchbase/cbgt"
+	"github.com/couchbase/cbgt/rest"
+)
+
+// SuggestDefaultSize is the number of suggestions returned when the
+// request doesn't specify a size, and SuggestMaxSize is the most that
+// may be asked for.
+var SuggestDefaultSize = 10
+var SuggestMaxSize = 1000
+
+// SuggestMaxFuzziness is the largest edit distance allowed for fuzzy
+// suggestions.
+var SuggestMaxFuzziness = 2
+
+// SuggestMaxTerms bounds the number of dictionary terms that are
+// considered for a suggest request, beyond which the suggestions are
+// reported as partial.  Fuzzy suggestions consider every term of the
+// field, so this keeps them from scanning huge dictionaries.
+var SuggestMaxTerms = 1000000
+
+// Suggestion is a term of an index field, along with the number of
+// documents that have the term, and its edit distance from the prefix
+// that was asked for.
+type Suggestion struct {
+	Term     string `json:"term"`
+	Count    uint64 `json:"count"`
+	Distance int    `json:"distance,omitempty"`
+}
+
+// SuggestTypeMaxCandidates bounds the number of terms, the most
+// frequent across all types, whose documents of a type are counted
+// for a suggest request scoped to that type, beyond which the
+// suggestions are reported as partial.
+var SuggestTypeMaxCandidates = 100
+
+// SuggestResult is the JSON response of the suggest REST endpoint.
+// The suggestions are partial when some pindexes couldn't be reached,
+// which are listed in MissingPIndexes, or when not every term could
+// be considered.
+type SuggestResult struct {
+	Status          string        `json:"status"`
+	Field           string        `json:"field"`
+	Type            string        `json:"type,omitempty"`
+	Prefix          string        `json:"prefix"` // After analysis.
+	Suggestions     []*Suggestion `json:"suggestions"`
+	Partial         bool          `json:"partial,omitempty"`
+	MissingPIndexes []string      `json:"missingPIndexes,omitempty"`
+}
+
+// suggestionWorse returns true when suggestion a ranks below b, by
+// document frequency, then by edit distance, then by term.
+func suggestionWorse(a, b *Suggestion) bool {
+	if a.Count != b.Count {
+		return a.Count < b.Count
+	}
+	if a.Distance != b.Distance {
+		return a.Distance > b.Distance
+	}
+	return a.Term > b.Term
+}
+
+// suggestionHeap is a min-heap that keeps the worst of the top
+// suggestions on top.
+type suggestionHeap []*Suggestion
+
+func (h suggestionHeap) Len() int           { return len(h) }
+func (h suggestionHeap) Less(i, j int) bool { return suggestionWorse(h[i], h[j]) }
+func (h suggestionHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *suggestionHeap) Push(x interface{}) {
+	*h = append(*h, x.(*Suggestion))
+}
+
+func (h *suggestionHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// offer keeps the suggestion if it's among the top size suggestions
+// seen so far.
+func (h *suggestionHeap) offer(s *Suggestion, size int) {
+	if len(*h) < size {
+		heap.Push(h, s)
+	} else if size > 0 && suggestionWorse((*h)[0], s) {
+		(*h)[0] = s
+		heap.Fix(h, 0)
+	}
+}
+
+// sorted returns the suggestions of the heap, best first.
+func (h suggestionHeap) sorted() []*Suggestion {
+	rv := []*Suggestion(h)
+	sort.Slice(rv, func(i, j int) bool {
+		return suggestionWorse(rv[j], rv[i])
+	})
+	return rv
+}
+
+// prefixEditDistance returns the smallest edit distance between the
+// prefix and any prefix of the term, or false when that's more than
+// max.
+func prefixEditDistance(prefix, term []rune, max int) (int, bool) {
+	// col[i] is the edit distance between prefix[:i] and the part of
+	// the term that's been seen so far
+	col := make([]int, len(prefix)+1)
+	for i := range col {
+		col[i] = i
+	}
+
+	best := col[len(prefix)]
+
+	for j, r := range term {
+		diag := col[0]
+		col[0] = j + 1
+		colMin := col[0]
+
+		for i := 1; i <= len(prefix); i++ {
+			cost := 1
+			if prefix[i-1] == r {
+				cost = 0
+			}
+			v := diag + cost
+			if col[i]+1 < v {
+				v = col[i] + 1
+			}
+			if col[i-1]+1 < v {
+				v = col[i-1] + 1
+			}
+			diag = col[i]
+			col[i] = v
+			if v < colMin {
+				colMin = v
+			}
+		}
+
+		if col[len(prefix)] < best {
+			best = col[len(prefix)]
+		}
+		if colMin > max || best == 0 {
+			break // Longer term prefixes can't do any better.
+		}
+	}
+
+	return best, best <= max
+}
+
+// suggestTerms returns the top terms of a term dictionary that start
+// with the prefix, or, with a fuzziness, that start within that edit
+// distance of the prefix.
+func suggestTerms(ctx context.Context, fd index.FieldDict, prefix string,
+	fuzziness, size, maxTerms int) ([]*Suggestion, bool, error) {
+	h := make(suggestionHeap, 0, size)
+
+	prefixRunes := []rune(prefix)
+
+	partial := false
+
+	for n := 0; ; n++ {
+		if n >= maxTerms {
+			partial = true
+			break
+		}
+
+		if n%1000 == 0 && ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+
+		entry, err := fd.Next()
+		if err != nil {
+			return nil, false, err
+		}
+		if entry == nil {
+			break
+		}
+
+		s := &Suggestion{Term: entry.Term, Count: entry.Count}
+
+		if fuzziness > 0 {
+			distance, ok := prefixEditDistance(prefixRunes,
+				[]rune(entry.Term), fuzziness)
+			if !ok {
+				continue
+			}
+			s.Distance = distance
+		} else if !strings.HasPrefix(entry.Term, prefix) {
+			continue
+		}
+
+		h.offer(s, size)
+	}
+
+	return h.sorted(), partial, nil
+}
+
+// ---------------------------------------------------------
+
+// suggestAnalyzerName returns the analyzer of an index field, where a
+// non-empty typ scopes the field to the document mapping of that type.
+func suggestAnalyzerName(m mapping.IndexMapping, typ, field string) (
+	string, error) {
+	im, ok := m.(*mapping.IndexMappingImpl)
+	if typ == "" || !ok {
+		return m.AnalyzerNameForPath(field), nil
+	}
+
+	dm := im.TypeMapping[typ]
+	if dm == nil {
+		return "", fmt.Errorf("no type mapping for type: %s", typ)
+	}
+
+	analyzer := im.DefaultAnalyzer
+	if dm.DefaultAnalyzer != "" {
+		analyzer = dm.DefaultAnalyzer
+	}
+
+	path := strings.Split(field, ".")
+	for i, name := range path {
+		if !dm.Enabled {
+			break
+		}
+
+		sub := dm.Properties[name]
+		if sub == nil {
+			if dm.Dynamic {
+				return analyzer, nil
+			}
+			break
+		}
+
+		if sub.DefaultAnalyzer != "" {
+			analyzer = sub.DefaultAnalyzer
+		}
+
+		if i == len(path)-1 {
+			for _, fm := range sub.Fields {
+				if fm.Name != "" && fm.Name != name {
+					continue
+				}
+				if !fm.Index {
+					return "", fmt.Errorf("field: %s is not indexed"+
+						" for type: %s", field, typ)
+				}
+				if fm.Analyzer != "" {
+					return fm.Analyzer, nil
+				}
+				return analyzer, nil
+			}
+			if sub.Enabled && sub.Dynamic && len(sub.Fields) <= 0 {
+				return analyzer, nil
+			}
+		}
+
+		dm = sub
+	}
+
+	return "", fmt.Errorf("field: %s is not mapped for type: %s", field, typ)
+}
+
+// suggestTypeFilter returns the query for the documents of a type,
+// which needs the type to be indexed, as it is in the type_field mode
+// of the doc_config of an index.
+func suggestTypeFilter(dc *BleveDocumentConfig, typ string) (
+	query.Query, error) {
+	if dc.Mode != "type_field" {
+		return nil, fmt.Errorf("type scoping needs a doc_config mode"+
+			" of type_field, mode: %s", dc.Mode)
+	}
+
+	q := query.NewMatchPhraseQuery(typ)
+	q.SetField(dc.TypeField)
+
+	return q, nil
+}
+
+// countTypeSuggestions recounts the candidate suggestions as the
+// number of documents of a type that have the term, through a search
+// of the alias for each candidate, returning the top size of them and
+// leaving out the terms that no document of the type has.
+func countTypeSuggestions(ctx context.Context, alias bleve.Index,
+	field string, typeFilter query.Query, candidates []*Suggestion,
+	size int) ([]*Suggestion, error) {
+	h := make(suggestionHeap, 0, size)
+
+	for _, c := range candidates {
+		tq := query.NewTermQuery(c.Term)
+		tq.SetField(field)
+
+		res, err := alias.SearchInContext(ctx, bleve.NewSearchRequestOptions(
+			query.NewConjunctionQuery([]query.Query{tq, typeFilter}),
+			0, 0, false))
+		if err != nil {
+			return nil, err
+		}
+		if res.Status != nil && res.Status.Failed > 0 {
+			return nil, fmt.Errorf("counting term: %s, errors: %v",
+				c.Term, res.Status.Errors)
+		}
+
+		if res.Total > 0 {
+			h.offer(&Suggestion{
+				Term:     c.Term,
+				Count:    res.Total,
+				Distance: c.Distance,
+			}, size)
+		}
+	}
+
+	return h.sorted(), nil
+}
+
+// suggestPrefix analyzes the prefix like the field's text, so that
+// it matches the indexed terms, using the last token for prefixes of
+// several words.
+func suggestPrefix(m mapping.IndexMapping, analyzerName,
+	prefix string) string {
+	analyzer := m.AnalyzerNamed(analyzerName)
+	if analyzer == nil {
+		return prefix
+	}
+	tokens := analyzer.Analyze([]byte(prefix))
+	if len(tokens) <= 0 {
+		return prefix
+	}
+	return string(tokens[len(tokens)-1].Term)
+}
+
+// SuggestHandler is a REST handler that suggests the terms of an
+// index field that complete a prefix, ranked by the number of
+// documents with the term across all the pindexes of the index, or
+// with a type, by the number of documents of that type.
+type SuggestHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewSuggestHandler(mgr *cbgt.Manager) *SuggestHandler {
+	return &SuggestHandler{mgr: mgr}
+}
+
+func (h *SuggestHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := rest.IndexNameLookup(req)
+	if indexName == "" {
+		rest.ShowError(w, req, "index name is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	field := req.FormValue("field")
+	if field == "" {
+		rest.ShowError(w, req, "suggest, field is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	intParam := func(name string, defaultVal, max int) (int, bool) {
+		v := req.FormValue(name)
+		if v == "" {
+			return defaultVal, true
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > max {
+			rest.ShowError(w, req, fmt.Sprintf("suggest, %s must be"+
+				" between 0 and %d, got: %q", name, max, v),
+				http.StatusBadRequest)
+			return 0, false
+		}
+		return n, true
+	}
+
+	size, ok := intParam("size", SuggestDefaultSize, SuggestMaxSize)
+	if !ok {
+		return
+	}
+	fuzziness, ok := intParam("fuzziness", 0, SuggestMaxFuzziness)
+	if !ok {
+		return
+	}
+	timeout, ok := intParam("timeout",
+		int(cbgt.QUERY_CTL_DEFAULT_TIMEOUT_MS), math.MaxInt32)
+	if !ok {
+		return
+	}
+
+	bp, err := bleveIndexParams(h.mgr, indexName)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("suggest,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return
+	}
+	m := bp.Mapping
+
+	typ := req.FormValue("type")
+
+	analyzerName, err := suggestAnalyzerName(m, typ, field)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("suggest,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	var typeFilter query.Query
+	if typ != "" {
+		typeFilter, err = suggestTypeFilter(&bp.DocConfig, typ)
+		if err != nil {
+			rest.ShowError(w, req, fmt.Sprintf("suggest,"+
+				" indexName: %s, err: %v", indexName, err),
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	prefix := suggestPrefix(m, analyzerName, req.FormValue("prefix"))
+
+	targets, err := indexTargets(h.mgr, indexName, nil)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("suggest,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(),
+		time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+
+	fdr := &FieldDictRequest{Field: field}
+	if fuzziness <= 0 {
+		fdr.Prefix = prefix
+	}
+
+	fd, err := aliasFieldDict(ctx, targets, fdr)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("suggest,"+
+			" indexName: %s, field: %s, err: %v", indexName, field, err),
+			http.StatusInternalServerError)
+		return
+	}
+	defer fd.Close()
+
+	// the most frequent terms across all types are the candidates
+	// for the suggestions of a type
+	n := size
+	if typeFilter != nil && n < SuggestTypeMaxCandidates {
+		n = SuggestTypeMaxCandidates
+	}
+
+	suggestions, partial, err := suggestTerms(ctx, fd, prefix,
+		fuzziness, n, SuggestMaxTerms)
+	if err == nil && typeFilter != nil {
+		if len(suggestions) >= n {
+			partial = true // There may be more candidates.
+		}
+
+		var reachable []bleve.Index
+		for _, target := range targets {
+			if _, ok := missingTargetName(target); !ok {
+				reachable = append(reachable, target)
+			}
+		}
+
+		suggestions, err = countTypeSuggestions(ctx,
+			bleve.NewIndexAlias(reachable...), field, typeFilter,
+			suggestions, size)
+	}
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("suggest,"+
+			" indexName: %s, field: %s, err: %v", indexName, field, err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	missing := missingPIndexNames(targets)
+
+	rest.MustEncode(w, &SuggestResult{
+		Status:          "ok",
+		Field:           field,
+		Type:            typ,
+		Prefix:          prefix,
+		Suggestions:     suggestions,
+		Partial:         partial || len(missing) > 0,
+		MissingPIndexes: missing,
+	})
+}
@@ -0,0 +1,164 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/index"
+)
+
+func TestPrefixEditDistance(t *testing.T) {
+	tests := []struct {
+		prefix, term string
+		max          int
+		expDistance  int
+		expOk        bool
+	}{
+		{"", "anything", 0, 0, true},
+		{"bee", "beer", 0, 0, true},
+		{"bee", "be", 1, 1, true},
+		{"ber", "beer", 1, 1, true},
+		{"bzer", "beer", 1, 1, true},
+		{"baer", "beer", 0, 1, false},
+		{"xyz", "beer", 2, 3, false},
+		{"héll", "hello", 1, 1, true},
+	}
+
+	for _, test := range tests {
+		d, ok := prefixEditDistance([]rune(test.prefix), []rune(test.term),
+			test.max)
+		if ok != test.expOk || (ok && d != test.expDistance) {
+			t.Errorf("test: %+v, got distance: %d, ok: %v", test, d, ok)
+		}
+	}
+}
+
+func TestSuggestTerms(t *testing.T) {
+	entries := func() index.FieldDict {
+		return &testFieldDict{entries: []index.DictEntry{
+			{Term: "bear", Count: 2},
+			{Term: "beer", Count: 10},
+			{Term: "beers", Count: 3},
+			{Term: "berry", Count: 3},
+			{Term: "wine", Count: 20},
+		}}
+	}
+
+	terms := func(suggestions []*Suggestion) []string {
+		rv := make([]string, 0, len(suggestions))
+		for _, s := range suggestions {
+			rv = append(rv, s.Term)
+		}
+		return rv
+	}
+
+	ctx := context.Background()
+
+	got, partial, err := suggestTerms(ctx, entries(), "bee", 0, 10, 100)
+	if err != nil || partial {
+		t.Fatalf("expected no err, got: %v, partial: %v", err, partial)
+	}
+	if exp := []string{"beer", "beers"}; !reflect.DeepEqual(terms(got), exp) {
+		t.Errorf("expected: %v, got: %v", exp, terms(got))
+	}
+
+	got, _, _ = suggestTerms(ctx, entries(), "bee", 1, 10, 100)
+	if exp := []string{"beer", "beers", "berry", "bear"}; !reflect.DeepEqual(terms(got), exp) {
+		t.Errorf("expected: %v, got: %v", exp, terms(got))
+	}
+	if got[2].Distance != 1 {
+		t.Errorf("expected distance 1 for berry, got: %+v", got[2])
+	}
+
+	got, _, _ = suggestTerms(ctx, entries(), "", 0, 2, 100)
+	if exp := []string{"wine", "beer"}; !reflect.DeepEqual(terms(got), exp) {
+		t.Errorf("expected: %v, got: %v", exp, terms(got))
+	}
+
+	got, partial, _ = suggestTerms(ctx, entries(), "b", 0, 10, 2)
+	if exp := []string{"beer", "bear"}; !reflect.DeepEqual(terms(got), exp) ||
+		!partial {
+		t.Errorf("expected partial: %v, got: %v, partial: %v",
+			exp, terms(got), partial)
+	}
+
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = suggestTerms(cancelledCtx, entries(), "b", 0, 10, 100)
+	if err != context.Canceled {
+		t.Errorf("expected cancelled err, got: %v", err)
+	}
+}
+
+func TestCountTypeSuggestions(t *testing.T) {
+	idx, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	docs := map[string]map[string]interface{}{
+		"b1": {"type": "beer", "name": "hoppy ale"},
+		"b2": {"type": "beer", "name": "hoppy lager"},
+		"r1": {"type": "brewery", "name": "hops brewery"},
+		"r2": {"type": "brewery", "name": "hops house"},
+		"r3": {"type": "brewery", "name": "hops barn hoppy"},
+	}
+	for id, doc := range docs {
+		err = idx.Index(id, doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = suggestTypeFilter(&BleveDocumentConfig{
+		Mode: "docid_prefix", DocIDPrefixDelim: "-"}, "beer")
+	if err == nil {
+		t.Errorf("expected err for a doc_config without a type field")
+	}
+
+	typeFilter, err := suggestTypeFilter(&BleveDocumentConfig{
+		Mode: "type_field", TypeField: "type"}, "beer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// across all types, hops is the most frequent
+	candidates := []*Suggestion{
+		{Term: "hops", Count: 3},
+		{Term: "hoppy", Count: 3},
+	}
+
+	got, err := countTypeSuggestions(context.Background(), idx, "name",
+		typeFilter, candidates, 10)
+	exp := []*Suggestion{{Term: "hoppy", Count: 2}}
+	if err != nil || !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %+v, got: %+v, err: %v", exp, got, err)
+	}
+}
+
+func TestMissingPIndexNames(t *testing.T) {
+	targets := []bleve.Index{
+		&MissingPIndex{name: "p2"},
+		&IndexClient{},
+		&fallbackPIndex{MissingPIndex: &MissingPIndex{name: "p1"}},
+	}
+
+	got := missingPIndexNames(targets)
+	if !reflect.DeepEqual(got, []string{"p1", "p2"}) {
+		t.Errorf("expected p1 and p2, got: %v", got)
+	}
+}
@@ -0,0 +1,513 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/blevesearch/bleve"
+	bleveMappingUI "github.com/blevesearch/bleve-mapping-ui"
+	"github.com/blevesearch/bleve/index"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/query"
+
+	"github.com/couchbase/cbgt"
+	"github.com/couchbase/cbgt/rest"
+)
+
+// QueryTermStats defines the part of the JSON query request that
+// enables the optional DFS-style pre-phase, where the coordinator
+// gathers term statistics from all the pindexes before the search.
+// The aggregated TermStats are forwarded to remote nodes, which score
+// with them in place of their own local statistics.
+type QueryTermStats struct {
+	GlobalTermStats bool       `json:"globalTermStats,omitempty"`
+	TermStats       *TermStats `json:"termStats,omitempty"`
+}
+
+// TermStats holds term and document frequencies, where Fields is
+// keyed by field name then by term, with a value of the number of
+// docs that have the term in that field.
+type TermStats struct {
+	DocCount uint64                       `json:"docCount"`
+	Fields   map[string]map[string]uint64 `json:"fields"`
+}
+
+// TermStatsRequest is the JSON request body of the termStats REST
+// endpoint, which returns the TermStats of the local pindexes.
+type TermStatsRequest struct {
+	QueryPIndexes
+	Fields map[string][]string `json:"fields"` // Keyed by field name.
+}
+
+// Merge adds the counts from another TermStats into the receiver.
+func (ts *TermStats) Merge(other *TermStats) {
+	if other == nil {
+		return
+	}
+	ts.DocCount += other.DocCount
+	if ts.Fields == nil {
+		ts.Fields = make(map[string]map[string]uint64, len(other.Fields))
+	}
+	for field, terms := range other.Fields {
+		m := ts.Fields[field]
+		if m == nil {
+			m = make(map[string]uint64, len(terms))
+			ts.Fields[field] = m
+		}
+		for term, count := range terms {
+			m[term] += count
+		}
+	}
+}
+
+// ---------------------------------------------------------
+
+// bleveIndexMapping returns the bleve index mapping from the index
+// definition of a fulltext-index, or of the first local target index
+// of a fulltext-alias.
+func bleveIndexMapping(mgr *cbgt.Manager, indexName string) (
+	mapping.IndexMapping, error) {
+	bp, err := bleveIndexParams(mgr, indexName)
+	if err != nil {
+		return nil, err
+	}
+
+	return bp.Mapping, nil
+}
+
+// bleveIndexParams returns the bleve params from the index definition
+// of a fulltext-index, or of the first local target index of a
+// fulltext-alias.
+func bleveIndexParams(mgr *cbgt.Manager, indexName string) (
+	*BleveParams, error) {
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err != nil {
+		return nil, err
+	}
+
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil {
+		return nil, fmt.Errorf("bleve: no indexDef, indexName: %s", indexName)
+	}
+
+	if indexDef.Type == "fulltext-alias" {
+		indexDef, err = aliasLeafIndexDef(indexDef, indexDefsByName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return bleveIndexDefParams(indexDef)
+}
+
+// bleveIndexDefMapping returns the index mapping of the definition of
+// a bleve index.
+func bleveIndexDefMapping(indexDef *cbgt.IndexDef) (
+	mapping.IndexMapping, error) {
+	bp, err := bleveIndexDefParams(indexDef)
+	if err != nil {
+		return nil, err
+	}
+
+	return bp.Mapping, nil
+}
+
+// bleveIndexDefParams returns the bleve params of the definition of a
+// bleve index.
+func bleveIndexDefParams(indexDef *cbgt.IndexDef) (*BleveParams, error) {
+	bp := NewBleveParams()
+	if len(indexDef.Params) > 0 {
+		b, err := bleveMappingUI.CleanseJSON([]byte(indexDef.Params))
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(b, bp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return bp, nil
+}
+
+// queryFieldTerms returns the analyzed terms of a query, keyed by
+// field name.  Only the term-oriented query types that contribute
+// tf-idf scores are considered.
+func queryFieldTerms(q query.Query, m mapping.IndexMapping) (
+	map[string][]string, error) {
+	rv := map[string][]string{}
+
+	add := func(field string, terms ...string) {
+		if field == "" {
+			field = m.DefaultSearchField()
+		}
+		rv[field] = append(rv[field], terms...)
+	}
+
+	analyze := func(field, analyzerName, text string) {
+		if field == "" {
+			field = m.DefaultSearchField()
+		}
+		if analyzerName == "" {
+			analyzerName = m.AnalyzerNameForPath(field)
+		}
+		analyzer := m.AnalyzerNamed(analyzerName)
+		if analyzer == nil {
+			return
+		}
+		for _, token := range analyzer.Analyze([]byte(text)) {
+			add(field, string(token.Term))
+		}
+	}
+
+	var visit func(q query.Query) error
+
+	visit = func(q query.Query) error {
+		switch q := q.(type) {
+		case *query.TermQuery:
+			add(q.FieldVal, q.Term)
+		case *query.PhraseQuery:
+			add(q.FieldVal, q.Terms...)
+		case *query.MatchQuery:
+			analyze(q.FieldVal, q.Analyzer, q.Match)
+		case *query.MatchPhraseQuery:
+			analyze(q.FieldVal, q.Analyzer, q.MatchPhrase)
+		case *query.QueryStringQuery:
+			pq, err := q.Parse()
+			if err != nil {
+				return err
+			}
+			return visit(pq)
+		case *query.ConjunctionQuery:
+			for _, c := range q.Conjuncts {
+				if err := visit(c); err != nil {
+					return err
+				}
+			}
+		case *query.DisjunctionQuery:
+			for _, d := range q.Disjuncts {
+				if err := visit(d); err != nil {
+					return err
+				}
+			}
+		case *query.BooleanQuery:
+			for _, c := range []query.Query{q.Must, q.Should} {
+				if c != nil {
+					if err := visit(c); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	err := visit(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+// localTermStats computes the TermStats of a single bleve index.
+func localTermStats(bindex bleve.Index, fields map[string][]string) (
+	*TermStats, error) {
+	docCount, err := bindex.DocCount()
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &TermStats{
+		DocCount: docCount,
+		Fields:   make(map[string]map[string]uint64, len(fields)),
+	}
+
+	for field, terms := range fields {
+		m := make(map[string]uint64, len(terms))
+		rv.Fields[field] = m
+
+		for _, term := range terms {
+			if _, exists := m[term]; exists {
+				continue
+			}
+
+			fd, err := bindex.FieldDictRange(field, []byte(term), []byte(term))
+			if err != nil {
+				return nil, err
+			}
+
+			m[term] = 0
+
+			entry, err := fd.Next()
+			for err == nil && entry != nil {
+				if entry.Term == term {
+					m[term] += entry.Count
+				}
+				entry, err = fd.Next()
+			}
+
+			fd.Close()
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return rv, nil
+}
+
+// gatherTermStats concurrently collects and merges the TermStats of
+// the local and remote targets of an index alias.
+func gatherTermStats(ctx context.Context, targets []bleve.Index,
+	fields map[string][]string) (*TermStats, error) {
+	rv := &TermStats{}
+
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+
+	for _, target := range targets {
+		var get func() (*TermStats, error)
+
+		switch t := target.(type) {
+		case *cacheBleveIndex:
+			get = func() (*TermStats, error) {
+				return localTermStats(t.bindex, fields)
+			}
+		case *IndexClient:
+			get = func() (*TermStats, error) {
+				return t.TermStats(ctx, fields)
+			}
+		default:
+			continue // Ex: a MissingPIndex has no stats.
+		}
+
+		wg.Add(1)
+		go func(get func() (*TermStats, error)) {
+			ts, err := get()
+			m.Lock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+			} else {
+				rv.Merge(ts)
+			}
+			m.Unlock()
+			wg.Done()
+		}(get)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return rv, nil
+}
+
+// ---------------------------------------------------------
+
+// TermStatsHandler is a REST handler that returns the TermStats of
+// the local pindexes of an index, for use by query coordinators, such
+// as for the term statistics pre-phase, and for the document
+// frequencies of suggestions and more_like_this terms.
+type TermStatsHandler struct {
+	mgr *cbgt.Manager
+}
+
+func NewTermStatsHandler(mgr *cbgt.Manager) *TermStatsHandler {
+	return &TermStatsHandler{mgr: mgr}
+}
+
+func (h *TermStatsHandler) ServeHTTP(
+	w http.ResponseWriter, req *http.Request) {
+	indexName := rest.IndexNameLookup(req)
+	if indexName == "" {
+		rest.ShowError(w, req, "index name is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("could not read request body,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	var tsr TermStatsRequest
+	err = UnmarshalJSON(requestBody, &tsr)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("could not parse request body,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	var onlyPIndexes map[string]bool
+	if len(tsr.PIndexNames) > 0 {
+		onlyPIndexes = cbgt.StringsToMap(tsr.PIndexNames)
+	}
+
+	alias, _, _, err := bleveIndexAlias(h.mgr, indexName, "", true,
+		nil, nil, false, onlyPIndexes)
+	if err != nil {
+		if _, ok := err.(*cbgt.ErrorLocalPIndexHealth); !ok {
+			rest.ShowError(w, req, fmt.Sprintf("termStats,"+
+				" indexName: %s, err: %v", indexName, err),
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	ts, err := gatherTermStats(req.Context(), aliasTargets(alias), tsr.Fields)
+	if err != nil {
+		rest.ShowError(w, req, fmt.Sprintf("termStats,"+
+			" indexName: %s, err: %v", indexName, err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	rest.MustEncode(w, ts)
+}
+
+// gatherQueryTermStats runs the term statistics pre-phase of a query
+// against all the targets of the index alias.
+func gatherQueryTermStats(ctx context.Context, mgr *cbgt.Manager,
+	indexName string, q query.Query, alias bleve.IndexAlias) (
+	*TermStats, error) {
+	m, err := bleveIndexMapping(mgr, indexName)
+	if err != nil {
+		return nil, fmt.Errorf("bleve: term stats mapping,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+
+	fields, err := queryFieldTerms(q, m)
+	if err != nil {
+		return nil, fmt.Errorf("bleve: term stats query terms,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+
+	return gatherTermStats(ctx, aliasTargets(alias), fields)
+}
+
+// ---------------------------------------------------------
+
+// termStatsQuery is a query that's scored with index-wide TermStats,
+// in place of the document frequencies of the pindex being searched.
+// It's marshaled as the wrapped query, with the TermStats sent along
+// in the QueryTermStats part of the request.
+type termStatsQuery struct {
+	query query.Query
+	stats *TermStats
+}
+
+func newTermStatsQuery(q query.Query, stats *TermStats) *termStatsQuery {
+	return &termStatsQuery{query: q, stats: stats}
+}
+
+// termStatsOf returns the TermStats that a search request's query is
+// scored with, if any.
+func termStatsOf(q query.Query) *TermStats {
+	if fq, ok := q.(*filteredQuery); ok {
+		q = fq.query
+	}
+	if tq, ok := q.(*termStatsQuery); ok {
+		return tq.stats
+	}
+	return nil
+}
+
+func (q *termStatsQuery) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.query)
+}
+
+func (q *termStatsQuery) Validate() error {
+	if vq, ok := q.query.(query.ValidatableQuery); ok {
+		return vq.Validate()
+	}
+	return nil
+}
+
+// Searcher hands the wrapped query a view of the index reader that
+// reports the index-wide statistics, which bleve's term searchers
+// compute their idf from.
+func (q *termStatsQuery) Searcher(i index.IndexReader, m mapping.IndexMapping,
+	options search.SearcherOptions) (search.Searcher, error) {
+	docCount, err := i.DocCount()
+	if err != nil {
+		return nil, err
+	}
+
+	return q.query.Searcher(&termStatsIndexReader{
+		IndexReader: i,
+		stats:       q.stats,
+		docCount:    docCount,
+	}, m, options)
+}
+
+// termStatsIndexReader reports the document count and document
+// frequencies of the TermStats.  The frequencies of terms that are
+// missing from the TermStats, such as the expansions of fuzzy and
+// prefix queries, are extrapolated from the pindex's own.
+type termStatsIndexReader struct {
+	index.IndexReader
+
+	stats    *TermStats
+	docCount uint64 // Of the pindex.
+}
+
+func (r *termStatsIndexReader) DocCount() (uint64, error) {
+	return r.stats.DocCount, nil
+}
+
+func (r *termStatsIndexReader) TermFieldReader(term []byte, field string,
+	includeFreq, includeNorm, includeTermVectors bool) (
+	index.TermFieldReader, error) {
+	tfr, err := r.IndexReader.TermFieldReader(term, field,
+		includeFreq, includeNorm, includeTermVectors)
+	if err != nil || tfr == nil {
+		return tfr, err
+	}
+
+	count, exists := r.stats.Fields[field][string(term)]
+	if !exists {
+		if r.docCount <= 0 {
+			return tfr, nil
+		}
+		count = tfr.Count() * r.stats.DocCount / r.docCount
+	}
+
+	return &termStatsTermFieldReader{TermFieldReader: tfr, count: count}, nil
+}
+
+type termStatsTermFieldReader struct {
+	index.TermFieldReader
+
+	count uint64
+}
+
+func (r *termStatsTermFieldReader) Count() uint64 {
+	return r.count
+}
@@ -0,0 +1,166 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+func TestTermStatsMerge(t *testing.T) {
+	ts := &TermStats{}
+	ts.Merge(&TermStats{
+		DocCount: 10,
+		Fields:   map[string]map[string]uint64{"a": {"x": 1, "y": 2}},
+	})
+	ts.Merge(&TermStats{
+		DocCount: 5,
+		Fields:   map[string]map[string]uint64{"a": {"x": 3}, "b": {"z": 4}},
+	})
+	ts.Merge(nil)
+
+	exp := &TermStats{
+		DocCount: 15,
+		Fields: map[string]map[string]uint64{
+			"a": {"x": 4, "y": 2},
+			"b": {"z": 4},
+		},
+	}
+	if !reflect.DeepEqual(ts, exp) {
+		t.Errorf("expected: %+v, got: %+v", exp, ts)
+	}
+}
+
+func TestQueryFieldTerms(t *testing.T) {
+	m := mapping.NewIndexMapping()
+
+	tq := bleve.NewTermQuery("beer")
+	tq.SetField("name")
+
+	mq := bleve.NewMatchQuery("Hoppy Ales")
+	mq.SetField("desc")
+
+	q := bleve.NewBooleanQuery()
+	q.AddMust(tq)
+	q.AddShould(mq)
+	q.AddMustNot(bleve.NewTermQuery("ignored"))
+
+	fields, err := queryFieldTerms(q, m)
+	if err != nil {
+		t.Fatalf("expected queryFieldTerms to work, err: %v", err)
+	}
+
+	exp := map[string][]string{
+		"name": {"beer"},
+		"desc": {"hoppy", "ales"},
+	}
+	if !reflect.DeepEqual(fields, exp) {
+		t.Errorf("expected: %v, got: %v", exp, fields)
+	}
+}
+
+func TestTermStatsQuery(t *testing.T) {
+	// the pindexes are skewed, where "beer" is rare in the first and
+	// common in the second
+	docs := []map[string]string{
+		{"a": "beer", "w1": "wine", "w2": "wine", "w3": "wine"},
+		{"b": "beer", "c": "beer", "d": "beer", "e": "wine"},
+	}
+
+	var indexes []bleve.Index
+	for _, pindexDocs := range docs {
+		idx, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer idx.Close()
+
+		for id, text := range pindexDocs {
+			err = idx.Index(id, map[string]interface{}{"text": text})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		indexes = append(indexes, idx)
+	}
+
+	q := bleve.NewMatchQuery("beer")
+	q.SetField("text")
+
+	fields, err := queryFieldTerms(q, mapping.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &TermStats{}
+	for _, idx := range indexes {
+		lts, err := localTermStats(idx, fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts.Merge(lts)
+	}
+	if ts.DocCount != 8 || ts.Fields["text"]["beer"] != 4 {
+		t.Fatalf("unexpected term stats: %+v", ts)
+	}
+
+	scores := func(q query.Query) map[string]float64 {
+		res, err := bleve.NewIndexAlias(indexes...).Search(
+			bleve.NewSearchRequest(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rv := map[string]float64{}
+		for _, hit := range res.Hits {
+			rv[hit.ID] = hit.Score
+		}
+		return rv
+	}
+
+	local := scores(q)
+	if len(local) != 4 || local["a"] == local["b"] {
+		t.Errorf("expected the local stats to score a and b apart,"+
+			" got: %v", local)
+	}
+
+	global := scores(newTermStatsQuery(q, ts))
+	if len(global) != 4 {
+		t.Fatalf("expected the same hits, got: %v", global)
+	}
+	for id, score := range global {
+		if score != global["a"] {
+			t.Errorf("expected identical docs to score the same,"+
+				" got: %v", global)
+			break
+		}
+		if local[id] == 0 {
+			t.Errorf("unexpected hit: %s", id)
+		}
+	}
+
+	// the stats are sent to remote nodes beside the wrapped query
+	req := bleve.NewSearchRequest(newFilteredQuery(newTermStatsQuery(q, ts),
+		bleve.NewMatchAllQuery()))
+	if termStatsOf(req.Query) != ts {
+		t.Errorf("expected the term stats of the filtered query")
+	}
+	buf, err := json.Marshal(req.Query)
+	if err != nil || !bytes.Contains(buf, []byte(`"match":"beer"`)) {
+		t.Errorf("expected the wrapped query, got: %s, err: %v", buf, err)
+	}
+}
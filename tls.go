@@ -0,0 +1,303 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/cbgt/rest"
+
+	log "github.com/couchbase/clog"
+)
+
+// TLSReloadInterval is how often the cert, key and CA files are
+// checked for changes, so that rotated certificates are picked up
+// without a restart.
+var TLSReloadInterval = 30 * time.Second
+
+// InternalClientCertsRequired is set when this node advertises an
+// https address for scatter-gather, in which case the scatter-gather
+// requests that it receives must come over TLS with a verified client
+// certificate.
+var InternalClientCertsRequired bool
+
+// Atomic counters that keep track of certificate reloads.
+var totTLSReloads uint64
+var totTLSReloadErrors uint64
+
+// For HTTPS, HTTP2 clients
+var TLSConfig *tls.Config
+
+// tlsCertsCurrent holds the certificates of this node, or nil when
+// TLS is not configured.
+var tlsCertsCurrent *tlsCerts
+
+// InitTLSConfig loads this node's certificate and key, which are both
+// presented as the client certificate of scatter-gather requests and
+// served by the https listeners, along with the CA bundle that the
+// certificates of the other nodes are verified against.  When caFile
+// is "", the CA bundle is read from the certFile.
+func InitTLSConfig(certFile, keyFile, caFile string) error {
+	if certFile == "" || keyFile == "" {
+		return nil
+	}
+
+	if caFile == "" {
+		caFile = certFile
+	}
+
+	c := &tlsCerts{certFile: certFile, keyFile: keyFile, caFile: caFile}
+
+	err := c.load()
+	if err != nil {
+		return err
+	}
+
+	tlsCertsCurrent = c
+
+	TLSConfig = &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		GetClientCertificate: c.getClientCertificate,
+	}
+
+	return nil
+}
+
+// TLSDial returns a DialTLS func for the http.Transports of
+// scatter-gather requests, or nil when TLS is not configured.  Each
+// connection verifies the server's certificate chain and hostname
+// against the CA bundle that's current at the time, as the RootCAs of
+// a tls.Config can't be changed once the config is in use.
+func TLSDial(dialer *net.Dialer, handshakeTimeout time.Duration,
+	nextProtos []string) func(network, addr string) (net.Conn, error) {
+	c := tlsCertsCurrent
+	if c == nil || TLSConfig == nil {
+		return nil
+	}
+
+	return func(network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		_, pool := c.current()
+
+		config := TLSConfig.Clone()
+		config.ServerName = host
+		config.RootCAs = pool
+		config.NextProtos = nextProtos
+
+		conn, err := dialer.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if handshakeTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		}
+
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if handshakeTimeout > 0 {
+			conn.SetDeadline(time.Time{})
+		}
+
+		return tlsConn, nil
+	}
+}
+
+// ReloadTLSConfig re-reads the certificate, key and CA files right
+// away, such as after a certificate rotation.
+func ReloadTLSConfig() error {
+	if tlsCertsCurrent == nil {
+		return nil
+	}
+	return tlsCertsCurrent.load()
+}
+
+// TLSServerConfig sets up the tls.Config of an https listener to
+// serve this node's current certificate and to verify the client
+// certificates of other nodes, at least when they're given, so that
+// internal routes can require them.
+func TLSServerConfig(config *tls.Config) *tls.Config {
+	c := tlsCertsCurrent
+	if c == nil {
+		return config
+	}
+
+	if config.ClientAuth < tls.VerifyClientCertIfGiven {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	config.Certificates = nil
+	config.GetCertificate = func(*tls.ClientHelloInfo) (
+		*tls.Certificate, error) {
+		cert, _ := c.current()
+		return cert, nil
+	}
+
+	base := config.Clone()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (
+		*tls.Config, error) {
+		_, pool := c.current()
+		rv := base.Clone()
+		rv.ClientCAs = pool
+		return rv, nil
+	}
+
+	return config
+}
+
+// checkInternalTLS rejects scatter-gather requests that don't come
+// with a verified client certificate, when this node requires them.
+func checkInternalTLS(w http.ResponseWriter, req *http.Request) bool {
+	if !InternalClientCertsRequired ||
+		req.Header.Get(rest.CLUSTER_ACTION) != "fts/scatter-gather" {
+		return true
+	}
+
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return true
+	}
+
+	requestBody, _ := ioutil.ReadAll(req.Body)
+	rest.PropagateError(w, requestBody, "rest_auth: scatter-gather request"+
+		" without a verified client certificate", http.StatusForbidden)
+
+	return false
+}
+
+// ---------------------------------------------------------
+
+type tlsCerts struct {
+	certFile, keyFile, caFile string
+
+	m         sync.RWMutex
+	cert      *tls.Certificate
+	pool      *x509.CertPool
+	modTimes  [3]time.Time
+	checkedAt time.Time
+}
+
+// current returns the current certificate and CA pool, re-reading the
+// files when they've changed since they were last checked.
+func (c *tlsCerts) current() (*tls.Certificate, *x509.CertPool) {
+	c.m.RLock()
+	cert, pool, checkedAt := c.cert, c.pool, c.checkedAt
+	c.m.RUnlock()
+
+	if time.Since(checkedAt) < TLSReloadInterval {
+		return cert, pool
+	}
+
+	c.m.Lock()
+	if c.checkedAt != checkedAt { // Another goroutine checked already.
+		cert, pool = c.cert, c.pool
+		c.m.Unlock()
+		return cert, pool
+	}
+	c.checkedAt = time.Now()
+	modTimes, err := c.statFiles()
+	changed := err == nil && modTimes != c.modTimes
+	c.m.Unlock()
+
+	if changed {
+		err = c.load()
+		if err != nil {
+			log.Warnf("tls: reload, err: %v", err)
+		}
+	}
+
+	c.m.RLock()
+	cert, pool = c.cert, c.pool
+	c.m.RUnlock()
+
+	return cert, pool
+}
+
+func (c *tlsCerts) statFiles() (rv [3]time.Time, err error) {
+	for i, f := range []string{c.certFile, c.keyFile, c.caFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return rv, err
+		}
+		rv[i] = fi.ModTime()
+	}
+	return rv, nil
+}
+
+// load reads the certificate, key and CA files, keeping the previous
+// certificates when the files are unreadable or mismatched, such as
+// while they're being replaced.
+func (c *tlsCerts) load() error {
+	modTimes, err := c.statFiles()
+	if err != nil {
+		atomic.AddUint64(&totTLSReloadErrors, 1)
+		return fmt.Errorf("tls: stat, err: %v", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		atomic.AddUint64(&totTLSReloadErrors, 1)
+		return fmt.Errorf("tls: LoadX509KeyPair, certFile: %s, keyFile: %s,"+
+			" err: %v", c.certFile, c.keyFile, err)
+	}
+
+	caPEM, err := ioutil.ReadFile(c.caFile)
+	if err != nil {
+		atomic.AddUint64(&totTLSReloadErrors, 1)
+		return fmt.Errorf("tls: ReadFile, caFile: %s, err: %v", c.caFile, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		atomic.AddUint64(&totTLSReloadErrors, 1)
+		return fmt.Errorf("tls: no certificates in caFile: %s", c.caFile)
+	}
+
+	c.m.Lock()
+	reloaded := c.cert != nil
+	c.cert = &cert
+	c.pool = pool
+	c.modTimes = modTimes
+	c.checkedAt = time.Now()
+	c.m.Unlock()
+
+	if reloaded {
+		atomic.AddUint64(&totTLSReloads, 1)
+		log.Printf("tls: reloaded, certFile: %s, caFile: %s",
+			c.certFile, c.caFile)
+	}
+
+	return nil
+}
+
+func (c *tlsCerts) getClientCertificate(*tls.CertificateRequestInfo) (
+	*tls.Certificate, error) {
+	cert, _ := c.current()
+	return cert, nil
+}
@@ -0,0 +1,179 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCerts writes a new CA, and a node cert and key signed by
+// the CA for 127.0.0.1, into the given files.
+func writeTestCerts(t *testing.T, certFile, keyFile, caFile string) {
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	writePEM := func(file, kind string, der []byte) {
+		err := ioutil.WriteFile(file,
+			pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	caKey := newKey()
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl,
+		&caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	nodeKey := newKey()
+	nodeTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano() + 1),
+		Subject:      pkix.Name{CommonName: "test node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	nodeDER, err := x509.CreateCertificate(rand.Reader, nodeTmpl, caCert,
+		&nodeKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeKeyDER, err := x509.MarshalECPrivateKey(nodeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writePEM(caFile, "CERTIFICATE", caDER)
+	writePEM(certFile, "CERTIFICATE", nodeDER)
+	writePEM(keyFile, "EC PRIVATE KEY", nodeKeyDER)
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("./tmp", "data")
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+
+	writeTestCerts(t, certFile, keyFile, caFile)
+
+	defer func() {
+		TLSConfig = nil
+		tlsCertsCurrent = nil
+	}()
+
+	err := InitTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(w, "%d", len(req.TLS.VerifiedChains))
+		}))
+	ts.TLS = TLSServerConfig(&tls.Config{})
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(client *http.Client) (string, error) {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialTLS: TLSDial(&net.Dialer{}, time.Second, nil),
+	}}
+
+	body, err := get(client)
+	if err != nil || body != "1" {
+		t.Errorf("expected verified client cert, got: %q, err: %v", body, err)
+	}
+
+	body, err = get(&http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}})
+	if err != nil || body != "0" {
+		t.Errorf("expected no client cert, got: %q, err: %v", body, err)
+	}
+
+	// rotate to a new CA, after which only the new certs are trusted
+	oldCert, _ := tlsCertsCurrent.current()
+
+	time.Sleep(10 * time.Millisecond)
+	writeTestCerts(t, certFile, keyFile, caFile)
+
+	err = ReloadTLSConfig()
+	if err != nil {
+		t.Fatalf("expected no err on reload, got: %v", err)
+	}
+
+	client = &http.Client{Transport: &http.Transport{
+		DialTLS: TLSDial(&net.Dialer{}, time.Second, nil),
+	}}
+
+	body, err = get(client)
+	if err != nil || body != "1" {
+		t.Errorf("expected rotated certs to work, got: %q, err: %v", body, err)
+	}
+
+	oldServer := httptest.NewUnstartedServer(http.NotFoundHandler())
+	oldServer.TLS = &tls.Config{Certificates: []tls.Certificate{*oldCert}}
+	oldServer.StartTLS()
+	defer oldServer.Close()
+
+	_, err = client.Get(oldServer.URL)
+	if err == nil {
+		t.Errorf("expected cert from the old CA to be rejected")
+	}
+}